@@ -44,6 +44,25 @@ func init() {
 				proxyExcludedPorts = strings.Split(localPortsExcludeProxy, ",")
 			}
 
+			// In sidecar mode, the ports to intercept are always given
+			interceptPortsEnv, sidecar := os.LookupEnv("SIDECAR_PORTS")
+			if !sidecar {
+				interceptPortsEnv = os.Getenv("INTERCEPT_PORTS")
+			}
+
+			var interceptPorts []config.PortMapping
+
+			if interceptPortsEnv != "" {
+				for _, value := range strings.Split(interceptPortsEnv, ",") {
+					mapping, err := config.ParsePortMapping(value)
+					if err != nil {
+						return fmt.Errorf("invalid intercept port: %w", err)
+					}
+
+					interceptPorts = append(interceptPorts, mapping)
+				}
+			}
+
 			istioInterceptMode := os.Getenv("ISTIO_INTERCEPTION_MODE")
 			istioEnabled := istioInterceptMode != ""
 			if istioEnabled {
@@ -51,7 +70,7 @@ func init() {
 				proxyExcludedPorts = append(proxyExcludedPorts, "15020", "15021")
 			}
 
-			return agent.Run(logr.NewContext(ctx, log), cfg, istioEnabled, proxyExcludedPorts)
+			return agent.Run(logr.NewContext(ctx, log), cfg, istioEnabled, proxyExcludedPorts, interceptPorts, sidecar)
 		},
 	}
 
@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/go-logr/logr"
+	"github.com/spf13/cobra"
+
+	"github.com/steved/kubewire/pkg/journal"
+)
+
+func init() {
+	var local bool
+
+	cleanupCmd := &cobra.Command{
+		Use:   "cleanup",
+		Short: "Roll back changes left behind by sessions which didn't exit cleanly.",
+		Long: `Roll back changes left behind by sessions which didn't exit cleanly.
+
+With --local, the WireGuard devices, routes and DNS configuration of local sessions which were killed or crashed are
+removed. This also happens when starting a session. Use gc to delete resources left behind in the cluster.`,
+		Args: cobra.NoArgs,
+		RunE: func(_ *cobra.Command, _ []string) error {
+			if !local {
+				return errors.New("nothing to clean up, pass --local to roll back local changes or use gc for cluster resources")
+			}
+
+			ctx := logr.NewContext(context.Background(), log)
+
+			stale, err := journal.Recover(ctx, journal.DefaultPath)
+			if err != nil {
+				return fmt.Errorf("unable to roll back local changes: %w", err)
+			}
+
+			if len(stale) == 0 {
+				fmt.Println("No local changes left behind")
+				return nil
+			}
+
+			changes := 0
+			for _, s := range stale {
+				changes += len(s.Changes)
+			}
+
+			fmt.Printf("Rolled back %d changes of %d sessions\n", changes, len(stale))
+
+			return nil
+		},
+	}
+
+	cleanupCmd.Flags().BoolVar(&local, "local", false, "Roll back local network changes of sessions which didn't exit cleanly")
+
+	rootCmd.AddCommand(cleanupCmd)
+}
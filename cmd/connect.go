@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/steved/kubewire/pkg/agent"
+	"github.com/steved/kubewire/pkg/config"
+	"github.com/steved/kubewire/pkg/kuberneteshelpers"
+)
+
+func init() {
+	var (
+		opts sessionOptions
+		name string
+	)
+
+	cfg := config.NewConfig()
+
+	connectCmd := &cobra.Command{
+		Use:   "connect [-- command...]",
+		Short: "Connect to the cluster network through a dedicated agent without modifying any existing workload.",
+		Long: `Connect to the cluster network through a dedicated agent without modifying any existing workload.
+
+If a command is given after "--", it's run once the session is ready and the session ends when it exits, with kw
+exiting with the same code. Signals received by kw are forwarded to the command.`,
+		Example: "  kw connect -n tools -- ./integration-tests.sh",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			args, command := splitCommand(cmd, args)
+			if len(args) > 0 {
+				return fmt.Errorf("unexpected arguments %q, separate a command to run with \"--\"", args)
+			}
+
+			client, restConfig, err := kuberneteshelpers.ClientConfig(opts.kubeconfig)
+			if err != nil {
+				return fmt.Errorf("failed to create kubernetes client: %w", err)
+			}
+
+			if name == "" {
+				name = agent.ConnectName()
+			}
+
+			cfg.TargetObject = agent.NewConnectDeployment(cfg.Namespace, name)
+			cfg.Ephemeral = true
+			cfg.Command = command
+
+			return runSession(cmd, cfg, &opts, client, restConfig)
+		},
+	}
+
+	connectCmd.Flags().StringVarP(&cfg.Namespace, "namespace", "n", "default", "Namespace to run the agent in")
+	connectCmd.Flags().StringVar(&name, "name", "", fmt.Sprintf("Name of the agent Deployment. Defaults to a generated %q name", agent.ConnectNamePrefix+"-*"))
+	connectCmd.Flags().BoolVarP(&cfg.KeepResources, "keep-resources", "k", false, "Keep created resources running when exiting")
+	addSessionFlags(connectCmd, cfg, &opts)
+
+	rootCmd.AddCommand(connectCmd)
+}
@@ -0,0 +1,122 @@
+package cmd
+
+import (
+	"context"
+	goflag "flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/go-logr/logr"
+	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/utils/ptr"
+
+	"github.com/steved/kubewire/pkg/config"
+	"github.com/steved/kubewire/pkg/doctor"
+	"github.com/steved/kubewire/pkg/kuberneteshelpers"
+)
+
+func init() {
+	var (
+		kubeconfig string
+		ordinal    int32
+		copyMode   string
+		opts       doctor.Options
+	)
+
+	doctorCmd := &cobra.Command{
+		Use:   "doctor [target]",
+		Short: "Check the local machine and cluster for everything needed to start a session.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := logr.NewContext(context.Background(), log)
+
+			if cmd.Flags().Changed("ordinal") {
+				opts.Ordinal = ptr.To(ordinal)
+			}
+
+			opts.Copy = copyMode != ""
+
+			checks := doctor.LocalChecks()
+
+			client, _, err := kuberneteshelpers.ClientConfig(kubeconfig)
+			if err != nil {
+				checks = append(checks, doctor.ClientCheck(err))
+			} else {
+				if len(args) > 0 {
+					opts.Target, err = kuberneteshelpers.ResolveObject(kubeconfig, opts.Namespace, args)
+					if service, ok := opts.Target.(*corev1.Service); ok {
+						opts.Target, _, err = kuberneteshelpers.ResolveService(ctx, client, service)
+					}
+
+					// As with proxy, a statefulset's pod is targeted as that ordinal of the statefulset
+					if pod, ok := opts.Target.(*corev1.Pod); ok && err == nil && !opts.Copy {
+						if sts, podOrdinal, resolveErr := kuberneteshelpers.ResolveStatefulSetPod(ctx, client, pod); resolveErr == nil && sts != nil {
+							opts.Target, opts.Ordinal = sts, ptr.To(podOrdinal)
+						}
+					}
+
+					checks = append(checks, doctor.TargetCheck(opts.Target, err))
+				}
+
+				checks = append(checks, doctor.ClusterChecks(client, opts)...)
+			}
+
+			results := doctor.Run(ctx, checks)
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+
+			fmt.Fprintln(w, "CHECK\tSTATUS\tDETAILS")
+
+			failed := 0
+
+			for _, result := range results {
+				if result.Status == doctor.StatusFail {
+					failed++
+				}
+
+				fmt.Fprintf(w, "%s\t%s\t%s\n", result.Name, result.Status, result.Message)
+			}
+
+			if err := w.Flush(); err != nil {
+				return err
+			}
+
+			hints := false
+
+			for _, result := range results {
+				if result.Status == doctor.StatusPass || result.Hint == "" {
+					continue
+				}
+
+				if !hints {
+					fmt.Println("\nHints:")
+
+					hints = true
+				}
+
+				fmt.Printf("  %s: %s\n", result.Name, result.Hint)
+			}
+
+			if failed > 0 {
+				return fmt.Errorf("%d of %d checks failed", failed, len(results))
+			}
+
+			return nil
+		},
+	}
+
+	doctorCmd.Flags().StringVarP(&kubeconfig, "kubeconfig", "", os.Getenv("KUBECONFIG"), "Kubernetes cfg file")
+	doctorCmd.Flags().StringVarP(&opts.Namespace, "namespace", "n", "default", "Namespace of the target object, or to run the agent in")
+	doctorCmd.Flags().StringSliceVarP(&opts.OverlayPrefixes, "overlay", "o", nil, "Specify the overlay CIDR for Wireguard, at most one of each IP family. Useful if auto-detection fails")
+	doctorCmd.Flags().Int32Var(&ordinal, "ordinal", 0, "Ordinal of the single pod to run the agent in when targeting a statefulset (default scale the statefulset to one replica)")
+	doctorCmd.Flags().StringVar(&copyMode, "copy", "", "Check the permissions to run the agent in a copy of the target rather than modifying the target")
+	doctorCmd.Flags().Lookup("copy").NoOptDefVal = copyShared
+	doctorCmd.Flags().StringVarP(&opts.AgentImage, "agent-image", "i", fmt.Sprintf("ghcr.io/steved/kubewire:%s", config.Version), "Agent image to use")
+
+	flags := goflag.NewFlagSet(doctorCmd.Name(), goflag.ContinueOnError)
+	flags.Func("overlay-pool", fmt.Sprintf("Range to allocate overlay CIDRs from, repeated for each range in order of preference (default %s)", defaultOverlayPool()), appendPrefix(&opts.OverlayPool))
+	doctorCmd.Flags().AddGoFlagSet(flags)
+
+	rootCmd.AddCommand(doctorCmd)
+}
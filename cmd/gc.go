@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/spf13/cobra"
+
+	"github.com/steved/kubewire/pkg/kuberneteshelpers"
+	"github.com/steved/kubewire/pkg/session"
+)
+
+func init() {
+	var (
+		kubeconfig, namespace string
+		yes                   bool
+		olderThan             time.Duration
+	)
+
+	gcCmd := &cobra.Command{
+		Use:   "gc",
+		Short: "Delete orphaned resources left behind by previous proxy sessions.",
+		Args:  cobra.NoArgs,
+		RunE: func(_ *cobra.Command, _ []string) error {
+			ctx := logr.NewContext(context.Background(), log)
+
+			client, _, err := kuberneteshelpers.ClientConfig(kubeconfig)
+			if err != nil {
+				return fmt.Errorf("failed to create kubernetes client: %w", err)
+			}
+
+			orphans, err := session.FindOrphans(ctx, client, namespace, olderThan)
+			if err != nil {
+				return fmt.Errorf("unable to find orphaned resources: %w", err)
+			}
+
+			if len(orphans) == 0 {
+				fmt.Println("No orphaned resources found")
+				return nil
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+
+			fmt.Fprintln(w, "NAMESPACE\tRESOURCE\tTARGET\tAGE\tREASON")
+
+			for _, orphan := range orphans {
+				fmt.Fprintf(w, "%s\t%s/%s\t%s\t%s\t%s\n", orphan.Namespace, orphan.Kind, orphan.Name, orphan.Target, age(orphan.CreatedAt), orphan.Reason)
+			}
+
+			if err := w.Flush(); err != nil {
+				return err
+			}
+
+			if !yes {
+				fmt.Printf("Delete %d resources? [y/N]: ", len(orphans))
+
+				answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+				if err != nil {
+					return fmt.Errorf("unable to read confirmation: %w", err)
+				}
+
+				if answer = strings.ToLower(strings.TrimSpace(answer)); answer != "y" && answer != "yes" {
+					fmt.Println("Aborted")
+					return nil
+				}
+			}
+
+			if err := session.DeleteOrphans(ctx, client, orphans); err != nil {
+				return err
+			}
+
+			fmt.Printf("Deleted %d resources\n", len(orphans))
+
+			return nil
+		},
+	}
+
+	gcCmd.Flags().StringVarP(&kubeconfig, "kubeconfig", "", os.Getenv("KUBECONFIG"), "Kubernetes cfg file")
+	gcCmd.Flags().StringVarP(&namespace, "namespace", "n", "", "Namespace to search for orphaned resources. Defaults to all namespaces")
+	gcCmd.Flags().BoolVarP(&yes, "yes", "y", false, "Delete orphaned resources without asking for confirmation")
+	gcCmd.Flags().DurationVar(&olderThan, "older-than", 0, "Only delete orphaned resources created at least this long ago, e.g. 24h")
+
+	rootCmd.AddCommand(gcCmd)
+}
@@ -2,69 +2,184 @@ package cmd
 
 import (
 	"context"
-	goflag "flag"
 	"fmt"
-	"net/netip"
-	"os"
+	"slices"
 
-	"github.com/go-logr/logr"
 	"github.com/spf13/cobra"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/utils/ptr"
 
+	"github.com/steved/kubewire/pkg/agent"
 	"github.com/steved/kubewire/pkg/config"
 	"github.com/steved/kubewire/pkg/kuberneteshelpers"
-	"github.com/steved/kubewire/pkg/proxy"
+)
+
+const (
+	copyShared   = "shared"
+	copyIsolated = "isolated"
 )
 
 func init() {
 	var (
-		kubeconfig, overlayPrefix string
-		directAccess              bool
+		opts           sessionOptions
+		targetAdapters []string
+		ports          []string
+		ordinal        int32
+		copyMode       string
 	)
 
 	cfg := config.NewConfig()
 
 	proxyCmd := &cobra.Command{
-		Use:   "proxy [target]",
+		Use:   "proxy [target] [-- command...]",
 		Short: "Proxy cluster access to the target Kubernetes object.",
-		Args:  cobra.MinimumNArgs(1),
-		RunE: func(_ *cobra.Command, args []string) error {
-			ctx, cancel := context.WithCancel(context.Background())
-			defer cancel()
+		Long: `Proxy cluster access to the target Kubernetes object.
+
+The target may be a deployment, statefulset, replicaset, daemonset, pod or service. Services are resolved to the
+workload running the pods they select, replacing the container serving the service's target port unless --container is
+given. Bare pods are recreated running the agent and recreated again as they were when exiting. For daemonsets, the
+agent runs on a single node chosen with --node while the daemonset's pods on other nodes are left running.
+
+Statefulsets are scaled down to a single replica running the agent, unless a single ordinal is targeted with
+--ordinal or as the statefulset's pod, e.g. pod/foo-2. Only that ordinal's pod is then recreated running the agent,
+keeping its volumes and DNS identity, while the statefulset's other pods are left running.
+
+With --sidecar, the target container keeps running and the agent is added alongside it. Connections to the container's
+TCP ports are forwarded to the same ports locally while the WireGuard tunnel has a recent handshake, and to the container
+itself when the tunnel is down or the local port refuses the connection.
+
+With --port, only connections to the given container ports are intercepted, each forwarded to the same port locally or
+to another local port given as PORT:LOCAL_PORT, e.g. --port 8080:3000. Combined with --sidecar, the container keeps
+serving the ports that aren't intercepted.
+
+With --copy, the target is left untouched and the agent runs in a new deployment copied from the target's pod template,
+which is deleted when exiting. The copy's pods share the target's labels, so services send them a share of its traffic,
+unless --copy=isolated is given, in which case they're only labeled with wgko.io/copy-of.
+
+Custom workloads such as Argo Rollouts and OpenKruise CloneSets can be targeted too. Other custom workload types are
+described with --target-adapter, giving the paths to their pod template and, optionally, their selector and replica
+count, e.g. --target-adapter 'Rollout.argoproj.io:template=spec.template,selector=spec.selector,replicas=spec.replicas'.
+
+If a command is given after "--", it's run once the session is ready and the session ends when it exits, with kw
+exiting with the same code. Signals received by kw are forwarded to the command.`,
+		Example: "  kw proxy deploy/foo -- go run ./cmd/server",
+		Args:    cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			args, command := splitCommand(cmd, args)
+			if len(args) == 0 {
+				return fmt.Errorf("a target is required")
+			}
 
-			client, restConfig, err := kuberneteshelpers.ClientConfig(kubeconfig)
+			client, restConfig, err := kuberneteshelpers.ClientConfig(opts.kubeconfig)
 			if err != nil {
 				return fmt.Errorf("failed to create kubernetes client: %w", err)
 			}
 
-			obj, err := kuberneteshelpers.ResolveObject(kubeconfig, cfg.Namespace, args)
+			ctx := context.Background()
+
+			obj, err := kuberneteshelpers.ResolveObject(opts.kubeconfig, cfg.Namespace, args)
 			if err != nil {
 				return fmt.Errorf("failed to resolve target kubernetes object: %w", err)
 			}
 
-			cfg.TargetObject = obj
+			if service, ok := obj.(*corev1.Service); ok {
+				var container string
+
+				obj, container, err = kuberneteshelpers.ResolveService(ctx, client, service)
+				if err != nil {
+					return fmt.Errorf("failed to resolve target service: %w", err)
+				}
+
+				// An explicit --container takes precedence over the container serving the service's target port
+				if cfg.Container == "" {
+					cfg.Container = container
+				}
+			}
+
+			if cmd.Flags().Changed("ordinal") {
+				cfg.Ordinal = ptr.To(ordinal)
+			}
+
+			// A statefulset's pod is targeted as that ordinal of the statefulset, which would otherwise recreate it. A copy
+			// is made of the pod itself.
+			if pod, ok := obj.(*corev1.Pod); ok && copyMode == "" {
+				sts, podOrdinal, err := kuberneteshelpers.ResolveStatefulSetPod(ctx, client, pod)
+				if err != nil {
+					return fmt.Errorf("failed to resolve target pod: %w", err)
+				}
 
-			if err := proxy.ResolveWireguardConfig(ctx, cfg, client, overlayPrefix, directAccess); err != nil {
-				return fmt.Errorf("unable to create wireguard config: %w", err)
+				if sts != nil {
+					if cfg.Ordinal != nil && *cfg.Ordinal != podOrdinal {
+						return fmt.Errorf("--ordinal %d doesn't match the ordinal of pod %s", *cfg.Ordinal, pod.Name)
+					}
+
+					obj, cfg.Ordinal = sts, ptr.To(podOrdinal)
+				}
+			}
+
+			if _, ok := obj.(*appsv1.StatefulSet); !ok && cfg.Ordinal != nil {
+				return fmt.Errorf("--ordinal requires a statefulset target")
+			}
+
+			for _, value := range targetAdapters {
+				target, err := config.ParseUnstructuredTarget(value)
+				if err != nil {
+					return fmt.Errorf("invalid --target-adapter: %w", err)
+				}
+
+				cfg.UnstructuredTargets = append(cfg.UnstructuredTargets, target)
+			}
+
+			for _, value := range ports {
+				mapping, err := config.ParsePortMapping(value)
+				if err != nil {
+					return fmt.Errorf("invalid --port: %w", err)
+				}
+
+				if slices.ContainsFunc(cfg.Ports, func(existing config.PortMapping) bool { return existing.Port == mapping.Port }) {
+					return fmt.Errorf("invalid --port: port %d is given more than once", mapping.Port)
+				}
+
+				cfg.Ports = append(cfg.Ports, mapping)
 			}
 
-			return proxy.Run(logr.NewContext(ctx, log), cfg, client, restConfig)
+			if copyMode != "" {
+				if copyMode != copyShared && copyMode != copyIsolated {
+					return fmt.Errorf("invalid --copy value %q, must be %q or %q", copyMode, copyShared, copyIsolated)
+				}
+
+				if cfg.Ordinal != nil {
+					return fmt.Errorf("--ordinal can't be used with --copy")
+				}
+
+				obj, err = agent.NewCopyDeployment(obj, client, restConfig, cfg.UnstructuredTargets, copyMode == copyShared)
+				if err != nil {
+					return fmt.Errorf("failed to copy target kubernetes object: %w", err)
+				}
+
+				cfg.Ephemeral = true
+			}
+
+			cfg.TargetObject = obj
+			cfg.Command = command
+
+			return runSession(cmd, cfg, &opts, client, restConfig)
 		},
 	}
 
-	proxyCmd.Flags().StringVarP(&kubeconfig, "kubeconfig", "", os.Getenv("KUBECONFIG"), "Kubernetes cfg file")
 	proxyCmd.Flags().StringVarP(&cfg.Namespace, "namespace", "n", "default", "Namespace of the target object")
 	proxyCmd.Flags().StringVarP(&cfg.Container, "container", "c", "", "Name of the container to replace")
-	proxyCmd.Flags().StringVarP(&overlayPrefix, "overlay", "o", "", "Specify the overlay CIDR for Wireguard. Useful if auto-detection fails")
-	proxyCmd.Flags().BoolVarP(&directAccess, "direct", "p", false, "Whether to try NAT hole punching (true) or use a load balancer for access to the pod")
-	proxyCmd.Flags().StringVarP(&cfg.AgentImage, "agent-image", "i", fmt.Sprintf("ghcr.io/steved/kubewire:%s", config.Version), "Agent image to use")
+	proxyCmd.Flags().StringVar(&cfg.Node, "node", "", "Node to run the agent on when targeting a daemonset (default the node of one of its pods)")
+	proxyCmd.Flags().Int32Var(&ordinal, "ordinal", 0, "Ordinal of the single pod to run the agent in when targeting a statefulset, leaving its other pods running (default scale the statefulset to one replica)")
+	proxyCmd.Flags().StringArrayVar(&targetAdapters, "target-adapter", nil, "Describe a custom workload type as KIND[.VERSION].GROUP:template=PATH[,selector=PATH][,replicas=PATH]")
+	proxyCmd.Flags().BoolVar(&cfg.Sidecar, "sidecar", false, "Run the agent alongside the target container rather than in its place, forwarding connections to the container's ports to the local machine while the tunnel is up and to the container otherwise")
+	proxyCmd.Flags().StringArrayVar(&ports, "port", nil, "Container port to intercept as PORT[:LOCAL_PORT], forwarding its connections to the local port (default intercept all ports)")
+	proxyCmd.Flags().StringVar(&copyMode, "copy", "", fmt.Sprintf("Run the agent in a copy of the target, deleted when exiting, rather than modifying the target. The copy's pods share the target's labels with %q or only carry a label of their own with %q", copyShared, copyIsolated))
+	proxyCmd.Flags().Lookup("copy").NoOptDefVal = copyShared
 	proxyCmd.Flags().BoolVarP(&cfg.KeepResources, "keep-resources", "k", true, "Keep created resources running when exiting")
-
-	// Workaround for lack of "TextVar" support in pflag / cobra
-	goflag.TextVar(&cfg.KubernetesClusterDetails.ServiceCIDR, "service-cidr", netip.Prefix{}, "Kubernetes Service CIDR")
-	goflag.TextVar(&cfg.KubernetesClusterDetails.NodeCIDR, "node-cidr", netip.Prefix{}, "Kubernetes node CIDR")
-	goflag.TextVar(&cfg.KubernetesClusterDetails.PodCIDR, "pod-cidr", netip.Prefix{}, "Kubernetes pod CIDR")
-	goflag.TextVar(&cfg.Wireguard.LocalAddress, "local-address", netip.AddrPort{}, "Local address accessible from remote agent")
-	proxyCmd.Flags().AddGoFlagSet(goflag.CommandLine)
+	proxyCmd.Flags().BoolVar(&cfg.KeepTarget, "keep-target", false, "Keep the target object running the agent when exiting rather than restoring its original state")
+	addSessionFlags(proxyCmd, cfg, &opts)
 
 	rootCmd.AddCommand(proxyCmd)
 }
@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"errors"
 	"os"
 	"strconv"
 
@@ -8,6 +9,8 @@ import (
 	"github.com/go-logr/zapr"
 	"github.com/spf13/cobra"
 	"go.uber.org/zap"
+
+	"github.com/steved/kubewire/pkg/proxy"
 )
 
 var log logr.Logger
@@ -59,6 +62,11 @@ func init() {
 
 func Execute() {
 	if err := rootCmd.Execute(); err != nil {
+		var exitErr *proxy.ExitError
+		if errors.As(err, &exitErr) {
+			os.Exit(exitErr.Code)
+		}
+
 		os.Exit(1)
 	}
 }
@@ -0,0 +1,156 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	goflag "flag"
+	"fmt"
+	"net/netip"
+	"os"
+	"strconv"
+
+	"github.com/go-logr/logr"
+	"github.com/spf13/cobra"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	"github.com/steved/kubewire/pkg/config"
+	"github.com/steved/kubewire/pkg/kuberneteshelpers"
+	"github.com/steved/kubewire/pkg/overlay"
+	"github.com/steved/kubewire/pkg/proxy"
+	"github.com/steved/kubewire/pkg/remap"
+	"github.com/steved/kubewire/pkg/routing"
+)
+
+// sessionOptions are options shared by commands which start a session with an agent in the cluster
+type sessionOptions struct {
+	kubeconfig      string
+	overlayPrefixes []string
+	directAccess    bool
+}
+
+func addSessionFlags(cmd *cobra.Command, cfg *config.Config, opts *sessionOptions) {
+	cmd.Flags().StringVarP(&opts.kubeconfig, "kubeconfig", "", os.Getenv("KUBECONFIG"), "Kubernetes cfg file")
+	cmd.Flags().StringSliceVarP(&opts.overlayPrefixes, "overlay", "o", nil, "Specify the overlay CIDR for Wireguard, at most one of each IP family. Useful if auto-detection fails")
+	cmd.Flags().BoolVarP(&opts.directAccess, "direct", "p", false, "Whether to try NAT hole punching (true) or use a load balancer for access to the pod")
+	cmd.Flags().StringVar(&cfg.DryRun, "dry-run", "", fmt.Sprintf("Print the changes which would be made to the cluster without making them. Either %q, to render them locally, or %q, to submit them to the API server without persisting them", config.DryRunClient, config.DryRunServer))
+	cmd.Flags().Lookup("dry-run").NoOptDefVal = config.DryRunClient
+	cmd.Flags().StringVar(&cfg.DryRunOutput, "output", config.DryRunOutputYAML, fmt.Sprintf("Format of the changes printed by --dry-run. One of %q or %q", config.DryRunOutputYAML, config.DryRunOutputDiff))
+	cmd.Flags().StringVar(&cfg.ExportWireguardConfig, "export-wg-config", "", "Write the local WireGuard configuration to this file in wg-quick format instead of configuring a local device and routes")
+	cfg.RulePriority = routing.DefaultRulePriority
+	cmd.Flags().Var((*rulePriority)(&cfg.RulePriority), "rule-priority", "Priority of the policy routing rules looking up the session's routing table on Linux. 0 adds routes to the main table instead")
+	cmd.Flags().BoolVar(&cfg.Remap, "remap", false, "Route cluster CIDRs colliding with local addresses and routes under substitute CIDRs, translated back by the agent, and rewrite DNS answers to match")
+	cmd.Flags().BoolVar(&cfg.DynamicRoutes, "dynamic-routes", false, "Route only the ClusterIPs of Services and the addresses of their endpoints as they come and go, rather than the cluster's CIDRs")
+	cmd.Flags().StringSliceVar(&cfg.RouteNamespaces, "route-namespace", nil, "Namespace whose Services and endpoints are routed with --dynamic-routes, repeated for each namespace (default all namespaces)")
+	cmd.Flags().StringVarP(&cfg.AgentImage, "agent-image", "i", fmt.Sprintf("ghcr.io/steved/kubewire:%s", config.Version), "Agent image to use")
+
+	// Workaround for lack of "TextVar" support in pflag / cobra
+	flags := goflag.NewFlagSet(cmd.Name(), goflag.ContinueOnError)
+	flags.Func("service-cidr", "Kubernetes Service CIDR, repeated for each IP family", appendPrefix(&cfg.KubernetesClusterDetails.ServiceCIDRs))
+	flags.Func("node-cidr", "Kubernetes node CIDR, repeated for each IP family", appendPrefix(&cfg.KubernetesClusterDetails.NodeCIDRs))
+	flags.Func("overlay-pool", fmt.Sprintf("Range to allocate overlay CIDRs from, repeated for each range in order of preference (default %s)", defaultOverlayPool()), appendPrefix(&cfg.OverlayPool))
+	flags.Func("remap-pool", fmt.Sprintf("Range to allocate substitutes for colliding cluster CIDRs from with --remap, repeated for each range in order of preference (default %s)", defaultRemapPool()), appendPrefix(&cfg.RemapPool))
+	flags.Func("pod-cidr", "Kubernetes pod CIDR, repeated for each IP family", appendPrefix(&cfg.KubernetesClusterDetails.PodCIDRs))
+	flags.TextVar(&cfg.Wireguard.LocalAddress, "local-address", netip.AddrPort{}, "Local address accessible from remote agent")
+	cmd.Flags().AddGoFlagSet(flags)
+}
+
+// appendPrefix returns a flag function parsing its value as a prefix and appending it to prefixes
+func appendPrefix(prefixes *[]netip.Prefix) func(string) error {
+	return func(value string) error {
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return err
+		}
+
+		*prefixes = append(*prefixes, prefix)
+
+		return nil
+	}
+}
+
+// rulePriority is a policy routing rule priority flag, rejecting negative priorities
+type rulePriority int
+
+func (p *rulePriority) String() string {
+	return strconv.Itoa(int(*p))
+}
+
+func (p *rulePriority) Set(value string) error {
+	priority, err := strconv.Atoi(value)
+	if err != nil {
+		return err
+	}
+
+	if priority < 0 {
+		return errors.New("must not be negative")
+	}
+
+	*p = rulePriority(priority)
+
+	return nil
+}
+
+func (p *rulePriority) Type() string {
+	return "int"
+}
+
+// defaultOverlayPool returns the default overlay pool for flag usage
+func defaultOverlayPool() string {
+	return overlay.JoinPrefixes(overlay.DefaultPool)
+}
+
+// defaultRemapPool returns the default remap pool for flag usage
+func defaultRemapPool() string {
+	return overlay.JoinPrefixes(remap.DefaultPool)
+}
+
+// splitCommand splits positional arguments into those before a "--" separator and the command following it
+func splitCommand(cmd *cobra.Command, args []string) ([]string, []string) {
+	if dash := cmd.ArgsLenAtDash(); dash >= 0 {
+		return args[:dash], args[dash:]
+	}
+
+	return args, nil
+}
+
+// runSession resolves the wireguard configuration for the target object in cfg and runs the session until exit
+func runSession(cmd *cobra.Command, cfg *config.Config, opts *sessionOptions, client kubernetes.Interface, restConfig *rest.Config) error {
+	switch cfg.DryRun {
+	case "", config.DryRunClient, config.DryRunServer:
+	default:
+		return fmt.Errorf("invalid --dry-run value %q, must be %q or %q", cfg.DryRun, config.DryRunClient, config.DryRunServer)
+	}
+
+	if cfg.DryRunOutput != config.DryRunOutputYAML && cfg.DryRunOutput != config.DryRunOutputDiff {
+		return fmt.Errorf("invalid --output value %q, must be %q or %q", cfg.DryRunOutput, config.DryRunOutputYAML, config.DryRunOutputDiff)
+	}
+
+	if cfg.DryRun != "" && len(cfg.Command) > 0 {
+		return fmt.Errorf("a command can't be run with --dry-run")
+	}
+
+	kubeContext, err := kuberneteshelpers.CurrentContext(opts.kubeconfig)
+	if err != nil {
+		return err
+	}
+
+	cfg.KubeContext = kubeContext
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := proxy.ResolveWireguardConfig(ctx, cfg, client, opts.overlayPrefixes, opts.directAccess); err != nil {
+		return fmt.Errorf("unable to create wireguard config: %w", err)
+	}
+
+	err = proxy.Run(logr.NewContext(ctx, log), cfg, client, restConfig)
+
+	// The command's exit code is propagated by Execute, so there's nothing more to report
+	var exitErr *proxy.ExitError
+	if errors.As(err, &exitErr) {
+		cmd.SilenceErrors = true
+	}
+
+	return err
+}
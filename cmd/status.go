@@ -0,0 +1,130 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/util/duration"
+
+	"github.com/steved/kubewire/pkg/kuberneteshelpers"
+	"github.com/steved/kubewire/pkg/session"
+)
+
+func init() {
+	var kubeconfig, namespace string
+
+	statusCmd := &cobra.Command{
+		Use:   "status",
+		Short: "List active proxy sessions in the cluster.",
+		Args:  cobra.NoArgs,
+		RunE: func(_ *cobra.Command, _ []string) error {
+			ctx := logr.NewContext(context.Background(), log)
+
+			client, _, err := kuberneteshelpers.ClientConfig(kubeconfig)
+			if err != nil {
+				return fmt.Errorf("failed to create kubernetes client: %w", err)
+			}
+
+			sessions, err := session.List(ctx, client, namespace)
+			if err != nil {
+				return fmt.Errorf("unable to list sessions: %w", err)
+			}
+
+			// Local statistics are only available with sufficient privileges on the machine running the session
+			peers, err := session.LocalPeerStats(ctx)
+			if err != nil {
+				log.V(1).Info("unable to read local wireguard statistics", "error", err.Error())
+			}
+
+			showPeers := false
+
+			for _, s := range sessions {
+				if _, ok := peers[s.PublicKey]; ok {
+					showPeers = true
+				}
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+
+			header := []string{"NAMESPACE", "TARGET", "CONTAINER", "MODE", "ENDPOINT", "RESOURCES", "AGE"}
+			if showPeers {
+				header = append(header, "DEVICE", "HANDSHAKE", "RX", "TX")
+			}
+
+			fmt.Fprintln(w, strings.Join(header, "\t"))
+
+			for _, s := range sessions {
+				row := []string{
+					s.Namespace,
+					fmt.Sprintf("%s/%s", s.Kind, s.Name),
+					valueOrNone(s.Container),
+					s.Mode,
+					valueOrNone(s.Endpoint),
+					valueOrNone(strings.Join(s.Resources, ",")),
+					age(s.StartedAt),
+				}
+
+				if showPeers {
+					if peer, ok := peers[s.PublicKey]; ok {
+						handshake := "never"
+						if !peer.LastHandshake.IsZero() {
+							handshake = age(peer.LastHandshake) + " ago"
+						}
+
+						row = append(row, peer.Device, handshake, formatBytes(peer.ReceiveBytes), formatBytes(peer.TransmitBytes))
+					} else {
+						row = append(row, "-", "-", "-", "-")
+					}
+				}
+
+				fmt.Fprintln(w, strings.Join(row, "\t"))
+			}
+
+			return w.Flush()
+		},
+	}
+
+	statusCmd.Flags().StringVarP(&kubeconfig, "kubeconfig", "", os.Getenv("KUBECONFIG"), "Kubernetes cfg file")
+	statusCmd.Flags().StringVarP(&namespace, "namespace", "n", "", "Namespace to list sessions in. Defaults to all namespaces")
+
+	rootCmd.AddCommand(statusCmd)
+}
+
+func valueOrNone(value string) string {
+	if value == "" {
+		return "-"
+	}
+
+	return value
+}
+
+func age(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+
+	return duration.HumanDuration(time.Since(t))
+}
+
+func formatBytes(b int64) string {
+	const unit = 1024
+
+	if b < unit {
+		return fmt.Sprintf("%d B", b)
+	}
+
+	div, exp := int64(unit), 0
+
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.2f %ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
@@ -2,25 +2,130 @@ package agent
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net"
 	"net/netip"
 	"os"
 	"os/signal"
+	"slices"
+	"strconv"
 	"strings"
 	"syscall"
 
 	"github.com/coreos/go-iptables/iptables"
 	"github.com/go-logr/logr"
+	"golang.zx2c4.com/wireguard/wgctrl"
 	"tailscale.com/net/netutil"
 
 	"github.com/steved/kubewire/pkg/config"
+	"github.com/steved/kubewire/pkg/kuberneteshelpers"
 	"github.com/steved/kubewire/pkg/nat"
+	"github.com/steved/kubewire/pkg/remap"
 	"github.com/steved/kubewire/pkg/routing"
 	"github.com/steved/kubewire/pkg/wg"
 )
 
-var defaultInterface = func() (string, netip.Addr, error) {
-	return netutil.DefaultInterfacePortable()
+// defaultInterface returns the name and global unicast addresses of the interface of the default route, overridden in
+// tests
+var defaultInterface = func() (string, []netip.Addr, error) {
+	name, _, err := netutil.DefaultInterfacePortable()
+	if err != nil {
+		// IPv6-only pods have no IPv4 default route
+		name, err = defaultIPv6Interface()
+		if err != nil {
+			return "", nil, fmt.Errorf("unable to determine default interface: %w", err)
+		}
+	}
+
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to find interface %q: %w", name, err)
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to list addresses of interface %q: %w", name, err)
+	}
+
+	var globalAddrs []netip.Addr
+
+	for _, addr := range addrs {
+		prefix, err := netip.ParsePrefix(addr.String())
+		if err == nil && prefix.Addr().IsGlobalUnicast() {
+			globalAddrs = append(globalAddrs, prefix.Addr().Unmap())
+		}
+	}
+
+	return name, globalAddrs, nil
+}
+
+// defaultIPv6Interface returns the name of the interface of the IPv6 default route
+func defaultIPv6Interface() (string, error) {
+	// Dialing UDP only selects the route and source address, without sending anything
+	conn, err := net.Dial("udp6", "[2001:4860:4860::8888]:53")
+	if err != nil {
+		return "", err
+	}
+
+	local := conn.LocalAddr().(*net.UDPAddr).IP
+	_ = conn.Close()
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return "", err
+	}
+
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(local) {
+				return iface.Name, nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("no interface has address %s", local)
+}
+
+// wireguardListenPort returns the port the wireguard device listens on, overridden in tests
+var wireguardListenPort = func(ctx context.Context, deviceName string) (int, error) {
+	client, err := wgctrl.New()
+	if err != nil {
+		return 0, fmt.Errorf("unable to create wireguard client: %w", err)
+	}
+
+	defer func() {
+		if err := client.Close(); err != nil {
+			logr.FromContextOrDiscard(ctx).Error(err, "unable to close wireguard client")
+		}
+	}()
+
+	device, err := client.Device(deviceName)
+	if err != nil {
+		return 0, fmt.Errorf("unable to get wireguard device %s: %w", deviceName, err)
+	}
+
+	return device.ListenPort, nil
+}
+
+// reportPodNetwork discovers the pod's network and writes it for the CLI to read, returning what was discovered
+func reportPodNetwork() (kuberneteshelpers.PodNetwork, error) {
+	_, podAddrs, err := defaultInterface()
+	if err != nil {
+		return kuberneteshelpers.PodNetwork{}, err
+	}
+
+	network, err := discoverPodNetwork(podAddrs)
+	if err != nil {
+		return network, err
+	}
+
+	return network, writePodNetwork(ContainerNetworkPath, network)
 }
 
 type iptablesManager interface {
@@ -29,9 +134,22 @@ type iptablesManager interface {
 	ChainExists(string, string) (bool, error)
 }
 
-func Run(ctx context.Context, cfg config.Wireguard, istioEnabled bool, proxyExcludedPorts []string) error {
+// Run runs the agent until signaled. Connections to the pod are forwarded to the local machine; either those to the
+// intercept ports or, without any, all but the excluded ports. In sidecar mode, connections to the intercept ports fall
+// back to the target container when the local machine is unreachable. Connections from the local machine to substitutes
+// of remapped cluster ranges are translated back, and DNS queries to the agent answered with the substitutes.
+func Run(ctx context.Context, cfg config.Wireguard, istioEnabled bool, proxyExcludedPorts []string, interceptPorts []config.PortMapping, sidecar bool) error {
 	log := logr.FromContextOrDiscard(ctx)
 
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// The pod's network is reported to the CLI, which reads it when unable to resolve the cluster's details itself
+	network, err := reportPodNetwork()
+	if err != nil {
+		log.Error(err, "unable to discover pod network")
+	}
+
 	var listenPort int
 
 	if cfg.DirectAccess {
@@ -64,7 +182,7 @@ func Run(ctx context.Context, cfg config.Wireguard, istioEnabled bool, proxyExcl
 		},
 		PrivateKey: cfg.AgentKey.Key,
 		ListenPort: listenPort,
-		Address:    cfg.AgentOverlayAddress,
+		Addresses:  cfg.AgentOverlayAddresses(),
 	})
 
 	wgStop, err := wireguardDevice.Start(ctx)
@@ -78,7 +196,13 @@ func Run(ctx context.Context, cfg config.Wireguard, istioEnabled bool, proxyExcl
 
 	log.V(1).Info("Starting route setup")
 
-	router := routing.NewRouting(wireguardDevice.DeviceName(), netip.Addr{}, netip.PrefixFrom(cfg.LocalOverlayAddress, 32))
+	var routes []netip.Prefix
+	for _, localOverlayAddress := range cfg.LocalOverlayAddresses() {
+		routes = append(routes, netip.PrefixFrom(localOverlayAddress, localOverlayAddress.BitLen()))
+	}
+
+	// The agent's pod has no other routes to take precedence over its own
+	router := routing.NewRouting(wireguardDevice.DeviceName(), netip.Addr{}, "", 0, routes...)
 
 	routerStop, err := router.Start(ctx)
 	if err != nil {
@@ -89,19 +213,70 @@ func Run(ctx context.Context, cfg config.Wireguard, istioEnabled bool, proxyExcl
 
 	log.Info("Routing setup complete")
 
+	var redirects []sidecarRedirect
+
+	if sidecar {
+		log.V(1).Info("Starting sidecar proxies", "ports", interceptPorts)
+
+		_, podAddrs, err := defaultInterface()
+		if err != nil {
+			return err
+		}
+
+		redirects, err = startSidecarProxies(ctx, sidecarOverlayAddress(cfg.LocalOverlayAddresses(), podAddrs), podAddrs, wireguardDevice.DeviceName(), interceptPorts)
+		if err != nil {
+			return err
+		}
+
+		log.Info("Sidecar proxies started")
+	}
+
 	log.V(1).Info("Starting IPTables setup")
 
-	ipt, err := iptables.New(iptables.IPFamily(iptables.ProtocolIPv4), iptables.Timeout(5))
+	wireguardPort, err := wireguardListenPort(ctx, wireguardDevice.DeviceName())
 	if err != nil {
-		return fmt.Errorf("unable to initialize iptables client: %w", err)
+		return err
 	}
 
-	if err := updateIPTablesRules(cfg, ipt, wireguardDevice.DeviceName(), istioEnabled, proxyExcludedPorts); err != nil {
-		return err
+	for _, localOverlayAddress := range cfg.LocalOverlayAddresses() {
+		protocol := iptables.ProtocolIPv4
+		if localOverlayAddress.Is6() {
+			protocol = iptables.ProtocolIPv6
+		}
+
+		ipt, err := iptables.New(iptables.IPFamily(protocol), iptables.Timeout(5))
+		if err != nil {
+			return fmt.Errorf("unable to initialize iptables client: %w", err)
+		}
+
+		if err := updateIPTablesRules(ipt, localOverlayAddress, wireguardDevice.DeviceName(), wireguardPort, istioEnabled, proxyExcludedPorts, interceptPorts, redirects); err != nil {
+			return err
+		}
+
+		if err := updateRemapRules(ipt, wireguardDevice.DeviceName(), cfg.Remaps, localOverlayAddress.Is6()); err != nil {
+			return err
+		}
 	}
 
 	log.Info("IPTables setup complete")
 
+	if len(cfg.Remaps) > 0 {
+		if len(network.Nameservers) == 0 {
+			return errors.New("unable to rewrite DNS answers to remapped ranges, the pod has no nameserver")
+		}
+
+		var listenAddrs []netip.AddrPort
+		for _, agentOverlayAddress := range cfg.AgentOverlayAddresses() {
+			listenAddrs = append(listenAddrs, netip.AddrPortFrom(agentOverlayAddress, dnsPort))
+		}
+
+		if err := startDNSProxy(ctx, listenAddrs, netip.AddrPortFrom(network.Nameservers[0], dnsPort), cfg.Remaps); err != nil {
+			return err
+		}
+
+		log.Info("DNS proxy started", "remaps", len(cfg.Remaps))
+	}
+
 	log.Info("Started, waiting for signal")
 
 	sigCh := make(chan os.Signal, 1)
@@ -111,37 +286,124 @@ func Run(ctx context.Context, cfg config.Wireguard, istioEnabled bool, proxyExcl
 	return nil
 }
 
-func updateIPTablesRules(cfg config.Wireguard, ipt iptablesManager, wireguardDeviceName string, istioEnabled bool, proxyExcludedPorts []string) error {
-	deviceName, deviceAddr, err := defaultInterface()
+// portForward forwards connections matching a rulespec to a destination on the local machine
+type portForward struct {
+	protocol    string
+	match       []string
+	destination string
+}
+
+// updateIPTablesRules intercepts TCP and UDP connections and pings to the pod's address of the same family as the local
+// overlay address, forwarding them to the local machine. Nothing is intercepted if the pod has no such address.
+// UDP to the tunnel's own port is never intercepted. With intercept ports, only connections to those ports are
+// intercepted and forwarded to their local ports. With sidecar redirects, only TCP connections to the target
+// container's ports are intercepted, redirected to the sidecar proxies instead. Connections and pings from the local
+// machine into the cluster are masqueraded as the pod.
+func updateIPTablesRules(ipt iptablesManager, localOverlayAddress netip.Addr, wireguardDeviceName string, wireguardPort int, istioEnabled bool, proxyExcludedPorts []string, interceptPorts []config.PortMapping, redirects []sidecarRedirect) error {
+	deviceName, deviceAddrs, err := defaultInterface()
 	if err != nil {
 		return fmt.Errorf("unable to determine default device name: %w", err)
 	}
 
-	if err := ipt.AppendUnique("nat", "POSTROUTING", "-p", "udp", "-o", deviceName, "-j", "MASQUERADE"); err != nil {
-		return fmt.Errorf("unable to create iptables rule: %w", err)
+	deviceAddrIndex := slices.IndexFunc(deviceAddrs, func(addr netip.Addr) bool { return addr.Is4() == localOverlayAddress.Is4() })
+	if deviceAddrIndex < 0 {
+		return nil
 	}
 
-	defaultIfaceRulespec := []string{"-p", "tcp", "-i", deviceName}
+	deviceAddr := deviceAddrs[deviceAddrIndex]
+
+	icmp, icmpType, istioOutbound := "icmp", "--icmp-type", "127.0.0.6:15001"
+	if localOverlayAddress.Is6() {
+		icmp, icmpType, istioOutbound = "icmpv6", "--icmpv6-type", "[::6]:15001"
+	}
 
-	if len(proxyExcludedPorts) > 0 {
-		defaultIfaceRulespec = append(defaultIfaceRulespec, "-m", "multiport", "!", "--dports", strings.Join(proxyExcludedPorts, ","))
+	for _, protocol := range []string{"udp", icmp} {
+		if err := ipt.AppendUnique("nat", "POSTROUTING", "-p", protocol, "-o", deviceName, "-j", "MASQUERADE"); err != nil {
+			return fmt.Errorf("unable to create iptables rule: %w", err)
+		}
 	}
 
-	defaultIfaceRulespec = append(defaultIfaceRulespec, "-j", "DNAT", "--to-destination", cfg.LocalOverlayAddress.String())
+	if len(redirects) > 0 {
+		for _, redirect := range redirects {
+			if err := ipt.AppendUnique("nat", "PREROUTING", "-p", "tcp", "-i", deviceName, "--dport", strconv.Itoa(redirect.Port), "-j", "REDIRECT", "--to-ports", strconv.Itoa(redirect.ListenPort)); err != nil {
+				return fmt.Errorf("unable to create iptables rule: %w", err)
+			}
+		}
+
+		if err := ipt.AppendUnique("nat", "POSTROUTING", "-p", "tcp", "-o", deviceName, "-j", "MASQUERADE"); err != nil {
+			return fmt.Errorf("unable to create iptables rule: %w", err)
+		}
 
-	if err := ipt.AppendUnique("nat", "PREROUTING", defaultIfaceRulespec...); err != nil {
-		return fmt.Errorf("unable to create iptables rule: %w", err)
+		return nil
+	}
+
+	var forwards []portForward
+
+	for _, protocol := range []string{"tcp", "udp"} {
+		if len(interceptPorts) > 0 {
+			for _, mapping := range interceptPorts {
+				forwards = append(forwards, portForward{
+					protocol:    protocol,
+					match:       []string{"--dport", strconv.Itoa(int(mapping.Port))},
+					destination: netip.AddrPortFrom(localOverlayAddress, mapping.LocalPort).String(),
+				})
+			}
+
+			continue
+		}
+
+		// Without intercept ports, all ports but the excluded ones are forwarded to the same ports locally
+		excludedPorts := proxyExcludedPorts
+		if protocol == "udp" {
+			excludedPorts = append(slices.Clone(excludedPorts), strconv.Itoa(wireguardPort))
+		}
+
+		forward := portForward{protocol: protocol, destination: localOverlayAddress.String()}
+		if len(excludedPorts) > 0 {
+			forward.match = []string{"-m", "multiport", "!", "--dports", strings.Join(excludedPorts, ",")}
+		}
+
+		forwards = append(forwards, forward)
+	}
+
+	// Pings to the pod are answered by the local machine
+	forwards = append(forwards, portForward{protocol: icmp, match: []string{icmpType, "echo-request"}, destination: localOverlayAddress.String()})
+
+	for _, forward := range forwards {
+		rulespec := append([]string{"-p", forward.protocol, "-i", deviceName}, forward.match...)
+		rulespec = append(rulespec, "-j", "DNAT", "--to-destination", forward.destination)
+
+		if err := ipt.AppendUnique("nat", "PREROUTING", rulespec...); err != nil {
+			return fmt.Errorf("unable to create iptables rule: %w", err)
+		}
 	}
 
 	if istioEnabled {
-		if err := ipt.InsertUnique("nat", "PREROUTING", 1, "-p", "tcp", "-i", wireguardDeviceName, "-j", "DNAT", "--to-destination", "127.0.0.6:15001"); err != nil {
+		if err := ipt.InsertUnique("nat", "PREROUTING", 1, "-p", "tcp", "-i", wireguardDeviceName, "-j", "DNAT", "--to-destination", istioOutbound); err != nil {
 			return fmt.Errorf("unable to create iptables rule: %w", err)
 		}
-	} else {
-		if err := ipt.AppendUnique("nat", "PREROUTING", "-p", "tcp", "-i", wireguardDeviceName, "--destination", deviceAddr.String(), "-j", "DNAT", "--to-destination", cfg.LocalOverlayAddress.String()); err != nil {
+	}
+
+	for _, forward := range forwards {
+		// TCP is handled by istio when enabled and pings to the pod from the local machine are answered by the agent
+		if forward.protocol == icmp || (forward.protocol == "tcp" && istioEnabled) {
+			continue
+		}
+
+		// Excluded ports only apply to connections from within the cluster
+		if len(interceptPorts) == 0 {
+			forward.match = nil
+		}
+
+		rulespec := append([]string{"-p", forward.protocol, "-i", wireguardDeviceName, "--destination", deviceAddr.String()}, forward.match...)
+		rulespec = append(rulespec, "-j", "DNAT", "--to-destination", forward.destination)
+
+		if err := ipt.AppendUnique("nat", "PREROUTING", rulespec...); err != nil {
 			return fmt.Errorf("unable to create iptables rule: %w", err)
 		}
+	}
 
+	if !istioEnabled {
 		if err := ipt.AppendUnique("nat", "POSTROUTING", "-p", "tcp", "-o", deviceName, "-j", "MASQUERADE"); err != nil {
 			return fmt.Errorf("unable to create iptables rule: %w", err)
 		}
@@ -149,3 +411,20 @@ func updateIPTablesRules(cfg config.Wireguard, ipt iptablesManager, wireguardDev
 
 	return nil
 }
+
+// updateRemapRules translates connections from the local machine to substitutes of remapped cluster ranges of the IP
+// family back to the cluster ranges. The rules come first, ahead of istio's, as its proxy would otherwise see the
+// substitutes as the connections' original destinations.
+func updateRemapRules(ipt iptablesManager, wireguardDeviceName string, remaps remap.Mappings, ipv6 bool) error {
+	for _, mapping := range remaps {
+		if mapping.Local.Addr().Is6() != ipv6 {
+			continue
+		}
+
+		if err := ipt.InsertUnique("nat", "PREROUTING", 1, "-i", wireguardDeviceName, "--destination", mapping.Local.String(), "-j", "NETMAP", "--to", mapping.Cluster.String()); err != nil {
+			return fmt.Errorf("unable to create iptables rule: %w", err)
+		}
+	}
+
+	return nil
+}
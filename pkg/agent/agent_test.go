@@ -8,6 +8,8 @@ import (
 	"testing"
 
 	"github.com/steved/kubewire/pkg/config"
+	"github.com/steved/kubewire/pkg/remap"
+	"github.com/steved/kubewire/pkg/wg"
 )
 
 type fakeIptables struct {
@@ -46,16 +48,19 @@ func (f *fakeIptables) ChainExists(table string, chain string) (bool, error) {
 }
 
 func Test_updateIPTablesRules(t *testing.T) {
-	defaultInterface = func() (string, netip.Addr, error) {
-		return "eth0", netip.AddrFrom4([4]byte{100, 34, 56, 10}), nil
+	defaultInterface = func() (string, []netip.Addr, error) {
+		return "eth0", []netip.Addr{netip.MustParseAddr("100.34.56.10"), netip.MustParseAddr("2600:1f14::10")}, nil
 	}
 
-	cfg := config.Wireguard{LocalOverlayAddress: netip.MustParseAddr("10.1.0.1")}
+	localOverlayAddress := netip.MustParseAddr("10.1.0.1")
 
 	tests := []struct {
 		name               string
+		ipv6               bool
 		istioEnabled       bool
 		proxyExcludedPorts []string
+		interceptPorts     []config.PortMapping
+		redirects          []sidecarRedirect
 		existingRules      map[string]map[string][]string
 		wantRules          map[string]map[string][]string
 		wantErr            bool
@@ -63,16 +68,23 @@ func Test_updateIPTablesRules(t *testing.T) {
 		{
 			"basic",
 			false,
+			false,
+			nil,
+			nil,
 			nil,
 			nil,
 			map[string]map[string][]string{
 				"nat": {
 					"PREROUTING": {
 						"-p tcp -i eth0 -j DNAT --to-destination 10.1.0.1",
+						"-p udp -i eth0 -m multiport ! --dports 19070 -j DNAT --to-destination 10.1.0.1",
+						"-p icmp -i eth0 --icmp-type echo-request -j DNAT --to-destination 10.1.0.1",
 						"-p tcp -i wg0 --destination 100.34.56.10 -j DNAT --to-destination 10.1.0.1",
+						"-p udp -i wg0 --destination 100.34.56.10 -j DNAT --to-destination 10.1.0.1",
 					},
 					"POSTROUTING": {
 						"-p udp -o eth0 -j MASQUERADE",
+						"-p icmp -o eth0 -j MASQUERADE",
 						"-p tcp -o eth0 -j MASQUERADE",
 					},
 				},
@@ -82,16 +94,23 @@ func Test_updateIPTablesRules(t *testing.T) {
 		{
 			"excluded ports",
 			false,
+			false,
 			[]string{"12345", "23456"},
 			nil,
+			nil,
+			nil,
 			map[string]map[string][]string{
 				"nat": {
 					"PREROUTING": {
 						"-p tcp -i eth0 -m multiport ! --dports 12345,23456 -j DNAT --to-destination 10.1.0.1",
+						"-p udp -i eth0 -m multiport ! --dports 12345,23456,19070 -j DNAT --to-destination 10.1.0.1",
+						"-p icmp -i eth0 --icmp-type echo-request -j DNAT --to-destination 10.1.0.1",
 						"-p tcp -i wg0 --destination 100.34.56.10 -j DNAT --to-destination 10.1.0.1",
+						"-p udp -i wg0 --destination 100.34.56.10 -j DNAT --to-destination 10.1.0.1",
 					},
 					"POSTROUTING": {
 						"-p udp -o eth0 -j MASQUERADE",
+						"-p icmp -o eth0 -j MASQUERADE",
 						"-p tcp -o eth0 -j MASQUERADE",
 					},
 				},
@@ -100,17 +119,102 @@ func Test_updateIPTablesRules(t *testing.T) {
 		},
 		{
 			"istio",
+			false,
 			true,
 			[]string{"12345", "23456"},
 			nil,
+			nil,
+			nil,
 			map[string]map[string][]string{
 				"nat": {
 					"PREROUTING": {
 						"-p tcp -i eth0 -m multiport ! --dports 12345,23456 -j DNAT --to-destination 10.1.0.1",
 						"-p tcp -i wg0 -j DNAT --to-destination 127.0.0.6:15001",
+						"-p udp -i eth0 -m multiport ! --dports 12345,23456,19070 -j DNAT --to-destination 10.1.0.1",
+						"-p icmp -i eth0 --icmp-type echo-request -j DNAT --to-destination 10.1.0.1",
+						"-p udp -i wg0 --destination 100.34.56.10 -j DNAT --to-destination 10.1.0.1",
 					},
 					"POSTROUTING": {
 						"-p udp -o eth0 -j MASQUERADE",
+						"-p icmp -o eth0 -j MASQUERADE",
+					},
+				},
+			},
+			false,
+		},
+		{
+			"sidecar",
+			false,
+			false,
+			[]string{"12345"},
+			[]config.PortMapping{{Port: 8080, LocalPort: 8080}, {Port: 8443, LocalPort: 8443}},
+			[]sidecarRedirect{{Port: 8080, ListenPort: 40000}, {Port: 8443, ListenPort: 40001}},
+			nil,
+			map[string]map[string][]string{
+				"nat": {
+					"PREROUTING": {
+						"-p tcp -i eth0 --dport 8080 -j REDIRECT --to-ports 40000",
+						"-p tcp -i eth0 --dport 8443 -j REDIRECT --to-ports 40001",
+					},
+					"POSTROUTING": {
+						"-p udp -o eth0 -j MASQUERADE",
+						"-p icmp -o eth0 -j MASQUERADE",
+						"-p tcp -o eth0 -j MASQUERADE",
+					},
+				},
+			},
+			false,
+		},
+		{
+			"intercept ports",
+			false,
+			false,
+			[]string{"12345"},
+			[]config.PortMapping{{Port: 8080, LocalPort: 3000}, {Port: 53, LocalPort: 5353}},
+			nil,
+			nil,
+			map[string]map[string][]string{
+				"nat": {
+					"PREROUTING": {
+						"-p tcp -i eth0 --dport 8080 -j DNAT --to-destination 10.1.0.1:3000",
+						"-p tcp -i eth0 --dport 53 -j DNAT --to-destination 10.1.0.1:5353",
+						"-p udp -i eth0 --dport 8080 -j DNAT --to-destination 10.1.0.1:3000",
+						"-p udp -i eth0 --dport 53 -j DNAT --to-destination 10.1.0.1:5353",
+						"-p icmp -i eth0 --icmp-type echo-request -j DNAT --to-destination 10.1.0.1",
+						"-p tcp -i wg0 --destination 100.34.56.10 --dport 8080 -j DNAT --to-destination 10.1.0.1:3000",
+						"-p tcp -i wg0 --destination 100.34.56.10 --dport 53 -j DNAT --to-destination 10.1.0.1:5353",
+						"-p udp -i wg0 --destination 100.34.56.10 --dport 8080 -j DNAT --to-destination 10.1.0.1:3000",
+						"-p udp -i wg0 --destination 100.34.56.10 --dport 53 -j DNAT --to-destination 10.1.0.1:5353",
+					},
+					"POSTROUTING": {
+						"-p udp -o eth0 -j MASQUERADE",
+						"-p icmp -o eth0 -j MASQUERADE",
+						"-p tcp -o eth0 -j MASQUERADE",
+					},
+				},
+			},
+			false,
+		},
+		{
+			"ipv6",
+			true,
+			true,
+			[]string{"12345"},
+			nil,
+			nil,
+			nil,
+			map[string]map[string][]string{
+				"nat": {
+					"PREROUTING": {
+						"-p tcp -i eth0 -m multiport ! --dports 12345 -j DNAT --to-destination fd77:676b:6f00::1",
+						"-p tcp -i wg0 -j DNAT --to-destination [::6]:15001",
+						"-p udp -i eth0 -m multiport ! --dports 12345,19070 -j DNAT --to-destination fd77:676b:6f00::1",
+						"-p icmpv6 -i eth0 --icmpv6-type echo-request -j DNAT --to-destination fd77:676b:6f00::1",
+						"-p udp -i wg0 --destination 2600:1f14::10 -j DNAT --to-destination fd77:676b:6f00::1",
+					},
+					"POSTROUTING": {
+						"-p udp -o eth0 -j MASQUERADE",
+						"-p icmpv6 -o eth0 -j MASQUERADE",
 					},
 				},
 			},
@@ -119,6 +223,11 @@ func Test_updateIPTablesRules(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
+			local := localOverlayAddress
+			if tt.ipv6 {
+				local = netip.MustParseAddr("fd77:676b:6f00::1")
+			}
+
 			rules := tt.existingRules
 			if rules == nil {
 				rules = make(map[string]map[string][]string)
@@ -126,7 +235,7 @@ func Test_updateIPTablesRules(t *testing.T) {
 
 			f := &fakeIptables{rules: rules}
 
-			if err := updateIPTablesRules(cfg, f, "wg0", tt.istioEnabled, tt.proxyExcludedPorts); (err != nil) != tt.wantErr {
+			if err := updateIPTablesRules(f, local, "wg0", wg.DefaultWireguardPort, tt.istioEnabled, tt.proxyExcludedPorts, tt.interceptPorts, tt.redirects); (err != nil) != tt.wantErr {
 				t.Errorf("updateIPTablesRules() error = %v, wantErr %v", err, tt.wantErr)
 			}
 
@@ -136,3 +245,45 @@ func Test_updateIPTablesRules(t *testing.T) {
 		})
 	}
 }
+
+func Test_updateIPTablesRulesWithoutPodAddress(t *testing.T) {
+	defaultInterface = func() (string, []netip.Addr, error) {
+		return "eth0", []netip.Addr{netip.MustParseAddr("100.34.56.10")}, nil
+	}
+
+	f := &fakeIptables{rules: make(map[string]map[string][]string)}
+
+	if err := updateIPTablesRules(f, netip.MustParseAddr("fd77:676b:6f00::1"), "wg0", wg.DefaultWireguardPort, false, nil, nil, nil); err != nil {
+		t.Errorf("updateIPTablesRules() error = %v", err)
+	}
+
+	if len(f.rules) > 0 {
+		t.Errorf("updateIPTablesRules() rules = %v, expected none for a family the pod has no address of", f.rules)
+	}
+}
+
+func Test_updateRemapRules(t *testing.T) {
+	remaps := remap.Mappings{
+		{Cluster: netip.MustParsePrefix("10.0.0.0/16"), Local: netip.MustParsePrefix("100.96.0.0/16")},
+		{Cluster: netip.MustParsePrefix("fd00:10::/56"), Local: netip.MustParsePrefix("fd77:676b:7000::/56")},
+	}
+
+	f := &fakeIptables{rules: map[string]map[string][]string{"nat": {"PREROUTING": {"-p tcp -i wg0 -j DNAT --to-destination 127.0.0.6:15001"}}}}
+
+	if err := updateRemapRules(f, "wg0", remaps, false); err != nil {
+		t.Errorf("updateRemapRules() error = %v", err)
+	}
+
+	want := map[string]map[string][]string{
+		"nat": {
+			"PREROUTING": {
+				"-p tcp -i wg0 -j DNAT --to-destination 127.0.0.6:15001",
+				"-i wg0 --destination 100.96.0.0/16 -j NETMAP --to 10.0.0.0/16",
+			},
+		},
+	}
+
+	if !reflect.DeepEqual(f.rules, want) {
+		t.Errorf("updateRemapRules() rules = %v, expected %v", f.rules, want)
+	}
+}
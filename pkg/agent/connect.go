@@ -0,0 +1,54 @@
+package agent
+
+import (
+	"fmt"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilrand "k8s.io/apimachinery/pkg/util/rand"
+	"k8s.io/utils/ptr"
+)
+
+const (
+	ConnectNamePrefix     = "kw-connect"
+	connectInstanceLabel  = "app.kubernetes.io/instance"
+	connectNameLabel      = "app.kubernetes.io/name"
+	connectNameLabelValue = "kubewire-connect"
+)
+
+// ConnectName returns a unique name for a connect Deployment
+func ConnectName() string {
+	return fmt.Sprintf("%s-%s", ConnectNamePrefix, utilrand.String(5))
+}
+
+// NewConnectDeployment returns a Deployment which runs nothing but the agent. It's used as an ephemeral target when
+// only cluster access is needed and no existing workload should be modified. The empty placeholder container is
+// replaced by the agent when the session starts.
+func NewConnectDeployment(namespace, name string) *appsv1.Deployment {
+	labels := map[string]string{
+		connectNameLabel:     connectNameLabelValue,
+		connectInstanceLabel: name,
+		ManagedByLabelName:   ManagedByLabelValue,
+	}
+
+	return &appsv1.Deployment{
+		ObjectMeta: v1.ObjectMeta{Name: name, Namespace: namespace, Labels: labels},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: ptr.To(int32(1)),
+			Selector: &v1.LabelSelector{
+				MatchLabels: map[string]string{
+					connectNameLabel:     connectNameLabelValue,
+					connectInstanceLabel: name,
+				},
+			},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: v1.ObjectMeta{Labels: labels},
+				Spec: corev1.PodSpec{
+					Containers:                    []corev1.Container{{Name: ContainerName}},
+					TerminationGracePeriodSeconds: ptr.To(int64(5)),
+				},
+			},
+		},
+	}
+}
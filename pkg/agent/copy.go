@@ -0,0 +1,116 @@
+package agent
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/rand"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/utils/ptr"
+
+	"github.com/steved/kubewire/pkg/config"
+)
+
+const CopyLabelName = "wgko.io/copy-of"
+
+// CopyName returns the name of the copy of the named target object made by the session with the given suffix
+func CopyName(name, suffix string) string {
+	return fmt.Sprintf("%s-kw-copy-%s", name, suffix)
+}
+
+// newCopySuffix returns a random suffix to tell the copies made by each session apart, so that neither a copy left
+// behind by a session which didn't exit cleanly nor one made by another user's session blocks making a new one
+var newCopySuffix = func() string { return rand.String(5) }
+
+// NewCopyDeployment returns a Deployment running a copy of the target object's pods. It's used as an ephemeral target
+// so that the target object itself is left untouched. With shared labels, the copy's pods keep the labels of the
+// target's pods so that services send them a share of the target's traffic; otherwise they're only labeled as a copy.
+func NewCopyDeployment(obj runtime.Object, client kubernetes.Interface, restConfig *rest.Config, unstructuredTargets []config.UnstructuredTarget, shared bool) (*appsv1.Deployment, error) {
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return nil, fmt.Errorf("unable to access target object metadata: %w", err)
+	}
+
+	template, err := copyTemplate(obj, client, restConfig, unstructuredTargets)
+	if err != nil {
+		return nil, err
+	}
+
+	selector := map[string]string{CopyLabelName: accessor.GetName()}
+
+	labels := maps.Clone(selector)
+	if shared {
+		maps.Copy(labels, template.Labels)
+	}
+
+	template.Labels = labels
+
+	return &appsv1.Deployment{
+		ObjectMeta: v1.ObjectMeta{
+			Name:      CopyName(accessor.GetName(), newCopySuffix()),
+			Namespace: accessor.GetNamespace(),
+			Labels:    map[string]string{CopyLabelName: accessor.GetName(), ManagedByLabelName: ManagedByLabelValue},
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: ptr.To(int32(1)),
+			Selector: &v1.LabelSelector{MatchLabels: selector},
+			Template: template,
+		},
+	}, nil
+}
+
+// copyTemplate returns the pod template of the target object, or the template of a pod equivalent to a bare pod
+func copyTemplate(obj runtime.Object, client kubernetes.Interface, restConfig *rest.Config, unstructuredTargets []config.UnstructuredTarget) (corev1.PodTemplateSpec, error) {
+	switch obj := obj.(type) {
+	case *corev1.Pod:
+		spec := recreatedPodSpec(*obj.Spec.DeepCopy())
+
+		// The copy is scheduled anew and mustn't take over the identity of a statefulset's pod
+		spec.NodeName = ""
+		spec.Hostname = ""
+		spec.Subdomain = ""
+
+		// Labels set by the pod's controller identify that particular pod or revision
+		labels := maps.Clone(obj.Labels)
+		for _, label := range []string{appsv1.DefaultDeploymentUniqueLabelKey, appsv1.ControllerRevisionHashLabelKey, appsv1.StatefulSetPodNameLabel, appsv1.PodIndexLabel} {
+			delete(labels, label)
+		}
+
+		return corev1.PodTemplateSpec{
+			ObjectMeta: v1.ObjectMeta{Labels: labels, Annotations: maps.Clone(obj.Annotations)},
+			Spec:       spec,
+		}, nil
+	case *appsv1.DaemonSet:
+		return *obj.Spec.Template.DeepCopy(), nil
+	case *appsv1.StatefulSet:
+		template := *obj.Spec.Template.DeepCopy()
+
+		// Volumes of the statefulset's claim templates only exist for its own pods, so the copy starts with empty ones
+		for _, claim := range obj.Spec.VolumeClaimTemplates {
+			if slices.ContainsFunc(template.Spec.Volumes, func(volume corev1.Volume) bool { return volume.Name == claim.Name }) {
+				continue
+			}
+
+			template.Spec.Volumes = append(template.Spec.Volumes, corev1.Volume{
+				Name:         claim.Name,
+				VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+			})
+		}
+
+		return template, nil
+	}
+
+	target, err := NewTargetAdapter(obj, client, restConfig, unstructuredTargets)
+	if err != nil {
+		return corev1.PodTemplateSpec{}, err
+	}
+
+	return target.PodTemplate()
+}
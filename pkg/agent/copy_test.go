@@ -0,0 +1,178 @@
+package agent
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/utils/ptr"
+
+	"github.com/steved/kubewire/pkg/config"
+	"github.com/steved/kubewire/pkg/runnable"
+)
+
+func TestNewCopyDeployment(t *testing.T) {
+	newCopySuffix = func() string { return "abcde" }
+
+	template := corev1.PodTemplateSpec{
+		ObjectMeta: v1.ObjectMeta{Labels: selector},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "test-container", Image: "test-image"}},
+		},
+	}
+
+	deployment := &appsv1.Deployment{
+		ObjectMeta: v1.ObjectMeta{Name: objectName, Namespace: namespace},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: ptr.To(int32(3)),
+			Selector: &v1.LabelSelector{MatchLabels: selector},
+			Template: template,
+		},
+	}
+
+	statefulsetPod := &corev1.Pod{
+		ObjectMeta: v1.ObjectMeta{
+			Name:      objectName + "-0",
+			Namespace: namespace,
+			Labels: map[string]string{
+				"app":                          "test",
+				appsv1.StatefulSetPodNameLabel: objectName + "-0",
+				appsv1.PodIndexLabel:           "0",
+				"controller-revision-hash":     "abc",
+			},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "test-container", Image: "test-image"}},
+			NodeName:   "node-1",
+			Hostname:   objectName + "-0",
+			Subdomain:  objectName,
+		},
+	}
+
+	statefulset := &appsv1.StatefulSet{
+		ObjectMeta: v1.ObjectMeta{Name: objectName, Namespace: namespace},
+		Spec: appsv1.StatefulSetSpec{
+			Selector: &v1.LabelSelector{MatchLabels: selector},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: v1.ObjectMeta{Labels: selector},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{
+						Name:         "test-container",
+						Image:        "test-image",
+						VolumeMounts: []corev1.VolumeMount{{Name: "data", MountPath: "/data"}},
+					}},
+				},
+			},
+			VolumeClaimTemplates: []corev1.PersistentVolumeClaim{{ObjectMeta: v1.ObjectMeta{Name: "data"}}},
+		},
+	}
+
+	copyLabel := map[string]string{CopyLabelName: objectName}
+
+	tests := []struct {
+		name         string
+		obj          runtime.Object
+		shared       bool
+		wantLabels   map[string]string
+		wantTemplate corev1.PodSpec
+	}{
+		{"shared", deployment, true, map[string]string{CopyLabelName: objectName, "app.kubernetes.io/name": objectName}, template.Spec},
+		{"isolated", deployment, false, copyLabel, template.Spec},
+		{
+			"statefulset",
+			statefulset,
+			true,
+			map[string]string{CopyLabelName: objectName, "app.kubernetes.io/name": objectName},
+			corev1.PodSpec{
+				Containers: statefulset.Spec.Template.Spec.Containers,
+				Volumes:    []corev1.Volume{{Name: "data", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}}},
+			},
+		},
+		{
+			"pod",
+			statefulsetPod,
+			true,
+			map[string]string{CopyLabelName: objectName + "-0", "app": "test"},
+			corev1.PodSpec{Containers: statefulsetPod.Spec.Containers},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			copied, err := NewCopyDeployment(tt.obj, fake.NewClientset(), nil, nil, tt.shared)
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			name := tt.wantLabels[CopyLabelName]
+
+			assert.Equal(t, CopyName(name, "abcde"), copied.Name)
+			assert.Equal(t, namespace, copied.Namespace)
+			assert.Equal(t, ptr.To(int32(1)), copied.Spec.Replicas)
+			assert.Equal(t, map[string]string{CopyLabelName: name}, copied.Spec.Selector.MatchLabels)
+			assert.Equal(t, tt.wantLabels, copied.Spec.Template.Labels)
+			assert.Equal(t, tt.wantTemplate, copied.Spec.Template.Spec)
+		})
+	}
+
+	t.Run("session", func(t *testing.T) {
+		copied, err := NewCopyDeployment(deployment, fake.NewClientset(), nil, nil, true)
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		cfg := config.NewConfig()
+		cfg.Ephemeral = true
+
+		testAgent(t, copied, cfg, func(t *testing.T, stop runnable.StopFunc, client kubernetes.Interface, _ netip.AddrPort) {
+			created, err := client.AppsV1().Deployments(namespace).Get(context.Background(), CopyName(objectName, "abcde"), v1.GetOptions{})
+			if assert.NoError(t, err) {
+				assert.Equal(t, ContainerName, created.Spec.Template.Spec.Containers[0].Name)
+			}
+
+			stop()
+
+			_, err = client.AppsV1().Deployments(namespace).Get(context.Background(), CopyName(objectName, "abcde"), v1.GetOptions{})
+			assert.True(t, errors.IsNotFound(err))
+		})
+	})
+
+	t.Run("leftover copy", func(t *testing.T) {
+		// Left behind by an earlier session which didn't exit cleanly
+		leftover := &appsv1.Deployment{
+			ObjectMeta: v1.ObjectMeta{
+				Name:      CopyName(objectName, "fghij"),
+				Namespace: namespace,
+				Labels:    map[string]string{CopyLabelName: objectName, ManagedByLabelName: ManagedByLabelValue},
+			},
+		}
+
+		copied, err := NewCopyDeployment(deployment, fake.NewClientset(), nil, nil, true)
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		cfg := config.NewConfig()
+		cfg.Ephemeral = true
+
+		client := fake.NewClientset(leftover)
+
+		testAgentWithClient(t, client, copied, cfg, func(t *testing.T, stop runnable.StopFunc, client kubernetes.Interface, _ netip.AddrPort) {
+			_, err := client.AppsV1().Deployments(namespace).Get(context.Background(), CopyName(objectName, "abcde"), v1.GetOptions{})
+			assert.NoError(t, err)
+
+			stop()
+
+			_, err = client.AppsV1().Deployments(namespace).Get(context.Background(), leftover.Name, v1.GetOptions{})
+			assert.NoError(t, err)
+		})
+	})
+}
@@ -0,0 +1,262 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/utils/ptr"
+)
+
+// prepareDaemonSet excludes a single node from the daemonset and prepares a pod to run the agent on that node in place
+// of the daemonset's own pod. The daemonset's pods on other nodes are left running.
+func (a *kubernetesAgent) prepareDaemonSet(ctx context.Context, ds *appsv1.DaemonSet, configName string) (map[string]string, error) {
+	node, err := a.daemonSetNode(ctx, ds)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := saveOriginalState(&ds.ObjectMeta, originalState{Template: ds.Spec.Template, UpdateStrategy: &ds.Spec.UpdateStrategy}); err != nil {
+		return nil, fmt.Errorf("unable to save original state of target object %s/%s: %w", ds.Namespace, ds.Name, err)
+	}
+
+	template := ds.Spec.Template.DeepCopy()
+	if template.Labels == nil {
+		template.Labels = make(map[string]string)
+	}
+
+	// Select the agent pod alone rather than the daemonset's pods on other nodes
+	template.Labels[SessionLabelName] = a.revision
+
+	if err := a.injectAgent(&ds.ObjectMeta, template, configName); err != nil {
+		return nil, err
+	}
+
+	template.Spec.NodeName = node
+
+	a.agentPod = &corev1.Pod{
+		ObjectMeta: v1.ObjectMeta{
+			Name:        RelatedObjectName(ds.Name),
+			Namespace:   ds.Namespace,
+			Labels:      template.Labels,
+			Annotations: template.Annotations,
+		},
+		Spec: template.Spec,
+	}
+
+	// Changing the template would otherwise roll the daemonset's pods on every node
+	ds.Spec.UpdateStrategy = appsv1.DaemonSetUpdateStrategy{Type: appsv1.OnDeleteDaemonSetStrategyType}
+
+	if ds.Spec.Template.Annotations == nil {
+		ds.Spec.Template.Annotations = make(map[string]string)
+	}
+
+	ds.Spec.Template.Annotations[WireguardRevisionAnnotationName] = a.revision
+	excludeNode(&ds.Spec.Template.Spec, node)
+
+	return map[string]string{SessionLabelName: a.revision}, nil
+}
+
+// writeDaemonSet updates the daemonset and, once its pod on the agent's node has been removed, creates the agent pod in
+// its place. If the agent pod can't be created, the daemonset is restored.
+func (a *kubernetesAgent) writeDaemonSet(ctx context.Context, ds *appsv1.DaemonSet, dryRun []string) (_ runtime.Object, err error) {
+	result, err := a.client.AppsV1().DaemonSets(ds.Namespace).Update(ctx, ds, v1.UpdateOptions{DryRun: dryRun})
+	if err != nil {
+		return nil, fmt.Errorf("failed to update target object %s/%s: %w", ds.Namespace, ds.Name, err)
+	}
+
+	defer func() {
+		if err == nil || len(dryRun) > 0 {
+			return
+		}
+
+		if restoreErr := a.restoreTarget(context.WithoutCancel(ctx), ds.Name); restoreErr != nil {
+			logr.FromContextOrDiscard(ctx).Error(restoreErr, "unable to restore target object", "name", ds.Name)
+		}
+	}()
+
+	pods := a.client.CoreV1().Pods(ds.Namespace)
+	node := a.agentPod.Spec.NodeName
+
+	if len(dryRun) == 0 {
+		if err := a.waitForDaemonSetPodsDeleted(ctx, ds, node); err != nil {
+			return nil, fmt.Errorf("timeout after %s waiting for daemonset pod on node %q to be deleted: %w", WaitTimeout.String(), node, err)
+		}
+
+		// Replace the agent pod of a previous session which was never restored
+		if err := pods.Delete(ctx, a.agentPod.Name, v1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+			return nil, fmt.Errorf("failed to delete existing agent pod %s/%s: %w", ds.Namespace, a.agentPod.Name, err)
+		}
+
+		if err := waitForPodDeleted(ctx, pods, a.agentPod.Name); err != nil {
+			return nil, fmt.Errorf("timeout after %s waiting for existing agent pod %s/%s to be deleted: %w", WaitTimeout.String(), ds.Namespace, a.agentPod.Name, err)
+		}
+	}
+
+	// Having a controller keeps the daemonset from adopting the agent pod, which shares its labels, and deletes the
+	// agent pod along with its config
+	secret, err := a.client.CoreV1().Secrets(ds.Namespace).Get(ctx, a.agentPod.Name, v1.GetOptions{})
+	if err == nil {
+		a.agentPod.OwnerReferences = []v1.OwnerReference{{
+			APIVersion: "v1",
+			Kind:       "Secret",
+			Name:       secret.Name,
+			UID:        secret.UID,
+			Controller: ptr.To(true),
+		}}
+	} else if !errors.IsNotFound(err) {
+		return nil, fmt.Errorf("unable to get agent config %s/%s: %w", ds.Namespace, a.agentPod.Name, err)
+	}
+
+	pod, err := pods.Create(ctx, a.agentPod, v1.CreateOptions{DryRun: dryRun})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create agent pod %s/%s: %w", ds.Namespace, a.agentPod.Name, err)
+	}
+
+	a.agentPod = pod
+
+	return result, nil
+}
+
+// restoreDaemonSet deletes the agent pod and restores the daemonset to the state saved in its original state
+// annotation, if present, returning whether it was restored. The daemonset then recreates its pod on the agent's node.
+func (a *kubernetesAgent) restoreDaemonSet(ctx context.Context, name string) (bool, error) {
+	agentPodName := RelatedObjectName(name)
+
+	if err := a.client.CoreV1().Pods(a.config.Namespace).Delete(ctx, agentPodName, v1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+		return false, fmt.Errorf("unable to delete agent pod %s/%s: %w", a.config.Namespace, agentPodName, err)
+	}
+
+	ds, err := a.client.AppsV1().DaemonSets(a.config.Namespace).Get(ctx, name, v1.GetOptions{})
+	if err != nil {
+		return false, err
+	}
+
+	state, ok, err := loadOriginalState(ds)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	ds.Annotations = state.Annotations
+	ds.Spec.Template = state.Template
+
+	if state.UpdateStrategy != nil {
+		ds.Spec.UpdateStrategy = *state.UpdateStrategy
+	}
+
+	if _, err := a.client.AppsV1().DaemonSets(a.config.Namespace).Update(ctx, ds, v1.UpdateOptions{}); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// daemonSetNode returns the node to run the agent on; either the configured node or that of the daemonset's first pod
+func (a *kubernetesAgent) daemonSetNode(ctx context.Context, ds *appsv1.DaemonSet) (string, error) {
+	if a.config.Node != "" {
+		return a.config.Node, nil
+	}
+
+	pods, err := a.daemonSetPods(ctx, ds, "")
+	if err != nil {
+		return "", err
+	}
+
+	if len(pods) == 0 {
+		return "", fmt.Errorf("daemonset %s/%s has no scheduled pods, pass --node to choose a node", ds.Namespace, ds.Name)
+	}
+
+	return pods[0].Spec.NodeName, nil
+}
+
+// daemonSetPods returns the scheduled pods owned by the daemonset, sorted by name. A non-empty node returns only the
+// pods on that node.
+func (a *kubernetesAgent) daemonSetPods(ctx context.Context, ds *appsv1.DaemonSet, node string) ([]corev1.Pod, error) {
+	selector, err := v1.LabelSelectorAsSelector(ds.Spec.Selector)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse selector of daemonset %s/%s: %w", ds.Namespace, ds.Name, err)
+	}
+
+	pods, err := a.client.CoreV1().Pods(ds.Namespace).List(ctx, v1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list pods of daemonset %s/%s: %w", ds.Namespace, ds.Name, err)
+	}
+
+	var owned []corev1.Pod
+
+	for _, pod := range pods.Items {
+		if owner := v1.GetControllerOf(&pod); owner == nil || owner.UID != ds.UID {
+			continue
+		}
+
+		if pod.Spec.NodeName == "" || (node != "" && pod.Spec.NodeName != node) {
+			continue
+		}
+
+		owned = append(owned, pod)
+	}
+
+	slices.SortFunc(owned, func(a, b corev1.Pod) int { return strings.Compare(a.Name, b.Name) })
+
+	return owned, nil
+}
+
+// waitForDaemonSetPodsDeleted waits until the daemonset has no pods left on the node
+func (a *kubernetesAgent) waitForDaemonSetPodsDeleted(ctx context.Context, ds *appsv1.DaemonSet, node string) error {
+	log := logr.FromContextOrDiscard(ctx)
+
+	deadlineCtx, cancel := context.WithTimeout(ctx, WaitTimeout)
+	defer cancel()
+
+	log.Info("Waiting for daemonset pod to be removed from node", "node", node)
+
+	return wait.PollUntilContextCancel(deadlineCtx, time.Second, true, func(ctx context.Context) (bool, error) {
+		pods, err := a.daemonSetPods(ctx, ds, node)
+		if err != nil {
+			log.V(1).Info("unable to list daemonset pods", "error", err.Error())
+			return false, nil
+		}
+
+		return len(pods) == 0, nil
+	})
+}
+
+// excludeNode adds a node affinity to the pod spec which keeps it from being scheduled on the node
+func excludeNode(spec *corev1.PodSpec, node string) {
+	requirement := corev1.NodeSelectorRequirement{
+		Key:      "metadata.name",
+		Operator: corev1.NodeSelectorOpNotIn,
+		Values:   []string{node},
+	}
+
+	if spec.Affinity == nil {
+		spec.Affinity = &corev1.Affinity{}
+	}
+
+	if spec.Affinity.NodeAffinity == nil {
+		spec.Affinity.NodeAffinity = &corev1.NodeAffinity{}
+	}
+
+	if spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+		spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution = &corev1.NodeSelector{}
+	}
+
+	required := spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution
+	if len(required.NodeSelectorTerms) == 0 {
+		required.NodeSelectorTerms = []corev1.NodeSelectorTerm{{}}
+	}
+
+	// Terms are ORed, so each must exclude the node
+	for i := range required.NodeSelectorTerms {
+		required.NodeSelectorTerms[i].MatchFields = append(required.NodeSelectorTerms[i].MatchFields, requirement)
+	}
+}
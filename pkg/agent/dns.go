@@ -0,0 +1,234 @@
+package agent
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/go-logr/logr"
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/steved/kubewire/pkg/remap"
+)
+
+const (
+	// dnsPort is the port the DNS proxy listens on and the pod's nameserver is queried on
+	dnsPort = 53
+	// dnsTimeout bounds each query to the pod's nameserver
+	dnsTimeout = 5 * time.Second
+)
+
+// dnsProxy forwards DNS queries from the local machine to the pod's nameserver, rewriting addresses within remapped
+// cluster ranges in answers to their substitutes, so that names resolve to addresses routed through the tunnel
+type dnsProxy struct {
+	upstream netip.AddrPort
+	remaps   remap.Mappings
+}
+
+// startDNSProxy serves DNS over UDP and TCP on the addresses until the context is canceled
+func startDNSProxy(ctx context.Context, addrs []netip.AddrPort, upstream netip.AddrPort, remaps remap.Mappings) error {
+	proxy := &dnsProxy{upstream: upstream, remaps: remaps}
+
+	for _, addr := range addrs {
+		packetConn, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(addr))
+		if err != nil {
+			return fmt.Errorf("unable to listen for DNS queries on %s: %w", addr, err)
+		}
+
+		listener, err := net.ListenTCP("tcp", net.TCPAddrFromAddrPort(addr))
+		if err != nil {
+			_ = packetConn.Close()
+			return fmt.Errorf("unable to listen for DNS queries on %s: %w", addr, err)
+		}
+
+		go func() {
+			<-ctx.Done()
+			_ = packetConn.Close()
+			_ = listener.Close()
+		}()
+
+		go proxy.serveUDP(ctx, packetConn)
+		go proxy.serveTCP(ctx, listener)
+	}
+
+	return nil
+}
+
+func (p *dnsProxy) serveUDP(ctx context.Context, conn *net.UDPConn) {
+	log := logr.FromContextOrDiscard(ctx)
+
+	for {
+		buf := make([]byte, 65535)
+
+		n, addr, err := conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Error(err, "unable to read DNS query")
+			}
+
+			return
+		}
+
+		go func() {
+			response, err := p.exchange(ctx, "udp", buf[:n])
+			if err != nil {
+				log.V(1).Info("unable to forward DNS query", "error", err.Error())
+				return
+			}
+
+			if _, err := conn.WriteToUDPAddrPort(response, addr); err != nil {
+				log.V(1).Info("unable to answer DNS query", "error", err.Error())
+			}
+		}()
+	}
+}
+
+func (p *dnsProxy) serveTCP(ctx context.Context, listener *net.TCPListener) {
+	log := logr.FromContextOrDiscard(ctx)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Error(err, "unable to accept DNS connection")
+			}
+
+			return
+		}
+
+		go func() {
+			defer func() {
+				_ = conn.Close()
+			}()
+
+			// Queries are answered in turn until the client closes the connection
+			for {
+				query, err := readTCPMessage(conn)
+				if err != nil {
+					return
+				}
+
+				response, err := p.exchange(ctx, "tcp", query)
+				if err != nil {
+					log.V(1).Info("unable to forward DNS query", "error", err.Error())
+					return
+				}
+
+				if err := writeTCPMessage(conn, response); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// exchange sends the query to the pod's nameserver over the network, returning its rewritten response
+func (p *dnsProxy) exchange(ctx context.Context, network string, query []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, dnsTimeout)
+	defer cancel()
+
+	var dialer net.Dialer
+
+	conn, err := dialer.DialContext(ctx, network, p.upstream.String())
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to %s: %w", p.upstream, err)
+	}
+
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	deadline, _ := ctx.Deadline()
+	if err := conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	var response []byte
+
+	if network == "tcp" {
+		if err := writeTCPMessage(conn, query); err != nil {
+			return nil, err
+		}
+
+		response, err = readTCPMessage(conn)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+
+		buf := make([]byte, 65535)
+
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		response = buf[:n]
+	}
+
+	return rewriteDNSResponse(response, p.remaps)
+}
+
+// rewriteDNSResponse replaces addresses within remapped cluster ranges in A and AAAA records of the response with their
+// substitutes. Responses without any are returned as is.
+func rewriteDNSResponse(response []byte, remaps remap.Mappings) ([]byte, error) {
+	var message dnsmessage.Message
+	if err := message.Unpack(response); err != nil {
+		return nil, fmt.Errorf("unable to parse DNS response: %w", err)
+	}
+
+	rewritten := false
+
+	for _, resources := range [][]dnsmessage.Resource{message.Answers, message.Additionals} {
+		for _, resource := range resources {
+			switch body := resource.Body.(type) {
+			case *dnsmessage.AResource:
+				if addr := netip.AddrFrom4(body.A); remaps.ToLocal(addr) != addr {
+					body.A = remaps.ToLocal(addr).As4()
+					rewritten = true
+				}
+			case *dnsmessage.AAAAResource:
+				if addr := netip.AddrFrom16(body.AAAA); remaps.ToLocal(addr) != addr {
+					body.AAAA = remaps.ToLocal(addr).As16()
+					rewritten = true
+				}
+			}
+		}
+	}
+
+	if !rewritten {
+		return response, nil
+	}
+
+	return message.Pack()
+}
+
+// readTCPMessage reads a DNS message prefixed by its length, as sent over TCP
+func readTCPMessage(r io.Reader) ([]byte, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+
+	message := make([]byte, length)
+	if _, err := io.ReadFull(r, message); err != nil {
+		return nil, err
+	}
+
+	return message, nil
+}
+
+// writeTCPMessage writes a DNS message prefixed by its length, as sent over TCP
+func writeTCPMessage(w io.Writer, message []byte) error {
+	_, err := w.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(message))), message...))
+
+	return err
+}
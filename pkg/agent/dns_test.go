@@ -0,0 +1,109 @@
+package agent
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/steved/kubewire/pkg/remap"
+)
+
+var testRemaps = remap.Mappings{
+	{Cluster: netip.MustParsePrefix("10.0.0.0/16"), Local: netip.MustParsePrefix("100.96.0.0/16")},
+}
+
+// dnsResponse returns a response to a query for name with an A record for each address
+func dnsResponse(t *testing.T, name string, addrs ...netip.Addr) []byte {
+	t.Helper()
+
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 1, Response: true})
+	assert.NoError(t, builder.StartQuestions())
+	assert.NoError(t, builder.Question(dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}))
+	assert.NoError(t, builder.StartAnswers())
+
+	for _, addr := range addrs {
+		header := dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 30}
+		assert.NoError(t, builder.AResource(header, dnsmessage.AResource{A: addr.As4()}))
+	}
+
+	response, err := builder.Finish()
+	assert.NoError(t, err)
+
+	return response
+}
+
+// answers returns the addresses of the A records of the response
+func answers(t *testing.T, response []byte) []netip.Addr {
+	t.Helper()
+
+	var message dnsmessage.Message
+	assert.NoError(t, message.Unpack(response))
+
+	var addrs []netip.Addr
+
+	for _, answer := range message.Answers {
+		if a, ok := answer.Body.(*dnsmessage.AResource); ok {
+			addrs = append(addrs, netip.AddrFrom4(a.A))
+		}
+	}
+
+	return addrs
+}
+
+func Test_rewriteDNSResponse(t *testing.T) {
+	tests := []struct {
+		name  string
+		addrs []netip.Addr
+		want  []netip.Addr
+	}{
+		{
+			"remapped",
+			[]netip.Addr{netip.MustParseAddr("10.0.3.4"), netip.MustParseAddr("172.20.1.1")},
+			[]netip.Addr{netip.MustParseAddr("100.96.3.4"), netip.MustParseAddr("172.20.1.1")},
+		},
+		{
+			"not remapped",
+			[]netip.Addr{netip.MustParseAddr("172.20.1.1")},
+			[]netip.Addr{netip.MustParseAddr("172.20.1.1")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := rewriteDNSResponse(dnsResponse(t, "hello-world.default.svc.cluster.local.", tt.addrs...), testRemaps)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, answers(t, got))
+		})
+	}
+}
+
+func Test_dnsProxy(t *testing.T) {
+	upstream, err := net.ListenUDP("udp4", net.UDPAddrFromAddrPort(netip.MustParseAddrPort("127.0.0.1:0")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { _ = upstream.Close() })
+
+	response := dnsResponse(t, "hello-world.default.svc.cluster.local.", netip.MustParseAddr("10.0.3.4"))
+
+	go func() {
+		buf := make([]byte, 512)
+
+		_, addr, err := upstream.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			return
+		}
+
+		_, _ = upstream.WriteToUDPAddrPort(response, addr)
+	}()
+
+	proxy := &dnsProxy{upstream: upstream.LocalAddr().(*net.UDPAddr).AddrPort(), remaps: testRemaps}
+
+	got, err := proxy.exchange(context.Background(), "udp", []byte("query"))
+	assert.NoError(t, err)
+	assert.Equal(t, []netip.Addr{netip.MustParseAddr("100.96.3.4")}, answers(t, got))
+}
@@ -0,0 +1,323 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/pmezard/go-difflib/difflib"
+	"gopkg.in/yaml.v3"
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/scheme"
+	sigsyaml "sigs.k8s.io/yaml"
+
+	"github.com/steved/kubewire/pkg/wg"
+)
+
+const redacted = "REDACTED"
+
+// Change is a modification the agent makes to an object in the cluster
+type Change struct {
+	// Before is the current state of the object, or nil if it doesn't exist yet
+	Before runtime.Object
+	// After is the state of the object once modified
+	After runtime.Object
+}
+
+// DryRun returns the changes Start would make to the cluster without making them. With server set, the changes are
+// submitted to the API server for validation and defaulting but aren't persisted.
+func (a *kubernetesAgent) DryRun(ctx context.Context, server bool) ([]Change, error) {
+	var (
+		changes []Change
+		dryRun  []string
+	)
+
+	if server {
+		dryRun = []string{v1.DryRunAll}
+	}
+
+	a.revision = newRevision()
+	a.startedAt = time.Now().UTC()
+
+	log := logr.FromContextOrDiscard(ctx)
+
+	objectName, err := meta.NewAccessor().Name(a.config.TargetObject)
+	if err != nil {
+		return nil, fmt.Errorf("unable to determine target object name: %w", err)
+	}
+
+	relatedObjectName := RelatedObjectName(objectName)
+
+	var before runtime.Object
+	if !a.config.Ephemeral {
+		before = a.config.TargetObject.DeepCopyObject()
+	}
+
+	matchLabels, err := a.prepareTarget(ctx, relatedObjectName)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := a.configSecret(a.config.Namespace, objectName, relatedObjectName)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create config: %w", err)
+	}
+
+	secrets := a.client.CoreV1().Secrets(a.config.Namespace)
+
+	change, err := dryRunApply(ctx, secrets.Get, secrets.Apply, secret, *secret.Name, &corev1.Secret{}, dryRun)
+	if err != nil {
+		return nil, fmt.Errorf("unable to render secret %s/%s: %w", a.config.Namespace, relatedObjectName, err)
+	}
+
+	changes = append(changes, change)
+
+	after := runtime.Object(a.config.TargetObject)
+	if server {
+		if after, err = a.writeTarget(ctx, dryRun); err != nil {
+			return nil, err
+		}
+	}
+
+	changes = append(changes, Change{Before: before, After: after})
+
+	if a.agentPod != nil {
+		changes = append(changes, Change{After: a.agentPod})
+	}
+
+	if a.config.Wireguard.DirectAccess {
+		log.Info("The network policy port is determined once the agent is running; showing the default port", "port", wg.DefaultWireguardPort)
+	}
+
+	if !a.config.Wireguard.DirectAccess && !a.config.Wireguard.LocalAddress.IsValid() {
+		services := a.client.CoreV1().Services(a.config.Namespace)
+
+		change, err := dryRunApply(ctx, services.Get, services.Apply, a.loadBalancerService(a.config.Namespace, objectName, relatedObjectName, matchLabels), relatedObjectName, &corev1.Service{}, dryRun)
+		if err != nil {
+			return nil, fmt.Errorf("unable to render load balancer service for %s/%s: %w", a.config.Namespace, objectName, err)
+		}
+
+		changes = append(changes, change)
+	}
+
+	if a.config.Wireguard.DirectAccess || !a.config.Wireguard.LocalAddress.IsValid() {
+		netpols := a.client.NetworkingV1().NetworkPolicies(a.config.Namespace)
+
+		change, err := dryRunApply(ctx, netpols.Get, netpols.Apply, a.networkPolicy(a.config.Namespace, objectName, relatedObjectName, matchLabels, int32(wg.DefaultWireguardPort)), relatedObjectName, &netv1.NetworkPolicy{}, dryRun)
+		if err != nil {
+			return nil, fmt.Errorf("unable to render network policy for %s/%s: %w", a.config.Namespace, objectName, err)
+		}
+
+		changes = append(changes, change)
+	}
+
+	return changes, nil
+}
+
+// dryRunApply returns the change applying the configuration would make. With dryRun set the configuration is applied
+// server-side without being persisted; otherwise it's converted into `into` as-is.
+func dryRunApply[A any, T runtime.Object](
+	ctx context.Context,
+	get func(context.Context, string, v1.GetOptions) (T, error),
+	apply func(context.Context, A, v1.ApplyOptions) (T, error),
+	config A,
+	name string,
+	into T,
+	dryRun []string,
+) (Change, error) {
+	var change Change
+
+	before, err := get(ctx, name, v1.GetOptions{})
+	if err == nil {
+		change.Before = before
+	} else if !errors.IsNotFound(err) {
+		return change, err
+	}
+
+	if len(dryRun) > 0 {
+		after, err := apply(ctx, config, v1.ApplyOptions{FieldManager: FieldManager, DryRun: dryRun})
+		if err != nil {
+			return change, err
+		}
+
+		change.After = after
+
+		return change, nil
+	}
+
+	contents, err := json.Marshal(config)
+	if err != nil {
+		return change, err
+	}
+
+	if err := json.Unmarshal(contents, into); err != nil {
+		return change, err
+	}
+
+	change.After = into
+
+	return change, nil
+}
+
+// RenderChanges writes the changes as YAML documents or, with diff set, as unified diffs against the current state of
+// each object. Secret values are redacted.
+func RenderChanges(w io.Writer, changes []Change, diff bool) error {
+	for i, change := range changes {
+		before, err := renderObject(change.Before)
+		if err != nil {
+			return err
+		}
+
+		after, err := renderObject(change.After)
+		if err != nil {
+			return err
+		}
+
+		if !diff {
+			if i > 0 {
+				if _, err := fmt.Fprintln(w, "---"); err != nil {
+					return err
+				}
+			}
+
+			if _, err := io.WriteString(w, after); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		name := objectReference(change.After)
+
+		fromFile := name + " (current)"
+		if change.Before == nil {
+			fromFile = "/dev/null"
+		}
+
+		err = difflib.WriteUnifiedDiff(w, difflib.UnifiedDiff{
+			A:        splitLines(before),
+			B:        splitLines(after),
+			FromFile: fromFile,
+			ToFile:   name + " (kubewire)",
+			Context:  3,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// splitLines splits the contents into lines, each retaining its trailing newline
+func splitLines(contents string) []string {
+	if contents == "" {
+		return nil
+	}
+
+	lines := strings.SplitAfter(contents, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	return lines
+}
+
+// objectReference returns the lowercase kind and name of the object, e.g. deployment/foo
+func objectReference(obj runtime.Object) string {
+	name, _ := meta.NewAccessor().Name(obj)
+
+	kinds, _, err := scheme.Scheme.ObjectKinds(obj)
+	if err != nil || len(kinds) == 0 {
+		return name
+	}
+
+	return strings.ToLower(kinds[0].Kind) + "/" + name
+}
+
+// renderObject returns the object as YAML without server-populated fields that are noise in a diff
+func renderObject(obj runtime.Object) (string, error) {
+	if obj == nil {
+		return "", nil
+	}
+
+	obj = obj.DeepCopyObject()
+
+	if kinds, _, err := scheme.Scheme.ObjectKinds(obj); err == nil && len(kinds) > 0 {
+		obj.GetObjectKind().SetGroupVersionKind(kinds[0])
+	}
+
+	if secret, ok := obj.(*corev1.Secret); ok {
+		redactSecret(secret)
+	}
+
+	contents, err := json.Marshal(obj)
+	if err != nil {
+		return "", fmt.Errorf("unable to marshal %s: %w", objectReference(obj), err)
+	}
+
+	var fields map[string]any
+	if err := json.Unmarshal(contents, &fields); err != nil {
+		return "", fmt.Errorf("unable to unmarshal %s: %w", objectReference(obj), err)
+	}
+
+	delete(fields, "status")
+
+	if metadata, ok := fields["metadata"].(map[string]any); ok {
+		for _, field := range []string{"managedFields", "resourceVersion", "uid", "generation", "creationTimestamp"} {
+			delete(metadata, field)
+		}
+	}
+
+	rendered, err := sigsyaml.Marshal(fields)
+	if err != nil {
+		return "", fmt.Errorf("unable to render %s: %w", objectReference(obj), err)
+	}
+
+	return string(rendered), nil
+}
+
+// redactSecret replaces the secret's data with readable string data. The private keys in the wireguard config are
+// redacted, as are the values of any other keys.
+func redactSecret(secret *corev1.Secret) {
+	data := make(map[string]string, len(secret.Data)+len(secret.StringData))
+
+	for key := range secret.StringData {
+		data[key] = redacted
+	}
+
+	for key, value := range secret.Data {
+		data[key] = redacted
+
+		if key != ConfigSecretKey {
+			continue
+		}
+
+		var cfg map[string]any
+		if err := yaml.Unmarshal(value, &cfg); err != nil {
+			continue
+		}
+
+		for _, field := range []string{"localkey", "agentkey"} {
+			if _, ok := cfg[field]; ok {
+				cfg[field] = redacted
+			}
+		}
+
+		if contents, err := yaml.Marshal(cfg); err == nil {
+			data[key] = string(contents)
+		}
+	}
+
+	secret.Data = nil
+	secret.StringData = data
+}
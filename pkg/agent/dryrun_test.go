@@ -0,0 +1,117 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/utils/ptr"
+
+	"github.com/steved/kubewire/pkg/config"
+)
+
+func TestAgentDryRun(t *testing.T) {
+	newRevision = func() string { return "1-2-3-4" }
+
+	deployment := &appsv1.Deployment{
+		ObjectMeta: v1.ObjectMeta{Name: objectName, Namespace: namespace},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: ptr.To(int32(3)),
+			Selector: &v1.LabelSelector{MatchLabels: selector},
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "test-container", Image: "test-image"}},
+				},
+			},
+		},
+	}
+
+	wireguardConfig, err := config.NewWireguardConfig(config.WithGeneratedKeypairs())
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	cfg := config.NewConfig()
+	cfg.TargetObject = deployment.DeepCopy()
+	cfg.Namespace = namespace
+	cfg.AgentImage = agentImage
+	cfg.Wireguard = wireguardConfig
+
+	client := fake.NewClientset(deployment.DeepCopy())
+
+	changes, err := NewKubernetesAgent(cfg, client, nil).DryRun(context.Background(), false)
+	if !assert.NoError(t, err) || !assert.Len(t, changes, 4) {
+		return
+	}
+
+	assert.Nil(t, changes[0].Before)
+
+	if secret, ok := changes[0].After.(*corev1.Secret); assert.True(t, ok) {
+		assert.Equal(t, relatedObjectName, secret.Name)
+		assert.Contains(t, secret.Data, ConfigSecretKey)
+	}
+
+	assert.Equal(t, deployment, changes[1].Before)
+
+	if modified, ok := changes[1].After.(*appsv1.Deployment); assert.True(t, ok) {
+		assert.Equal(t, ptr.To(int32(1)), modified.Spec.Replicas)
+		assert.Equal(t, ContainerName, modified.Spec.Template.Spec.Containers[0].Name)
+	}
+
+	if service, ok := changes[2].After.(*corev1.Service); assert.True(t, ok) {
+		assert.Equal(t, corev1.ServiceTypeLoadBalancer, service.Spec.Type)
+		assert.Equal(t, selector, service.Spec.Selector)
+	}
+
+	if netpol, ok := changes[3].After.(*netv1.NetworkPolicy); assert.True(t, ok) {
+		assert.Equal(t, selector, netpol.Spec.PodSelector.MatchLabels)
+	}
+
+	t.Run("nothing is modified", func(t *testing.T) {
+		current, err := client.AppsV1().Deployments(namespace).Get(context.Background(), objectName, v1.GetOptions{})
+		if assert.NoError(t, err) {
+			assert.Equal(t, deployment.Spec, current.Spec)
+			assert.Empty(t, current.Annotations)
+		}
+
+		_, err = client.CoreV1().Secrets(namespace).Get(context.Background(), relatedObjectName, v1.GetOptions{})
+		assert.True(t, errors.IsNotFound(err))
+
+		_, err = client.CoreV1().Services(namespace).Get(context.Background(), relatedObjectName, v1.GetOptions{})
+		assert.True(t, errors.IsNotFound(err))
+	})
+
+	t.Run("yaml", func(t *testing.T) {
+		var out bytes.Buffer
+
+		if assert.NoError(t, RenderChanges(&out, changes, false)) {
+			assert.Contains(t, out.String(), "kind: Secret\n")
+			assert.Contains(t, out.String(), "localkey: "+redacted)
+			assert.Contains(t, out.String(), "agentkey: "+redacted)
+			assert.NotContains(t, out.String(), wireguardConfig.LocalKey.String())
+			assert.NotContains(t, out.String(), wireguardConfig.AgentKey.String())
+			assert.Contains(t, out.String(), "kind: Deployment\n")
+			assert.Contains(t, out.String(), "kind: Service\n")
+			assert.Contains(t, out.String(), "kind: NetworkPolicy\n")
+		}
+	})
+
+	t.Run("diff", func(t *testing.T) {
+		var out bytes.Buffer
+
+		if assert.NoError(t, RenderChanges(&out, changes, true)) {
+			assert.Contains(t, out.String(), "--- /dev/null\n+++ secret/wg-test-object (kubewire)\n@@ -0,0 +1,26 @@\n")
+			assert.Contains(t, out.String(), "--- deployment/test-object (current)\n+++ deployment/test-object (kubewire)\n")
+			assert.Contains(t, out.String(), "-  replicas: 3\n+  replicas: 1\n")
+			assert.Contains(t, out.String(), "-      - image: test-image\n")
+			assert.NotContains(t, out.String(), wireguardConfig.LocalKey.String())
+		}
+	})
+}
@@ -2,7 +2,9 @@ package agent
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"maps"
 	"net"
 	"net/netip"
 	"slices"
@@ -19,8 +21,11 @@ import (
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/apimachinery/pkg/watch"
@@ -31,6 +36,7 @@ import (
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
 	watchtools "k8s.io/client-go/tools/watch"
+	"k8s.io/client-go/util/retry"
 	"k8s.io/utils/ptr"
 
 	"github.com/steved/kubewire/pkg/config"
@@ -43,15 +49,47 @@ const (
 	DefaultContainerAnnotationName  = "kubectl.kubernetes.io/default-container"
 	FieldManager                    = "wireguard"
 	WireguardRevisionAnnotationName = "wgko.io/revision"
+	OriginalStateAnnotationName     = "wgko.io/original-state"
+	ContainerAnnotationName         = "wgko.io/container"
+	ModeAnnotationName              = "wgko.io/mode"
+	EndpointAnnotationName          = "wgko.io/endpoint"
+	StartedAtAnnotationName         = "wgko.io/started-at"
+	PublicKeyAnnotationName         = "wgko.io/public-key"
+	TargetAnnotationName            = "wgko.io/target"
+	SessionLabelName                = "wgko.io/session"
+	CreatedAtLabelName              = "wgko.io/created-at"
+	ManagedByLabelName              = "app.kubernetes.io/managed-by"
+	ManagedByLabelValue             = "kubewire"
 	WaitTimeout                     = 5 * time.Minute
 	WireguardConfigVolumeName       = "wireguard-config"
 	ContainerAddressPath            = "/app/address"
+	ContainerNetworkPath            = "/app/network.json"
 	ContainerName                   = "agent"
+	ConfigSecretKey                 = "wg.yml"
+
+	ModeLoadBalancer = "load-balancer"
+	ModeDirect       = "direct"
+	ModeLocalAddress = "local-address"
 )
 
 type Agent interface {
 	runnable.Runnable
 	AgentAddress() netip.AddrPort
+	// PodNetwork returns the network reported by the agent, if it was needed to complete the cluster's details
+	PodNetwork() (kuberneteshelpers.PodNetwork, bool)
+	DryRun(ctx context.Context, server bool) ([]Change, error)
+}
+
+// originalState is the portion of the target object modified by the agent, saved before modification so it
+// can be restored when the session ends
+type originalState struct {
+	Annotations               map[string]string                 `json:"annotations,omitempty"`
+	Replicas                  *int32                            `json:"replicas,omitempty"`
+	Template                  corev1.PodTemplateSpec            `json:"template"`
+	UpdateStrategy            *appsv1.DaemonSetUpdateStrategy   `json:"updateStrategy,omitempty"`
+	StatefulSetUpdateStrategy *appsv1.StatefulSetUpdateStrategy `json:"statefulSetUpdateStrategy,omitempty"`
+	// Ordinal is the ordinal of the StatefulSet pod running the agent, which is recreated when restoring
+	Ordinal *int32 `json:"ordinal,omitempty"`
 }
 
 type kubernetesAgent struct {
@@ -59,7 +97,25 @@ type kubernetesAgent struct {
 	client     kubernetes.Interface
 	restConfig *rest.Config
 
+	revision     string
+	startedAt    time.Time
 	agentAddress netip.AddrPort
+	podNetwork   *kuberneteshelpers.PodNetwork
+
+	// agentPod is the pod created to run the agent when the target is a DaemonSet
+	agentPod *corev1.Pod
+	// agentTemplate is the template the pod of a single ordinal is recreated from when the target is a StatefulSet
+	agentTemplate *corev1.PodTemplateSpec
+	// target adapts the target object when it's a workload modified through its pod template
+	target TargetAdapter
+	// created are the related objects this session created rather than found, e.g. kept by an earlier session with
+	// --keep-resources, which are the only ones deleted if it fails to start
+	created relatedObjects
+}
+
+// relatedObjects are the objects created alongside the agent, sharing its related object name
+type relatedObjects struct {
+	service, networkPolicy, secret bool
 }
 
 func NewKubernetesAgent(config *config.Config, client kubernetes.Interface, restConfig *rest.Config) Agent {
@@ -70,153 +126,534 @@ func (a *kubernetesAgent) AgentAddress() netip.AddrPort {
 	return a.agentAddress
 }
 
-func (a *kubernetesAgent) Start(ctx context.Context) (runnable.StopFunc, error) {
-	var (
-		matchLabels           map[string]string
-		replaceContainerIndex int
-		revision              = newRevision()
-	)
+func (a *kubernetesAgent) PodNetwork() (kuberneteshelpers.PodNetwork, bool) {
+	if a.podNetwork == nil {
+		return kuberneteshelpers.PodNetwork{}, false
+	}
+
+	return *a.podNetwork, true
+}
+
+func (a *kubernetesAgent) Start(ctx context.Context) (_ runnable.StopFunc, err error) {
+	a.revision = newRevision()
+	a.startedAt = time.Now().UTC()
 
 	log := logr.FromContextOrDiscard(ctx)
-	accessor := meta.NewAccessor()
 
-	objectName, err := accessor.Name(a.config.TargetObject)
+	objectName, err := meta.NewAccessor().Name(a.config.TargetObject)
 	if err != nil {
 		return nil, fmt.Errorf("unable to determine target object name: %w", err)
 	}
 
-	relatedObjectName := wgObjectName(objectName)
-
-	switch targetObject := a.config.TargetObject.(type) {
-	case *appsv1.Deployment:
-		matchLabels = targetObject.Spec.Selector.MatchLabels
+	relatedObjectName := RelatedObjectName(objectName)
 
-		if targetObject.Spec.Template.Annotations == nil {
-			targetObject.Spec.Template.Annotations = make(map[string]string)
-		}
-
-		targetObject.Spec.Template.Annotations[WireguardRevisionAnnotationName] = revision
-		targetObject.Spec.Replicas = ptr.To(int32(1))
-
-		replaceContainerIndex = containerIndexOrDefault(a.config.Container, targetObject.Spec.Template.Annotations, targetObject.Spec.Template.Spec.Containers)
-		if replaceContainerIndex == -1 {
-			return nil, fmt.Errorf("unable to find container to replace in target object %s/%s", targetObject.Namespace, targetObject.Name)
-		}
-
-		if err := a.applyConfig(ctx, a.config.Namespace, relatedObjectName); err != nil {
-			return nil, fmt.Errorf("unable to create config: %w", err)
-		}
+	matchLabels, err := a.prepareTarget(ctx, relatedObjectName)
+	if err != nil {
+		return nil, err
+	}
 
-		a.replaceContainerWithAgent(&targetObject.Spec.Template.Spec, relatedObjectName, replaceContainerIndex)
+	// written is whether the target object has been modified, which is undone along with the objects this session
+	// created alongside the agent if any later step fails
+	var written bool
 
-		_, err := a.client.AppsV1().Deployments(targetObject.Namespace).Update(ctx, targetObject, v1.UpdateOptions{})
-		if err != nil {
-			return nil, fmt.Errorf("failed to update target object %s/%s: %w", targetObject.Namespace, targetObject.Name, err)
-		}
-	case *appsv1.StatefulSet:
-		matchLabels = targetObject.Spec.Selector.MatchLabels
-
-		if targetObject.Spec.Template.Annotations == nil {
-			targetObject.Spec.Template.Annotations = make(map[string]string)
+	defer func() {
+		if err == nil {
+			return
 		}
 
-		targetObject.Spec.Template.Annotations[WireguardRevisionAnnotationName] = revision
-		targetObject.Spec.Replicas = ptr.To(int32(1))
+		ctx := context.WithoutCancel(ctx)
 
-		replaceContainerIndex = containerIndexOrDefault(a.config.Container, targetObject.Spec.Template.Annotations, targetObject.Spec.Template.Spec.Containers)
-		if replaceContainerIndex == -1 {
-			return nil, fmt.Errorf("unable to find container to replace in target object %s/%s", targetObject.Namespace, targetObject.Name)
+		if written {
+			if revertErr := a.revertTarget(ctx, objectName); revertErr != nil {
+				log.Error(revertErr, "unable to revert target object", "name", objectName)
+			}
 		}
 
-		if err := a.applyConfig(ctx, a.config.Namespace, relatedObjectName); err != nil {
-			return nil, fmt.Errorf("unable to create config: %w", err)
-		}
+		a.deleteRelatedObjects(ctx, relatedObjectName, a.created)
+	}()
 
-		a.replaceContainerWithAgent(&targetObject.Spec.Template.Spec, relatedObjectName, replaceContainerIndex)
+	if err := a.applyConfig(ctx, a.config.Namespace, objectName, relatedObjectName); err != nil {
+		return nil, fmt.Errorf("unable to create config: %w", err)
+	}
 
-		_, err := a.client.AppsV1().StatefulSets(targetObject.Namespace).Update(ctx, targetObject, v1.UpdateOptions{})
-		if err != nil {
-			return nil, fmt.Errorf("failed to update target object %s/%s: %w", targetObject.Namespace, targetObject.Name, err)
-		}
-	default:
-		return nil, fmt.Errorf("target object is not a supported type: %t", targetObject)
+	if _, err := a.writeTarget(ctx, nil); err != nil {
+		return nil, err
 	}
 
+	written = true
+
 	if a.config.Wireguard.DirectAccess {
-		address, err := waitForPod(ctx, a.client.CoreV1().RESTClient(), a.restConfig, a.config.Namespace, matchLabels, revision)
+		address, err := waitForPod(ctx, a.client.CoreV1().RESTClient(), a.restConfig, a.config.Namespace, matchLabels, a.revision)
 		if err != nil {
 			return nil, fmt.Errorf("failed to find new pod for %s/%s: %w", a.config.Namespace, objectName, err)
 		}
 
-		if err := a.applyNetworkPolicy(ctx, a.config.Namespace, relatedObjectName, matchLabels, int32(address.Port())); err != nil {
+		if err := a.applyNetworkPolicy(ctx, a.config.Namespace, objectName, relatedObjectName, matchLabels, int32(address.Port())); err != nil {
 			return nil, fmt.Errorf("failed to create network policy for %s/%s: %w", a.config.Namespace, objectName, err)
 		}
 
 		a.agentAddress = address
 	} else if !a.config.Wireguard.LocalAddress.IsValid() {
-		address, err := a.applyLoadbalancer(ctx, a.config.Namespace, relatedObjectName, matchLabels)
+		address, err := a.applyLoadbalancer(ctx, a.config.Namespace, objectName, relatedObjectName, matchLabels)
 		if err != nil {
 			return nil, fmt.Errorf("failed to create load balancer service for %s/%s: %w", a.config.Namespace, objectName, err)
 		}
 
-		if err := a.applyNetworkPolicy(ctx, a.config.Namespace, relatedObjectName, matchLabels, int32(wg.DefaultWireguardPort)); err != nil {
+		if err := a.applyNetworkPolicy(ctx, a.config.Namespace, objectName, relatedObjectName, matchLabels, int32(wg.DefaultWireguardPort)); err != nil {
 			return nil, fmt.Errorf("failed to create network policy for %s/%s: %w", a.config.Namespace, objectName, err)
 		}
 
 		a.agentAddress = address
 	}
 
+	// Without cluster-scoped permissions, the cluster's details are completed with what the agent discovers
+	if missing := a.config.KubernetesClusterDetails.Missing(); len(missing) > 0 {
+		log.Info("Waiting for the agent to discover the cluster's network", "missing", missing)
+
+		network, err := waitForPodNetwork(ctx, a.client.CoreV1().RESTClient(), a.restConfig, a.config.Namespace, matchLabels, a.revision)
+		if err != nil {
+			return nil, fmt.Errorf("failed to discover the pod network of %s/%s: %w", a.config.Namespace, objectName, err)
+		}
+
+		a.podNetwork = &network
+	}
+
+	if a.agentAddress.IsValid() {
+		if err := a.recordEndpoint(ctx, objectName, a.agentAddress); err != nil {
+			return nil, fmt.Errorf("failed to record agent endpoint for %s/%s: %w", a.config.Namespace, objectName, err)
+		}
+	}
+
 	return func() {
+		// The context may already be canceled by the time the session is stopped
+		ctx := context.WithoutCancel(ctx)
+
+		if !a.config.KeepTarget {
+			if err := a.revertTarget(ctx, objectName); err != nil {
+				log.Error(err, "unable to revert target object", "name", objectName)
+			}
+		}
+
 		if a.config.KeepResources {
 			return
 		}
 
-		if err := a.client.CoreV1().Services(a.config.Namespace).Delete(ctx, relatedObjectName, v1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
-			log.Error(err, "unable to delete service", "name", relatedObjectName)
+		a.deleteRelatedObjects(ctx, relatedObjectName, relatedObjects{service: true, networkPolicy: true, secret: true})
+	}, nil
+}
+
+// deleteRelatedObjects deletes the given objects of the service, network policy and config secret created alongside
+// the agent, whichever exist
+func (a *kubernetesAgent) deleteRelatedObjects(ctx context.Context, name string, objects relatedObjects) {
+	log := logr.FromContextOrDiscard(ctx)
+
+	if objects.service {
+		if err := a.client.CoreV1().Services(a.config.Namespace).Delete(ctx, name, v1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+			log.Error(err, "unable to delete service", "name", name)
 		}
+	}
 
-		if err := a.client.NetworkingV1().NetworkPolicies(a.config.Namespace).Delete(ctx, relatedObjectName, v1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
-			log.Error(err, "unable to delete netpol", "name", relatedObjectName)
+	if objects.networkPolicy {
+		if err := a.client.NetworkingV1().NetworkPolicies(a.config.Namespace).Delete(ctx, name, v1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+			log.Error(err, "unable to delete netpol", "name", name)
 		}
+	}
 
-		if err := a.client.CoreV1().Secrets(a.config.Namespace).Delete(ctx, relatedObjectName, v1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
-			log.Error(err, "unable to delete secret", "name", relatedObjectName)
+	if objects.secret {
+		if err := a.client.CoreV1().Secrets(a.config.Namespace).Delete(ctx, name, v1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+			log.Error(err, "unable to delete secret", "name", name)
 		}
-	}, nil
+	}
 }
 
-func (a *kubernetesAgent) applyConfig(ctx context.Context, namespace, configName string) error {
-	cfg, err := yaml.Marshal(a.config.Wireguard)
+// found returns whether the error of getting an object means it exists, returning other errors than its absence
+func found[T any](_ T, err error) (bool, error) {
+	if errors.IsNotFound(err) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// prepareTarget modifies the target object in place to run the agent, returning the labels selecting its pods
+func (a *kubernetesAgent) prepareTarget(ctx context.Context, configName string) (map[string]string, error) {
+	switch targetObject := a.config.TargetObject.(type) {
+	case *corev1.Pod:
+		return a.preparePod(targetObject, configName)
+	case *appsv1.DaemonSet:
+		return a.prepareDaemonSet(ctx, targetObject, configName)
+	case *appsv1.StatefulSet:
+		if a.config.Ordinal != nil {
+			return a.prepareStatefulSetOrdinal(targetObject, configName, *a.config.Ordinal)
+		}
+	case *appsv1.ReplicaSet:
+		// The owner would revert any changes to the replicaset
+		if owner := v1.GetControllerOf(targetObject); owner != nil {
+			return nil, fmt.Errorf("replicaset %s/%s is managed by %s %q, target it instead", targetObject.Namespace, targetObject.Name, strings.ToLower(owner.Kind), owner.Name)
+		}
+	}
+
+	target, err := a.targetAdapter()
+	if err != nil {
+		return nil, err
+	}
+
+	return a.prepareWorkload(target, configName)
+}
+
+// targetAdapter returns the adapter for the target object
+func (a *kubernetesAgent) targetAdapter() (TargetAdapter, error) {
+	if a.target != nil {
+		return a.target, nil
+	}
+
+	target, err := NewTargetAdapter(a.config.TargetObject, a.client, a.restConfig, a.config.UnstructuredTargets)
+	if err != nil {
+		return nil, err
+	}
+
+	a.target = target
+
+	return target, nil
+}
+
+// prepareWorkload scales a workload down to a single replica running the agent
+func (a *kubernetesAgent) prepareWorkload(target TargetAdapter, configName string) (map[string]string, error) {
+	obj := target.Object()
+
+	template, err := target.PodTemplate()
+	if err != nil {
+		return nil, err
+	}
+
+	selector, err := target.Selector()
+	if err != nil {
+		return nil, err
+	}
+
+	replicas, err := target.Replicas()
+	if err != nil {
+		return nil, err
+	}
+
+	if !a.config.Ephemeral {
+		if err := saveOriginalState(obj, originalState{Replicas: replicas, Template: template}); err != nil {
+			return nil, fmt.Errorf("unable to save original state of target object %s/%s: %w", obj.GetNamespace(), obj.GetName(), err)
+		}
+	}
+
+	if err := target.SetReplicas(ptr.To(int32(1))); err != nil {
+		return nil, fmt.Errorf("unable to scale target object %s/%s: %w", obj.GetNamespace(), obj.GetName(), err)
+	}
+
+	if err := a.injectAgent(obj, &template, configName); err != nil {
+		return nil, err
+	}
+
+	if err := target.SetPodTemplate(template); err != nil {
+		return nil, fmt.Errorf("unable to set pod template of target object %s/%s: %w", obj.GetNamespace(), obj.GetName(), err)
+	}
+
+	return selector.MatchLabels, nil
+}
+
+// injectAgent marks the pod template with the session's revision and replaces the target container with the agent
+func (a *kubernetesAgent) injectAgent(obj v1.Object, template *corev1.PodTemplateSpec, configName string) error {
+	// The agent would intercept traffic for the whole node
+	if template.Spec.HostNetwork {
+		return fmt.Errorf("target object %s/%s uses the host network, which isn't supported", obj.GetNamespace(), obj.GetName())
+	}
+
+	if template.Annotations == nil {
+		template.Annotations = make(map[string]string)
+	}
+
+	template.Annotations[WireguardRevisionAnnotationName] = a.revision
+
+	replaceContainerIndex := containerIndexOrDefault(a.config.Container, template.Annotations, template.Spec.Containers)
+	if replaceContainerIndex == -1 {
+		return fmt.Errorf("unable to find container to replace in target object %s/%s", obj.GetNamespace(), obj.GetName())
+	}
+
+	container := template.Spec.Containers[replaceContainerIndex]
+
+	// Only the container's ports are intercepted when it keeps running
+	if a.config.Sidecar && len(a.config.Ports) == 0 && !slices.ContainsFunc(container.Ports, tcpPort) {
+		return fmt.Errorf("container %s of target object %s/%s declares no TCP ports to intercept as a sidecar", container.Name, obj.GetNamespace(), obj.GetName())
+	}
+
+	a.setSessionAnnotations(obj, container.Name)
+	a.replaceContainerWithAgent(&template.Spec, configName, replaceContainerIndex)
+
+	return nil
+}
+
+// writeTarget creates or updates the target object in the cluster, returning the result. Passing dryRun submits the
+// request without persisting it.
+func (a *kubernetesAgent) writeTarget(ctx context.Context, dryRun []string) (runtime.Object, error) {
+	switch targetObject := a.config.TargetObject.(type) {
+	case *corev1.Pod:
+		return a.recreatePod(ctx, targetObject, dryRun)
+	case *appsv1.DaemonSet:
+		return a.writeDaemonSet(ctx, targetObject, dryRun)
+	case *appsv1.StatefulSet:
+		if a.config.Ordinal != nil {
+			return a.writeStatefulSetOrdinal(ctx, targetObject, dryRun)
+		}
+	}
+
+	target, err := a.targetAdapter()
+	if err != nil {
+		return nil, err
+	}
+
+	obj := target.Object()
+
+	result, err := target.Apply(ctx, a.config.Ephemeral, dryRun)
+	if err != nil {
+		verb := "update"
+		if a.config.Ephemeral {
+			verb = "create"
+		}
+
+		return nil, fmt.Errorf("failed to %s target object %s/%s: %w", verb, obj.GetNamespace(), obj.GetName(), err)
+	}
+
+	return result, nil
+}
+
+// mode returns how the local machine and agent connect to one another
+func (a *kubernetesAgent) mode() string {
+	switch {
+	case a.config.Wireguard.DirectAccess:
+		return ModeDirect
+	case a.config.Wireguard.LocalAddress.IsValid():
+		return ModeLocalAddress
+	default:
+		return ModeLoadBalancer
+	}
+}
+
+// setSessionAnnotations records details about the session on the target object for use by `status` and `gc`
+func (a *kubernetesAgent) setSessionAnnotations(obj v1.Object, containerName string) {
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+
+	annotations[ContainerAnnotationName] = containerName
+	annotations[ModeAnnotationName] = a.mode()
+	annotations[StartedAtAnnotationName] = a.startedAt.Format(time.RFC3339)
+	annotations[PublicKeyAnnotationName] = a.config.Wireguard.AgentKey.PublicKey().String()
+
+	if a.config.Wireguard.LocalAddress.IsValid() {
+		annotations[EndpointAnnotationName] = a.config.Wireguard.LocalAddress.String()
+	}
+
+	obj.SetAnnotations(annotations)
+}
+
+// relatedObjectLabels returns labels identifying objects created alongside the agent so they can be found by `gc`
+func (a *kubernetesAgent) relatedObjectLabels() map[string]string {
+	return map[string]string{
+		ManagedByLabelName: ManagedByLabelValue,
+		SessionLabelName:   a.revision,
+		CreatedAtLabelName: strconv.FormatInt(a.startedAt.Unix(), 10),
+	}
+}
+
+// relatedObjectAnnotations returns annotations referencing the target object from objects created alongside the agent
+func (a *kubernetesAgent) relatedObjectAnnotations(name string) map[string]string {
+	return map[string]string{
+		TargetAnnotationName: fmt.Sprintf("%s/%s", TargetKind(a.config.TargetObject), name),
+	}
+}
+
+// recordEndpoint annotates the target object with the agent endpoint once it's known
+func (a *kubernetesAgent) recordEndpoint(ctx context.Context, name string, endpoint netip.AddrPort) error {
+	patch, err := json.Marshal(map[string]any{
+		"metadata": map[string]any{
+			"annotations": map[string]string{EndpointAnnotationName: endpoint.String()},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	switch a.config.TargetObject.(type) {
+	case *appsv1.DaemonSet:
+		_, err = a.client.AppsV1().DaemonSets(a.config.Namespace).Patch(ctx, name, types.MergePatchType, patch, v1.PatchOptions{})
+		return err
+	case *corev1.Pod:
+		_, err = a.client.CoreV1().Pods(a.config.Namespace).Patch(ctx, name, types.MergePatchType, patch, v1.PatchOptions{})
+		return err
+	}
+
+	target, err := a.targetAdapter()
+	if err != nil {
+		return err
+	}
+
+	return target.Patch(ctx, patch)
+}
+
+// revertTarget undoes the changes made to the target object. Ephemeral targets are deleted and all others are restored
+// to their original state.
+func (a *kubernetesAgent) revertTarget(ctx context.Context, name string) error {
+	if !a.config.Ephemeral {
+		return a.restoreTarget(ctx, name)
+	}
+
+	target, err := a.targetAdapter()
+	if err != nil {
+		return err
+	}
+
+	if err := target.Delete(ctx); err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+
+	logr.FromContextOrDiscard(ctx).Info("Deleted target object", "name", name, "namespace", a.config.Namespace)
+
+	return nil
+}
+
+// restoreTarget reverts the target object to the state saved in its original state annotation, if present
+func (a *kubernetesAgent) restoreTarget(ctx context.Context, name string) error {
+	log := logr.FromContextOrDiscard(ctx)
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		var (
+			restored bool
+			err      error
+		)
+
+		switch targetObject := a.config.TargetObject.(type) {
+		case *corev1.Pod:
+			restored, err = a.restorePod(ctx, targetObject)
+		case *appsv1.DaemonSet:
+			restored, err = a.restoreDaemonSet(ctx, name)
+		case *appsv1.StatefulSet:
+			restored, err = a.restoreStatefulSet(ctx, name)
+		default:
+			restored, err = a.restoreWorkload(ctx)
+		}
+
+		if err != nil || !restored {
+			return err
+		}
+
+		log.Info("Restored target object", "name", name, "namespace", a.config.Namespace)
+
+		return nil
+	})
+}
+
+// restoreWorkload restores the workload's pod template and replica count, returning whether it was restored
+func (a *kubernetesAgent) restoreWorkload(ctx context.Context) (bool, error) {
+	target, err := a.targetAdapter()
+	if err != nil {
+		return false, err
+	}
+
+	current, err := target.Get(ctx)
 	if err != nil {
-		return fmt.Errorf("unable to marshal wireguard config to YAML: %w", err)
+		return false, err
 	}
 
-	secret := corev1apply.Secret(configName, namespace).WithData(map[string][]byte{"wg.yml": cfg})
-	_, err = a.client.CoreV1().Secrets(namespace).Apply(ctx, secret, v1.ApplyOptions{FieldManager: FieldManager})
+	obj := current.Object()
+
+	state, ok, err := loadOriginalState(obj)
+	if err != nil || !ok {
+		return false, err
+	}
 
-	return err
+	obj.SetAnnotations(state.Annotations)
+
+	if err := current.SetReplicas(state.Replicas); err != nil {
+		return false, err
+	}
+
+	if err := current.SetPodTemplate(state.Template); err != nil {
+		return false, err
+	}
+
+	if _, err := current.Apply(ctx, false, nil); err != nil {
+		return false, err
+	}
+
+	return true, nil
 }
 
+func (a *kubernetesAgent) applyConfig(ctx context.Context, namespace, objectName, configName string) error {
+	secret, err := a.configSecret(namespace, objectName, configName)
+	if err != nil {
+		return err
+	}
+
+	exists, err := found(a.client.CoreV1().Secrets(namespace).Get(ctx, configName, v1.GetOptions{}))
+	if err != nil {
+		return fmt.Errorf("unable to get secret: %w", err)
+	}
+
+	if _, err := a.client.CoreV1().Secrets(namespace).Apply(ctx, secret, v1.ApplyOptions{FieldManager: FieldManager}); err != nil {
+		return err
+	}
+
+	a.created.secret = a.created.secret || !exists
+
+	return nil
+}
+
+func (a *kubernetesAgent) configSecret(namespace, objectName, configName string) (*corev1apply.SecretApplyConfiguration, error) {
+	cfg, err := yaml.Marshal(a.config.Wireguard)
+	if err != nil {
+		return nil, fmt.Errorf("unable to marshal wireguard config to YAML: %w", err)
+	}
+
+	return corev1apply.Secret(configName, namespace).
+		WithLabels(a.relatedObjectLabels()).
+		WithAnnotations(a.relatedObjectAnnotations(objectName)).
+		WithData(map[string][]byte{ConfigSecretKey: cfg}), nil
+}
+
+// replaceContainerWithAgent replaces the container with the agent or, in sidecar mode, runs the agent alongside it to
+// intercept connections to its ports
 func (a *kubernetesAgent) replaceContainerWithAgent(podSpec *corev1.PodSpec, configName string, containerIndex int) {
-	var excludePorts []string
+	var excludePorts, interceptPorts []string
+
+	for _, mapping := range a.config.Ports {
+		interceptPorts = append(interceptPorts, mapping.String())
+	}
 
-	// Remove liveness probes in case they're checking the container we're
-	// replacing; if the proxy service isn't up yet these would fail.
 	for index, container := range podSpec.Containers {
-		podSpec.Containers[index].LivenessProbe = nil
-		podSpec.Containers[index].ReadinessProbe = nil
-		podSpec.Containers[index].StartupProbe = nil
+		// Remove liveness probes in case they're checking the container we're
+		// replacing; if the proxy service isn't up yet these would fail. A
+		// sidecar keeps the container running to fall back to, so its probes
+		// still pass.
+		if !a.config.Sidecar {
+			podSpec.Containers[index].LivenessProbe = nil
+			podSpec.Containers[index].ReadinessProbe = nil
+			podSpec.Containers[index].StartupProbe = nil
+		}
 
 		if index != containerIndex {
 			// Add other listeners to allow direct access without proxying through wireguard
 			for _, port := range container.Ports {
 				excludePorts = append(excludePorts, strconv.FormatInt(int64(port.ContainerPort), 10))
 			}
+		} else if a.config.Sidecar && len(a.config.Ports) == 0 {
+			// Without selected ports, a sidecar intercepts all of the container's own ports
+			for _, port := range container.Ports {
+				if tcpPort(port) {
+					interceptPorts = append(interceptPorts, config.PortMapping{Port: uint16(port.ContainerPort), LocalPort: uint16(port.ContainerPort)}.String())
+				}
+			}
 		}
 	}
 
 	replacedContainer := podSpec.Containers[containerIndex]
-	podSpec.Containers[containerIndex] = corev1.Container{
+	agentContainer := corev1.Container{
 		Name:            ContainerName,
 		Image:           a.config.AgentImage,
 		ImagePullPolicy: corev1.PullAlways,
@@ -252,6 +689,19 @@ func (a *kubernetesAgent) replaceContainerWithAgent(podSpec *corev1.PodSpec, con
 		},
 	}
 
+	if a.config.Sidecar {
+		// The ports remain declared by the target container, which keeps running
+		agentContainer.Ports = nil
+		agentContainer.Env = append(agentContainer.Env, corev1.EnvVar{Name: "SIDECAR_PORTS", Value: strings.Join(interceptPorts, ",")})
+		podSpec.Containers = append(podSpec.Containers, agentContainer)
+	} else {
+		if len(interceptPorts) > 0 {
+			agentContainer.Env = append(agentContainer.Env, corev1.EnvVar{Name: "INTERCEPT_PORTS", Value: strings.Join(interceptPorts, ",")})
+		}
+
+		podSpec.Containers[containerIndex] = agentContainer
+	}
+
 	volume := corev1.Volume{
 		Name: WireguardConfigVolumeName,
 		VolumeSource: corev1.VolumeSource{
@@ -270,40 +720,22 @@ func (a *kubernetesAgent) replaceContainerWithAgent(podSpec *corev1.PodSpec, con
 	}
 }
 
-func (a *kubernetesAgent) applyLoadbalancer(ctx context.Context, namespace, name string, selector map[string]string) (netip.AddrPort, error) {
+func (a *kubernetesAgent) applyLoadbalancer(ctx context.Context, namespace, objectName, name string, selector map[string]string) (netip.AddrPort, error) {
 	log := logr.FromContextOrDiscard(ctx)
 
-	annotations := map[string]string{
-		// AWS
-		"service.beta.kubernetes.io/aws-load-balancer-backend-protocol":                  "tcp",
-		"service.beta.kubernetes.io/aws-load-balancer-internal":                          "false",
-		"service.beta.kubernetes.io/aws-load-balancer-type":                              "nlb",
-		"service.beta.kubernetes.io/aws-load-balancer-cross-zone-load-balancing-enabled": "true",
-		// GCP
-		"cloud.google.com/l4-rbs": "enabled",
-		// No Azure annotations necessary
-	}
+	service := a.loadBalancerService(namespace, objectName, name, selector)
 
-	service := corev1apply.Service(name, namespace).
-		WithAnnotations(annotations).
-		WithSpec(&corev1apply.ServiceSpecApplyConfiguration{
-			Ports: []corev1apply.ServicePortApplyConfiguration{{
-				Name:       ptr.To("wireguard"),
-				Protocol:   ptr.To(corev1.ProtocolUDP),
-				Port:       ptr.To(int32(wg.DefaultWireguardPort)),
-				TargetPort: ptr.To(intstr.FromInt32(wg.DefaultWireguardPort)),
-			}},
-			Selector:              selector,
-			Type:                  ptr.To(corev1.ServiceTypeLoadBalancer),
-			ExternalTrafficPolicy: ptr.To(corev1.ServiceExternalTrafficPolicyLocal),
-			InternalTrafficPolicy: ptr.To(corev1.ServiceInternalTrafficPolicyLocal),
-		})
-
-	_, err := a.client.CoreV1().Services(namespace).Apply(ctx, service, v1.ApplyOptions{FieldManager: FieldManager})
+	exists, err := found(a.client.CoreV1().Services(namespace).Get(ctx, name, v1.GetOptions{}))
 	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("unable to get service: %w", err)
+	}
+
+	if _, err := a.client.CoreV1().Services(namespace).Apply(ctx, service, v1.ApplyOptions{FieldManager: FieldManager}); err != nil {
 		return netip.AddrPort{}, fmt.Errorf("unable to apply service: %w", err)
 	}
 
+	a.created.service = a.created.service || !exists
+
 	svc, err := waitForLoadBalancerReady(ctx, a.client.CoreV1().RESTClient(), namespace, name)
 	if err != nil {
 		return netip.AddrPort{}, fmt.Errorf("timeout after %s waiting for load balancer service to be ready: %w", WaitTimeout.String(), err)
@@ -320,14 +752,14 @@ func (a *kubernetesAgent) applyLoadbalancer(ctx context.Context, namespace, name
 		log.Info("Load balancer ready, waiting for DNS to resolve", "hostname", ing.Hostname)
 
 		err = wait.PollUntilContextCancel(resolveCtx, 5*time.Second, true, func(ctx context.Context) (bool, error) {
-			ips, _ := net.DefaultResolver.LookupIP(ctx, "ip4", ing.Hostname)
+			ips, _ := lookupIP(ctx, "ip", ing.Hostname)
 			if len(ips) == 0 {
 				return false, nil
 			}
 
-			ip = netip.AddrFrom4([4]byte(ips[0]))
+			ip = preferredAddr(ips)
 
-			return true, nil
+			return ip.IsValid(), nil
 		})
 
 		if err != nil {
@@ -347,8 +779,60 @@ func (a *kubernetesAgent) applyLoadbalancer(ctx context.Context, namespace, name
 	return netip.AddrPort{}, fmt.Errorf("unable to find load balancer address for service %q", svc.Name)
 }
 
-func (a *kubernetesAgent) applyNetworkPolicy(ctx context.Context, namespace, name string, selector map[string]string, port int32) error {
-	netpol := netv1apply.NetworkPolicy(name, namespace).
+func (a *kubernetesAgent) loadBalancerService(namespace, objectName, name string, selector map[string]string) *corev1apply.ServiceApplyConfiguration {
+	annotations := map[string]string{
+		// AWS
+		"service.beta.kubernetes.io/aws-load-balancer-backend-protocol":                  "tcp",
+		"service.beta.kubernetes.io/aws-load-balancer-internal":                          "false",
+		"service.beta.kubernetes.io/aws-load-balancer-type":                              "nlb",
+		"service.beta.kubernetes.io/aws-load-balancer-cross-zone-load-balancing-enabled": "true",
+		// GCP
+		"cloud.google.com/l4-rbs": "enabled",
+		// No Azure annotations necessary
+	}
+
+	for k, v := range a.relatedObjectAnnotations(objectName) {
+		annotations[k] = v
+	}
+
+	return corev1apply.Service(name, namespace).
+		WithLabels(a.relatedObjectLabels()).
+		WithAnnotations(annotations).
+		WithSpec(&corev1apply.ServiceSpecApplyConfiguration{
+			Ports: []corev1apply.ServicePortApplyConfiguration{{
+				Name:       ptr.To("wireguard"),
+				Protocol:   ptr.To(corev1.ProtocolUDP),
+				Port:       ptr.To(int32(wg.DefaultWireguardPort)),
+				TargetPort: ptr.To(intstr.FromInt32(wg.DefaultWireguardPort)),
+			}},
+			Selector:              selector,
+			Type:                  ptr.To(corev1.ServiceTypeLoadBalancer),
+			ExternalTrafficPolicy: ptr.To(corev1.ServiceExternalTrafficPolicyLocal),
+			InternalTrafficPolicy: ptr.To(corev1.ServiceInternalTrafficPolicyLocal),
+		})
+}
+
+func (a *kubernetesAgent) applyNetworkPolicy(ctx context.Context, namespace, objectName, name string, selector map[string]string, port int32) error {
+	netpol := a.networkPolicy(namespace, objectName, name, selector, port)
+
+	exists, err := found(a.client.NetworkingV1().NetworkPolicies(namespace).Get(ctx, name, v1.GetOptions{}))
+	if err != nil {
+		return fmt.Errorf("unable to get network policy: %w", err)
+	}
+
+	if _, err := a.client.NetworkingV1().NetworkPolicies(namespace).Apply(ctx, netpol, v1.ApplyOptions{FieldManager: FieldManager}); err != nil {
+		return err
+	}
+
+	a.created.networkPolicy = a.created.networkPolicy || !exists
+
+	return nil
+}
+
+func (a *kubernetesAgent) networkPolicy(namespace, objectName, name string, selector map[string]string, port int32) *netv1apply.NetworkPolicyApplyConfiguration {
+	return netv1apply.NetworkPolicy(name, namespace).
+		WithLabels(a.relatedObjectLabels()).
+		WithAnnotations(a.relatedObjectAnnotations(objectName)).
 		WithSpec(&netv1apply.NetworkPolicySpecApplyConfiguration{
 			PodSelector: &metav1apply.LabelSelectorApplyConfiguration{MatchLabels: selector},
 			Ingress: []netv1apply.NetworkPolicyIngressRuleApplyConfiguration{{
@@ -359,13 +843,87 @@ func (a *kubernetesAgent) applyNetworkPolicy(ctx context.Context, namespace, nam
 			}},
 			PolicyTypes: []netv1.PolicyType{netv1.PolicyTypeIngress},
 		})
+}
 
-	_, err := a.client.NetworkingV1().NetworkPolicies(namespace).Apply(ctx, netpol, v1.ApplyOptions{FieldManager: FieldManager})
+// saveOriginalState records the parts of the object the agent modifies in an annotation. If the annotation already
+// exists and the object still runs the agent, e.g. from a previous session which was never restored, it is left as-is
+// since it reflects the true original. Once the object has been redeployed without the agent, e.g. by `helm upgrade`
+// keeping unknown annotations, the annotation is stale and replaced. The object's annotations, less those of the
+// previous session, are added to the given state.
+func saveOriginalState(obj v1.Object, original originalState) error {
+	_, saved := obj.GetAnnotations()[OriginalStateAnnotationName]
+	if saved && runsAgent(obj, original.Template) {
+		return nil
+	}
 
-	return err
+	original.Annotations = maps.Clone(obj.GetAnnotations())
+	for _, name := range []string{OriginalStateAnnotationName, ContainerAnnotationName, ModeAnnotationName, EndpointAnnotationName, StartedAtAnnotationName, PublicKeyAnnotationName} {
+		delete(original.Annotations, name)
+	}
+
+	state, err := json.Marshal(original)
+	if err != nil {
+		return err
+	}
+
+	annotations := make(map[string]string, len(original.Annotations)+1)
+	for k, v := range original.Annotations {
+		annotations[k] = v
+	}
+
+	annotations[OriginalStateAnnotationName] = string(state)
+	obj.SetAnnotations(annotations)
+
+	return nil
+}
+
+// runsAgent returns whether a session's agent was injected into the object or its pod template, which carry the
+// session's revision until restored
+func runsAgent(obj v1.Object, template corev1.PodTemplateSpec) bool {
+	_, objectRevision := obj.GetAnnotations()[WireguardRevisionAnnotationName]
+	_, templateRevision := template.Annotations[WireguardRevisionAnnotationName]
+
+	return objectRevision || templateRevision
+}
+
+// loadOriginalState returns the saved original state of the object and whether one was saved at all
+func loadOriginalState(obj v1.Object) (originalState, bool, error) {
+	var state originalState
+
+	contents, ok := obj.GetAnnotations()[OriginalStateAnnotationName]
+	if !ok {
+		return state, false, nil
+	}
+
+	if err := json.Unmarshal([]byte(contents), &state); err != nil {
+		return state, false, fmt.Errorf("unable to parse original state annotation: %w", err)
+	}
+
+	return state, true, nil
+}
+
+// TargetKind returns the lowercase kind of a supported target object
+func TargetKind(obj runtime.Object) string {
+	switch obj := obj.(type) {
+	case *appsv1.Deployment:
+		return "deployment"
+	case *appsv1.StatefulSet:
+		return "statefulset"
+	case *appsv1.ReplicaSet:
+		return "replicaset"
+	case *appsv1.DaemonSet:
+		return "daemonset"
+	case *corev1.Pod:
+		return "pod"
+	case *unstructured.Unstructured:
+		return strings.ToLower(obj.GetKind())
+	default:
+		return "unknown"
+	}
 }
 
-func wgObjectName(name string) string {
+// RelatedObjectName returns the name of the objects created alongside the agent for the named target object
+func RelatedObjectName(name string) string {
 	return fmt.Sprintf("wg-%s", name)
 }
 
@@ -385,11 +943,55 @@ func containerIndexOrDefault(containerName string, annotations map[string]string
 	return slices.IndexFunc(containers, func(container corev1.Container) bool { return container.Name == containerName })
 }
 
+// tcpPort returns whether the container port is a TCP port, which is the default protocol
+func tcpPort(port corev1.ContainerPort) bool {
+	return port.Protocol == "" || port.Protocol == corev1.ProtocolTCP
+}
+
 func podReady(c corev1.PodCondition) bool {
 	return c.Status == corev1.ConditionTrue && c.Type == corev1.PodReady
 }
 
 var waitForPod = func(ctx context.Context, client cache.Getter, restConfig *rest.Config, namespace string, matchLabels map[string]string, revision string) (address netip.AddrPort, err error) {
+	pod, err := waitForReadyPod(ctx, client, namespace, matchLabels, revision)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	logr.FromContextOrDiscard(ctx).Info("Waiting for pod remote address", "pod", pod.Name)
+
+	err = pollPodFile(ctx, restConfig, pod, ContainerAddressPath, func(contents string) (err error) {
+		address, err = netip.ParseAddrPort(strings.Split(contents, "\n")[0])
+		return err
+	})
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("timeout after %s waiting for pod address: %w", WaitTimeout.String(), err)
+	}
+
+	return address, nil
+}
+
+// waitForPodNetwork waits for the agent to report the pod's network, overridden in tests
+var waitForPodNetwork = func(ctx context.Context, client cache.Getter, restConfig *rest.Config, namespace string, matchLabels map[string]string, revision string) (network kuberneteshelpers.PodNetwork, err error) {
+	pod, err := waitForReadyPod(ctx, client, namespace, matchLabels, revision)
+	if err != nil {
+		return kuberneteshelpers.PodNetwork{}, err
+	}
+
+	logr.FromContextOrDiscard(ctx).Info("Waiting for pod network", "pod", pod.Name)
+
+	err = pollPodFile(ctx, restConfig, pod, ContainerNetworkPath, func(contents string) error {
+		return json.Unmarshal([]byte(contents), &network)
+	})
+	if err != nil {
+		return kuberneteshelpers.PodNetwork{}, fmt.Errorf("timeout after %s waiting for pod network: %w", WaitTimeout.String(), err)
+	}
+
+	return network, nil
+}
+
+// waitForReadyPod waits for a pod of the given revision to be ready
+func waitForReadyPod(ctx context.Context, client cache.Getter, namespace string, matchLabels map[string]string, revision string) (*corev1.Pod, error) {
 	log := logr.FromContextOrDiscard(ctx)
 
 	lw := cache.NewFilteredListWatchFromClient(client, "pods", namespace, func(o *v1.ListOptions) {
@@ -401,47 +1003,39 @@ var waitForPod = func(ctx context.Context, client cache.Getter, restConfig *rest
 
 	log.Info("Waiting for new pod to by ready", "revision", revision)
 
-	sync, syncErr := watchtools.UntilWithSync(deadlineCtx, lw, &corev1.Pod{}, nil, func(event watch.Event) (bool, error) {
+	sync, err := watchtools.UntilWithSync(deadlineCtx, lw, &corev1.Pod{}, nil, func(event watch.Event) (bool, error) {
 		pod := event.Object.(*corev1.Pod)
 
 		return pod.Annotations[WireguardRevisionAnnotationName] == revision && slices.ContainsFunc(pod.Status.Conditions, podReady), nil
 	})
-	if syncErr != nil {
-		err = fmt.Errorf("timeout after %s waiting for pod to be ready: %w", WaitTimeout.String(), syncErr)
-		return
+	if err != nil {
+		return nil, fmt.Errorf("timeout after %s waiting for pod to be ready: %w", WaitTimeout.String(), err)
 	}
 
-	pod := sync.Object.(*corev1.Pod)
-	log = log.WithValues("pod", pod.Name)
+	return sync.Object.(*corev1.Pod), nil
+}
 
-	log.Info("Waiting for pod remote address", "pod", pod.Name)
+// pollPodFile reads a file written by the agent until it exists and parses successfully
+func pollPodFile(ctx context.Context, restConfig *rest.Config, pod *corev1.Pod, path string, parse func(string) error) error {
+	log := logr.FromContextOrDiscard(ctx).WithValues("pod", pod.Name, "path", path)
 
-	pollErr := wait.PollUntilContextCancel(deadlineCtx, 5*time.Second, true, func(ctx context.Context) (bool, error) {
-		contents, err := kuberneteshelpers.FileContents(ctx, restConfig, pod, ContainerName, ContainerAddressPath)
-		if err != nil {
-			log.V(1).Info("unable to read address from pod", "error", err.Error())
-			return false, nil
-		}
+	deadlineCtx, cancel := context.WithTimeout(ctx, WaitTimeout)
+	defer cancel()
 
-		podAddress := strings.Split(contents, "\n")[0]
-		if podAddress == "" {
-			log.V(1).Info("unable to read address from pod", "error", err.Error())
+	return wait.PollUntilContextCancel(deadlineCtx, 5*time.Second, true, func(ctx context.Context) (bool, error) {
+		contents, err := kuberneteshelpers.FileContents(ctx, restConfig, pod, ContainerName, path)
+		if err != nil {
+			log.V(1).Info("unable to read file from pod", "error", err.Error())
 			return false, nil
 		}
 
-		address, err = netip.ParseAddrPort(podAddress)
-		if err != nil {
-			log.V(1).Info("unable to read address from pod", "error", err.Error())
+		if err := parse(contents); err != nil {
+			log.V(1).Info("unable to parse file from pod", "error", err.Error())
 			return false, nil
 		}
 
 		return true, nil
 	})
-	if pollErr != nil {
-		err = fmt.Errorf("timeout after %s waiting for pod address: %w", WaitTimeout.String(), pollErr)
-	}
-
-	return
 }
 
 var waitForLoadBalancerReady = func(ctx context.Context, client cache.Getter, namespace, name string) (*corev1.Service, error) {
@@ -470,4 +1064,27 @@ var waitForLoadBalancerReady = func(ctx context.Context, client cache.Getter, na
 	return sync.Object.(*corev1.Service), nil
 }
 
+// preferredAddr returns the first IPv4 address, or the first IPv6 address of IPv6-only hosts. IPv4 is preferred since
+// not all local networks have IPv6 connectivity.
+func preferredAddr(ips []net.IP) netip.Addr {
+	var preferred netip.Addr
+
+	for _, ip := range ips {
+		addr, ok := netip.AddrFromSlice(ip)
+		if !ok {
+			continue
+		}
+
+		if addr = addr.Unmap(); !preferred.IsValid() || (addr.Is4() && preferred.Is6()) {
+			preferred = addr
+		}
+	}
+
+	return preferred
+}
+
+var lookupIP = func(ctx context.Context, network, host string) ([]net.IP, error) {
+	return net.DefaultResolver.LookupIP(ctx, network, host)
+}
+
 var newRevision = func() string { return uuid.New().String() }
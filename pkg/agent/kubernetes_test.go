@@ -3,6 +3,7 @@ package agent
 import (
 	"context"
 	"fmt"
+	"net"
 	"net/netip"
 	"testing"
 
@@ -14,14 +15,17 @@ import (
 	"k8s.io/apimachinery/pkg/api/errors"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/fake"
 	"k8s.io/client-go/rest"
+	k8stesting "k8s.io/client-go/testing"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/utils/ptr"
 
 	"github.com/steved/kubewire/pkg/config"
+	"github.com/steved/kubewire/pkg/kuberneteshelpers"
 	"github.com/steved/kubewire/pkg/runnable"
 	"github.com/steved/kubewire/pkg/wg"
 )
@@ -33,9 +37,24 @@ var (
 	relatedObjectName = fmt.Sprintf("wg-%s", objectName)
 	selector          = map[string]string{"app.kubernetes.io/name": objectName}
 	agentAddr         = netip.MustParseAddrPort("4.5.6.7:19017")
+	podNetwork        = kuberneteshelpers.PodNetwork{
+		PodIPs:        []netip.Addr{netip.MustParseAddr("100.64.0.5")},
+		Nameservers:   []netip.Addr{netip.MustParseAddr("172.0.0.10")},
+		ClusterDomain: "cluster.local",
+	}
 )
 
 func testAgent(t *testing.T, obj runtime.Object, cfg *config.Config, f func(t *testing.T, stop runnable.StopFunc, client kubernetes.Interface, remoteAddr netip.AddrPort)) {
+	var objects []runtime.Object
+	if !cfg.Ephemeral {
+		objects = append(objects, obj)
+	}
+
+	testAgentWithClient(t, fake.NewClientset(objects...), obj, cfg, f)
+}
+
+// testAgentWithClient starts the agent for the target object with a client already holding any objects needed
+func testAgentWithClient(t *testing.T, client *fake.Clientset, obj runtime.Object, cfg *config.Config, f func(t *testing.T, stop runnable.StopFunc, client kubernetes.Interface, remoteAddr netip.AddrPort)) {
 	newRevision = func() string { return "1-2-3-4" }
 
 	waitForLoadBalancerReady = func(_ context.Context, _ cache.Getter, namespace, name string) (*corev1.Service, error) {
@@ -56,11 +75,18 @@ func testAgent(t *testing.T, obj runtime.Object, cfg *config.Config, f func(t *t
 		return agentAddr, nil
 	}
 
+	waitForPodNetwork = func(_ context.Context, _ cache.Getter, _ *rest.Config, _ string, _ map[string]string, _ string) (kuberneteshelpers.PodNetwork, error) {
+		return podNetwork, nil
+	}
+
+	lookupIP = func(_ context.Context, _, _ string) ([]net.IP, error) {
+		return []net.IP{net.IPv4(1, 2, 3, 4)}, nil
+	}
+
 	cfg.TargetObject = obj
 	cfg.Namespace = namespace
 	cfg.AgentImage = agentImage
 
-	client := fake.NewClientset(obj)
 	a := NewKubernetesAgent(cfg, client, nil)
 	stop, err := a.Start(context.Background())
 
@@ -88,9 +114,11 @@ func TestAgentDeployment(t *testing.T) {
 		},
 	}
 
+	original := deployment.DeepCopy()
+
 	t.Run("deployment", func(t *testing.T) {
 		testAgent(t, deployment.DeepCopy(), config.NewConfig(), func(t *testing.T, _ runnable.StopFunc, client kubernetes.Interface, remoteAddr netip.AddrPort) {
-			assert.True(t, remoteAddr.IsValid(), "failed to return a valid remote address")
+			assert.Equal(t, netip.MustParseAddrPort("1.2.3.4:19070"), remoteAddr)
 
 			service, err := client.CoreV1().Services(namespace).Get(context.Background(), relatedObjectName, v1.GetOptions{})
 			if assert.NoError(t, err) {
@@ -102,9 +130,19 @@ func TestAgentDeployment(t *testing.T) {
 						"service.beta.kubernetes.io/aws-load-balancer-type":                              "nlb",
 						"service.beta.kubernetes.io/aws-load-balancer-cross-zone-load-balancing-enabled": "true",
 						"cloud.google.com/l4-rbs":                                                        "enabled",
+						TargetAnnotationName:                                                             "deployment/test-object",
 					},
 					service.ObjectMeta.Annotations)
 
+				assert.Equal(
+					t,
+					map[string]string{
+						ManagedByLabelName: ManagedByLabelValue,
+						SessionLabelName:   "1-2-3-4",
+						CreatedAtLabelName: service.Labels[CreatedAtLabelName],
+					},
+					service.ObjectMeta.Labels)
+
 				assert.Equal(
 					t,
 					corev1.ServiceSpec{
@@ -348,6 +386,91 @@ func TestAgentDeployment(t *testing.T) {
 		})
 	})
 
+	t.Run("deployment with sidecar", func(t *testing.T) {
+		testDeployment := deployment.DeepCopy()
+		testDeployment.Spec.Template.Spec.Containers = []corev1.Container{
+			{
+				Name:          "test-container",
+				Image:         "test-image",
+				LivenessProbe: &corev1.Probe{InitialDelaySeconds: 10},
+				Ports: []corev1.ContainerPort{
+					{Name: "http", ContainerPort: 8080},
+					{Name: "dns", ContainerPort: 53, Protocol: corev1.ProtocolUDP},
+				},
+			},
+			{Name: "other-container", Ports: []corev1.ContainerPort{{Name: "other", ContainerPort: 12345}}},
+		}
+
+		original := testDeployment.DeepCopy()
+
+		cfg := config.NewConfig()
+		cfg.Sidecar = true
+
+		testAgent(t, testDeployment, cfg, func(t *testing.T, stop runnable.StopFunc, client kubernetes.Interface, _ netip.AddrPort) {
+			deployment, err := client.AppsV1().Deployments(namespace).Get(context.Background(), objectName, v1.GetOptions{})
+			if assert.NoError(t, err) {
+				containers := deployment.Spec.Template.Spec.Containers
+
+				if assert.Len(t, containers, 3) {
+					assert.Equal(t, "test-container", containers[0].Name)
+					assert.Equal(t, "test-image", containers[0].Image)
+					assert.Equal(t, original.Spec.Template.Spec.Containers[0].Ports, containers[0].Ports)
+					assert.Equal(t, original.Spec.Template.Spec.Containers[0].LivenessProbe, containers[0].LivenessProbe)
+
+					assert.Equal(t, ContainerName, containers[2].Name)
+					assert.Empty(t, containers[2].Ports)
+					assert.Contains(t, containers[2].Env, corev1.EnvVar{Name: "LOCAL_PORTS_EXCLUDE_PROXY", Value: "12345"})
+					assert.Contains(t, containers[2].Env, corev1.EnvVar{Name: "SIDECAR_PORTS", Value: "8080:8080"})
+				}
+
+				assert.Equal(t, "test-container", deployment.Annotations[ContainerAnnotationName])
+			}
+
+			stop()
+
+			restored, err := client.AppsV1().Deployments(namespace).Get(context.Background(), objectName, v1.GetOptions{})
+			if assert.NoError(t, err) {
+				assert.Equal(t, original.Spec.Template, restored.Spec.Template)
+			}
+		})
+	})
+
+	t.Run("deployment with sidecar without ports", func(t *testing.T) {
+		cfg := config.NewConfig()
+		cfg.Sidecar = true
+		cfg.TargetObject = deployment.DeepCopy()
+
+		a := &kubernetesAgent{config: cfg, client: fake.NewClientset()}
+
+		_, err := a.prepareTarget(context.Background(), relatedObjectName)
+		assert.EqualError(t, err, "container test-container of target object test-namespace/test-object declares no TCP ports to intercept as a sidecar")
+	})
+
+	t.Run("deployment with intercept ports", func(t *testing.T) {
+		cfg := config.NewConfig()
+		cfg.Ports = []config.PortMapping{{Port: 8080, LocalPort: 3000}, {Port: 8443, LocalPort: 8443}}
+
+		testAgent(t, deployment.DeepCopy(), cfg, func(t *testing.T, _ runnable.StopFunc, client kubernetes.Interface, _ netip.AddrPort) {
+			deployment, err := client.AppsV1().Deployments(namespace).Get(context.Background(), objectName, v1.GetOptions{})
+			if assert.NoError(t, err) && assert.Len(t, deployment.Spec.Template.Spec.Containers, 1) {
+				assert.Contains(t, deployment.Spec.Template.Spec.Containers[0].Env, corev1.EnvVar{Name: "INTERCEPT_PORTS", Value: "8080:3000,8443:8443"})
+			}
+		})
+	})
+
+	t.Run("deployment with sidecar and intercept ports", func(t *testing.T) {
+		cfg := config.NewConfig()
+		cfg.Sidecar = true
+		cfg.Ports = []config.PortMapping{{Port: 9090, LocalPort: 3000}}
+
+		testAgent(t, deployment.DeepCopy(), cfg, func(t *testing.T, _ runnable.StopFunc, client kubernetes.Interface, _ netip.AddrPort) {
+			deployment, err := client.AppsV1().Deployments(namespace).Get(context.Background(), objectName, v1.GetOptions{})
+			if assert.NoError(t, err) && assert.Len(t, deployment.Spec.Template.Spec.Containers, 2) {
+				assert.Contains(t, deployment.Spec.Template.Spec.Containers[1].Env, corev1.EnvVar{Name: "SIDECAR_PORTS", Value: "9090:3000"})
+			}
+		})
+	})
+
 	t.Run("deployment with direct", func(t *testing.T) {
 		cfg := config.NewConfig()
 		cfg.Wireguard.DirectAccess = true
@@ -427,6 +550,12 @@ func TestAgentDeployment(t *testing.T) {
 				)
 			}
 
+			assert.Equal(t, "test-container", deployment.Annotations[ContainerAnnotationName])
+			assert.Equal(t, ModeDirect, deployment.Annotations[ModeAnnotationName])
+			assert.Equal(t, agentAddr.String(), deployment.Annotations[EndpointAnnotationName])
+			assert.Equal(t, cfg.Wireguard.AgentKey.PublicKey().String(), deployment.Annotations[PublicKeyAnnotationName])
+			assert.NotEmpty(t, deployment.Annotations[StartedAtAnnotationName])
+
 			netpol, err := client.NetworkingV1().NetworkPolicies(namespace).Get(context.Background(), relatedObjectName, v1.GetOptions{})
 			if assert.NoError(t, err) {
 				assert.Equal(
@@ -546,12 +675,18 @@ func TestAgentDeployment(t *testing.T) {
 	t.Run("deployment down", func(t *testing.T) {
 		cfg := config.NewConfig()
 
-		testAgent(t, deployment, cfg, func(t *testing.T, stop runnable.StopFunc, client kubernetes.Interface, _ netip.AddrPort) {
+		testAgent(t, deployment.DeepCopy(), cfg, func(t *testing.T, stop runnable.StopFunc, client kubernetes.Interface, _ netip.AddrPort) {
 			cfg.KeepResources = true
 
 			stop()
 
-			_, err := client.CoreV1().Services(namespace).Get(context.Background(), relatedObjectName, v1.GetOptions{})
+			restored, err := client.AppsV1().Deployments(namespace).Get(context.Background(), objectName, v1.GetOptions{})
+			if assert.NoError(t, err) {
+				assert.Equal(t, original.Spec, restored.Spec)
+				assert.Empty(t, restored.Annotations)
+			}
+
+			_, err = client.CoreV1().Services(namespace).Get(context.Background(), relatedObjectName, v1.GetOptions{})
 			assert.NoError(t, err)
 
 			_, err = client.NetworkingV1().NetworkPolicies(namespace).Get(context.Background(), relatedObjectName, v1.GetOptions{})
@@ -576,6 +711,213 @@ func TestAgentDeployment(t *testing.T) {
 	})
 }
 
+func TestAgentRestoreOnFailure(t *testing.T) {
+	deployment := &appsv1.Deployment{
+		ObjectMeta: v1.ObjectMeta{Name: objectName, Namespace: namespace, Annotations: map[string]string{"existing": "annotation"}},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: ptr.To(int32(3)),
+			Selector: &v1.LabelSelector{
+				MatchLabels: selector,
+			},
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{Name: "test-container", Image: "test-image", LivenessProbe: &corev1.Probe{InitialDelaySeconds: 10}},
+					},
+				},
+			},
+		},
+	}
+
+	waitForPod = func(_ context.Context, _ cache.Getter, _ *rest.Config, _ string, _ map[string]string, _ string) (address netip.AddrPort, err error) {
+		return netip.AddrPort{}, fmt.Errorf("timeout")
+	}
+
+	cfg := config.NewConfig()
+	cfg.TargetObject = deployment.DeepCopy()
+	cfg.Namespace = namespace
+	cfg.AgentImage = agentImage
+	cfg.Wireguard.DirectAccess = true
+
+	client := fake.NewClientset(cfg.TargetObject)
+
+	_, err := NewKubernetesAgent(cfg, client, nil).Start(context.Background())
+	assert.Error(t, err)
+
+	restored, err := client.AppsV1().Deployments(namespace).Get(context.Background(), objectName, v1.GetOptions{})
+	if assert.NoError(t, err) {
+		assert.Equal(t, deployment.Spec, restored.Spec)
+		assert.Equal(t, deployment.Annotations, restored.Annotations)
+	}
+
+	_, err = client.CoreV1().Secrets(namespace).Get(context.Background(), relatedObjectName, v1.GetOptions{})
+	assert.True(t, errors.IsNotFound(err))
+}
+
+func TestAgentWriteFailure(t *testing.T) {
+	newRevision = func() string { return "1-2-3-4" }
+
+	cfg := config.NewConfig()
+	cfg.TargetObject = NewConnectDeployment(namespace, objectName)
+	cfg.Namespace = namespace
+	cfg.AgentImage = agentImage
+
+	// The target object doesn't exist, so it can't be updated once the config is created
+	client := fake.NewClientset()
+
+	_, err := NewKubernetesAgent(cfg, client, nil).Start(context.Background())
+	assert.Error(t, err)
+
+	_, err = client.CoreV1().Secrets(namespace).Get(context.Background(), relatedObjectName, v1.GetOptions{})
+	assert.True(t, errors.IsNotFound(err))
+}
+
+func TestAgentKeepsExistingObjectsOnFailure(t *testing.T) {
+	waitForPod = func(_ context.Context, _ cache.Getter, _ *rest.Config, _ string, _ map[string]string, _ string) (address netip.AddrPort, err error) {
+		return netip.AddrPort{}, fmt.Errorf("timeout")
+	}
+
+	cfg := config.NewConfig()
+	cfg.TargetObject = NewConnectDeployment(namespace, objectName)
+	cfg.Namespace = namespace
+	cfg.AgentImage = agentImage
+	cfg.Wireguard.DirectAccess = true
+
+	// Kept by an earlier session started with --keep-resources
+	service := &corev1.Service{ObjectMeta: v1.ObjectMeta{Name: relatedObjectName, Namespace: namespace}}
+	secret := &corev1.Secret{ObjectMeta: v1.ObjectMeta{Name: relatedObjectName, Namespace: namespace}}
+
+	client := fake.NewClientset(cfg.TargetObject, service, secret)
+
+	_, err := NewKubernetesAgent(cfg, client, nil).Start(context.Background())
+	assert.Error(t, err)
+
+	_, err = client.CoreV1().Services(namespace).Get(context.Background(), relatedObjectName, v1.GetOptions{})
+	assert.NoError(t, err)
+
+	_, err = client.CoreV1().Secrets(namespace).Get(context.Background(), relatedObjectName, v1.GetOptions{})
+	assert.NoError(t, err)
+}
+
+func Test_saveOriginalState(t *testing.T) {
+	previous := `{"annotations":{"chart":"1.0.0"},"template":{"metadata":{},"spec":{"containers":null}}}`
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		template    corev1.PodTemplateSpec
+		want        map[string]string
+	}{
+		{
+			"unsaved",
+			map[string]string{"chart": "2.0.0"},
+			corev1.PodTemplateSpec{},
+			map[string]string{"chart": "2.0.0"},
+		},
+		{
+			"never restored",
+			map[string]string{"chart": "1.0.0", OriginalStateAnnotationName: previous, ModeAnnotationName: ModeDirect},
+			corev1.PodTemplateSpec{ObjectMeta: v1.ObjectMeta{Annotations: map[string]string{WireguardRevisionAnnotationName: "1-2-3-4"}}},
+			map[string]string{"chart": "1.0.0"},
+		},
+		{
+			"redeployed",
+			map[string]string{"chart": "2.0.0", OriginalStateAnnotationName: previous, ModeAnnotationName: ModeDirect},
+			corev1.PodTemplateSpec{},
+			map[string]string{"chart": "2.0.0"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			obj := &v1.ObjectMeta{Annotations: tt.annotations}
+			assert.NoError(t, saveOriginalState(obj, originalState{Template: tt.template}))
+
+			state, ok, err := loadOriginalState(obj)
+			assert.NoError(t, err)
+			assert.True(t, ok)
+			assert.Equal(t, tt.want, state.Annotations)
+		})
+	}
+}
+
+func TestAgentEphemeral(t *testing.T) {
+	cfg := config.NewConfig()
+	cfg.Ephemeral = true
+	cfg.KeepResources = false
+
+	testAgent(t, NewConnectDeployment(namespace, objectName), cfg, func(t *testing.T, stop runnable.StopFunc, client kubernetes.Interface, _ netip.AddrPort) {
+		deployment, err := client.AppsV1().Deployments(namespace).Get(context.Background(), objectName, v1.GetOptions{})
+		if assert.NoError(t, err) {
+			assert.Equal(t, ptr.To(int32(1)), deployment.Spec.Replicas)
+			assert.NotContains(t, deployment.Annotations, OriginalStateAnnotationName)
+
+			if assert.Len(t, deployment.Spec.Template.Spec.Containers, 1) {
+				assert.Equal(t, ContainerName, deployment.Spec.Template.Spec.Containers[0].Name)
+				assert.Equal(t, agentImage, deployment.Spec.Template.Spec.Containers[0].Image)
+			}
+		}
+
+		stop()
+
+		_, err = client.AppsV1().Deployments(namespace).Get(context.Background(), objectName, v1.GetOptions{})
+		assert.True(t, errors.IsNotFound(err))
+
+		_, err = client.CoreV1().Secrets(namespace).Get(context.Background(), relatedObjectName, v1.GetOptions{})
+		assert.True(t, errors.IsNotFound(err))
+	})
+}
+
+func TestAgentPodNetwork(t *testing.T) {
+	newRevision = func() string { return "1-2-3-4" }
+
+	waitForPodNetwork = func(_ context.Context, _ cache.Getter, _ *rest.Config, namespace string, matchLabels map[string]string, revision string) (kuberneteshelpers.PodNetwork, error) {
+		assert.Equal(t, "test-namespace", namespace)
+		assert.Equal(t, "1-2-3-4", revision)
+		assert.NotEmpty(t, matchLabels)
+
+		return podNetwork, nil
+	}
+
+	resolved := kuberneteshelpers.ClusterDetails{
+		ServiceIP:    netip.MustParseAddr("172.0.0.10"),
+		PodCIDRs:     []netip.Prefix{netip.MustParsePrefix("100.64.0.0/16")},
+		ServiceCIDRs: []netip.Prefix{netip.MustParsePrefix("172.0.0.0/16")},
+	}
+
+	tests := []struct {
+		name           string
+		clusterDetails kuberneteshelpers.ClusterDetails
+		wantNetwork    bool
+	}{
+		{"resolved cluster details", resolved, false},
+		{"missing cluster details", kuberneteshelpers.ClusterDetails{PodCIDRs: resolved.PodCIDRs}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.NewConfig()
+			cfg.TargetObject = NewConnectDeployment(namespace, objectName)
+			cfg.Ephemeral = true
+			cfg.Namespace = namespace
+			cfg.AgentImage = agentImage
+			cfg.KubernetesClusterDetails = tt.clusterDetails
+			cfg.Wireguard.LocalAddress = netip.MustParseAddrPort("192.168.1.10:19070")
+
+			a := NewKubernetesAgent(cfg, fake.NewClientset(), nil)
+
+			_, err := a.Start(context.Background())
+			if assert.NoError(t, err) {
+				network, ok := a.PodNetwork()
+
+				assert.Equal(t, tt.wantNetwork, ok)
+
+				if tt.wantNetwork {
+					assert.Equal(t, podNetwork, network)
+				}
+			}
+		})
+	}
+}
+
 func TestAgentStatefulset(t *testing.T) {
 	statefulset := &appsv1.StatefulSet{
 		ObjectMeta: v1.ObjectMeta{Name: objectName, Namespace: namespace},
@@ -595,9 +937,11 @@ func TestAgentStatefulset(t *testing.T) {
 		},
 	}
 
+	original := statefulset.DeepCopy()
+
 	t.Run("statefulset", func(t *testing.T) {
 		testAgent(t, statefulset.DeepCopy(), config.NewConfig(), func(t *testing.T, _ runnable.StopFunc, client kubernetes.Interface, remoteAddr netip.AddrPort) {
-			assert.True(t, remoteAddr.IsValid(), "failed to return a valid remote address")
+			assert.Equal(t, netip.MustParseAddrPort("1.2.3.4:19070"), remoteAddr)
 
 			service, err := client.CoreV1().Services(namespace).Get(context.Background(), relatedObjectName, v1.GetOptions{})
 			if assert.NoError(t, err) {
@@ -609,9 +953,19 @@ func TestAgentStatefulset(t *testing.T) {
 						"service.beta.kubernetes.io/aws-load-balancer-type":                              "nlb",
 						"service.beta.kubernetes.io/aws-load-balancer-cross-zone-load-balancing-enabled": "true",
 						"cloud.google.com/l4-rbs":                                                        "enabled",
+						TargetAnnotationName:                                                             "statefulset/test-object",
 					},
 					service.ObjectMeta.Annotations)
 
+				assert.Equal(
+					t,
+					map[string]string{
+						ManagedByLabelName: ManagedByLabelValue,
+						SessionLabelName:   "1-2-3-4",
+						CreatedAtLabelName: service.Labels[CreatedAtLabelName],
+					},
+					service.ObjectMeta.Labels)
+
 				assert.Equal(
 					t,
 					corev1.ServiceSpec{
@@ -1053,12 +1407,18 @@ func TestAgentStatefulset(t *testing.T) {
 	t.Run("statefulset stop", func(t *testing.T) {
 		cfg := config.NewConfig()
 
-		testAgent(t, statefulset, cfg, func(t *testing.T, stop runnable.StopFunc, client kubernetes.Interface, _ netip.AddrPort) {
+		testAgent(t, statefulset.DeepCopy(), cfg, func(t *testing.T, stop runnable.StopFunc, client kubernetes.Interface, _ netip.AddrPort) {
 			cfg.KeepResources = true
 
 			stop()
 
-			_, err := client.CoreV1().Services(namespace).Get(context.Background(), relatedObjectName, v1.GetOptions{})
+			restored, err := client.AppsV1().StatefulSets(namespace).Get(context.Background(), objectName, v1.GetOptions{})
+			if assert.NoError(t, err) {
+				assert.Equal(t, original.Spec, restored.Spec)
+				assert.Empty(t, restored.Annotations)
+			}
+
+			_, err = client.CoreV1().Services(namespace).Get(context.Background(), relatedObjectName, v1.GetOptions{})
 			assert.NoError(t, err)
 
 			_, err = client.NetworkingV1().NetworkPolicies(namespace).Get(context.Background(), relatedObjectName, v1.GetOptions{})
@@ -1083,6 +1443,352 @@ func TestAgentStatefulset(t *testing.T) {
 	})
 }
 
+func TestAgentStatefulSetOrdinal(t *testing.T) {
+	statefulset := &appsv1.StatefulSet{
+		ObjectMeta: v1.ObjectMeta{Name: objectName, Namespace: namespace},
+		Spec: appsv1.StatefulSetSpec{
+			Replicas: ptr.To(int32(3)),
+			Selector: &v1.LabelSelector{MatchLabels: selector},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: v1.ObjectMeta{Labels: selector},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "test-container", Image: "test-image"}},
+				},
+			},
+			UpdateStrategy: appsv1.StatefulSetUpdateStrategy{Type: appsv1.RollingUpdateStatefulSetStrategyType},
+		},
+	}
+
+	// The statefulset controller recreates deleted pods from the statefulset's current template
+	statefulSetClient := func() *fake.Clientset {
+		objects := []runtime.Object{statefulset.DeepCopy()}
+		for ordinal := range 3 {
+			objects = append(objects, &corev1.Pod{ObjectMeta: v1.ObjectMeta{Name: statefulSetPodName(objectName, int32(ordinal)), Namespace: namespace, Labels: selector}})
+		}
+
+		client := fake.NewClientset(objects...)
+		client.PrependReactor("delete", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+			tracker, name := client.Tracker(), action.(k8stesting.DeleteAction).GetName()
+
+			if err := tracker.Delete(corev1.SchemeGroupVersion.WithResource("pods"), namespace, name); err != nil {
+				return true, nil, err
+			}
+
+			obj, err := tracker.Get(appsv1.SchemeGroupVersion.WithResource("statefulsets"), namespace, objectName)
+			if err != nil {
+				return true, nil, err
+			}
+
+			template := obj.(*appsv1.StatefulSet).Spec.Template
+			pod := &corev1.Pod{
+				ObjectMeta: v1.ObjectMeta{Name: name, Namespace: namespace, Labels: template.Labels, Annotations: template.Annotations},
+				Spec:       template.Spec,
+			}
+
+			return true, nil, tracker.Create(corev1.SchemeGroupVersion.WithResource("pods"), pod, namespace)
+		})
+
+		return client
+	}
+
+	t.Run("ordinal", func(t *testing.T) {
+		cfg := config.NewConfig()
+		cfg.Ordinal = ptr.To(int32(2))
+
+		testAgentWithClient(t, statefulSetClient(), statefulset.DeepCopy(), cfg, func(t *testing.T, stop runnable.StopFunc, client kubernetes.Interface, _ netip.AddrPort) {
+			ctx := context.Background()
+
+			sts, err := client.AppsV1().StatefulSets(namespace).Get(ctx, objectName, v1.GetOptions{})
+			if assert.NoError(t, err) {
+				assert.Equal(t, ptr.To(int32(3)), sts.Spec.Replicas)
+				assert.Equal(t, appsv1.OnDeleteStatefulSetStrategyType, sts.Spec.UpdateStrategy.Type)
+				assert.Equal(t, statefulset.Spec.Template.Spec, sts.Spec.Template.Spec)
+				assert.Equal(t, selector, sts.Spec.Template.Labels)
+				assert.Equal(t, "1-2-3-4", sts.Spec.Template.Annotations[WireguardRevisionAnnotationName])
+			}
+
+			pod, err := client.CoreV1().Pods(namespace).Get(ctx, statefulSetPodName(objectName, 2), v1.GetOptions{})
+			if assert.NoError(t, err) {
+				assert.Equal(t, ContainerName, pod.Spec.Containers[0].Name)
+				assert.Equal(t, "1-2-3-4", pod.Labels[SessionLabelName])
+			}
+
+			service, err := client.CoreV1().Services(namespace).Get(ctx, relatedObjectName, v1.GetOptions{})
+			if assert.NoError(t, err) {
+				assert.Equal(t, map[string]string{SessionLabelName: "1-2-3-4"}, service.Spec.Selector)
+			}
+
+			// Other ordinals recreated during the session, e.g. when evicted, don't run the agent
+			assert.NoError(t, client.CoreV1().Pods(namespace).Delete(ctx, statefulSetPodName(objectName, 0), v1.DeleteOptions{}))
+
+			pod, err = client.CoreV1().Pods(namespace).Get(ctx, statefulSetPodName(objectName, 0), v1.GetOptions{})
+			if assert.NoError(t, err) {
+				assert.Equal(t, "test-container", pod.Spec.Containers[0].Name)
+				assert.NotContains(t, pod.Labels, SessionLabelName)
+			}
+
+			stop()
+
+			restored, err := client.AppsV1().StatefulSets(namespace).Get(ctx, objectName, v1.GetOptions{})
+			if assert.NoError(t, err) {
+				assert.Equal(t, statefulset.Spec, restored.Spec)
+				assert.Empty(t, restored.Annotations)
+			}
+
+			pod, err = client.CoreV1().Pods(namespace).Get(ctx, statefulSetPodName(objectName, 2), v1.GetOptions{})
+			if assert.NoError(t, err) {
+				assert.Equal(t, "test-container", pod.Spec.Containers[0].Name)
+			}
+		})
+	})
+
+	t.Run("missing ordinal", func(t *testing.T) {
+		cfg := config.NewConfig()
+		cfg.Ordinal = ptr.To(int32(3))
+		cfg.TargetObject = statefulset.DeepCopy()
+
+		a := &kubernetesAgent{config: cfg, client: fake.NewClientset()}
+
+		_, err := a.prepareTarget(context.Background(), relatedObjectName)
+		assert.EqualError(t, err, "statefulset test-namespace/test-object has no pod with ordinal 3")
+	})
+}
+
+func TestAgentReplicaSet(t *testing.T) {
+	replicaset := &appsv1.ReplicaSet{
+		ObjectMeta: v1.ObjectMeta{Name: objectName, Namespace: namespace},
+		Spec: appsv1.ReplicaSetSpec{
+			Replicas: ptr.To(int32(3)),
+			Selector: &v1.LabelSelector{MatchLabels: selector},
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "test-container", Image: "test-image"}},
+				},
+			},
+		},
+	}
+
+	t.Run("replicaset", func(t *testing.T) {
+		testAgent(t, replicaset.DeepCopy(), config.NewConfig(), func(t *testing.T, stop runnable.StopFunc, client kubernetes.Interface, _ netip.AddrPort) {
+			rs, err := client.AppsV1().ReplicaSets(namespace).Get(context.Background(), objectName, v1.GetOptions{})
+			if assert.NoError(t, err) {
+				assert.Equal(t, ptr.To(int32(1)), rs.Spec.Replicas)
+				assert.Equal(t, ContainerName, rs.Spec.Template.Spec.Containers[0].Name)
+				assert.Contains(t, rs.Annotations, EndpointAnnotationName)
+			}
+
+			service, err := client.CoreV1().Services(namespace).Get(context.Background(), relatedObjectName, v1.GetOptions{})
+			if assert.NoError(t, err) {
+				assert.Equal(t, "replicaset/test-object", service.Annotations[TargetAnnotationName])
+			}
+
+			stop()
+
+			restored, err := client.AppsV1().ReplicaSets(namespace).Get(context.Background(), objectName, v1.GetOptions{})
+			if assert.NoError(t, err) {
+				assert.Equal(t, replicaset.Spec, restored.Spec)
+				assert.Empty(t, restored.Annotations)
+			}
+		})
+	})
+
+	t.Run("replicaset owned by deployment", func(t *testing.T) {
+		owned := replicaset.DeepCopy()
+		owned.OwnerReferences = []v1.OwnerReference{{Kind: "Deployment", Name: "owner", Controller: ptr.To(true)}}
+
+		cfg := config.NewConfig()
+		cfg.TargetObject = owned
+		cfg.Namespace = namespace
+
+		_, err := NewKubernetesAgent(cfg, fake.NewClientset(owned), nil).Start(context.Background())
+		assert.ErrorContains(t, err, `managed by deployment "owner", target it instead`)
+	})
+}
+
+func TestAgentPod(t *testing.T) {
+	podLabels := map[string]string{"app.kubernetes.io/name": objectName}
+
+	pod := &corev1.Pod{
+		ObjectMeta: v1.ObjectMeta{Name: objectName, Namespace: namespace, Labels: podLabels, ResourceVersion: "10"},
+		Spec: corev1.PodSpec{
+			NodeName:   "node-1",
+			Containers: []corev1.Container{{Name: "test-container", Image: "test-image"}},
+		},
+		Status: corev1.PodStatus{Phase: corev1.PodRunning},
+	}
+
+	t.Run("pod", func(t *testing.T) {
+		testAgent(t, pod.DeepCopy(), config.NewConfig(), func(t *testing.T, stop runnable.StopFunc, client kubernetes.Interface, _ netip.AddrPort) {
+			recreated, err := client.CoreV1().Pods(namespace).Get(context.Background(), objectName, v1.GetOptions{})
+			if assert.NoError(t, err) {
+				assert.Equal(t, map[string]string{"app.kubernetes.io/name": objectName, SessionLabelName: "1-2-3-4"}, recreated.Labels)
+				assert.Equal(t, "1-2-3-4", recreated.Annotations[WireguardRevisionAnnotationName])
+				assert.Equal(t, "test-container", recreated.Annotations[ContainerAnnotationName])
+				assert.Contains(t, recreated.Annotations, OriginalStateAnnotationName)
+				assert.Equal(t, ContainerName, recreated.Spec.Containers[0].Name)
+				assert.Equal(t, "node-1", recreated.Spec.NodeName)
+				assert.Empty(t, recreated.Status.Phase)
+			}
+
+			service, err := client.CoreV1().Services(namespace).Get(context.Background(), relatedObjectName, v1.GetOptions{})
+			if assert.NoError(t, err) {
+				assert.Equal(t, map[string]string{SessionLabelName: "1-2-3-4"}, service.Spec.Selector)
+				assert.Equal(t, "pod/test-object", service.Annotations[TargetAnnotationName])
+			}
+
+			stop()
+
+			restored, err := client.CoreV1().Pods(namespace).Get(context.Background(), objectName, v1.GetOptions{})
+			if assert.NoError(t, err) {
+				assert.Equal(t, pod.Spec, restored.Spec)
+				assert.Equal(t, podLabels, restored.Labels)
+				assert.Empty(t, restored.Annotations)
+			}
+		})
+	})
+
+	t.Run("pod owned by replicaset", func(t *testing.T) {
+		owned := pod.DeepCopy()
+		owned.OwnerReferences = []v1.OwnerReference{{Kind: "ReplicaSet", Name: "owner", Controller: ptr.To(true)}}
+
+		cfg := config.NewConfig()
+		cfg.TargetObject = owned
+		cfg.Namespace = namespace
+
+		_, err := NewKubernetesAgent(cfg, fake.NewClientset(owned), nil).Start(context.Background())
+		assert.ErrorContains(t, err, `managed by replicaset "owner", target it instead`)
+	})
+
+	t.Run("pod using the host network", func(t *testing.T) {
+		hostNetwork := pod.DeepCopy()
+		hostNetwork.Spec.HostNetwork = true
+
+		cfg := config.NewConfig()
+		cfg.TargetObject = hostNetwork
+		cfg.Namespace = namespace
+
+		_, err := NewKubernetesAgent(cfg, fake.NewClientset(hostNetwork), nil).Start(context.Background())
+		assert.ErrorContains(t, err, "uses the host network")
+	})
+}
+
+func TestAgentDaemonSet(t *testing.T) {
+	daemonset := &appsv1.DaemonSet{
+		ObjectMeta: v1.ObjectMeta{Name: objectName, Namespace: namespace, UID: "ds-uid"},
+		Spec: appsv1.DaemonSetSpec{
+			Selector: &v1.LabelSelector{MatchLabels: selector},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: v1.ObjectMeta{Labels: selector},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "test-container", Image: "test-image"}},
+				},
+			},
+			UpdateStrategy: appsv1.DaemonSetUpdateStrategy{Type: appsv1.RollingUpdateDaemonSetStrategyType},
+		},
+	}
+
+	t.Run("daemonset", func(t *testing.T) {
+		cfg := config.NewConfig()
+		cfg.Node = "node-2"
+
+		testAgent(t, daemonset.DeepCopy(), cfg, func(t *testing.T, stop runnable.StopFunc, client kubernetes.Interface, _ netip.AddrPort) {
+			ds, err := client.AppsV1().DaemonSets(namespace).Get(context.Background(), objectName, v1.GetOptions{})
+			if assert.NoError(t, err) {
+				assert.Equal(t, appsv1.OnDeleteDaemonSetStrategyType, ds.Spec.UpdateStrategy.Type)
+				assert.Equal(t, "test-image", ds.Spec.Template.Spec.Containers[0].Image)
+				assert.Equal(
+					t,
+					&corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{{
+						MatchFields: []corev1.NodeSelectorRequirement{{Key: "metadata.name", Operator: corev1.NodeSelectorOpNotIn, Values: []string{"node-2"}}},
+					}}},
+					ds.Spec.Template.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution,
+				)
+			}
+
+			agentPod, err := client.CoreV1().Pods(namespace).Get(context.Background(), relatedObjectName, v1.GetOptions{})
+			if assert.NoError(t, err) {
+				assert.Equal(t, "node-2", agentPod.Spec.NodeName)
+				assert.Equal(t, ContainerName, agentPod.Spec.Containers[0].Name)
+				assert.Equal(t, "1-2-3-4", agentPod.Labels[SessionLabelName])
+				assert.Equal(t, "1-2-3-4", agentPod.Annotations[WireguardRevisionAnnotationName])
+
+				if owner := v1.GetControllerOf(agentPod); assert.NotNil(t, owner) {
+					assert.Equal(t, "Secret", owner.Kind)
+					assert.Equal(t, relatedObjectName, owner.Name)
+				}
+			}
+
+			stop()
+
+			restored, err := client.AppsV1().DaemonSets(namespace).Get(context.Background(), objectName, v1.GetOptions{})
+			if assert.NoError(t, err) {
+				assert.Equal(t, daemonset.Spec, restored.Spec)
+				assert.Empty(t, restored.Annotations)
+			}
+
+			_, err = client.CoreV1().Pods(namespace).Get(context.Background(), relatedObjectName, v1.GetOptions{})
+			assert.True(t, errors.IsNotFound(err))
+		})
+	})
+
+	t.Run("node of the first pod", func(t *testing.T) {
+		daemonsetPod := func(name, node string, uid types.UID) *corev1.Pod {
+			return &corev1.Pod{
+				ObjectMeta: v1.ObjectMeta{
+					Name:            name,
+					Namespace:       namespace,
+					Labels:          selector,
+					OwnerReferences: []v1.OwnerReference{{Kind: "DaemonSet", Name: objectName, UID: uid, Controller: ptr.To(true)}},
+				},
+				Spec: corev1.PodSpec{NodeName: node},
+			}
+		}
+
+		client := fake.NewClientset(
+			daemonsetPod("test-object-c", "node-3", daemonset.UID),
+			daemonsetPod("test-object-b", "node-2", daemonset.UID),
+			daemonsetPod("other-a", "node-1", "other-uid"),
+			daemonsetPod("test-object-a", "", daemonset.UID),
+		)
+
+		a := &kubernetesAgent{config: config.NewConfig(), client: client}
+
+		node, err := a.daemonSetNode(context.Background(), daemonset)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "node-2", node)
+		}
+
+		_, err = a.daemonSetNode(context.Background(), &appsv1.DaemonSet{ObjectMeta: v1.ObjectMeta{Name: "empty", Namespace: namespace}, Spec: daemonset.Spec})
+		assert.ErrorContains(t, err, "pass --node")
+	})
+}
+
+func Test_excludeNode(t *testing.T) {
+	exclude := corev1.NodeSelectorRequirement{Key: "metadata.name", Operator: corev1.NodeSelectorOpNotIn, Values: []string{"node-1"}}
+	zone := corev1.NodeSelectorRequirement{Key: "topology.kubernetes.io/zone", Operator: corev1.NodeSelectorOpIn, Values: []string{"a"}}
+
+	spec := corev1.PodSpec{
+		Affinity: &corev1.Affinity{
+			NodeAffinity: &corev1.NodeAffinity{
+				RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{
+					NodeSelectorTerms: []corev1.NodeSelectorTerm{{MatchExpressions: []corev1.NodeSelectorRequirement{zone}}, {}},
+				},
+			},
+		},
+	}
+
+	excludeNode(&spec, "node-1")
+
+	assert.Equal(
+		t,
+		[]corev1.NodeSelectorTerm{
+			{MatchExpressions: []corev1.NodeSelectorRequirement{zone}, MatchFields: []corev1.NodeSelectorRequirement{exclude}},
+			{MatchFields: []corev1.NodeSelectorRequirement{exclude}},
+		},
+		spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms,
+	)
+}
+
 func Test_containerIndexOrDefault(t *testing.T) {
 	tests := []struct {
 		name          string
@@ -1161,3 +1867,22 @@ func Test_containerIndexOrDefault(t *testing.T) {
 		})
 	}
 }
+
+func Test_preferredAddr(t *testing.T) {
+	tests := []struct {
+		name string
+		ips  []net.IP
+		want netip.Addr
+	}{
+		{"ipv4", []net.IP{net.IPv4(1, 2, 3, 4)}, netip.MustParseAddr("1.2.3.4")},
+		{"ipv6", []net.IP{net.ParseIP("2600:1f14::1")}, netip.MustParseAddr("2600:1f14::1")},
+		{"dual-stack", []net.IP{net.ParseIP("2600:1f14::1"), net.IPv4(1, 2, 3, 4), net.IPv4(5, 6, 7, 8)}, netip.MustParseAddr("1.2.3.4")},
+		{"none", nil, netip.Addr{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, preferredAddr(tt.ips))
+		})
+	}
+}
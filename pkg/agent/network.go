@@ -0,0 +1,170 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/steved/kubewire/pkg/kuberneteshelpers"
+)
+
+// Paths read to discover the pod's network, overridden in tests
+var (
+	resolvConfPath     = "/etc/resolv.conf"
+	ipv4RouteTablePath = "/proc/net/route"
+	ipv6RouteTablePath = "/proc/net/ipv6_route"
+)
+
+// discoverPodNetwork returns the cluster's network as seen from the pod with the given addresses
+func discoverPodNetwork(podAddrs []netip.Addr) (kuberneteshelpers.PodNetwork, error) {
+	network := kuberneteshelpers.PodNetwork{PodIPs: podAddrs}
+
+	resolvConf, err := os.ReadFile(resolvConfPath)
+	if err != nil {
+		return network, fmt.Errorf("unable to read %s: %w", resolvConfPath, err)
+	}
+
+	network.Nameservers, network.Searches, err = kuberneteshelpers.ParseResolvConf(bytes.NewReader(resolvConf))
+	if err != nil {
+		return network, fmt.Errorf("unable to read %s: %w", resolvConfPath, err)
+	}
+
+	network.ClusterDomain = kuberneteshelpers.ClusterDomainFromSearches(network.Searches)
+
+	ipv4Routes, err := readRoutes(ipv4RouteTablePath, parseIPv4Routes)
+	if err != nil {
+		return network, err
+	}
+
+	ipv6Routes, err := readRoutes(ipv6RouteTablePath, parseIPv6Routes)
+	if err != nil {
+		return network, err
+	}
+
+	network.Routes = append(ipv4Routes, ipv6Routes...)
+
+	return network, nil
+}
+
+// writePodNetwork writes the pod's network to path for the CLI to read
+func writePodNetwork(path string, network kuberneteshelpers.PodNetwork) error {
+	contents, err := json.Marshal(network)
+	if err != nil {
+		return fmt.Errorf("unable to encode pod network: %w", err)
+	}
+
+	return os.WriteFile(path, contents, 0o600)
+}
+
+// readRoutes returns the cluster routes of a route table, or none when the route table doesn't exist, e.g. as IPv6
+// is disabled
+func readRoutes(path string, parse func(io.Reader) ([]netip.Prefix, error)) ([]netip.Prefix, error) {
+	contents, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to read %s: %w", path, err)
+	}
+
+	routes, err := parse(bytes.NewReader(contents))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %s: %w", path, err)
+	}
+
+	return routes, nil
+}
+
+// parseIPv4Routes returns the cluster routes of /proc/net/route, whose addresses are hex in host byte order
+func parseIPv4Routes(r io.Reader) ([]netip.Prefix, error) {
+	var routes []netip.Prefix
+
+	scanner := bufio.NewScanner(r)
+	scanner.Scan() // Skip the header
+
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 8 {
+			continue
+		}
+
+		destination, err := strconv.ParseUint(fields[1], 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid destination %q: %w", fields[1], err)
+		}
+
+		mask, err := strconv.ParseUint(fields[7], 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mask %q: %w", fields[7], err)
+		}
+
+		var destinationBytes, maskBytes [4]byte
+
+		binary.NativeEndian.PutUint32(destinationBytes[:], uint32(destination))
+		binary.NativeEndian.PutUint32(maskBytes[:], uint32(mask))
+
+		// Non-contiguous masks have no prefix length
+		bits, size := net.IPMask(maskBytes[:]).Size()
+		if size == 0 {
+			continue
+		}
+
+		if route := netip.PrefixFrom(netip.AddrFrom4(destinationBytes), bits); clusterRoute(fields[0], route) {
+			routes = append(routes, route.Masked())
+		}
+	}
+
+	return routes, scanner.Err()
+}
+
+// parseIPv6Routes returns the cluster routes of /proc/net/ipv6_route, whose addresses are hex in network byte order
+func parseIPv6Routes(r io.Reader) ([]netip.Prefix, error) {
+	var routes []netip.Prefix
+
+	scanner := bufio.NewScanner(r)
+
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 {
+			continue
+		}
+
+		destination, err := hex.DecodeString(fields[0])
+		if err != nil || len(destination) != 16 {
+			return nil, fmt.Errorf("invalid destination %q", fields[0])
+		}
+
+		bits, err := strconv.ParseUint(fields[1], 16, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid prefix length %q: %w", fields[1], err)
+		}
+
+		if route := netip.PrefixFrom(netip.AddrFrom16([16]byte(destination)), int(bits)); clusterRoute(fields[9], route) {
+			routes = append(routes, route.Masked())
+		}
+	}
+
+	return routes, scanner.Err()
+}
+
+// clusterRoute returns whether a route of the pod leads into the cluster rather than being the default route or one
+// to link-local, loopback or multicast addresses
+func clusterRoute(iface string, route netip.Prefix) bool {
+	addr := route.Addr()
+
+	return iface != "lo" &&
+		route.IsValid() &&
+		route.Bits() > 0 &&
+		!addr.IsLinkLocalUnicast() &&
+		!addr.IsLoopback() &&
+		!addr.IsMulticast() &&
+		!addr.IsUnspecified()
+}
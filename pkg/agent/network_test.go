@@ -0,0 +1,72 @@
+package agent
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/steved/kubewire/pkg/kuberneteshelpers"
+)
+
+// hostOrder returns the address in the hex host byte order of /proc/net/route
+func hostOrder(addr string) string {
+	return fmt.Sprintf("%08X", binary.NativeEndian.Uint32(netip.MustParseAddr(addr).AsSlice()))
+}
+
+func Test_discoverPodNetwork(t *testing.T) {
+	dir := t.TempDir()
+
+	resolvConfPath = filepath.Join(dir, "resolv.conf")
+	ipv4RouteTablePath = filepath.Join(dir, "route")
+	ipv6RouteTablePath = filepath.Join(dir, "ipv6_route")
+
+	resolvConf := "search test-ns.svc.example.internal svc.example.internal example.internal\nnameserver 172.0.0.10\noptions ndots:5\n"
+
+	ipv4Routes := "Iface\tDestination\tGateway \tFlags\tRefCnt\tUse\tMetric\tMask\t\tMTU\tWindow\tIRTT\n" +
+		fmt.Sprintf("eth0\t%s\t%s\t0003\t0\t0\t0\t%s\t0\t0\t0\n", hostOrder("0.0.0.0"), hostOrder("100.64.0.1"), hostOrder("0.0.0.0")) +
+		fmt.Sprintf("eth0\t%s\t%s\t0001\t0\t0\t0\t%s\t0\t0\t0\n", hostOrder("100.64.0.0"), hostOrder("0.0.0.0"), hostOrder("255.255.255.0")) +
+		fmt.Sprintf("eth0\t%s\t%s\t0005\t0\t0\t0\t%s\t0\t0\t0\n", hostOrder("169.254.1.1"), hostOrder("0.0.0.0"), hostOrder("255.255.255.255")) +
+		fmt.Sprintf("eth0\t%s\t%s\t0003\t0\t0\t0\t%s\t0\t0\t0\n", hostOrder("100.65.0.0"), hostOrder("100.64.0.1"), hostOrder("255.255.0.0"))
+
+	ipv6Routes := "26001f140abcde000000000000000000 40 00000000000000000000000000000000 00 00000000000000000000000000000000 00000100 00000001 00000000 00000001     eth0\n" +
+		"fe800000000000000000000000000000 40 00000000000000000000000000000000 00 00000000000000000000000000000000 00000100 00000001 00000000 00000001     eth0\n" +
+		"00000000000000000000000000000000 00 00000000000000000000000000000000 00 fe800000000000000000000000000001 00000400 00000001 00000000 00000003     eth0\n" +
+		"00000000000000000000000000000001 80 00000000000000000000000000000000 00 00000000000000000000000000000000 00000000 00000001 00000000 80200001       lo\n" +
+		"ff000000000000000000000000000000 08 00000000000000000000000000000000 00 00000000000000000000000000000000 00000100 00000001 00000000 00000001     eth0\n"
+
+	for path, contents := range map[string]string{resolvConfPath: resolvConf, ipv4RouteTablePath: ipv4Routes, ipv6RouteTablePath: ipv6Routes} {
+		if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	podAddrs := []netip.Addr{netip.MustParseAddr("100.64.0.5"), netip.MustParseAddr("2600:1f14:abc:de00::5")}
+
+	network, err := discoverPodNetwork(podAddrs)
+	if assert.NoError(t, err) {
+		assert.Equal(t, kuberneteshelpers.PodNetwork{
+			PodIPs:        podAddrs,
+			Nameservers:   []netip.Addr{netip.MustParseAddr("172.0.0.10")},
+			Searches:      []string{"test-ns.svc.example.internal", "svc.example.internal", "example.internal"},
+			ClusterDomain: "example.internal",
+			Routes: []netip.Prefix{
+				netip.MustParsePrefix("100.64.0.0/24"),
+				netip.MustParsePrefix("100.65.0.0/16"),
+				netip.MustParsePrefix("2600:1f14:abc:de00::/64"),
+			},
+		}, network)
+	}
+
+	// IPv6 may be disabled in the pod
+	assert.NoError(t, os.Remove(ipv6RouteTablePath))
+
+	network, err = discoverPodNetwork(podAddrs)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("100.64.0.0/24"), netip.MustParsePrefix("100.65.0.0/16")}, network.Routes)
+	}
+}
@@ -0,0 +1,161 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+// preparePod modifies a bare pod to run the agent. Most of a pod's spec can't be updated, so the pod is recreated
+// rather than updated when written.
+func (a *kubernetesAgent) preparePod(pod *corev1.Pod, configName string) (map[string]string, error) {
+	// The owner would replace the pod with one of its own
+	if owner := v1.GetControllerOf(pod); owner != nil {
+		return nil, fmt.Errorf("pod %s/%s is managed by %s %q, target it instead", pod.Namespace, pod.Name, strings.ToLower(owner.Kind), owner.Name)
+	}
+
+	original := corev1.PodTemplateSpec{ObjectMeta: v1.ObjectMeta{Labels: pod.Labels}, Spec: pod.Spec}
+	if err := saveOriginalState(&pod.ObjectMeta, originalState{Template: original}); err != nil {
+		return nil, fmt.Errorf("unable to save original state of target object %s/%s: %w", pod.Namespace, pod.Name, err)
+	}
+
+	template := corev1.PodTemplateSpec{
+		ObjectMeta: v1.ObjectMeta{Labels: maps.Clone(pod.Labels), Annotations: maps.Clone(pod.Annotations)},
+		Spec:       *pod.Spec.DeepCopy(),
+	}
+
+	if template.Labels == nil {
+		template.Labels = make(map[string]string)
+	}
+
+	// Select the new pod alone rather than any others sharing its labels
+	template.Labels[SessionLabelName] = a.revision
+
+	if err := a.injectAgent(&pod.ObjectMeta, &template, configName); err != nil {
+		return nil, err
+	}
+
+	maps.Copy(pod.Annotations, template.Annotations)
+	pod.ObjectMeta = recreatedObjectMeta(pod.ObjectMeta)
+	pod.Labels = template.Labels
+	pod.Spec = recreatedPodSpec(template.Spec)
+	pod.Status = corev1.PodStatus{}
+
+	return map[string]string{SessionLabelName: a.revision}, nil
+}
+
+// recreatePod replaces the existing pod with the prepared one. If the replacement can't be created, the original pod is
+// recreated in its place.
+func (a *kubernetesAgent) recreatePod(ctx context.Context, pod *corev1.Pod, dryRun []string) (runtime.Object, error) {
+	pods := a.client.CoreV1().Pods(pod.Namespace)
+
+	if err := pods.Delete(ctx, pod.Name, v1.DeleteOptions{DryRun: dryRun}); err != nil && !errors.IsNotFound(err) {
+		return nil, fmt.Errorf("failed to delete target object %s/%s: %w", pod.Namespace, pod.Name, err)
+	}
+
+	// The pod isn't actually deleted, so creating its replacement would conflict with it
+	if len(dryRun) > 0 {
+		return pod, nil
+	}
+
+	if err := waitForPodDeleted(ctx, pods, pod.Name); err != nil {
+		return nil, fmt.Errorf("timeout after %s waiting for target object %s/%s to be deleted: %w", WaitTimeout.String(), pod.Namespace, pod.Name, err)
+	}
+
+	result, err := pods.Create(ctx, pod, v1.CreateOptions{})
+	if err != nil {
+		if restoreErr := a.restoreTarget(context.WithoutCancel(ctx), pod.Name); restoreErr != nil {
+			logr.FromContextOrDiscard(ctx).Error(restoreErr, "unable to restore target object", "name", pod.Name)
+		}
+
+		return nil, fmt.Errorf("failed to create target object %s/%s: %w", pod.Namespace, pod.Name, err)
+	}
+
+	return result, nil
+}
+
+// restorePod recreates the pod from the state saved in its original state annotation, if present, returning whether it
+// was restored
+func (a *kubernetesAgent) restorePod(ctx context.Context, target *corev1.Pod) (bool, error) {
+	pods := a.client.CoreV1().Pods(a.config.Namespace)
+
+	pod, err := pods.Get(ctx, target.Name, v1.GetOptions{})
+	if errors.IsNotFound(err) {
+		// The pod running the agent was never created; fall back to the state saved when preparing it
+		pod = target
+	} else if err != nil {
+		return false, err
+	}
+
+	state, ok, err := loadOriginalState(pod)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	if err := pods.Delete(ctx, pod.Name, v1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+		return false, err
+	}
+
+	if err := waitForPodDeleted(ctx, pods, pod.Name); err != nil {
+		return false, fmt.Errorf("timeout after %s waiting for pod to be deleted: %w", WaitTimeout.String(), err)
+	}
+
+	original := &corev1.Pod{
+		ObjectMeta: recreatedObjectMeta(v1.ObjectMeta{
+			Name:            pod.Name,
+			Namespace:       pod.Namespace,
+			Labels:          state.Template.Labels,
+			Annotations:     state.Annotations,
+			OwnerReferences: pod.OwnerReferences,
+		}),
+		Spec: recreatedPodSpec(state.Template.Spec),
+	}
+
+	if _, err := pods.Create(ctx, original, v1.CreateOptions{}); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// recreatedObjectMeta returns the metadata of an existing object without the fields set by the API server, for creating
+// the object anew
+func recreatedObjectMeta(objectMeta v1.ObjectMeta) v1.ObjectMeta {
+	return v1.ObjectMeta{
+		Name:            objectMeta.Name,
+		Namespace:       objectMeta.Namespace,
+		Labels:          objectMeta.Labels,
+		Annotations:     objectMeta.Annotations,
+		OwnerReferences: objectMeta.OwnerReferences,
+		Finalizers:      objectMeta.Finalizers,
+	}
+}
+
+// recreatedPodSpec returns the spec of an existing pod without the fields which can't be set when creating it
+func recreatedPodSpec(spec corev1.PodSpec) corev1.PodSpec {
+	spec.EphemeralContainers = nil
+
+	return spec
+}
+
+// waitForPodDeleted waits until the named pod no longer exists, which happens once its containers have terminated
+func waitForPodDeleted(ctx context.Context, pods corev1client.PodInterface, name string) error {
+	deadlineCtx, cancel := context.WithTimeout(ctx, WaitTimeout)
+	defer cancel()
+
+	return wait.PollUntilContextCancel(deadlineCtx, time.Second, true, func(ctx context.Context) (bool, error) {
+		_, err := pods.Get(ctx, name, v1.GetOptions{})
+
+		return errors.IsNotFound(err), nil
+	})
+}
@@ -0,0 +1,254 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"golang.zx2c4.com/wireguard/wgctrl"
+
+	"github.com/steved/kubewire/pkg/config"
+)
+
+const (
+	// handshakeTimeout is how long after the last handshake the tunnel is considered up. WireGuard rejects sessions
+	// older than 3 minutes, and handshakes are renewed every 2 minutes while traffic flows.
+	handshakeTimeout = 3 * time.Minute
+	// localDialTimeout bounds connecting to the local machine through the tunnel before falling back
+	localDialTimeout = 5 * time.Second
+	// handshakeInterval is how often the latest handshake is checked, rather than for every connection
+	handshakeInterval = 5 * time.Second
+)
+
+// lastHandshake returns the time of the latest handshake with the device's peer, overridden in tests
+var lastHandshake = func(ctx context.Context, deviceName string) (time.Time, error) {
+	client, err := wgctrl.New()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("unable to create wireguard client: %w", err)
+	}
+
+	defer func() {
+		if err := client.Close(); err != nil {
+			logr.FromContextOrDiscard(ctx).Error(err, "unable to close wireguard client")
+		}
+	}()
+
+	device, err := client.Device(deviceName)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("unable to get wireguard device %s: %w", deviceName, err)
+	}
+
+	if len(device.Peers) == 0 {
+		return time.Time{}, nil
+	}
+
+	return device.Peers[0].LastHandshakeTime, nil
+}
+
+// sidecarRedirect redirects connections to a port of the target container to the port of its sidecar proxy
+type sidecarRedirect struct {
+	Port       int
+	ListenPort int
+}
+
+// tunnelMonitor caches the time of the latest handshake with the device's peer, refreshed on a ticker
+type tunnelMonitor struct {
+	deviceName string
+
+	mu        sync.Mutex
+	handshake time.Time
+}
+
+// refresh updates the cached handshake, treating the tunnel as down when it can't be determined
+func (m *tunnelMonitor) refresh(ctx context.Context) {
+	handshake, err := lastHandshake(ctx, m.deviceName)
+	if err != nil {
+		logr.FromContextOrDiscard(ctx).V(1).Info("unable to determine latest handshake", "error", err.Error())
+		handshake = time.Time{}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.handshake = handshake
+}
+
+// run refreshes the cached handshake until the context is canceled
+func (m *tunnelMonitor) run(ctx context.Context) {
+	ticker := time.NewTicker(handshakeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.refresh(ctx)
+		}
+	}
+}
+
+// up returns whether the wireguard peer had recently completed a handshake when last checked
+func (m *tunnelMonitor) up() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return time.Since(m.handshake) < handshakeTimeout
+}
+
+// sidecarOverlayAddress returns the local machine's overlay address of the pod's address family, preferring IPv4 on
+// dual-stack pods. The first is used when the pod's family can't be determined.
+func sidecarOverlayAddress(overlayAddrs, podAddrs []netip.Addr) netip.Addr {
+	for _, overlayAddr := range overlayAddrs {
+		if slices.ContainsFunc(podAddrs, func(addr netip.Addr) bool { return addr.Is4() == overlayAddr.Is4() }) {
+			return overlayAddr
+		}
+	}
+
+	if len(overlayAddrs) == 0 {
+		return netip.Addr{}
+	}
+
+	return overlayAddrs[0]
+}
+
+// sidecarProxy forwards connections to one of the target container's ports to its local port on the local machine while
+// the tunnel is up. When it's down or the local machine refuses the connection, they're forwarded to the target
+// container, which keeps running alongside the agent, on the first of the loopback and pod addresses it accepts them on.
+type sidecarProxy struct {
+	port      int
+	localPort int
+	local     netip.Addr
+	fallbacks []netip.Addr
+	tunnel    *tunnelMonitor
+	listener  net.Listener
+}
+
+// startSidecarProxies starts a proxy for each of the ports, returning the redirects to them. The proxies are stopped
+// when the context is canceled.
+func startSidecarProxies(ctx context.Context, local netip.Addr, podAddrs []netip.Addr, deviceName string, ports []config.PortMapping) ([]sidecarRedirect, error) {
+	tunnel := &tunnelMonitor{deviceName: deviceName}
+	tunnel.refresh(ctx)
+
+	go tunnel.run(ctx)
+
+	// Containers bound to all addresses accept connections on loopback, while others only on the pod's addresses
+	fallbacks := append([]netip.Addr{netip.AddrFrom4([4]byte{127, 0, 0, 1}), netip.IPv6Loopback()}, podAddrs...)
+
+	var redirects []sidecarRedirect
+
+	for _, mapping := range ports {
+		port := int(mapping.Port)
+
+		listener, err := net.Listen("tcp", ":0")
+		if err != nil {
+			return nil, fmt.Errorf("unable to listen for connections to port %d: %w", port, err)
+		}
+
+		proxy := &sidecarProxy{port: port, localPort: int(mapping.LocalPort), local: local, fallbacks: fallbacks, tunnel: tunnel, listener: listener}
+
+		go func() {
+			<-ctx.Done()
+			_ = listener.Close()
+		}()
+
+		go proxy.serve(ctx)
+
+		redirects = append(redirects, sidecarRedirect{Port: port, ListenPort: listener.Addr().(*net.TCPAddr).Port})
+	}
+
+	return redirects, nil
+}
+
+func (p *sidecarProxy) serve(ctx context.Context) {
+	log := logr.FromContextOrDiscard(ctx).WithValues("port", p.port)
+
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Error(err, "unable to accept connection")
+			}
+
+			return
+		}
+
+		go func() {
+			upstream, err := p.dial(ctx)
+			if err != nil {
+				log.Error(err, "unable to forward connection")
+
+				_ = conn.Close()
+
+				return
+			}
+
+			pipe(conn, upstream)
+		}()
+	}
+}
+
+// dial connects to the local port on the local machine if the tunnel is up, falling back to the target container
+func (p *sidecarProxy) dial(ctx context.Context) (net.Conn, error) {
+	log := logr.FromContextOrDiscard(ctx).WithValues("port", p.port)
+
+	var dialer net.Dialer
+
+	if p.tunnel.up() {
+		dialCtx, cancel := context.WithTimeout(ctx, localDialTimeout)
+		defer cancel()
+
+		conn, err := dialer.DialContext(dialCtx, "tcp", netip.AddrPortFrom(p.local, uint16(p.localPort)).String())
+		if err == nil {
+			return conn, nil
+		}
+
+		log.V(1).Info("unable to connect through the tunnel, falling back to the target container", "error", err.Error())
+	}
+
+	var errs []error
+
+	for _, addr := range p.fallbacks {
+		conn, err := dialer.DialContext(ctx, "tcp", netip.AddrPortFrom(addr, uint16(p.port)).String())
+		if err == nil {
+			return conn, nil
+		}
+
+		errs = append(errs, err)
+	}
+
+	return nil, fmt.Errorf("unable to connect to the target container: %w", errors.Join(errs...))
+}
+
+// pipe copies data between the connections until both directions are done, then closes them
+func pipe(a, b net.Conn) {
+	var wg sync.WaitGroup
+
+	copyConn := func(dst, src net.Conn) {
+		defer wg.Done()
+
+		_, _ = io.Copy(dst, src)
+
+		// Signal the end of the stream while still allowing data in the other direction
+		if tcpConn, ok := dst.(*net.TCPConn); ok {
+			_ = tcpConn.CloseWrite()
+		}
+	}
+
+	wg.Add(2)
+
+	go copyConn(a, b)
+	go copyConn(b, a)
+
+	wg.Wait()
+
+	_ = a.Close()
+	_ = b.Close()
+}
@@ -0,0 +1,219 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/steved/kubewire/pkg/config"
+)
+
+// serve accepts connections on the address, replying with the name before closing them
+func serve(t *testing.T, address, name string) net.Listener {
+	t.Helper()
+
+	listener, err := net.Listen("tcp4", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			_, _ = io.WriteString(conn, name)
+			_ = conn.Close()
+		}
+	}()
+
+	return listener
+}
+
+func read(t *testing.T, conn net.Conn) string {
+	t.Helper()
+
+	defer conn.Close()
+
+	contents, err := io.ReadAll(conn)
+	assert.NoError(t, err)
+
+	return string(contents)
+}
+
+func Test_sidecarProxy(t *testing.T) {
+	container := serve(t, "127.0.0.1:0", "container")
+	port := container.Addr().(*net.TCPAddr).Port
+
+	serve(t, fmt.Sprintf("127.0.0.2:%d", port), "local")
+
+	mapped := serve(t, "127.0.0.2:0", "mapped local")
+	mappedPort := mapped.Addr().(*net.TCPAddr).Port
+
+	// A container bound only to the pod's address, stood in for by another loopback address
+	podBound := serve(t, "127.0.0.4:0", "pod address")
+	podBoundPort := podBound.Addr().(*net.TCPAddr).Port
+
+	fallbacks := []netip.Addr{netip.MustParseAddr("127.0.0.1"), netip.IPv6Loopback(), netip.MustParseAddr("127.0.0.4")}
+
+	tests := []struct {
+		name      string
+		port      int
+		local     netip.Addr
+		localPort int
+		handshake time.Time
+		err       error
+		want      string
+	}{
+		{"tunnel up", port, netip.MustParseAddr("127.0.0.2"), port, time.Now().Add(-time.Minute), nil, "local"},
+		{"mapped local port", port, netip.MustParseAddr("127.0.0.2"), mappedPort, time.Now(), nil, "mapped local"},
+		{"tunnel down", port, netip.MustParseAddr("127.0.0.2"), port, time.Now().Add(-5 * time.Minute), nil, "container"},
+		{"no handshake", port, netip.MustParseAddr("127.0.0.2"), port, time.Time{}, nil, "container"},
+		{"handshake error", port, netip.MustParseAddr("127.0.0.2"), port, time.Now(), fmt.Errorf("no device"), "container"},
+		{"local port refused", port, netip.MustParseAddr("127.0.0.3"), port, time.Now(), nil, "container"},
+		{"container on pod address", podBoundPort, netip.MustParseAddr("127.0.0.3"), podBoundPort, time.Now(), nil, "pod address"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lastHandshake = func(_ context.Context, deviceName string) (time.Time, error) {
+				assert.Equal(t, "wg0", deviceName)
+				return tt.handshake, tt.err
+			}
+
+			tunnel := &tunnelMonitor{deviceName: "wg0"}
+			tunnel.refresh(context.Background())
+
+			proxy := &sidecarProxy{port: tt.port, localPort: tt.localPort, local: tt.local, fallbacks: fallbacks, tunnel: tunnel}
+
+			conn, err := proxy.dial(context.Background())
+			if assert.NoError(t, err) {
+				assert.Equal(t, tt.want, read(t, conn))
+			}
+		})
+	}
+
+	t.Run("redirect", func(t *testing.T) {
+		lastHandshake = func(context.Context, string) (time.Time, error) { return time.Now(), nil }
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		redirects, err := startSidecarProxies(ctx, netip.MustParseAddr("127.0.0.2"), nil, "wg0", []config.PortMapping{{Port: uint16(port), LocalPort: uint16(mappedPort)}})
+		if !assert.NoError(t, err) || !assert.Len(t, redirects, 1) {
+			return
+		}
+
+		assert.Equal(t, port, redirects[0].Port)
+
+		conn, err := net.Dial("tcp4", fmt.Sprintf("127.0.0.1:%d", redirects[0].ListenPort))
+		if assert.NoError(t, err) {
+			assert.Equal(t, "mapped local", read(t, conn))
+		}
+	})
+}
+
+func Test_tunnelMonitor(t *testing.T) {
+	calls := 0
+
+	lastHandshake = func(context.Context, string) (time.Time, error) {
+		calls++
+		return time.Now(), nil
+	}
+
+	tunnel := &tunnelMonitor{deviceName: "wg0"}
+	assert.False(t, tunnel.up())
+
+	tunnel.refresh(context.Background())
+
+	// Connections only read the cached handshake
+	for range 3 {
+		assert.True(t, tunnel.up())
+	}
+
+	assert.Equal(t, 1, calls)
+}
+
+func Test_sidecarOverlayAddress(t *testing.T) {
+	overlayAddrs := []netip.Addr{netip.MustParseAddr("100.64.0.1"), netip.MustParseAddr("fd00:64::1")}
+
+	tests := []struct {
+		name         string
+		overlayAddrs []netip.Addr
+		podAddrs     []netip.Addr
+		want         netip.Addr
+	}{
+		{"ipv4", overlayAddrs, []netip.Addr{netip.MustParseAddr("10.0.0.5")}, netip.MustParseAddr("100.64.0.1")},
+		{"ipv6", overlayAddrs, []netip.Addr{netip.MustParseAddr("2600:1f14::10")}, netip.MustParseAddr("fd00:64::1")},
+		{"dual-stack", overlayAddrs, []netip.Addr{netip.MustParseAddr("2600:1f14::10"), netip.MustParseAddr("10.0.0.5")}, netip.MustParseAddr("100.64.0.1")},
+		{"unknown family", overlayAddrs, nil, netip.MustParseAddr("100.64.0.1")},
+		{"ipv6 overlay only", overlayAddrs[1:], []netip.Addr{netip.MustParseAddr("10.0.0.5")}, netip.MustParseAddr("fd00:64::1")},
+		{"no overlay", nil, []netip.Addr{netip.MustParseAddr("10.0.0.5")}, netip.Addr{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, sidecarOverlayAddress(tt.overlayAddrs, tt.podAddrs))
+		})
+	}
+}
+
+func Test_replaceContainerWithAgentProbes(t *testing.T) {
+	probe := &corev1.Probe{InitialDelaySeconds: 10}
+
+	tests := []struct {
+		name    string
+		sidecar bool
+		want    *corev1.Probe
+	}{
+		{"replaced", false, nil},
+		{"sidecar", true, probe},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.NewConfig()
+			cfg.Sidecar = tt.sidecar
+
+			podSpec := &corev1.PodSpec{
+				Containers: []corev1.Container{
+					{
+						Name:           "test-container",
+						Ports:          []corev1.ContainerPort{{Name: "http", ContainerPort: 8080}},
+						LivenessProbe:  probe,
+						ReadinessProbe: probe,
+						StartupProbe:   probe,
+					},
+					{Name: "other-container", LivenessProbe: probe},
+				},
+			}
+
+			a := &kubernetesAgent{config: cfg}
+			a.replaceContainerWithAgent(podSpec, relatedObjectName, 0)
+
+			for _, container := range podSpec.Containers {
+				if container.Name == ContainerName {
+					continue
+				}
+
+				assert.Equal(t, tt.want, container.LivenessProbe, container.Name)
+			}
+
+			if tt.sidecar {
+				assert.Equal(t, probe, podSpec.Containers[0].ReadinessProbe)
+				assert.Equal(t, probe, podSpec.Containers[0].StartupProbe)
+			}
+		})
+	}
+}
@@ -0,0 +1,222 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/utils/ptr"
+)
+
+// prepareStatefulSetOrdinal prepares the statefulset to run the agent in the pod of a single ordinal, leaving its other
+// pods running. The ordinal's pod is recreated by the statefulset from a template running the agent, keeping its name,
+// volumes and DNS identity, after which the statefulset's own template is put back so that any of its other pods
+// recreated during the session, e.g. when evicted, run unchanged. The update strategy is set to OnDelete so that the
+// agent's pod is left alone in the meantime.
+func (a *kubernetesAgent) prepareStatefulSetOrdinal(sts *appsv1.StatefulSet, configName string, ordinal int32) (map[string]string, error) {
+	start, replicas := int32(0), ptr.Deref(sts.Spec.Replicas, 1)
+	if sts.Spec.Ordinals != nil {
+		start = sts.Spec.Ordinals.Start
+	}
+
+	if ordinal < start || ordinal >= start+replicas {
+		return nil, fmt.Errorf("statefulset %s/%s has no pod with ordinal %d", sts.Namespace, sts.Name, ordinal)
+	}
+
+	original := originalState{
+		Replicas:                  sts.Spec.Replicas,
+		Template:                  sts.Spec.Template,
+		StatefulSetUpdateStrategy: &sts.Spec.UpdateStrategy,
+		Ordinal:                   ptr.To(ordinal),
+	}
+
+	if err := saveOriginalState(&sts.ObjectMeta, original); err != nil {
+		return nil, fmt.Errorf("unable to save original state of target object %s/%s: %w", sts.Namespace, sts.Name, err)
+	}
+
+	template := sts.Spec.Template.DeepCopy()
+	if template.Labels == nil {
+		template.Labels = make(map[string]string)
+	}
+
+	// Select the agent pod alone rather than the statefulset's other pods
+	template.Labels[SessionLabelName] = a.revision
+
+	if err := a.injectAgent(&sts.ObjectMeta, template, configName); err != nil {
+		return nil, err
+	}
+
+	a.agentTemplate = template
+
+	// The revision alone marks the statefulset as running the agent, which doesn't roll its pods with OnDelete
+	if sts.Spec.Template.Annotations == nil {
+		sts.Spec.Template.Annotations = make(map[string]string)
+	}
+
+	sts.Spec.Template.Annotations[WireguardRevisionAnnotationName] = a.revision
+	sts.Spec.UpdateStrategy = appsv1.StatefulSetUpdateStrategy{Type: appsv1.OnDeleteStatefulSetStrategyType}
+
+	return map[string]string{SessionLabelName: a.revision}, nil
+}
+
+// writeStatefulSetOrdinal updates the statefulset with the agent's template and deletes the pod of the agent's ordinal,
+// which the statefulset recreates running the agent. The statefulset's template is then put back, and pods of other
+// ordinals recreated from the agent's template in the meantime are deleted to be recreated from it too. If any step
+// fails, the statefulset is restored.
+func (a *kubernetesAgent) writeStatefulSetOrdinal(ctx context.Context, sts *appsv1.StatefulSet, dryRun []string) (_ runtime.Object, err error) {
+	statefulSets := a.client.AppsV1().StatefulSets(sts.Namespace)
+
+	withAgent := sts.DeepCopy()
+	withAgent.Spec.Template = *a.agentTemplate
+
+	result, err := statefulSets.Update(ctx, withAgent, v1.UpdateOptions{DryRun: dryRun})
+	if err != nil {
+		return nil, fmt.Errorf("failed to update target object %s/%s: %w", sts.Namespace, sts.Name, err)
+	}
+
+	if len(dryRun) > 0 {
+		return result, nil
+	}
+
+	defer func() {
+		if err == nil {
+			return
+		}
+
+		if restoreErr := a.restoreTarget(context.WithoutCancel(ctx), sts.Name); restoreErr != nil {
+			logr.FromContextOrDiscard(ctx).Error(restoreErr, "unable to restore target object", "name", sts.Name)
+		}
+	}()
+
+	pods := a.client.CoreV1().Pods(sts.Namespace)
+	podName := statefulSetPodName(sts.Name, *a.config.Ordinal)
+
+	if err := pods.Delete(ctx, podName, v1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+		return nil, fmt.Errorf("failed to delete pod %s/%s: %w", sts.Namespace, podName, err)
+	}
+
+	if err := waitForPodRevision(ctx, pods, podName, a.revision); err != nil {
+		return nil, fmt.Errorf("timeout after %s waiting for pod %s/%s to be recreated: %w", WaitTimeout.String(), sts.Namespace, podName, err)
+	}
+
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		current, err := statefulSets.Get(ctx, sts.Name, v1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		current.Spec.Template = sts.Spec.Template
+
+		result, err = statefulSets.Update(ctx, current, v1.UpdateOptions{})
+
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to restore the template of target object %s/%s: %w", sts.Namespace, sts.Name, err)
+	}
+
+	if err := a.deleteAgentPods(ctx, sts.Namespace, a.revision, podName); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// restoreStatefulSet restores the statefulset to the state saved in its original state annotation, if present,
+// returning whether it was restored. If a single ordinal was running the agent, its pod is deleted to be recreated from
+// the original template.
+func (a *kubernetesAgent) restoreStatefulSet(ctx context.Context, name string) (bool, error) {
+	sts, err := a.client.AppsV1().StatefulSets(a.config.Namespace).Get(ctx, name, v1.GetOptions{})
+	if err != nil {
+		return false, err
+	}
+
+	state, ok, err := loadOriginalState(sts)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	revision := sts.Spec.Template.Annotations[WireguardRevisionAnnotationName]
+
+	sts.Annotations = state.Annotations
+	sts.Spec.Replicas = state.Replicas
+	sts.Spec.Template = state.Template
+
+	if state.StatefulSetUpdateStrategy != nil {
+		sts.Spec.UpdateStrategy = *state.StatefulSetUpdateStrategy
+	}
+
+	if _, err := a.client.AppsV1().StatefulSets(a.config.Namespace).Update(ctx, sts, v1.UpdateOptions{}); err != nil {
+		return false, err
+	}
+
+	if state.Ordinal != nil {
+		podName := statefulSetPodName(name, *state.Ordinal)
+
+		if err := a.client.CoreV1().Pods(a.config.Namespace).Delete(ctx, podName, v1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+			return false, fmt.Errorf("unable to delete agent pod %s/%s: %w", a.config.Namespace, podName, err)
+		}
+
+		if revision != "" {
+			if err := a.deleteAgentPods(ctx, a.config.Namespace, revision, podName); err != nil {
+				return false, err
+			}
+		}
+	}
+
+	return true, nil
+}
+
+// deleteAgentPods deletes the pods running the agent of the session's revision other than the named one, which the
+// statefulset recreates from its template
+func (a *kubernetesAgent) deleteAgentPods(ctx context.Context, namespace, revision, except string) error {
+	pods := a.client.CoreV1().Pods(namespace)
+
+	list, err := pods.List(ctx, v1.ListOptions{LabelSelector: labels.SelectorFromSet(map[string]string{SessionLabelName: revision}).String()})
+	if err != nil {
+		return fmt.Errorf("unable to list agent pods in %s: %w", namespace, err)
+	}
+
+	for _, pod := range list.Items {
+		if pod.Name == except {
+			continue
+		}
+
+		logr.FromContextOrDiscard(ctx).Info("Recreating pod which ran the agent from the statefulset's template", "pod", pod.Name)
+
+		if err := pods.Delete(ctx, pod.Name, v1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+			return fmt.Errorf("unable to delete agent pod %s/%s: %w", namespace, pod.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// statefulSetPodName returns the name of the statefulset's pod with the ordinal
+func statefulSetPodName(name string, ordinal int32) string {
+	return fmt.Sprintf("%s-%d", name, ordinal)
+}
+
+// waitForPodRevision waits until the named pod has been recreated with the session's revision
+func waitForPodRevision(ctx context.Context, pods corev1client.PodInterface, name, revision string) error {
+	deadlineCtx, cancel := context.WithTimeout(ctx, WaitTimeout)
+	defer cancel()
+
+	return wait.PollUntilContextCancel(deadlineCtx, time.Second, true, func(ctx context.Context) (bool, error) {
+		pod, err := pods.Get(ctx, name, v1.GetOptions{})
+		if err != nil {
+			return false, nil
+		}
+
+		return pod.Annotations[WireguardRevisionAnnotationName] == revision, nil
+	})
+}
@@ -0,0 +1,369 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
+	"k8s.io/utils/ptr"
+
+	"github.com/steved/kubewire/pkg/config"
+)
+
+// DefaultUnstructuredTargets are the custom workload types which can be targeted without any configuration
+var DefaultUnstructuredTargets = []config.UnstructuredTarget{
+	{
+		GroupVersionKind: schema.GroupVersionKind{Group: "argoproj.io", Kind: "Rollout"},
+		TemplatePath:     "spec.template",
+		SelectorPath:     "spec.selector",
+		ReplicasPath:     "spec.replicas",
+	},
+	{
+		GroupVersionKind: schema.GroupVersionKind{Group: "apps.kruise.io", Kind: "CloneSet"},
+		TemplatePath:     "spec.template",
+		SelectorPath:     "spec.selector",
+		ReplicasPath:     "spec.replicas",
+	},
+}
+
+// Object is a Kubernetes object along with its metadata
+type Object interface {
+	runtime.Object
+	v1.Object
+}
+
+// TargetAdapter exposes the parts of a workload the agent modifies, regardless of the workload's type. Changes made
+// through the adapter are local until the workload is applied.
+type TargetAdapter interface {
+	// Object returns the workload, including any changes made through the adapter
+	Object() Object
+	// PodTemplate returns a copy of the workload's pod template
+	PodTemplate() (corev1.PodTemplateSpec, error)
+	// SetPodTemplate replaces the workload's pod template
+	SetPodTemplate(template corev1.PodTemplateSpec) error
+	// Selector returns the label selector of the workload's pods
+	Selector() (*v1.LabelSelector, error)
+	// Replicas returns the workload's replica count, which is nil if unset or if the workload isn't scaled by one
+	Replicas() (*int32, error)
+	// SetReplicas replaces the workload's replica count, if it has one
+	SetReplicas(replicas *int32) error
+
+	// Apply writes the workload to the cluster, creating it if create is set and updating it otherwise. Passing dryRun
+	// submits the request without persisting it.
+	Apply(ctx context.Context, create bool, dryRun []string) (runtime.Object, error)
+	// Get returns an adapter for the current state of the workload in the cluster
+	Get(ctx context.Context) (TargetAdapter, error)
+	// Patch applies a JSON merge patch to the workload in the cluster
+	Patch(ctx context.Context, patch []byte) error
+	// Delete deletes the workload from the cluster, along with its pods
+	Delete(ctx context.Context) error
+}
+
+// newDynamicClient returns a client for custom workload types, overridden in tests
+var newDynamicClient = func(restConfig *rest.Config) (dynamic.Interface, error) {
+	return dynamic.NewForConfig(restConfig)
+}
+
+// NewTargetAdapter returns an adapter for the workload. Deployments, StatefulSets and ReplicaSets are supported, along
+// with unstructured objects of the types described by unstructuredTargets or DefaultUnstructuredTargets.
+func NewTargetAdapter(obj runtime.Object, client kubernetes.Interface, restConfig *rest.Config, unstructuredTargets []config.UnstructuredTarget) (TargetAdapter, error) {
+	switch obj := obj.(type) {
+	case *appsv1.Deployment:
+		return &typedTarget[*appsv1.Deployment]{
+			object:   obj,
+			client:   client.AppsV1().Deployments(obj.Namespace),
+			template: func(d *appsv1.Deployment) *corev1.PodTemplateSpec { return &d.Spec.Template },
+			selector: func(d *appsv1.Deployment) *v1.LabelSelector { return d.Spec.Selector },
+			replicas: func(d *appsv1.Deployment) **int32 { return &d.Spec.Replicas },
+		}, nil
+	case *appsv1.StatefulSet:
+		return &typedTarget[*appsv1.StatefulSet]{
+			object:   obj,
+			client:   client.AppsV1().StatefulSets(obj.Namespace),
+			template: func(s *appsv1.StatefulSet) *corev1.PodTemplateSpec { return &s.Spec.Template },
+			selector: func(s *appsv1.StatefulSet) *v1.LabelSelector { return s.Spec.Selector },
+			replicas: func(s *appsv1.StatefulSet) **int32 { return &s.Spec.Replicas },
+		}, nil
+	case *appsv1.ReplicaSet:
+		return &typedTarget[*appsv1.ReplicaSet]{
+			object:   obj,
+			client:   client.AppsV1().ReplicaSets(obj.Namespace),
+			template: func(r *appsv1.ReplicaSet) *corev1.PodTemplateSpec { return &r.Spec.Template },
+			selector: func(r *appsv1.ReplicaSet) *v1.LabelSelector { return r.Spec.Selector },
+			replicas: func(r *appsv1.ReplicaSet) **int32 { return &r.Spec.Replicas },
+		}, nil
+	case *unstructured.Unstructured:
+		return newUnstructuredTarget(obj, client, restConfig, unstructuredTargets)
+	default:
+		return nil, fmt.Errorf("target object is not a supported type: %T", obj)
+	}
+}
+
+// typedClient is the subset of a typed client used by typedTarget
+type typedClient[T Object] interface {
+	Get(ctx context.Context, name string, opts v1.GetOptions) (T, error)
+	Create(ctx context.Context, obj T, opts v1.CreateOptions) (T, error)
+	Update(ctx context.Context, obj T, opts v1.UpdateOptions) (T, error)
+	Patch(ctx context.Context, name string, pt types.PatchType, data []byte, opts v1.PatchOptions, subresources ...string) (T, error)
+	Delete(ctx context.Context, name string, opts v1.DeleteOptions) error
+}
+
+// typedTarget adapts a built-in workload type using accessors for its fields
+type typedTarget[T Object] struct {
+	object T
+	client typedClient[T]
+
+	template func(T) *corev1.PodTemplateSpec
+	selector func(T) *v1.LabelSelector
+	replicas func(T) **int32
+}
+
+func (t *typedTarget[T]) Object() Object {
+	return t.object
+}
+
+func (t *typedTarget[T]) PodTemplate() (corev1.PodTemplateSpec, error) {
+	return *t.template(t.object).DeepCopy(), nil
+}
+
+func (t *typedTarget[T]) SetPodTemplate(template corev1.PodTemplateSpec) error {
+	*t.template(t.object) = template
+	return nil
+}
+
+func (t *typedTarget[T]) Selector() (*v1.LabelSelector, error) {
+	if selector := t.selector(t.object); selector != nil {
+		return selector, nil
+	}
+
+	return nil, fmt.Errorf("target object %s/%s has no selector", t.object.GetNamespace(), t.object.GetName())
+}
+
+func (t *typedTarget[T]) Replicas() (*int32, error) {
+	return *t.replicas(t.object), nil
+}
+
+func (t *typedTarget[T]) SetReplicas(replicas *int32) error {
+	*t.replicas(t.object) = replicas
+	return nil
+}
+
+func (t *typedTarget[T]) Apply(ctx context.Context, create bool, dryRun []string) (runtime.Object, error) {
+	if create {
+		return t.client.Create(ctx, t.object, v1.CreateOptions{DryRun: dryRun})
+	}
+
+	return t.client.Update(ctx, t.object, v1.UpdateOptions{DryRun: dryRun})
+}
+
+func (t *typedTarget[T]) Get(ctx context.Context) (TargetAdapter, error) {
+	obj, err := t.client.Get(ctx, t.object.GetName(), v1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	current := *t
+	current.object = obj
+
+	return &current, nil
+}
+
+func (t *typedTarget[T]) Patch(ctx context.Context, patch []byte) error {
+	_, err := t.client.Patch(ctx, t.object.GetName(), types.MergePatchType, patch, v1.PatchOptions{})
+	return err
+}
+
+func (t *typedTarget[T]) Delete(ctx context.Context) error {
+	return t.client.Delete(ctx, t.object.GetName(), v1.DeleteOptions{PropagationPolicy: ptr.To(v1.DeletePropagationBackground)})
+}
+
+// unstructuredTarget adapts a custom workload type using the field paths of its UnstructuredTarget
+type unstructuredTarget struct {
+	object *unstructured.Unstructured
+	client dynamic.ResourceInterface
+
+	templatePath []string
+	selectorPath []string
+	replicasPath []string
+}
+
+func newUnstructuredTarget(obj *unstructured.Unstructured, client kubernetes.Interface, restConfig *rest.Config, unstructuredTargets []config.UnstructuredTarget) (TargetAdapter, error) {
+	gvk := obj.GroupVersionKind()
+
+	var (
+		target config.UnstructuredTarget
+		found  bool
+	)
+
+	for _, t := range slices.Concat(unstructuredTargets, DefaultUnstructuredTargets) {
+		if t.Matches(gvk) {
+			target, found = t, true
+			break
+		}
+	}
+
+	if !found {
+		return nil, fmt.Errorf("target object kind %s is not supported, describe it with --target-adapter", gvk.GroupKind())
+	}
+
+	groupResources, err := restmapper.GetAPIGroupResources(client.Discovery())
+	if err != nil {
+		return nil, fmt.Errorf("unable to discover API resources: %w", err)
+	}
+
+	mapping, err := restmapper.NewDiscoveryRESTMapper(groupResources).RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		return nil, fmt.Errorf("unable to find resource for kind %s: %w", gvk, err)
+	}
+
+	dynamicClient, err := newDynamicClient(restConfig)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create dynamic client: %w", err)
+	}
+
+	return &unstructuredTarget{
+		object:       obj,
+		client:       dynamicClient.Resource(mapping.Resource).Namespace(obj.GetNamespace()),
+		templatePath: fieldPath(target.TemplatePath),
+		selectorPath: fieldPath(target.SelectorPath),
+		replicasPath: fieldPath(target.ReplicasPath),
+	}, nil
+}
+
+func (t *unstructuredTarget) Object() Object {
+	return t.object
+}
+
+func (t *unstructuredTarget) PodTemplate() (corev1.PodTemplateSpec, error) {
+	var template corev1.PodTemplateSpec
+
+	field, found, err := unstructured.NestedMap(t.object.Object, t.templatePath...)
+	if err != nil {
+		return template, fmt.Errorf("unable to read pod template of target object %s/%s: %w", t.object.GetNamespace(), t.object.GetName(), err)
+	} else if !found {
+		return template, fmt.Errorf("target object %s/%s has no pod template at %s", t.object.GetNamespace(), t.object.GetName(), strings.Join(t.templatePath, "."))
+	}
+
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(field, &template); err != nil {
+		return template, fmt.Errorf("unable to parse pod template of target object %s/%s: %w", t.object.GetNamespace(), t.object.GetName(), err)
+	}
+
+	return template, nil
+}
+
+func (t *unstructuredTarget) SetPodTemplate(template corev1.PodTemplateSpec) error {
+	field, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&template)
+	if err != nil {
+		return err
+	}
+
+	// An unset creation timestamp is serialized as null, which custom resource validation may reject
+	unstructured.RemoveNestedField(field, "metadata", "creationTimestamp")
+
+	return unstructured.SetNestedMap(t.object.Object, field, t.templatePath...)
+}
+
+func (t *unstructuredTarget) Selector() (*v1.LabelSelector, error) {
+	if len(t.selectorPath) == 0 {
+		template, err := t.PodTemplate()
+		if err != nil {
+			return nil, err
+		}
+
+		return &v1.LabelSelector{MatchLabels: template.Labels}, nil
+	}
+
+	field, found, err := unstructured.NestedMap(t.object.Object, t.selectorPath...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read selector of target object %s/%s: %w", t.object.GetNamespace(), t.object.GetName(), err)
+	} else if !found {
+		return nil, fmt.Errorf("target object %s/%s has no selector at %s", t.object.GetNamespace(), t.object.GetName(), strings.Join(t.selectorPath, "."))
+	}
+
+	var selector v1.LabelSelector
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(field, &selector); err != nil {
+		return nil, fmt.Errorf("unable to parse selector of target object %s/%s: %w", t.object.GetNamespace(), t.object.GetName(), err)
+	}
+
+	return &selector, nil
+}
+
+func (t *unstructuredTarget) Replicas() (*int32, error) {
+	var replicas *int32
+
+	if len(t.replicasPath) == 0 {
+		return replicas, nil
+	}
+
+	value, found, err := unstructured.NestedInt64(t.object.Object, t.replicasPath...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read replicas of target object %s/%s: %w", t.object.GetNamespace(), t.object.GetName(), err)
+	} else if found {
+		replicas = ptr.To(int32(value))
+	}
+
+	return replicas, nil
+}
+
+func (t *unstructuredTarget) SetReplicas(replicas *int32) error {
+	if len(t.replicasPath) == 0 {
+		return nil
+	}
+
+	if replicas == nil {
+		unstructured.RemoveNestedField(t.object.Object, t.replicasPath...)
+		return nil
+	}
+
+	return unstructured.SetNestedField(t.object.Object, int64(*replicas), t.replicasPath...)
+}
+
+func (t *unstructuredTarget) Apply(ctx context.Context, create bool, dryRun []string) (runtime.Object, error) {
+	if create {
+		return t.client.Create(ctx, t.object, v1.CreateOptions{DryRun: dryRun})
+	}
+
+	return t.client.Update(ctx, t.object, v1.UpdateOptions{DryRun: dryRun})
+}
+
+func (t *unstructuredTarget) Get(ctx context.Context) (TargetAdapter, error) {
+	obj, err := t.client.Get(ctx, t.object.GetName(), v1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	current := *t
+	current.object = obj
+
+	return &current, nil
+}
+
+func (t *unstructuredTarget) Patch(ctx context.Context, patch []byte) error {
+	_, err := t.client.Patch(ctx, t.object.GetName(), types.MergePatchType, patch, v1.PatchOptions{})
+	return err
+}
+
+func (t *unstructuredTarget) Delete(ctx context.Context) error {
+	return t.client.Delete(ctx, t.object.GetName(), v1.DeleteOptions{PropagationPolicy: ptr.To(v1.DeletePropagationBackground)})
+}
+
+// fieldPath splits a dot-separated field path into its fields
+func fieldPath(path string) []string {
+	if path == "" {
+		return nil
+	}
+
+	return strings.Split(path, ".")
+}
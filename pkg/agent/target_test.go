@@ -0,0 +1,144 @@
+package agent
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+
+	"github.com/steved/kubewire/pkg/config"
+)
+
+func TestAgentUnstructured(t *testing.T) {
+	newRevision = func() string { return "1-2-3-4" }
+
+	rolloutResource := schema.GroupVersionResource{Group: "argoproj.io", Version: "v1alpha1", Resource: "rollouts"}
+
+	rollout := &unstructured.Unstructured{Object: map[string]any{
+		"apiVersion": "argoproj.io/v1alpha1",
+		"kind":       "Rollout",
+		"metadata":   map[string]any{"name": objectName, "namespace": namespace},
+		"spec": map[string]any{
+			"replicas": int64(3),
+			"selector": map[string]any{"matchLabels": map[string]any{"app.kubernetes.io/name": objectName}},
+			"template": map[string]any{
+				"metadata": map[string]any{"labels": map[string]any{"app.kubernetes.io/name": objectName}},
+				"spec": map[string]any{
+					"containers": []any{map[string]any{"name": "test-container", "image": "test-image"}},
+				},
+			},
+			"strategy": map[string]any{"canary": map[string]any{}},
+		},
+	}}
+
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(
+		runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{rolloutResource: "RolloutList"},
+		rollout.DeepCopy(),
+	)
+
+	newDynamicClient = func(_ *rest.Config) (dynamic.Interface, error) {
+		return dynamicClient, nil
+	}
+
+	client := fake.NewClientset()
+	client.Resources = []*v1.APIResourceList{{
+		GroupVersion: "argoproj.io/v1alpha1",
+		APIResources: []v1.APIResource{{Name: "rollouts", Kind: "Rollout", Namespaced: true}},
+	}}
+
+	cfg := config.NewConfig()
+	cfg.TargetObject = rollout.DeepCopy()
+	cfg.Namespace = namespace
+	cfg.AgentImage = agentImage
+	cfg.Wireguard.LocalAddress = netip.MustParseAddrPort("1.2.3.4:19070")
+
+	stop, err := NewKubernetesAgent(cfg, client, nil).Start(context.Background())
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	modified, err := dynamicClient.Resource(rolloutResource).Namespace(namespace).Get(context.Background(), objectName, v1.GetOptions{})
+	if assert.NoError(t, err) {
+		replicas, _, _ := unstructured.NestedInt64(modified.Object, "spec", "replicas")
+		assert.Equal(t, int64(1), replicas)
+
+		containers, _, _ := unstructured.NestedSlice(modified.Object, "spec", "template", "spec", "containers")
+		if assert.Len(t, containers, 1) {
+			assert.Equal(t, ContainerName, containers[0].(map[string]any)["name"])
+		}
+
+		revision, _, _ := unstructured.NestedString(modified.Object, "spec", "template", "metadata", "annotations", WireguardRevisionAnnotationName)
+		assert.Equal(t, "1-2-3-4", revision)
+		assert.Contains(t, modified.GetAnnotations(), OriginalStateAnnotationName)
+
+		_, found, _ := unstructured.NestedFieldNoCopy(modified.Object, "spec", "template", "metadata", "creationTimestamp")
+		assert.False(t, found)
+	}
+
+	stop()
+
+	restored, err := dynamicClient.Resource(rolloutResource).Namespace(namespace).Get(context.Background(), objectName, v1.GetOptions{})
+	if assert.NoError(t, err) {
+		assert.Equal(t, rollout.Object["spec"].(map[string]any)["strategy"], restored.Object["spec"].(map[string]any)["strategy"])
+		assert.Empty(t, restored.GetAnnotations())
+
+		replicas, _, _ := unstructured.NestedInt64(restored.Object, "spec", "replicas")
+		assert.Equal(t, int64(3), replicas)
+
+		containers, _, _ := unstructured.NestedSlice(restored.Object, "spec", "template", "spec", "containers")
+		if assert.Len(t, containers, 1) {
+			assert.Equal(t, "test-container", containers[0].(map[string]any)["name"])
+			assert.Equal(t, "test-image", containers[0].(map[string]any)["image"])
+		}
+
+		_, found, _ := unstructured.NestedFieldNoCopy(restored.Object, "spec", "template", "metadata", "annotations")
+		assert.False(t, found)
+	}
+}
+
+func TestNewTargetAdapter(t *testing.T) {
+	client := fake.NewClientset()
+	client.Resources = []*v1.APIResourceList{{
+		GroupVersion: "example.com/v1",
+		APIResources: []v1.APIResource{{Name: "widgets", Kind: "Widget", Namespaced: true}},
+	}}
+
+	_, err := NewTargetAdapter(&unstructured.Unstructured{Object: map[string]any{"apiVersion": "example.com/v1", "kind": "Widget"}}, client, nil, nil)
+	assert.ErrorContains(t, err, "target object kind Widget.example.com is not supported")
+
+	target, err := NewTargetAdapter(
+		&unstructured.Unstructured{Object: map[string]any{
+			"apiVersion": "example.com/v1",
+			"kind":       "Widget",
+			"spec": map[string]any{
+				"pods": map[string]any{"metadata": map[string]any{"labels": map[string]any{"app": "widget"}}},
+			},
+		}},
+		client,
+		nil,
+		[]config.UnstructuredTarget{{GroupVersionKind: schema.GroupVersionKind{Group: "example.com", Kind: "Widget"}, TemplatePath: "spec.pods"}},
+	)
+
+	// Without a selector path, the template's labels select its pods
+	if assert.NoError(t, err) {
+		selector, err := target.Selector()
+		if assert.NoError(t, err) {
+			assert.Equal(t, map[string]string{"app": "widget"}, selector.MatchLabels)
+		}
+
+		replicas, err := target.Replicas()
+		if assert.NoError(t, err) {
+			assert.Nil(t, replicas)
+		}
+	}
+}
@@ -7,6 +7,17 @@ import (
 	"k8s.io/apimachinery/pkg/runtime"
 
 	"github.com/steved/kubewire/pkg/kuberneteshelpers"
+	"github.com/steved/kubewire/pkg/remap"
+)
+
+const (
+	// DryRunClient renders changes locally without contacting the API server
+	DryRunClient = "client"
+	// DryRunServer submits changes to the API server for validation and defaulting without persisting them
+	DryRunServer = "server"
+
+	DryRunOutputYAML = "yaml"
+	DryRunOutputDiff = "diff"
 )
 
 type Config struct {
@@ -19,9 +30,61 @@ type Config struct {
 	Namespace string
 	// Container is the name of the container to target within the Kubernetes object
 	Container string
+	// UnstructuredTargets describe custom workload types which can be targeted, in addition to the defaults known to
+	// the agent
+	UnstructuredTargets []UnstructuredTarget
+	// Node is the node to run the agent on when the target object is a DaemonSet. If empty, the node of one of the
+	// DaemonSet's pods is used.
+	Node string
+	// Ordinal is the ordinal of the single pod to run the agent in when the target object is a StatefulSet. If nil, the
+	// StatefulSet is scaled down to a single replica running the agent instead.
+	Ordinal *int32
 
 	// KeepResources will prevent load balancers and other created resources from being deleted when exiting
 	KeepResources bool
+	// KeepTarget will prevent the target object from being restored to its original state when exiting
+	KeepTarget bool
+	// Ports are the ports of the target container to intercept and the local ports they're forwarded to. If empty,
+	// all ports are intercepted and forwarded to the same ports locally.
+	Ports []PortMapping
+	// Sidecar runs the agent alongside the target container rather than in its place. Connections to the container's
+	// ports are forwarded to the local machine while the tunnel is up, and to the container itself otherwise.
+	Sidecar bool
+	// Ephemeral indicates the target object is a Deployment which doesn't exist yet; it's created when starting and
+	// deleted when exiting rather than modified and restored
+	Ephemeral bool
+
+	// DryRun renders the changes which would be made to the cluster instead of making them. It's one of DryRunClient,
+	// DryRunServer or empty to disable.
+	DryRun string
+	// DryRunOutput is the format changes are rendered in during a dry run; one of DryRunOutputYAML or DryRunOutputDiff
+	DryRunOutput string
+
+	// ExportWireguardConfig is the path to write the local wireguard configuration to, in wg-quick format, in place of
+	// setting up a local device and routing
+	ExportWireguardConfig string
+
+	// KubeContext is the kubeconfig context of the cluster, which the chosen overlays are persisted for
+	KubeContext string
+	// OverlayPool is the ranges overlays are allocated from. If empty, overlay.DefaultPool is used.
+	OverlayPool []netip.Prefix
+	// RulePriority is the priority of the rules looking up the session's routing table on Linux. If 0, routes are
+	// added to the main table instead.
+	RulePriority int
+	// Remap exposes cluster ranges colliding with local addresses and routes under substitute ranges, which the agent
+	// translates back
+	Remap bool
+	// RemapPool is the ranges substitutes are allocated from. If empty, remap.DefaultPool is used.
+	RemapPool []netip.Prefix
+	// DynamicRoutes routes only the ClusterIPs of Services and the addresses of EndpointSlices' endpoints as they come
+	// and go, rather than the cluster's ranges
+	DynamicRoutes bool
+	// RouteNamespaces limits DynamicRoutes to the Services and EndpointSlices in these namespaces. If empty, all
+	// namespaces are watched.
+	RouteNamespaces []string
+
+	// Command is a local command, and its arguments, run once the session is ready. The session ends when it exits.
+	Command []string
 
 	// Wireguard contains wireguard-specific configuration
 	Wireguard Wireguard
@@ -47,6 +110,10 @@ type Wireguard struct {
 	// LocalAddress represents the local endpoint address for wireguard
 	LocalAddress netip.AddrPort
 
+	// ListenPort is the port the local wireguard device listens on when no local address is set, chosen to not collide
+	// with other sessions on the local machine
+	ListenPort int
+
 	// OverlayPrefix is the prefix of the overlay network
 	OverlayPrefix netip.Prefix
 
@@ -56,8 +123,43 @@ type Wireguard struct {
 	// AgentOverlayAddress is the agent address inside the overlay network
 	AgentOverlayAddress netip.Addr
 
+	// IPv6OverlayPrefix is the prefix of the IPv6 overlay network, only set when the cluster has IPv6 addresses
+	IPv6OverlayPrefix netip.Prefix
+
+	// LocalIPv6OverlayAddress is the proxy address inside the IPv6 overlay network
+	LocalIPv6OverlayAddress netip.Addr
+
+	// AgentIPv6OverlayAddress is the agent address inside the IPv6 overlay network
+	AgentIPv6OverlayAddress netip.Addr
+
 	// AllowedIPs is the set of prefixes allowed to be routed through wireguard
 	AllowedIPs []netip.Prefix
+
+	// Remaps are the cluster ranges exposed locally under substitute ranges. The agent translates the substitutes back
+	// and rewrites DNS answers to them.
+	Remaps remap.Mappings
+}
+
+// LocalOverlayAddresses returns the proxy addresses inside the overlay networks of each family
+func (wg Wireguard) LocalOverlayAddresses() []netip.Addr {
+	return validAddrs(wg.LocalOverlayAddress, wg.LocalIPv6OverlayAddress)
+}
+
+// AgentOverlayAddresses returns the agent addresses inside the overlay networks of each family
+func (wg Wireguard) AgentOverlayAddresses() []netip.Addr {
+	return validAddrs(wg.AgentOverlayAddress, wg.AgentIPv6OverlayAddress)
+}
+
+func validAddrs(addrs ...netip.Addr) []netip.Addr {
+	var valid []netip.Addr
+
+	for _, addr := range addrs {
+		if addr.IsValid() {
+			valid = append(valid, addr)
+		}
+	}
+
+	return valid
 }
 
 type WireguardOption func(*Wireguard) error
@@ -101,6 +203,13 @@ func WithLocalAddress(address netip.AddrPort) WireguardOption {
 	}
 }
 
+func WithListenPort(listenPort int) WireguardOption {
+	return func(wg *Wireguard) error {
+		wg.ListenPort = listenPort
+		return nil
+	}
+}
+
 func WithDirectAccess(directAccess bool) WireguardOption {
 	return func(wg *Wireguard) error {
 		wg.DirectAccess = directAccess
@@ -126,6 +235,31 @@ func WithOverlay(overlay, localAddress, agentAddress string) WireguardOption {
 	}
 }
 
+func WithIPv6Overlay(overlay, localAddress, agentAddress string) WireguardOption {
+	return func(wg *Wireguard) (err error) {
+		wg.IPv6OverlayPrefix, err = netip.ParsePrefix(overlay)
+		if err != nil {
+			return
+		}
+
+		wg.LocalIPv6OverlayAddress, err = netip.ParseAddr(localAddress)
+		if err != nil {
+			return
+		}
+
+		wg.AgentIPv6OverlayAddress, err = netip.ParseAddr(agentAddress)
+
+		return
+	}
+}
+
+func WithRemaps(remaps remap.Mappings) WireguardOption {
+	return func(wg *Wireguard) error {
+		wg.Remaps = remaps
+		return nil
+	}
+}
+
 func WithAllowedIPs(allowedIPs ...string) WireguardOption {
 	return func(wg *Wireguard) error {
 		for _, allowedIP := range allowedIPs {
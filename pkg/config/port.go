@@ -0,0 +1,53 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// PortMapping maps a port of the target container to the local port connections to it are forwarded to
+type PortMapping struct {
+	Port      uint16
+	LocalPort uint16
+}
+
+// ParsePortMapping parses a mapping of the form `PORT[:LOCAL_PORT]`, e.g. `8080:3000`. Without a local port,
+// connections are forwarded to the same port locally.
+func ParsePortMapping(value string) (PortMapping, error) {
+	port, localPort, found := strings.Cut(value, ":")
+
+	parsedPort, err := parsePort(port)
+	if err != nil {
+		return PortMapping{}, fmt.Errorf("invalid port in %q: %w", value, err)
+	}
+
+	mapping := PortMapping{Port: parsedPort, LocalPort: parsedPort}
+
+	if found {
+		mapping.LocalPort, err = parsePort(localPort)
+		if err != nil {
+			return PortMapping{}, fmt.Errorf("invalid local port in %q: %w", value, err)
+		}
+	}
+
+	return mapping, nil
+}
+
+// String returns the mapping in the form parsed by ParsePortMapping
+func (p PortMapping) String() string {
+	return fmt.Sprintf("%d:%d", p.Port, p.LocalPort)
+}
+
+func parsePort(value string) (uint16, error) {
+	port, err := strconv.ParseUint(value, 10, 16)
+	if err != nil {
+		return 0, err
+	}
+
+	if port == 0 {
+		return 0, fmt.Errorf("port must be between 1 and 65535")
+	}
+
+	return uint16(port), nil
+}
@@ -0,0 +1,42 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePortMapping(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    PortMapping
+		wantErr string
+	}{
+		{name: "port", value: "8080", want: PortMapping{Port: 8080, LocalPort: 8080}},
+		{name: "local port", value: "8080:3000", want: PortMapping{Port: 8080, LocalPort: 3000}},
+		{name: "named port", value: "http", wantErr: `invalid port in "http"`},
+		{name: "out of range", value: "70000", wantErr: `invalid port in "70000"`},
+		{name: "zero", value: "0:3000", wantErr: `invalid port in "0:3000": port must be between 1 and 65535`},
+		{name: "missing local port", value: "8080:", wantErr: `invalid local port in "8080:"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParsePortMapping(tt.value)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+
+			if assert.NoError(t, err) {
+				assert.Equal(t, tt.want, got)
+
+				// The string form parses back to the same mapping
+				parsed, err := ParsePortMapping(got.String())
+				assert.NoError(t, err)
+				assert.Equal(t, got, parsed)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var kubeVersion = regexp.MustCompile(`^v[0-9]+((alpha|beta)[0-9]+)?$`)
+
+// UnstructuredTarget describes where the agent finds the parts of a custom workload type it modifies, e.g. an Argo
+// Rollout. Paths are dot-separated field paths such as spec.template.
+type UnstructuredTarget struct {
+	// GroupVersionKind is the type of workload. An empty version matches all versions.
+	GroupVersionKind schema.GroupVersionKind
+
+	// TemplatePath is the path to the workload's pod template
+	TemplatePath string
+	// SelectorPath is the path to the label selector of the workload's pods. If empty, the pod template's labels are
+	// used instead.
+	SelectorPath string
+	// ReplicasPath is the path to the workload's replica count. If empty, the workload isn't scaled.
+	ReplicasPath string
+}
+
+// Matches returns whether the target describes workloads of the given type
+func (t UnstructuredTarget) Matches(gvk schema.GroupVersionKind) bool {
+	return t.GroupVersionKind.GroupKind() == gvk.GroupKind() && (t.GroupVersionKind.Version == "" || t.GroupVersionKind.Version == gvk.Version)
+}
+
+// ParseUnstructuredTarget parses a target of the form `KIND[.VERSION].GROUP:template=PATH[,selector=PATH][,replicas=PATH]`,
+// e.g. `Rollout.argoproj.io:template=spec.template,selector=spec.selector,replicas=spec.replicas`. Paths may also be
+// given as JSONPath expressions such as `{.spec.template}`.
+func ParseUnstructuredTarget(value string) (UnstructuredTarget, error) {
+	var target UnstructuredTarget
+
+	kind, paths, found := strings.Cut(value, ":")
+	if !found {
+		return target, fmt.Errorf("expected KIND.GROUP:template=PATH, got %q", value)
+	}
+
+	kind, group, _ := strings.Cut(kind, ".")
+	if kind == "" {
+		return target, fmt.Errorf("missing kind in %q", value)
+	}
+
+	// Unlike a group, a version has no dots so it's only present if it looks like one
+	version := ""
+	if v, rest, found := strings.Cut(group, "."); found && kubeVersion.MatchString(v) {
+		version, group = v, rest
+	}
+
+	target.GroupVersionKind = schema.GroupVersionKind{Group: group, Version: version, Kind: kind}
+
+	for _, field := range strings.Split(paths, ",") {
+		name, path, found := strings.Cut(field, "=")
+		if !found {
+			return target, fmt.Errorf("expected NAME=PATH, got %q", field)
+		}
+
+		path = strings.TrimPrefix(strings.TrimSuffix(strings.TrimPrefix(path, "{"), "}"), ".")
+
+		switch name {
+		case "template":
+			target.TemplatePath = path
+		case "selector":
+			target.SelectorPath = path
+		case "replicas":
+			target.ReplicasPath = path
+		default:
+			return target, fmt.Errorf("unknown path %q, expected one of template, selector or replicas", name)
+		}
+	}
+
+	if target.TemplatePath == "" {
+		return target, fmt.Errorf("missing template path in %q", value)
+	}
+
+	return target, nil
+}
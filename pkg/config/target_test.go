@@ -0,0 +1,74 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestParseUnstructuredTarget(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    UnstructuredTarget
+		wantErr string
+	}{
+		{
+			name:  "all paths",
+			value: "Rollout.argoproj.io:template=spec.template,selector=spec.selector,replicas=spec.replicas",
+			want: UnstructuredTarget{
+				GroupVersionKind: schema.GroupVersionKind{Group: "argoproj.io", Kind: "Rollout"},
+				TemplatePath:     "spec.template",
+				SelectorPath:     "spec.selector",
+				ReplicasPath:     "spec.replicas",
+			},
+		},
+		{
+			name:  "version and jsonpath",
+			value: "CloneSet.v1alpha1.apps.kruise.io:template={.spec.template}",
+			want: UnstructuredTarget{
+				GroupVersionKind: schema.GroupVersionKind{Group: "apps.kruise.io", Version: "v1alpha1", Kind: "CloneSet"},
+				TemplatePath:     "spec.template",
+			},
+		},
+		{
+			name:    "no paths",
+			value:   "Rollout.argoproj.io",
+			wantErr: "expected KIND.GROUP:template=PATH",
+		},
+		{
+			name:    "no template",
+			value:   "Rollout.argoproj.io:replicas=spec.replicas",
+			wantErr: "missing template path",
+		},
+		{
+			name:    "unknown path",
+			value:   "Rollout.argoproj.io:template=spec.template,pods=spec.pods",
+			wantErr: `unknown path "pods"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseUnstructuredTarget(tt.value)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+
+			if assert.NoError(t, err) {
+				assert.Equal(t, tt.want, got)
+			}
+		})
+	}
+}
+
+func TestUnstructuredTargetMatches(t *testing.T) {
+	rollout := schema.GroupVersionKind{Group: "argoproj.io", Version: "v1alpha1", Kind: "Rollout"}
+
+	assert.True(t, UnstructuredTarget{GroupVersionKind: rollout.GroupKind().WithVersion("")}.Matches(rollout))
+	assert.True(t, UnstructuredTarget{GroupVersionKind: rollout}.Matches(rollout))
+	assert.False(t, UnstructuredTarget{GroupVersionKind: rollout.GroupKind().WithVersion("v1")}.Matches(rollout))
+	assert.False(t, UnstructuredTarget{GroupVersionKind: schema.GroupVersionKind{Group: "apps", Kind: "Rollout"}}.Matches(rollout))
+}
@@ -0,0 +1,362 @@
+package doctor
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/steved/kubewire/pkg/agent"
+	"github.com/steved/kubewire/pkg/config"
+	"github.com/steved/kubewire/pkg/proxy"
+)
+
+type Status string
+
+const (
+	StatusPass Status = "PASS"
+	StatusWarn Status = "WARN"
+	StatusFail Status = "FAIL"
+)
+
+// Result is the outcome of a single check, along with a hint for remediating it when it didn't pass
+type Result struct {
+	Name    string
+	Status  Status
+	Message string
+	Hint    string
+}
+
+// Check verifies a single precondition for starting a session
+type Check func(ctx context.Context) Result
+
+// Options configure the cluster checks
+type Options struct {
+	// Namespace is the namespace the agent runs in
+	Namespace string
+	// Target is the target object, if any. Without one, permissions for `connect` are checked instead.
+	Target runtime.Object
+	// AgentImage is the container image reference used for the agent
+	AgentImage string
+	// OverlayPrefixes are the overlay prefixes passed to proxy, if any
+	OverlayPrefixes []string
+	// OverlayPool is the ranges overlays are allocated from, if not the default
+	OverlayPool []netip.Prefix
+	// Ordinal is the ordinal of the single pod running the agent when the target is a StatefulSet, if any
+	Ordinal *int32
+	// Copy is whether the agent runs in a copy of the target rather than the target itself
+	Copy bool
+}
+
+// permission is a set of verbs on a resource the agent needs
+type permission struct {
+	namespace   string
+	group       string
+	resource    string
+	subresource string
+	verbs       []string
+	hint        string
+	// optional permissions aren't needed for a session, but save the agent discovering the cluster's details
+	optional bool
+}
+
+// interfaceAddrs returns the addresses of local interfaces, overridden in tests
+var interfaceAddrs = net.InterfaceAddrs
+
+// Run runs the checks in order, returning their results
+func Run(ctx context.Context, checks []Check) []Result {
+	results := make([]Result, 0, len(checks))
+
+	for _, check := range checks {
+		results = append(results, check(ctx))
+	}
+
+	return results
+}
+
+// LocalChecks returns checks of the local machine
+func LocalChecks() []Check {
+	return localChecks()
+}
+
+// ClientCheck reports a failure to create a Kubernetes client, in which case no cluster checks can run
+func ClientCheck(err error) Check {
+	return func(_ context.Context) Result {
+		return Result{Name: "Kubernetes client", Status: StatusFail, Message: err.Error(), Hint: "Check the kubeconfig passed with --kubeconfig or KUBECONFIG"}
+	}
+}
+
+// TargetCheck reports whether the target object was found
+func TargetCheck(target runtime.Object, err error) Check {
+	return func(_ context.Context) Result {
+		if err != nil {
+			return Result{Name: "Target", Status: StatusFail, Message: err.Error(), Hint: "Check the target's kind, name and namespace"}
+		}
+
+		name, _ := meta.NewAccessor().Name(target)
+
+		return Result{Name: "Target", Status: StatusPass, Message: agent.TargetKind(target) + "/" + name}
+	}
+}
+
+// ClusterChecks returns checks of the cluster permissions and configuration needed for a session
+func ClusterChecks(client kubernetes.Interface, opts Options) []Check {
+	var checks []Check
+
+	for _, p := range permissions(opts) {
+		checks = append(checks, permissionCheck(client, p))
+	}
+
+	return append(checks, overlayCheck(client, opts), agentImageCheck(client, opts))
+}
+
+func permissions(opts Options) []permission {
+	namespace := opts.Namespace
+
+	roleHint := func(verbs []string, resource string) string {
+		return fmt.Sprintf("Ask a cluster administrator for a Role granting %s on %s in namespace %q", strings.Join(verbs, ", "), resource, namespace)
+	}
+
+	workload := func(group, resource string, verbs ...string) permission {
+		return permission{namespace: namespace, group: group, resource: resource, verbs: verbs, hint: roleHint(verbs, resource)}
+	}
+
+	// Without a target, check what `connect` needs to create its own deployment, which a copy of the target needs too
+	deployments := workload("apps", "deployments", "get", "create", "update", "delete")
+
+	var workloads []permission
+
+	kind := agent.TargetKind(opts.Target)
+	if kind == "unknown" {
+		workloads = append(workloads, deployments)
+	} else {
+		group, resource := targetResource(opts.Target)
+
+		switch {
+		case opts.Copy:
+			// The target is only read to copy it
+			if group != deployments.group || resource != deployments.resource {
+				workloads = append(workloads, workload(group, resource, "get"))
+			}
+
+			workloads = append(workloads, deployments)
+		case kind == "daemonset":
+			// The agent runs in a pod created alongside the daemonset
+			workloads = append(workloads, workload(group, resource, "get", "update"), workload("", "pods", "get", "create", "delete"))
+		case kind == "statefulset" && opts.Ordinal != nil:
+			// The ordinal's pod is deleted to be recreated running the agent
+			workloads = append(workloads, workload(group, resource, "get", "update"), workload("", "pods", "get", "delete"))
+		case kind == "pod":
+			// Pods are recreated rather than updated
+			workloads = append(workloads, workload(group, resource, "get", "create", "delete"))
+		default:
+			workloads = append(workloads, workload(group, resource, "get", "update"))
+		}
+	}
+
+	permissions := []permission{
+		{namespace: namespace, resource: "secrets", verbs: []string{"get", "patch", "delete"}},
+		{namespace: namespace, resource: "services", verbs: []string{"get", "list", "watch", "patch", "delete"}},
+		{namespace: namespace, group: "networking.k8s.io", resource: "networkpolicies", verbs: []string{"get", "patch", "delete"}},
+		{namespace: namespace, resource: "pods", verbs: []string{"list", "watch"}},
+		{namespace: namespace, resource: "pods", subresource: "exec", verbs: []string{"create"}},
+	}
+
+	for i, p := range permissions {
+		resource := p.resource
+		if p.subresource != "" {
+			resource += "/" + p.subresource
+		}
+
+		permissions[i].hint = roleHint(p.verbs, resource)
+	}
+
+	return append(
+		append(workloads, permissions...),
+		permission{
+			namespace: "kube-system",
+			resource:  "services",
+			verbs:     []string{"get"},
+			hint:      `The agent will discover the DNS service and service CIDRs instead. Ask a cluster administrator to grant get on the "kube-dns" service in namespace "kube-system", or pass --service-cidr, to skip discovery`,
+			optional:  true,
+		},
+		permission{
+			resource: "nodes",
+			verbs:    []string{"list"},
+			hint:     "Node CIDRs are resolved from the addresses of the namespace's pods' nodes instead. Ask a cluster administrator for a ClusterRole granting list on nodes, or pass --node-cidr, to route all nodes",
+			optional: true,
+		},
+	)
+}
+
+// targetResource returns the API group and resource of the target object, guessed from its kind for custom workloads,
+// e.g. Argo Rollouts
+func targetResource(target runtime.Object) (string, string) {
+	switch kind := agent.TargetKind(target); kind {
+	case "deployment", "statefulset", "replicaset", "daemonset":
+		return "apps", kind + "s"
+	case "pod":
+		return "", "pods"
+	default:
+		resource, _ := meta.UnsafeGuessKindToResource(target.GetObjectKind().GroupVersionKind())
+
+		return resource.Group, resource.Resource
+	}
+}
+
+func permissionCheck(client kubernetes.Interface, p permission) Check {
+	return func(ctx context.Context) Result {
+		resource := p.resource
+		if p.subresource != "" {
+			resource += "/" + p.subresource
+		}
+
+		name := "RBAC " + resource
+		if p.namespace != "" {
+			name += " (" + p.namespace + ")"
+		}
+
+		var denied []string
+
+		for _, verb := range p.verbs {
+			review := &authorizationv1.SelfSubjectAccessReview{
+				Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+					ResourceAttributes: &authorizationv1.ResourceAttributes{
+						Namespace:   p.namespace,
+						Verb:        verb,
+						Group:       p.group,
+						Resource:    p.resource,
+						Subresource: p.subresource,
+					},
+				},
+			}
+
+			review, err := client.AuthorizationV1().SelfSubjectAccessReviews().Create(ctx, review, v1.CreateOptions{})
+			if err != nil {
+				return Result{Name: name, Status: StatusFail, Message: fmt.Sprintf("unable to review access: %s", err), Hint: "Check the kubeconfig and that the cluster is reachable"}
+			}
+
+			if !review.Status.Allowed {
+				denied = append(denied, verb)
+			}
+		}
+
+		if len(denied) > 0 {
+			status := StatusFail
+			if p.optional {
+				status = StatusWarn
+			}
+
+			return Result{Name: name, Status: status, Message: "denied: " + strings.Join(denied, ", "), Hint: p.hint}
+		}
+
+		return Result{Name: name, Status: StatusPass, Message: strings.Join(p.verbs, ", ")}
+	}
+}
+
+// overlayCheck verifies an overlay range can be allocated, or that the given one doesn't conflict with the cluster or
+// local addresses
+func overlayCheck(client kubernetes.Interface, opts Options) Check {
+	return func(ctx context.Context) Result {
+		name := "Overlay range"
+
+		cfg := config.NewConfig()
+		cfg.Namespace = opts.Namespace
+		cfg.OverlayPool = opts.OverlayPool
+
+		if err := proxy.ResolveWireguardConfig(ctx, cfg, client, opts.OverlayPrefixes, false); err != nil {
+			return Result{Name: name, Status: StatusFail, Message: err.Error(), Hint: "Pass --overlay-pool or --overlay with a range that's unused locally and in the cluster"}
+		}
+
+		overlays := []netip.Prefix{cfg.Wireguard.OverlayPrefix}
+		if cfg.Wireguard.IPv6OverlayPrefix.IsValid() {
+			overlays = append(overlays, cfg.Wireguard.IPv6OverlayPrefix)
+		}
+
+		addrs, err := interfaceAddrs()
+		if err != nil {
+			return Result{Name: name, Status: StatusWarn, Message: fmt.Sprintf("unable to list local addresses: %s", err)}
+		}
+
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+
+			ip, ok := netip.AddrFromSlice(ipNet.IP)
+			if !ok {
+				continue
+			}
+
+			ones, _ := ipNet.Mask.Size()
+			local := netip.PrefixFrom(ip.Unmap(), ones)
+
+			for _, overlay := range overlays {
+				if local.Overlaps(overlay) {
+					return Result{
+						Name:    name,
+						Status:  StatusFail,
+						Message: fmt.Sprintf("%s overlaps local network %s", overlay, local.Masked()),
+						Hint:    "Pass --overlay with a range that's unused locally and in the cluster",
+					}
+				}
+			}
+		}
+
+		overlayStrings := make([]string, len(overlays))
+		for i, overlay := range overlays {
+			overlayStrings[i] = overlay.String()
+		}
+
+		return Result{Name: name, Status: StatusPass, Message: strings.Join(overlayStrings, ", ")}
+	}
+}
+
+// agentImageCheck looks for pods which previously failed to pull the agent image
+func agentImageCheck(client kubernetes.Interface, opts Options) Check {
+	return func(ctx context.Context) Result {
+		name := "Agent image"
+		hint := "Mirror the agent image to a registry the cluster can pull from and pass --agent-image"
+
+		pods, err := client.CoreV1().Pods(opts.Namespace).List(ctx, v1.ListOptions{})
+		if err != nil {
+			return Result{Name: name, Status: StatusWarn, Message: fmt.Sprintf("unable to list pods: %s", err), Hint: hint}
+		}
+
+		for _, pod := range pods.Items {
+			for _, status := range pod.Status.ContainerStatuses {
+				if status.Image != opts.AgentImage || status.State.Waiting == nil {
+					continue
+				}
+
+				if reason := status.State.Waiting.Reason; reason == "ErrImagePull" || reason == "ImagePullBackOff" {
+					return Result{
+						Name:    name,
+						Status:  StatusFail,
+						Message: fmt.Sprintf("pod %s failed to pull %s: %s", pod.Name, opts.AgentImage, status.State.Waiting.Message),
+						Hint:    hint,
+					}
+				}
+			}
+		}
+
+		if strings.HasSuffix(opts.AgentImage, ":latest") {
+			return Result{
+				Name:    name,
+				Status:  StatusWarn,
+				Message: opts.AgentImage,
+				Hint:    "The latest agent image may not match this version of kw; pass --agent-image to pin a release",
+			}
+		}
+
+		return Result{Name: name, Status: StatusPass, Message: opts.AgentImage}
+	}
+}
@@ -0,0 +1,27 @@
+//go:build darwin
+
+package doctor
+
+import (
+	"context"
+	"os"
+)
+
+func localChecks() []Check {
+	return []Check{privilegesCheck, wireguardCheck}
+}
+
+func privilegesCheck(_ context.Context) Result {
+	name := "Privileges"
+
+	if os.Geteuid() != 0 {
+		return Result{Name: name, Status: StatusFail, Message: "not running as root", Hint: "Run kw with sudo -E"}
+	}
+
+	return Result{Name: name, Status: StatusPass, Message: "running as root"}
+}
+
+func wireguardCheck(_ context.Context) Result {
+	// WireGuard runs in userspace on a utun device which is always assigned a free name
+	return Result{Name: "WireGuard device", Status: StatusPass, Message: "userspace utun device"}
+}
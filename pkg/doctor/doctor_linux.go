@@ -0,0 +1,129 @@
+//go:build linux
+
+package doctor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"github.com/godbus/dbus/v5"
+	"golang.org/x/sys/unix"
+
+	"github.com/steved/kubewire/pkg/wg"
+)
+
+const capNetAdmin = 12
+
+func localChecks() []Check {
+	return []Check{privilegesCheck, wireguardModuleCheck, resolvedCheck, deviceNameCheck}
+}
+
+func privilegesCheck(_ context.Context) Result {
+	name := "Privileges"
+	hint := "Run kw with sudo -E, or grant it CAP_NET_ADMIN"
+
+	if os.Geteuid() == 0 {
+		return Result{Name: name, Status: StatusPass, Message: "running as root"}
+	}
+
+	capabilities, err := effectiveCapabilities()
+	if err != nil {
+		return Result{Name: name, Status: StatusFail, Message: fmt.Sprintf("not root and unable to read capabilities: %s", err), Hint: hint}
+	}
+
+	if capabilities&(1<<capNetAdmin) == 0 {
+		return Result{Name: name, Status: StatusFail, Message: "not root and missing CAP_NET_ADMIN", Hint: hint}
+	}
+
+	return Result{Name: name, Status: StatusPass, Message: "CAP_NET_ADMIN"}
+}
+
+// effectiveCapabilities returns the effective capability set of the current process
+func effectiveCapabilities() (uint64, error) {
+	status, err := os.ReadFile("/proc/self/status")
+	if err != nil {
+		return 0, err
+	}
+
+	for _, line := range strings.Split(string(status), "\n") {
+		if value, ok := strings.CutPrefix(line, "CapEff:"); ok {
+			return strconv.ParseUint(strings.TrimSpace(value), 16, 64)
+		}
+	}
+
+	return 0, errors.New("no CapEff entry in /proc/self/status")
+}
+
+func wireguardModuleCheck(_ context.Context) Result {
+	name := "WireGuard kernel module"
+
+	if _, err := os.Stat("/sys/module/wireguard"); err == nil {
+		return Result{Name: name, Status: StatusPass, Message: "loaded"}
+	}
+
+	var uname unix.Utsname
+	if err := unix.Uname(&uname); err != nil {
+		return Result{Name: name, Status: StatusWarn, Message: fmt.Sprintf("not loaded and unable to determine kernel release: %s", err), Hint: "Load it with modprobe wireguard"}
+	}
+
+	release := unix.ByteSliceToString(uname.Release[:])
+
+	for _, file := range []string{"modules.builtin", "modules.dep"} {
+		contents, err := os.ReadFile(filepath.Join("/lib/modules", release, file))
+		if err == nil && strings.Contains(string(contents), "/wireguard.ko") {
+			return Result{Name: name, Status: StatusPass, Message: "available, loaded on demand"}
+		}
+	}
+
+	return Result{
+		Name:    name,
+		Status:  StatusFail,
+		Message: fmt.Sprintf("not found for kernel %s", release),
+		Hint:    "Install the wireguard kernel module, included with Linux 5.6 and later, and load it with modprobe wireguard",
+	}
+}
+
+func resolvedCheck(ctx context.Context) Result {
+	name := "systemd-resolved"
+	hint := "DNS for cluster names is configured through systemd-resolved; start it with systemctl enable --now systemd-resolved"
+
+	conn, err := dbus.ConnectSystemBus()
+	if err != nil {
+		return Result{Name: name, Status: StatusFail, Message: fmt.Sprintf("unable to connect to the system D-Bus: %s", err), Hint: hint}
+	}
+
+	defer func() {
+		if err := conn.Close(); err != nil {
+			logr.FromContextOrDiscard(ctx).Error(err, "unable to close dbus client")
+		}
+	}()
+
+	err = conn.Object("org.freedesktop.resolve1", "/org/freedesktop/resolve1").CallWithContext(ctx, "org.freedesktop.DBus.Peer.Ping", 0).Err
+	if err != nil {
+		return Result{Name: name, Status: StatusFail, Message: fmt.Sprintf("unreachable over D-Bus: %s", err), Hint: hint}
+	}
+
+	return Result{Name: name, Status: StatusPass, Message: "reachable over D-Bus"}
+}
+
+func deviceNameCheck(_ context.Context) Result {
+	name := "WireGuard device"
+
+	deviceName, ok := wg.FreeDeviceName()
+	if !ok {
+		return Result{
+			Name:    name,
+			Status:  StatusFail,
+			Message: fmt.Sprintf("%s0 to %s%d already exist", wg.DeviceNamePrefix, wg.DeviceNamePrefix, wg.MaxDevices-1),
+			Hint:    "Other sessions may be running; otherwise remove unused devices with ip link delete",
+		}
+	}
+
+	return Result{Name: name, Status: StatusPass, Message: fmt.Sprintf("%s is free", deviceName)}
+}
@@ -0,0 +1,133 @@
+package doctor
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/utils/ptr"
+)
+
+func TestClusterChecks(t *testing.T) {
+	namespace := "test-namespace"
+	agentImage := "ghcr.io/steved/kubewire:v1.0.0"
+
+	client := fake.NewClientset(
+		&corev1.Pod{
+			ObjectMeta: v1.ObjectMeta{Name: "pod", Namespace: namespace},
+			Status:     corev1.PodStatus{PodIP: "10.0.0.5"},
+		},
+		&corev1.Pod{
+			ObjectMeta: v1.ObjectMeta{Name: "agent", Namespace: namespace},
+			Status: corev1.PodStatus{
+				ContainerStatuses: []corev1.ContainerStatus{{
+					Image: "registry.example.com/kubewire:v1.0.0",
+					State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "ImagePullBackOff", Message: "Back-off pulling image"}},
+				}},
+			},
+		},
+		&corev1.Service{
+			ObjectMeta: v1.ObjectMeta{Name: "kube-dns", Namespace: "kube-system"},
+			Spec:       corev1.ServiceSpec{ClusterIP: "172.20.0.10"},
+		},
+		&corev1.Node{
+			Status: corev1.NodeStatus{Addresses: []corev1.NodeAddress{{Type: corev1.NodeInternalIP, Address: "192.168.1.10"}}},
+		},
+	)
+
+	// Deny listing nodes and exec'ing into pods
+	client.PrependReactor("create", "selfsubjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview)
+		attributes := review.Spec.ResourceAttributes
+		review.Status.Allowed = attributes.Resource != "nodes" && attributes.Subresource != "exec"
+
+		return true, review, nil
+	})
+
+	interfaceAddrs = func() ([]net.Addr, error) {
+		return []net.Addr{&net.IPNet{IP: net.IPv4(127, 0, 0, 1), Mask: net.CIDRMask(8, 32)}}, nil
+	}
+
+	results := func(opts Options) map[string]Result {
+		byName := make(map[string]Result)
+		for _, result := range Run(context.Background(), ClusterChecks(client, opts)) {
+			byName[result.Name] = result
+		}
+
+		return byName
+	}
+
+	t.Run("without target", func(t *testing.T) {
+		byName := results(Options{Namespace: namespace, AgentImage: agentImage})
+
+		assert.Equal(t, Result{Name: "RBAC deployments (test-namespace)", Status: StatusPass, Message: "get, create, update, delete"}, byName["RBAC deployments (test-namespace)"])
+		assert.Equal(t, StatusPass, byName["RBAC secrets (test-namespace)"].Status)
+		assert.Equal(t, StatusPass, byName["RBAC services (kube-system)"].Status)
+		assert.Equal(t, Result{Name: "RBAC pods/exec (test-namespace)", Status: StatusFail, Message: "denied: create", Hint: `Ask a cluster administrator for a Role granting create on pods/exec in namespace "test-namespace"`}, byName["RBAC pods/exec (test-namespace)"])
+		assert.Equal(t, StatusWarn, byName["RBAC nodes"].Status)
+		assert.Contains(t, byName["RBAC nodes"].Hint, "--node-cidr")
+		assert.Equal(t, Result{Name: "Overlay range", Status: StatusPass, Message: "10.1.0.0/28"}, byName["Overlay range"])
+		assert.Equal(t, Result{Name: "Agent image", Status: StatusPass, Message: agentImage}, byName["Agent image"])
+	})
+
+	t.Run("with target", func(t *testing.T) {
+		byName := results(Options{Namespace: namespace, AgentImage: agentImage, Target: &appsv1.StatefulSet{}})
+
+		assert.NotContains(t, byName, "RBAC deployments (test-namespace)")
+		assert.Equal(t, Result{Name: "RBAC statefulsets (test-namespace)", Status: StatusPass, Message: "get, update"}, byName["RBAC statefulsets (test-namespace)"])
+	})
+
+	t.Run("with ordinal", func(t *testing.T) {
+		checked := checkedPermissions(Options{Namespace: namespace, Target: &appsv1.StatefulSet{}, Ordinal: ptr.To(int32(2))})
+
+		assert.Contains(t, checked, "statefulsets: get, update")
+		assert.Contains(t, checked, "pods: get, delete")
+	})
+
+	t.Run("with copy", func(t *testing.T) {
+		checked := checkedPermissions(Options{Namespace: namespace, Target: &appsv1.StatefulSet{}, Copy: true})
+
+		assert.Contains(t, checked, "statefulsets: get")
+		assert.NotContains(t, checked, "statefulsets: get, update")
+		assert.Contains(t, checked, "deployments: get, create, update, delete")
+	})
+
+	t.Run("overlapping local network", func(t *testing.T) {
+		interfaceAddrs = func() ([]net.Addr, error) {
+			return []net.Addr{&net.IPNet{IP: net.IPv4(10, 1, 2, 3), Mask: net.CIDRMask(16, 32)}}, nil
+		}
+
+		// Allocated overlays avoid local networks, given ones don't
+		result := results(Options{Namespace: namespace, AgentImage: agentImage, OverlayPrefixes: []string{"10.1.0.0/28"}})["Overlay range"]
+
+		assert.Equal(t, StatusFail, result.Status)
+		assert.Equal(t, "10.1.0.0/28 overlaps local network 10.1.0.0/16", result.Message)
+	})
+
+	t.Run("agent image pull failure", func(t *testing.T) {
+		result := results(Options{Namespace: namespace, AgentImage: "registry.example.com/kubewire:v1.0.0"})["Agent image"]
+
+		assert.Equal(t, StatusFail, result.Status)
+		assert.Equal(t, "pod agent failed to pull registry.example.com/kubewire:v1.0.0: Back-off pulling image", result.Message)
+	})
+}
+
+// checkedPermissions returns the resources and verbs of the permissions checked for the options
+func checkedPermissions(opts Options) []string {
+	var checked []string
+
+	for _, p := range permissions(opts) {
+		checked = append(checked, p.resource+": "+strings.Join(p.verbs, ", "))
+	}
+
+	return checked
+}
@@ -0,0 +1,369 @@
+package journal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/go-logr/logr"
+	"golang.org/x/sys/unix"
+)
+
+// DefaultPath is the directory journals are kept in. It persists across reboots, as some changes, such as resolver
+// configuration on macOS, do too.
+const DefaultPath = "/var/lib/kubewire/journal"
+
+// Kind is the kind of a local change
+type Kind string
+
+const (
+	// KindLink is a network device created for the session
+	KindLink Kind = "link"
+	// KindRoute is a route to Prefix through Device in Table
+	KindRoute Kind = "route"
+	// KindRule is a rule looking up Table at Priority for IPv4, or IPv6, packets without the table's firewall mark
+	KindRule Kind = "rule"
+	// KindLinkDNS is DNS configuration set for Device with systemd-resolved
+	KindLinkDNS Kind = "link-dns"
+	// KindResolver is a resolver configuration file written to Path
+	KindResolver Kind = "resolver"
+	// KindSearchDomains is mDNSResponder's AlwaysAppendSearchDomains preference being enabled
+	KindSearchDomains Kind = "search-domains"
+)
+
+// Change is a change made to the local machine's network configuration, which is rolled back if the session making it
+// doesn't exit cleanly
+type Change struct {
+	Kind     Kind         `json:"kind"`
+	Device   string       `json:"device,omitempty"`
+	Prefix   netip.Prefix `json:"prefix"`
+	Table    int          `json:"table,omitempty"`
+	Priority int          `json:"priority,omitempty"`
+	IPv6     bool         `json:"ipv6,omitempty"`
+	Path     string       `json:"path,omitempty"`
+}
+
+// Journal records the local changes of a session as they're made. The session holds a lock on the journal for as
+// long as it runs, so that journals of sessions which died can be told apart from those of running sessions even
+// after a reboot or their process ID being reused.
+type Journal struct {
+	path string
+	lock *os.File
+
+	mu      sync.Mutex
+	changes []Change
+}
+
+// Open creates the journal of the current process in dir
+func Open(dir string) (*Journal, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("unable to create %s: %w", dir, err)
+	}
+
+	path := filepath.Join(dir, strconv.Itoa(os.Getpid())+".json")
+
+	lock, err := os.OpenFile(lockPath(path), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open %s: %w", lockPath(path), err)
+	}
+
+	if err := unix.Flock(int(lock.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		return nil, errors.Join(fmt.Errorf("unable to lock %s: %w", lockPath(path), err), lock.Close())
+	}
+
+	j := &Journal{path: path, lock: lock}
+
+	if err := j.write(); err != nil {
+		return nil, errors.Join(err, lock.Close())
+	}
+
+	return j, nil
+}
+
+// Record appends a change to the journal. Changes are recorded before being made where possible, so that a session
+// dying partway through making one still has it rolled back. A nil journal records nothing.
+func (j *Journal) Record(change Change) error {
+	if j == nil {
+		return nil
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.changes = append(j.changes, change)
+
+	return j.write()
+}
+
+// Forget removes a change from the journal once it's been undone, so that journals of long-running sessions don't grow
+// with changes made and undone repeatedly. A nil journal forgets nothing.
+func (j *Journal) Forget(change Change) error {
+	if j == nil {
+		return nil
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	i := slices.Index(j.changes, change)
+	if i < 0 {
+		return nil
+	}
+
+	j.changes = slices.Delete(j.changes, i, i+1)
+
+	return j.write()
+}
+
+// Close rolls back the changes the session didn't undo and forget itself, e.g. as it failed partway through making
+// them, then removes the journal. Changes which can't be rolled back are left in the journal, for the next session or
+// kw cleanup --local to recover.
+func (j *Journal) Close(ctx context.Context) error {
+	if j == nil {
+		return nil
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if len(j.changes) > 0 {
+		logr.FromContextOrDiscard(ctx).Info("Rolling back local changes which weren't undone", "journal", j.path, "changes", len(j.changes))
+
+		if err := j.rollback(ctx); err != nil {
+			return errors.Join(fmt.Errorf("unable to roll back %s, run kw cleanup --local: %w", j.path, err), j.lock.Close())
+		}
+	}
+
+	return errors.Join(removeJournal(j.path), j.lock.Close())
+}
+
+// rollback undoes the journal's changes, except those to devices and files since used by other running sessions
+func (j *Journal) rollback(ctx context.Context) error {
+	_, running, err := findJournals(filepath.Dir(j.path), j.path)
+	if err != nil {
+		return err
+	}
+
+	var changes []Change
+
+	for _, change := range j.changes {
+		if !inUse(change, running) {
+			changes = append(changes, change)
+		}
+	}
+
+	if err := rollback(ctx, changes); err != nil {
+		return err
+	}
+
+	j.changes = nil
+
+	return j.write()
+}
+
+func (j *Journal) write() error {
+	contents, err := json.MarshalIndent(j.changes, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to encode journal: %w", err)
+	}
+
+	// Write atomically so that the journal is never partial
+	tmp := j.path + ".tmp"
+
+	if err := os.WriteFile(tmp, contents, 0o644); err != nil {
+		return fmt.Errorf("unable to write %s: %w", tmp, err)
+	}
+
+	if err := os.Rename(tmp, j.path); err != nil {
+		return fmt.Errorf("unable to write %s: %w", j.path, err)
+	}
+
+	return nil
+}
+
+type contextKey struct{}
+
+// NewContext returns a context carrying the journal, which changes made with it are recorded to
+func NewContext(ctx context.Context, j *Journal) context.Context {
+	return context.WithValue(ctx, contextKey{}, j)
+}
+
+// FromContext returns the journal of the context, or nil, which records nothing, if there's none
+func FromContext(ctx context.Context) *Journal {
+	j, _ := ctx.Value(contextKey{}).(*Journal)
+	return j
+}
+
+// Stale is the journal of a session which died without rolling back its changes
+type Stale struct {
+	Path    string
+	Changes []Change
+}
+
+// FindStale returns the journals in dir of sessions which are no longer running, and the changes of those which are
+func FindStale(dir string) ([]Stale, []Change, error) {
+	return findJournals(dir, "")
+}
+
+// findJournals returns the journals in dir of sessions which are no longer running, and the changes of those which are,
+// ignoring the journal at the path excluded
+func findJournals(dir, excluded string) ([]Stale, []Change, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, fmt.Errorf("unable to read %s: %w", dir, err)
+	}
+
+	var (
+		stale   []Stale
+		running []Change
+	)
+
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+
+		path := filepath.Join(dir, entry.Name())
+		if path == excluded {
+			continue
+		}
+
+		changes, err := readJournal(path)
+		if errors.Is(err, os.ErrNotExist) {
+			// Removed by its session exiting meanwhile
+			continue
+		} else if err != nil {
+			return nil, nil, err
+		}
+
+		alive, err := locked(path)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if alive {
+			running = append(running, changes...)
+		} else {
+			stale = append(stale, Stale{Path: path, Changes: changes})
+		}
+	}
+
+	return stale, running, nil
+}
+
+// Recover rolls back the changes of sessions which died without doing so themselves, removing their journals. Changes
+// to devices and files still used by running sessions are left alone.
+func Recover(ctx context.Context, dir string) ([]Stale, error) {
+	log := logr.FromContextOrDiscard(ctx)
+
+	stale, running, err := FindStale(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []error
+
+	for _, s := range stale {
+		log.Info("Rolling back local changes of a session which didn't exit cleanly", "journal", s.Path, "changes", len(s.Changes))
+
+		var changes []Change
+
+		for _, change := range s.Changes {
+			if !inUse(change, running) {
+				changes = append(changes, change)
+			}
+		}
+
+		if err := rollback(ctx, changes); err != nil {
+			errs = append(errs, fmt.Errorf("unable to roll back %s: %w", s.Path, err))
+			continue
+		}
+
+		if err := removeJournal(s.Path); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return stale, errors.Join(errs...)
+}
+
+// inUse returns whether a stale change's device, file or routing table has since been taken by a running session, e.g.
+// as a device with the same name was created after the stale one was deleted by hand
+func inUse(change Change, running []Change) bool {
+	return slices.ContainsFunc(running, func(other Change) bool {
+		switch {
+		case change.Device != "" && other.Device == change.Device:
+			return true
+		case change.Path != "" && other.Path == change.Path:
+			return true
+		case change.Kind == KindSearchDomains && other.Kind == KindSearchDomains:
+			return true
+		case change.Kind == KindRule && other.Kind == KindRule && other.Table == change.Table:
+			return true
+		default:
+			return false
+		}
+	})
+}
+
+func readJournal(path string) ([]Change, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []Change
+	if err := json.Unmarshal(contents, &changes); err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %w", path, err)
+	}
+
+	return changes, nil
+}
+
+// locked returns whether the journal's session is running, holding its lock
+func locked(path string) (bool, error) {
+	lock, err := os.OpenFile(lockPath(path), os.O_RDWR, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("unable to open %s: %w", lockPath(path), err)
+	}
+
+	// Closing the file releases the lock if it was taken
+	err = unix.Flock(int(lock.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+	if closeErr := lock.Close(); closeErr != nil {
+		return false, fmt.Errorf("unable to close %s: %w", lockPath(path), closeErr)
+	}
+
+	if errors.Is(err, unix.EWOULDBLOCK) {
+		return true, nil
+	} else if err != nil {
+		return false, fmt.Errorf("unable to lock %s: %w", lockPath(path), err)
+	}
+
+	return false, nil
+}
+
+func removeJournal(path string) error {
+	for _, p := range []string{path, lockPath(path)} {
+		if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("unable to remove %s: %w", p, err)
+		}
+	}
+
+	return nil
+}
+
+func lockPath(path string) string {
+	return strings.TrimSuffix(path, ".json") + ".lock"
+}
@@ -0,0 +1,132 @@
+package journal
+
+import (
+	"context"
+	"encoding/json"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJournal(t *testing.T) {
+	dir := t.TempDir()
+
+	j, err := Open(dir)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	ctx := NewContext(context.Background(), j)
+
+	changes := []Change{
+		{Kind: KindLink, Device: "kw-test-wg3"},
+		{Kind: KindRoute, Device: "kw-test-wg3", Prefix: netip.MustParsePrefix("100.64.0.0/16")},
+	}
+
+	for _, change := range changes {
+		assert.NoError(t, FromContext(ctx).Record(change))
+	}
+
+	// The running session's journal isn't stale
+	stale, running, err := FindStale(dir)
+	if assert.NoError(t, err) {
+		assert.Empty(t, stale)
+		assert.Equal(t, changes, running)
+	}
+
+	// Routes deleted while running are forgotten
+	assert.NoError(t, FromContext(ctx).Forget(changes[1]))
+
+	_, running, err = FindStale(dir)
+	if assert.NoError(t, err) {
+		assert.Equal(t, changes[:1], running)
+	}
+
+	// The device wasn't deleted by the session, so it's rolled back on close, nothing being left to recover
+	assert.NoError(t, j.Close(ctx))
+
+	assert.NoFileExists(t, j.path)
+
+	stale, running, err = FindStale(dir)
+	if assert.NoError(t, err) {
+		assert.Empty(t, stale)
+		assert.Empty(t, running)
+	}
+
+	// Without a journal, nothing is recorded
+	assert.NoError(t, FromContext(context.Background()).Record(changes[0]))
+}
+
+func TestRecover(t *testing.T) {
+	dir := t.TempDir()
+
+	// A session which was killed leaves its journal, and lock file, behind unlocked
+	killed := []Change{
+		{Kind: KindLink, Device: "kw-test-missing"},
+		{Kind: KindRoute, Device: "kw-test-missing", Prefix: netip.MustParsePrefix("100.64.0.0/16")},
+	}
+
+	contents, err := json.Marshal(killed)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "1234.json"), contents, 0o644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "1234.lock"), nil, 0o644))
+
+	j, err := Open(dir)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	defer func() {
+		assert.NoError(t, j.Close(context.Background()))
+	}()
+
+	stale, running, err := FindStale(dir)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []Stale{{Path: filepath.Join(dir, "1234.json"), Changes: killed}}, stale)
+		assert.Empty(t, running)
+	}
+
+	// The killed session's device no longer exists, so there's nothing to roll back but its journal
+	stale, err = Recover(context.Background(), dir)
+	if assert.NoError(t, err) {
+		assert.Len(t, stale, 1)
+	}
+
+	assert.NoFileExists(t, filepath.Join(dir, "1234.json"))
+	assert.NoFileExists(t, filepath.Join(dir, "1234.lock"))
+	assert.FileExists(t, j.path)
+}
+
+func TestInUse(t *testing.T) {
+	running := []Change{
+		{Kind: KindLink, Device: "wg0"},
+		{Kind: KindResolver, Path: "/etc/resolver/kubewire-utun4"},
+		{Kind: KindSearchDomains},
+		{Kind: KindRule, Table: 52004, Priority: 5300},
+	}
+
+	tests := []struct {
+		name   string
+		change Change
+		want   bool
+	}{
+		{"same device", Change{Kind: KindRoute, Device: "wg0", Prefix: netip.MustParsePrefix("10.0.0.0/16")}, true},
+		{"other device", Change{Kind: KindLink, Device: "wg1"}, false},
+		{"same resolver", Change{Kind: KindResolver, Path: "/etc/resolver/kubewire-utun4"}, true},
+		{"other resolver", Change{Kind: KindResolver, Path: "/etc/resolver/kubewire-utun5"}, false},
+		{"search domains", Change{Kind: KindSearchDomains}, true},
+		{"same table", Change{Kind: KindRule, Table: 52004, Priority: 5300, IPv6: true}, true},
+		{"other table", Change{Kind: KindRule, Table: 52005, Priority: 5300}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, inUse(tt.change, running))
+		})
+	}
+}
@@ -0,0 +1,45 @@
+//go:build darwin
+
+package journal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+
+	"github.com/go-logr/logr"
+)
+
+// rollback undoes the changes in the reverse order they were made. utun devices, and their routes, are removed by the
+// kernel when the process owning them exits, leaving resolver configuration to roll back.
+func rollback(ctx context.Context, changes []Change) error {
+	log := logr.FromContextOrDiscard(ctx)
+
+	var errs []error
+
+	for _, change := range slices.Backward(changes) {
+		switch change.Kind {
+		case KindResolver:
+			log.V(1).Info("Removing resolver", "path", change.Path)
+
+			if err := os.Remove(change.Path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				errs = append(errs, fmt.Errorf("unable to remove %s: %w", change.Path, err))
+			}
+		case KindSearchDomains:
+			log.V(1).Info("Disabling mDNSResponder AlwaysAppendSearchDomains")
+
+			if _, err := exec.Command("defaults", "write", "/Library/Preferences/com.apple.mDNSResponder.plist", "AlwaysAppendSearchDomains", "-bool", "no").CombinedOutput(); err != nil {
+				errs = append(errs, fmt.Errorf("unable to disable mDNSResponder AlwaysAppendSearchDomains: %w", err))
+			}
+
+			if _, err := exec.Command("killall", "mDNSResponder").CombinedOutput(); err != nil {
+				errs = append(errs, fmt.Errorf("unable to restart mDNSResponder: %w", err))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,139 @@
+//go:build linux
+
+package journal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+
+	"github.com/go-logr/logr"
+	"github.com/godbus/dbus/v5"
+	"github.com/jsimonetti/rtnetlink"
+	"golang.org/x/sys/unix"
+)
+
+// rollback undoes the changes in the reverse order they were made. Changes which no longer apply, e.g. routes of a
+// device which has since been deleted, are skipped. Rules outlive their device, so they're always deleted.
+func rollback(ctx context.Context, changes []Change) error {
+	log := logr.FromContextOrDiscard(ctx)
+
+	netlink, err := rtnetlink.Dial(nil)
+	if err != nil {
+		return fmt.Errorf("unable to initialize netlink client: %w", err)
+	}
+
+	defer func() {
+		if err := netlink.Close(); err != nil {
+			log.Error(err, "unable to close netlink client")
+		}
+	}()
+
+	var errs []error
+
+	for _, change := range slices.Backward(changes) {
+		if change.Kind == KindRule {
+			log.V(1).Info("Deleting rule", "table", change.Table, "priority", change.Priority)
+
+			if err := netlink.Rule.Delete(ruleMessage(change)); err != nil && !errors.Is(err, unix.ENOENT) {
+				errs = append(errs, fmt.Errorf("unable to delete rule for table %d: %w", change.Table, err))
+			}
+
+			continue
+		}
+
+		iface, err := net.InterfaceByName(change.Device)
+		if err != nil {
+			continue
+		}
+
+		switch change.Kind {
+		case KindLink:
+			log.V(1).Info("Deleting device", "device", change.Device)
+
+			if err := netlink.Link.Delete(uint32(iface.Index)); err != nil && !errors.Is(err, unix.ENODEV) {
+				errs = append(errs, fmt.Errorf("unable to delete %s: %w", change.Device, err))
+			}
+		case KindRoute:
+			log.V(1).Info("Deleting route", "route", change.Prefix.String(), "device", change.Device)
+
+			if err := netlink.Route.Delete(routeMessage(change, iface.Index)); err != nil && !errors.Is(err, unix.ESRCH) {
+				errs = append(errs, fmt.Errorf("unable to delete route for %s: %w", change.Prefix, err))
+			}
+		case KindLinkDNS:
+			log.V(1).Info("Reverting DNS", "device", change.Device)
+
+			if err := revertLinkDNS(ctx, iface.Index); err != nil {
+				errs = append(errs, fmt.Errorf("unable to revert DNS of %s: %w", change.Device, err))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func routeMessage(change Change, index int) *rtnetlink.RouteMessage {
+	// Routes journaled before tables were used are in the main one
+	table := uint32(unix.RT_TABLE_MAIN)
+	if change.Table != 0 {
+		table = uint32(change.Table)
+	}
+
+	message := &rtnetlink.RouteMessage{
+		Family:    unix.AF_INET,
+		Table:     unix.RT_TABLE_UNSPEC,
+		DstLength: uint8(change.Prefix.Bits()),
+		Attributes: rtnetlink.RouteAttributes{
+			Dst:      net.IP(change.Prefix.Addr().AsSlice()),
+			OutIface: uint32(index),
+			Table:    table,
+		},
+	}
+
+	if change.Prefix.Addr().Is6() {
+		message.Family = unix.AF_INET6
+	}
+
+	return message
+}
+
+func ruleMessage(change Change) *rtnetlink.RuleMessage {
+	table := uint32(change.Table)
+	priority := uint32(change.Priority)
+
+	family := uint8(unix.AF_INET)
+	if change.IPv6 {
+		family = unix.AF_INET6
+	}
+
+	return &rtnetlink.RuleMessage{
+		Family: family,
+		Table:  unix.RT_TABLE_UNSPEC,
+		Action: unix.FR_ACT_TO_TBL,
+		Flags:  unix.FIB_RULE_INVERT,
+		Attributes: &rtnetlink.RuleAttributes{
+			Table:    &table,
+			FwMark:   &table,
+			Priority: &priority,
+		},
+	}
+}
+
+func revertLinkDNS(ctx context.Context, index int) error {
+	dbusClient, err := dbus.ConnectSystemBus()
+	if err != nil {
+		return fmt.Errorf("unable to create dbus client: %w", err)
+	}
+
+	defer func() {
+		if err := dbusClient.Close(); err != nil {
+			logr.FromContextOrDiscard(ctx).Error(err, "unable to close dbus client")
+		}
+	}()
+
+	resolved := dbusClient.Object("org.freedesktop.resolve1", "/org/freedesktop/resolve1")
+
+	return resolved.CallWithContext(ctx, "org.freedesktop.resolve1.Manager.RevertLink", 0, index).Err
+}
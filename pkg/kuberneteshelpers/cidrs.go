@@ -0,0 +1,254 @@
+package kuberneteshelpers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"go4.org/netipx"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1beta1 "k8s.io/api/networking/v1beta1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// ipv6PrefixBits is the smallest size of the IPv6 pod and node ranges observed addresses are part of, those of a
+	// single subnet
+	ipv6PrefixBits = 64
+	// ipv6ServicePrefixBits is the smallest size of IPv6 service ranges, the largest allowed by Kubernetes
+	ipv6ServicePrefixBits = 108
+	// serviceCIDRsV1Path is the path of networking.k8s.io/v1 ServiceCIDRs, which the client predates
+	serviceCIDRsV1Path = "/apis/networking.k8s.io/v1/servicecidrs"
+)
+
+// kubeadmClusterConfiguration is the part of kubeadm's ClusterConfiguration describing the cluster's ranges
+type kubeadmClusterConfiguration struct {
+	Networking struct {
+		PodSubnet     string `json:"podSubnet"`
+		ServiceSubnet string `json:"serviceSubnet"`
+	} `json:"networking"`
+}
+
+// kubeadmSubnets returns the pod and service ranges of clusters created with kubeadm
+func kubeadmSubnets(ctx context.Context, client kubernetes.Interface) ([]netip.Prefix, []netip.Prefix, error) {
+	configMap, err := client.CoreV1().ConfigMaps("kube-system").Get(ctx, "kubeadm-config", v1.GetOptions{})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var clusterConfiguration kubeadmClusterConfiguration
+	if err := yaml.Unmarshal([]byte(configMap.Data["ClusterConfiguration"]), &clusterConfiguration); err != nil {
+		return nil, nil, fmt.Errorf("unable to parse kubeadm ClusterConfiguration: %w", err)
+	}
+
+	podSubnets, err := parsePrefixes(clusterConfiguration.Networking.PodSubnet)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid kubeadm podSubnet: %w", err)
+	}
+
+	serviceSubnets, err := parsePrefixes(clusterConfiguration.Networking.ServiceSubnet)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid kubeadm serviceSubnet: %w", err)
+	}
+
+	return podSubnets, serviceSubnets, nil
+}
+
+// ciliumPodCIDRs returns the pod ranges of Cilium's cluster-scope IPAM
+func ciliumPodCIDRs(ctx context.Context, client kubernetes.Interface) ([]netip.Prefix, error) {
+	configMap, err := client.CoreV1().ConfigMaps("kube-system").Get(ctx, "cilium-config", v1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	return parsePrefixes(configMap.Data["cluster-pool-ipv4-cidr"], configMap.Data["cluster-pool-ipv6-cidr"])
+}
+
+// flannelNetConf is the part of flannel's network configuration describing the pod ranges
+type flannelNetConf struct {
+	Network     string `json:"Network"`
+	IPv6Network string `json:"IPv6Network"`
+}
+
+// flannelPodCIDRs returns the pod ranges of flannel, deployed in either its own namespace or kube-system
+func flannelPodCIDRs(ctx context.Context, client kubernetes.Interface) ([]netip.Prefix, error) {
+	var (
+		configMap *corev1.ConfigMap
+		err       error
+	)
+
+	for _, namespace := range []string{"kube-flannel", "kube-system"} {
+		configMap, err = client.CoreV1().ConfigMaps(namespace).Get(ctx, "kube-flannel-cfg", v1.GetOptions{})
+		if err == nil {
+			break
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var netConf flannelNetConf
+	if err := json.Unmarshal([]byte(configMap.Data["net-conf.json"]), &netConf); err != nil {
+		return nil, fmt.Errorf("unable to parse flannel net-conf.json: %w", err)
+	}
+
+	return parsePrefixes(netConf.Network, netConf.IPv6Network)
+}
+
+// kubeProxyConfiguration is the part of kube-proxy's configuration describing the pod ranges
+type kubeProxyConfiguration struct {
+	ClusterCIDR string `json:"clusterCIDR"`
+}
+
+// kubeProxyClusterCIDRs returns the pod ranges kube-proxy is configured with
+func kubeProxyClusterCIDRs(ctx context.Context, client kubernetes.Interface) ([]netip.Prefix, error) {
+	configMap, err := client.CoreV1().ConfigMaps("kube-system").Get(ctx, "kube-proxy", v1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	var configuration kubeProxyConfiguration
+	if err := yaml.Unmarshal([]byte(configMap.Data["config.conf"]), &configuration); err != nil {
+		return nil, fmt.Errorf("unable to parse kube-proxy configuration: %w", err)
+	}
+
+	return parsePrefixes(configuration.ClusterCIDR)
+}
+
+// nodePodCIDRs returns the pod ranges allocated to the nodes, merged into as few prefixes as possible
+func nodePodCIDRs(nodes []corev1.Node) ([]netip.Prefix, error) {
+	var builder netipx.IPSetBuilder
+
+	for _, node := range nodes {
+		prefixes, err := parsePrefixes(node.Spec.PodCIDRs...)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pod CIDR of node %s: %w", node.Name, err)
+		}
+
+		for _, prefix := range prefixes {
+			builder.AddPrefix(prefix)
+		}
+	}
+
+	set, err := builder.IPSet()
+	if err != nil {
+		return nil, err
+	}
+
+	return set.Prefixes(), nil
+}
+
+// serviceCIDRObjects returns the service ranges of the cluster's ServiceCIDR objects, read from networking.k8s.io/v1
+// where served and v1beta1 otherwise
+func serviceCIDRObjects(ctx context.Context, client kubernetes.Interface) ([]netip.Prefix, error) {
+	serviceCIDRs, err := serviceCIDRsV1(ctx, client)
+	if err != nil {
+		logr.FromContextOrDiscard(ctx).V(1).Info("Unable to list networking.k8s.io/v1 ServiceCIDRs, trying v1beta1", "error", err.Error())
+
+		serviceCIDRs, err = client.NetworkingV1beta1().ServiceCIDRs().List(ctx, v1.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var prefixes []netip.Prefix
+
+	for _, serviceCIDR := range serviceCIDRs.Items {
+		cidrs, err := parsePrefixes(serviceCIDR.Spec.CIDRs...)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ServiceCIDR %s: %w", serviceCIDR.Name, err)
+		}
+
+		prefixes = append(prefixes, cidrs...)
+	}
+
+	return prefixes, nil
+}
+
+// serviceCIDRsV1 lists the networking.k8s.io/v1 ServiceCIDRs, whose schema is unchanged from v1beta1
+func serviceCIDRsV1(ctx context.Context, client kubernetes.Interface) (*networkingv1beta1.ServiceCIDRList, error) {
+	restClient := client.Discovery().RESTClient()
+	if restClient == nil {
+		return nil, errors.New("no REST client")
+	}
+
+	body, err := restClient.Get().AbsPath(serviceCIDRsV1Path).DoRaw(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var serviceCIDRs networkingv1beta1.ServiceCIDRList
+	if err := json.Unmarshal(body, &serviceCIDRs); err != nil {
+		return nil, fmt.Errorf("unable to parse ServiceCIDRs: %w", err)
+	}
+
+	return &serviceCIDRs, nil
+}
+
+// coveringPrefixes returns, for each family, the smallest prefix covering all of its addresses. IPv6 prefixes are no
+// smaller than the given size, that of the ranges the addresses are allocated from.
+func coveringPrefixes(addrs []netip.Addr, ipv6Bits int) []netip.Prefix {
+	var prefixes []netip.Prefix
+
+	for _, is4 := range []bool{true, false} {
+		var first, last netip.Addr
+
+		for _, addr := range addrs {
+			if addr.Is4() != is4 {
+				continue
+			}
+
+			if !first.IsValid() || addr.Less(first) {
+				first = addr
+			}
+
+			if !last.IsValid() || last.Less(addr) {
+				last = addr
+			}
+		}
+
+		if !first.IsValid() {
+			continue
+		}
+
+		bits := first.BitLen()
+		if !is4 {
+			bits = ipv6Bits
+		}
+
+		// Shorten the prefix until it covers the last address too, which a zero-length prefix always does
+		prefix, _ := first.Prefix(bits)
+		for !prefix.Contains(last) {
+			prefix, _ = first.Prefix(prefix.Bits() - 1)
+		}
+
+		prefixes = append(prefixes, prefix)
+	}
+
+	return prefixes
+}
+
+// parsePrefixes parses the prefixes in each of the values, which may hold several separated by commas or spaces
+func parsePrefixes(values ...string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+
+	for _, value := range values {
+		for _, field := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' }) {
+			prefix, err := netip.ParsePrefix(field)
+			if err != nil {
+				return nil, err
+			}
+
+			prefixes = append(prefixes, prefix.Masked())
+		}
+	}
+
+	return prefixes, nil
+}
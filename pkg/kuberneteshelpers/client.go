@@ -24,3 +24,15 @@ func ClientConfig(kubeconfig string) (kubernetes.Interface, *rest.Config, error)
 
 	return client, restConfig, nil
 }
+
+// CurrentContext returns the name of the kubeconfig's current context
+func CurrentContext(kubeconfig string) (string, error) {
+	clientGetter := &genericclioptions.ConfigFlags{KubeConfig: ptr.To(kubeconfig)}
+
+	rawConfig, err := clientGetter.ToRawKubeConfigLoader().RawConfig()
+	if err != nil {
+		return "", fmt.Errorf("unable to load kubeconfig: %w", err)
+	}
+
+	return rawConfig.CurrentContext, nil
+}
@@ -5,105 +5,312 @@ import (
 	"fmt"
 	"net/netip"
 
+	"github.com/go-logr/logr"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 )
 
+// ClusterDetails describes the addresses used within the cluster. Each list holds the ranges of each of the cluster's
+// IP families, of which there may be several, e.g. for multiple node subnets.
 type ClusterDetails struct {
-	ServiceIP                      netip.Addr
-	PodCIDR, ServiceCIDR, NodeCIDR netip.Prefix
+	ServiceIP                         netip.Addr
+	PodCIDRs, ServiceCIDRs, NodeCIDRs []netip.Prefix
+	// ClusterDomain is the DNS domain of the cluster, if discovered
+	ClusterDomain string
 }
 
+// Domain returns the DNS domain of the cluster, falling back to the default when it wasn't discovered
+func (c ClusterDetails) Domain() string {
+	if c.ClusterDomain == "" {
+		return DefaultClusterDomain
+	}
+
+	return c.ClusterDomain
+}
+
+// Missing returns the details needed for a session which couldn't be resolved, e.g. for lack of cluster-scoped
+// permissions. Node ranges aren't needed, since only nodes' addresses rather than cluster services are within them.
+func (c ClusterDetails) Missing() []string {
+	var missing []string
+
+	if len(c.PodCIDRs) == 0 {
+		missing = append(missing, "pod CIDRs")
+	}
+
+	if len(c.ServiceCIDRs) == 0 {
+		missing = append(missing, "service CIDRs")
+	}
+
+	if !c.ServiceIP.IsValid() {
+		missing = append(missing, "DNS service IP")
+	}
+
+	return missing
+}
+
+// Prefixes returns the pod, service and node prefixes of the cluster
+func (c ClusterDetails) Prefixes() []netip.Prefix {
+	var prefixes []netip.Prefix
+
+	prefixes = append(prefixes, c.PodCIDRs...)
+	prefixes = append(prefixes, c.ServiceCIDRs...)
+	prefixes = append(prefixes, c.NodeCIDRs...)
+
+	return prefixes
+}
+
+// HasIPv6 returns whether any of the cluster's prefixes are IPv6
+func (c ClusterDetails) HasIPv6() bool {
+	for _, prefix := range c.Prefixes() {
+		if prefix.Addr().Is6() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Resolve fills in the cluster's ranges which weren't given. Each range is read from the first authoritative source
+// available, falling back to covering the addresses observed in the cluster. Only the namespace's pods need to be
+// readable; details which can't be resolved with the user's permissions are left out and reported by Missing, to be
+// discovered by the agent instead.
 func (c ClusterDetails) Resolve(ctx context.Context, client kubernetes.Interface, namespace string) (ClusterDetails, error) {
+	log := logr.FromContextOrDiscard(ctx)
+
 	pods, err := client.CoreV1().Pods(namespace).List(ctx, v1.ListOptions{})
 	if err != nil {
 		return ClusterDetails{}, fmt.Errorf("unable to list pods for cluster details: %w", err)
 	}
 
-	podCIDR := c.PodCIDR
-	if !podCIDR.IsValid() {
-		podAddr, err := func() (netip.Addr, error) {
-			// Find the first non-hostNetwork pod and assume that represents the pod CIDR as a /16
-			for _, p := range pods.Items {
-				if p.Spec.HostNetwork || p.Status.PodIP == "" {
-					continue
-				}
+	// Nodes are only needed to resolve pod and node ranges
+	var (
+		nodes       []corev1.Node
+		nodesListed bool
+	)
 
-				addr, err := netip.ParseAddr(p.Status.PodIP)
-				if err != nil {
-					continue
-				}
+	if len(c.PodCIDRs) == 0 || len(c.NodeCIDRs) == 0 {
+		nodeList, err := client.CoreV1().Nodes().List(ctx, v1.ListOptions{})
+		if err != nil && !errors.IsForbidden(err) {
+			return ClusterDetails{}, fmt.Errorf("unable to list nodes for cluster details: %w", err)
+		}
+
+		if err != nil {
+			log.V(1).Info("Unable to list nodes, using the addresses of the namespace's pods' nodes", "error", err.Error())
+		} else {
+			nodes, nodesListed = nodeList.Items, true
+		}
+	}
+
+	var podAddrs, nodeAddrs []netip.Addr
 
-				return addr, nil
+	for _, p := range pods.Items {
+		for _, podIP := range podIPs(p.Status) {
+			addr, err := netip.ParseAddr(podIP)
+			if err != nil {
+				continue
 			}
 
-			return netip.Addr{}, fmt.Errorf("unable to find any pods")
-		}()
-		if err != nil {
-			return ClusterDetails{}, fmt.Errorf("unable to obtain pod CIDR: %w", err)
+			// Pods on the host network have their node's address
+			if p.Spec.HostNetwork {
+				nodeAddrs = append(nodeAddrs, addr)
+			} else {
+				podAddrs = append(podAddrs, addr)
+			}
 		}
 
-		podCIDR, err = podAddr.Prefix(16)
-		if err != nil {
-			return ClusterDetails{}, fmt.Errorf("unable to obtain pod CIDR: %w", err)
+		if nodesListed {
+			continue
+		}
+
+		for _, hostIP := range hostIPs(p.Status) {
+			if addr, err := netip.ParseAddr(hostIP); err == nil {
+				nodeAddrs = append(nodeAddrs, addr)
+			}
 		}
 	}
 
+	for _, node := range nodes {
+		for _, address := range node.Status.Addresses {
+			if address.Type != corev1.NodeInternalIP {
+				continue
+			}
+
+			nodeAddr, err := netip.ParseAddr(address.Address)
+			if err != nil {
+				continue
+			}
+
+			nodeAddrs = append(nodeAddrs, nodeAddr)
+		}
+	}
+
+	var serviceAddrs []netip.Addr
+
 	dnsService, err := client.CoreV1().Services("kube-system").Get(ctx, "kube-dns", v1.GetOptions{})
-	if err != nil {
+	switch {
+	case errors.IsForbidden(err) || errors.IsNotFound(err):
+		log.V(1).Info("Unable to find kube-dns service for DNS service IP", "error", err.Error())
+	case err != nil:
 		return ClusterDetails{}, fmt.Errorf("unable to find kube-dns service for service CIDR: %w", err)
+	default:
+		serviceAddrs, err = clusterIPs(*dnsService)
+		if err != nil {
+			return ClusterDetails{}, fmt.Errorf("unable to obtain service CIDR: %w", err)
+		}
 	}
 
-	serviceAddr, err := netip.ParseAddr(dnsService.Spec.ClusterIP)
-	if err != nil {
-		return ClusterDetails{}, fmt.Errorf("unable to obtain service CIDR: %w", err)
+	podCIDRs := c.PodCIDRs
+	if len(podCIDRs) == 0 {
+		podCIDRs = firstCIDRs(ctx, "pod", []cidrSource{
+			{"kubeadm-config", func(ctx context.Context) ([]netip.Prefix, error) {
+				podSubnet, _, err := kubeadmSubnets(ctx, client)
+				return podSubnet, err
+			}},
+			{"cilium-config", func(ctx context.Context) ([]netip.Prefix, error) { return ciliumPodCIDRs(ctx, client) }},
+			{"kube-flannel-cfg", func(ctx context.Context) ([]netip.Prefix, error) { return flannelPodCIDRs(ctx, client) }},
+			{"kube-proxy", func(ctx context.Context) ([]netip.Prefix, error) { return kubeProxyClusterCIDRs(ctx, client) }},
+			{"node pod CIDRs", func(context.Context) ([]netip.Prefix, error) { return nodePodCIDRs(nodes) }},
+			{"pod addresses", func(context.Context) ([]netip.Prefix, error) {
+				return coveringPrefixes(podAddrs, ipv6PrefixBits), nil
+			}},
+		})
+	}
+
+	serviceCIDRs := c.ServiceCIDRs
+	if len(serviceCIDRs) == 0 {
+		serviceCIDRs = firstCIDRs(ctx, "service", []cidrSource{
+			{"ServiceCIDR", func(ctx context.Context) ([]netip.Prefix, error) { return serviceCIDRObjects(ctx, client) }},
+			{"kubeadm-config", func(ctx context.Context) ([]netip.Prefix, error) {
+				_, serviceSubnet, err := kubeadmSubnets(ctx, client)
+				return serviceSubnet, err
+			}},
+			{"service addresses", func(ctx context.Context) ([]netip.Prefix, error) {
+				return coveringPrefixes(append(namespaceClusterIPs(ctx, client, namespace), serviceAddrs...), ipv6ServicePrefixBits), nil
+			}},
+		})
+	}
+
+	nodeCIDRs := c.NodeCIDRs
+	if len(nodeCIDRs) == 0 {
+		nodeCIDRs = coveringPrefixes(nodeAddrs, ipv6PrefixBits)
 	}
 
-	serviceCIDR := c.ServiceCIDR
-	if !serviceCIDR.IsValid() {
-		serviceCIDR, err = serviceAddr.Prefix(16)
+	resolved := ClusterDetails{
+		ServiceCIDRs:  serviceCIDRs,
+		PodCIDRs:      podCIDRs,
+		NodeCIDRs:     nodeCIDRs,
+		ClusterDomain: c.ClusterDomain,
+	}
+
+	// The primary family's address of kube-dns is used as the DNS server
+	if len(serviceAddrs) > 0 {
+		resolved.ServiceIP = serviceAddrs[0]
+	}
+
+	return resolved, nil
+}
+
+// cidrSource is a source of the prefixes of one of the cluster's ranges
+type cidrSource struct {
+	name     string
+	prefixes func(ctx context.Context) ([]netip.Prefix, error)
+}
+
+// firstCIDRs returns the prefixes of the first source with any. Sources which can't be read, e.g. because they don't
+// exist in the cluster or aren't readable by the user, are skipped.
+func firstCIDRs(ctx context.Context, rangeName string, sources []cidrSource) []netip.Prefix {
+	log := logr.FromContextOrDiscard(ctx)
+
+	for _, source := range sources {
+		prefixes, err := source.prefixes(ctx)
 		if err != nil {
-			return ClusterDetails{}, fmt.Errorf("unable to obtain service CIDR: %w", err)
+			log.V(1).Info("Unable to resolve CIDRs", "range", rangeName, "source", source.name, "error", err.Error())
+			continue
+		}
+
+		if len(prefixes) > 0 {
+			log.V(1).Info("Resolved CIDRs", "range", rangeName, "source", source.name, "cidrs", prefixes)
+			return prefixes
 		}
 	}
 
-	nodeCIDR := c.NodeCIDR
-	if !nodeCIDR.IsValid() {
-		nodes, err := client.CoreV1().Nodes().List(ctx, v1.ListOptions{})
-		if err != nil {
-			return ClusterDetails{}, fmt.Errorf("unable to list nodes for cluster details: %w", err)
+	return nil
+}
+
+// podIPs returns the pod's addresses of each family, falling back to its primary address
+func podIPs(status corev1.PodStatus) []string {
+	if len(status.PodIPs) == 0 {
+		if status.PodIP == "" {
+			return nil
 		}
 
-		if len(nodes.Items) < 1 {
-			return ClusterDetails{}, fmt.Errorf("no nodes found for cluster details: %w", err)
+		return []string{status.PodIP}
+	}
+
+	ips := make([]string, len(status.PodIPs))
+	for i, podIP := range status.PodIPs {
+		ips[i] = podIP.IP
+	}
+
+	return ips
+}
+
+// hostIPs returns the addresses of each family of the pod's node, falling back to its primary address
+func hostIPs(status corev1.PodStatus) []string {
+	if len(status.HostIPs) == 0 {
+		if status.HostIP == "" {
+			return nil
 		}
 
-		nodeCIDR, err = func() (netip.Prefix, error) {
-			for _, node := range nodes.Items {
-				for _, address := range node.Status.Addresses {
-					if address.Type == corev1.NodeInternalIP {
-						nodeAddr, err := netip.ParseAddr(address.Address)
-						if err != nil {
-							continue
-						}
-
-						return nodeAddr.Prefix(16)
-					}
-				}
-			}
+		return []string{status.HostIP}
+	}
+
+	ips := make([]string, len(status.HostIPs))
+	for i, hostIP := range status.HostIPs {
+		ips[i] = hostIP.IP
+	}
+
+	return ips
+}
+
+// clusterIPs returns the service's cluster IPs of each family, falling back to its primary cluster IP
+func clusterIPs(service corev1.Service) ([]netip.Addr, error) {
+	ips := service.Spec.ClusterIPs
+	if len(ips) == 0 {
+		ips = []string{service.Spec.ClusterIP}
+	}
 
-			return netip.Prefix{}, fmt.Errorf("no valid InternalIP node addresses found")
-		}()
+	addrs := make([]netip.Addr, len(ips))
+
+	for i, ip := range ips {
+		addr, err := netip.ParseAddr(ip)
 		if err != nil {
-			return ClusterDetails{}, fmt.Errorf("unable to obtain node CIDR: %w", err)
+			return nil, err
+		}
+
+		addrs[i] = addr
+	}
+
+	return addrs, nil
+}
+
+// namespaceClusterIPs returns the cluster IPs of the services in the namespace, if they can be listed
+func namespaceClusterIPs(ctx context.Context, client kubernetes.Interface, namespace string) []netip.Addr {
+	services, err := client.CoreV1().Services(namespace).List(ctx, v1.ListOptions{})
+	if err != nil {
+		return nil
+	}
+
+	var addrs []netip.Addr
+
+	for _, service := range services.Items {
+		// Headless services have no cluster IPs
+		if ips, err := clusterIPs(service); err == nil {
+			addrs = append(addrs, ips...)
 		}
 	}
 
-	return ClusterDetails{
-		ServiceIP:   serviceAddr,
-		ServiceCIDR: serviceCIDR,
-		PodCIDR:     podCIDR,
-		NodeCIDR:    nodeCIDR,
-	}, nil
+	return addrs
 }
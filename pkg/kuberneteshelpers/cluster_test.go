@@ -2,14 +2,24 @@ package kuberneteshelpers
 
 import (
 	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"net/netip"
 	"reflect"
 	"testing"
 
 	corev1 "k8s.io/api/core/v1"
+	networkingv1beta1 "k8s.io/api/networking/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+	k8stesting "k8s.io/client-go/testing"
 )
 
 func TestGetClusterDetails(t *testing.T) {
@@ -45,12 +55,23 @@ func TestGetClusterDetails(t *testing.T) {
 	}
 
 	validClusterDetails := ClusterDetails{
-		ServiceIP:   netip.MustParseAddr("172.0.0.1"),
-		PodCIDR:     netip.MustParsePrefix("100.64.0.0/16"),
-		ServiceCIDR: netip.MustParsePrefix("172.0.0.0/16"),
-		NodeCIDR:    netip.MustParsePrefix("10.0.0.0/16"),
+		ServiceIP:    netip.MustParseAddr("172.0.0.1"),
+		PodCIDRs:     []netip.Prefix{netip.MustParsePrefix("100.64.0.1/32")},
+		ServiceCIDRs: []netip.Prefix{netip.MustParsePrefix("172.0.0.1/32")},
+		NodeCIDRs:    []netip.Prefix{netip.MustParsePrefix("10.0.0.1/32")},
 	}
 
+	// Details which can't be resolved are left out
+	withoutPodCIDRs := validClusterDetails
+	withoutPodCIDRs.PodCIDRs = nil
+
+	withoutServices := validClusterDetails
+	withoutServices.ServiceIP = netip.Addr{}
+	withoutServices.ServiceCIDRs = nil
+
+	withoutNodeCIDRs := validClusterDetails
+	withoutNodeCIDRs.NodeCIDRs = nil
+
 	tests := []struct {
 		name    string
 		objects []runtime.Object
@@ -70,8 +91,8 @@ func TestGetClusterDetails(t *testing.T) {
 				validNode,
 			},
 			ClusterDetails{},
-			ClusterDetails{},
-			true,
+			withoutPodCIDRs,
+			false,
 		},
 		{
 			"only pods with no IP",
@@ -85,8 +106,8 @@ func TestGetClusterDetails(t *testing.T) {
 				validNode,
 			},
 			ClusterDetails{},
-			ClusterDetails{},
-			true,
+			withoutPodCIDRs,
+			false,
 		},
 		{
 			"only pods with invalid IP",
@@ -100,8 +121,8 @@ func TestGetClusterDetails(t *testing.T) {
 				validNode,
 			},
 			ClusterDetails{},
-			ClusterDetails{},
-			true,
+			withoutPodCIDRs,
+			false,
 		},
 		{
 			"pods with invalid IP",
@@ -123,8 +144,8 @@ func TestGetClusterDetails(t *testing.T) {
 			"no kube-dns",
 			[]runtime.Object{validPod, validNode},
 			ClusterDetails{},
-			ClusterDetails{},
-			true,
+			withoutServices,
+			false,
 		},
 		{
 			"kube-dns with invalid ClusterIP",
@@ -146,8 +167,8 @@ func TestGetClusterDetails(t *testing.T) {
 			"no nodes",
 			[]runtime.Object{validPod, kubeDNS},
 			ClusterDetails{},
-			ClusterDetails{},
-			true,
+			withoutNodeCIDRs,
+			false,
 		},
 		{
 			"only nodes with external IP",
@@ -162,8 +183,8 @@ func TestGetClusterDetails(t *testing.T) {
 				},
 			},
 			ClusterDetails{},
-			ClusterDetails{},
-			true,
+			withoutNodeCIDRs,
+			false,
 		},
 		{
 			"only nodes with invalid IP",
@@ -178,8 +199,8 @@ func TestGetClusterDetails(t *testing.T) {
 				},
 			},
 			ClusterDetails{},
-			ClusterDetails{},
-			true,
+			withoutNodeCIDRs,
+			false,
 		},
 		{
 			"nodes with invalid IP",
@@ -209,15 +230,259 @@ func TestGetClusterDetails(t *testing.T) {
 			"prefilled CIDRs",
 			[]runtime.Object{kubeDNS},
 			ClusterDetails{
-				PodCIDR:     netip.MustParsePrefix("100.64.0.0/24"),
-				ServiceCIDR: netip.MustParsePrefix("172.0.0.0/12"),
-				NodeCIDR:    netip.MustParsePrefix("10.0.0.0/12"),
+				PodCIDRs:     []netip.Prefix{netip.MustParsePrefix("100.64.0.0/24")},
+				ServiceCIDRs: []netip.Prefix{netip.MustParsePrefix("172.0.0.0/12")},
+				NodeCIDRs:    []netip.Prefix{netip.MustParsePrefix("10.0.0.0/12")},
+			},
+			ClusterDetails{
+				ServiceIP:    netip.MustParseAddr("172.0.0.1"),
+				PodCIDRs:     []netip.Prefix{netip.MustParsePrefix("100.64.0.0/24")},
+				ServiceCIDRs: []netip.Prefix{netip.MustParsePrefix("172.0.0.0/12")},
+				NodeCIDRs:    []netip.Prefix{netip.MustParsePrefix("10.0.0.0/12")},
+			},
+			false,
+		},
+		{
+			"dual-stack cluster",
+			[]runtime.Object{
+				&corev1.Pod{
+					ObjectMeta: v1.ObjectMeta{Name: "test-pod-dual-stack", Namespace: namespace},
+					Status: corev1.PodStatus{
+						PodIP:  "100.64.0.1",
+						PodIPs: []corev1.PodIP{{IP: "100.64.0.1"}, {IP: "2600:1f14:abc:de00::1"}},
+					},
+				},
+				&corev1.Service{
+					ObjectMeta: v1.ObjectMeta{Name: "kube-dns", Namespace: "kube-system"},
+					Spec: corev1.ServiceSpec{
+						ClusterIP:  "fd12:3456:789a::a",
+						ClusterIPs: []string{"fd12:3456:789a::a", "172.0.0.1"},
+					},
+				},
+				&corev1.Node{
+					ObjectMeta: v1.ObjectMeta{Name: "node-1"},
+					Status: corev1.NodeStatus{
+						Addresses: []corev1.NodeAddress{
+							{Type: corev1.NodeInternalIP, Address: "10.0.0.1"},
+							{Type: corev1.NodeInternalIP, Address: "2600:1f14:abc:de01::1"},
+							{Type: corev1.NodeInternalIP, Address: "10.0.1.1"},
+						},
+					},
+				},
+			},
+			ClusterDetails{},
+			ClusterDetails{
+				ServiceIP:    netip.MustParseAddr("fd12:3456:789a::a"),
+				PodCIDRs:     []netip.Prefix{netip.MustParsePrefix("100.64.0.1/32"), netip.MustParsePrefix("2600:1f14:abc:de00::/64")},
+				ServiceCIDRs: []netip.Prefix{netip.MustParsePrefix("172.0.0.1/32"), netip.MustParsePrefix("fd12:3456:789a::/108")},
+				NodeCIDRs:    []netip.Prefix{netip.MustParsePrefix("10.0.0.0/23"), netip.MustParsePrefix("2600:1f14:abc:de01::/64")},
+			},
+			false,
+		},
+		{
+			"ipv6 cluster",
+			[]runtime.Object{
+				&corev1.Pod{
+					ObjectMeta: v1.ObjectMeta{Name: "test-pod-ipv6", Namespace: namespace},
+					Status:     corev1.PodStatus{PodIP: "2600:1f14:abc:de00::1"},
+				},
+				&corev1.Service{
+					ObjectMeta: v1.ObjectMeta{Name: "kube-dns", Namespace: "kube-system"},
+					Spec:       corev1.ServiceSpec{ClusterIP: "fd12:3456:789a::a"},
+				},
+				&corev1.Node{
+					ObjectMeta: v1.ObjectMeta{Name: "node-1"},
+					Status: corev1.NodeStatus{
+						Addresses: []corev1.NodeAddress{{Type: corev1.NodeInternalIP, Address: "2600:1f14:abc:de00::2"}},
+					},
+				},
+			},
+			ClusterDetails{},
+			ClusterDetails{
+				ServiceIP:    netip.MustParseAddr("fd12:3456:789a::a"),
+				PodCIDRs:     []netip.Prefix{netip.MustParsePrefix("2600:1f14:abc:de00::/64")},
+				ServiceCIDRs: []netip.Prefix{netip.MustParsePrefix("fd12:3456:789a::/108")},
+				NodeCIDRs:    []netip.Prefix{netip.MustParsePrefix("2600:1f14:abc:de00::/64")},
+			},
+			false,
+		},
+		{
+			"kubeadm config",
+			[]runtime.Object{
+				validPod,
+				kubeDNS,
+				validNode,
+				&corev1.ConfigMap{
+					ObjectMeta: v1.ObjectMeta{Name: "kubeadm-config", Namespace: "kube-system"},
+					Data: map[string]string{
+						"ClusterConfiguration": "apiVersion: kubeadm.k8s.io/v1beta3\nkind: ClusterConfiguration\nnetworking:\n  podSubnet: 100.64.0.0/12,fd00:10::/56\n  serviceSubnet: 172.0.0.0/20\n",
+					},
+				},
+			},
+			ClusterDetails{},
+			ClusterDetails{
+				ServiceIP:    netip.MustParseAddr("172.0.0.1"),
+				PodCIDRs:     []netip.Prefix{netip.MustParsePrefix("100.64.0.0/12"), netip.MustParsePrefix("fd00:10::/56")},
+				ServiceCIDRs: []netip.Prefix{netip.MustParsePrefix("172.0.0.0/20")},
+				NodeCIDRs:    []netip.Prefix{netip.MustParsePrefix("10.0.0.1/32")},
+			},
+			false,
+		},
+		{
+			"cilium config",
+			[]runtime.Object{
+				validPod,
+				kubeDNS,
+				validNode,
+				&corev1.ConfigMap{
+					ObjectMeta: v1.ObjectMeta{Name: "cilium-config", Namespace: "kube-system"},
+					Data:       map[string]string{"cluster-pool-ipv4-cidr": "100.64.0.0/14 100.72.0.0/14"},
+				},
+			},
+			ClusterDetails{},
+			ClusterDetails{
+				ServiceIP:    netip.MustParseAddr("172.0.0.1"),
+				PodCIDRs:     []netip.Prefix{netip.MustParsePrefix("100.64.0.0/14"), netip.MustParsePrefix("100.72.0.0/14")},
+				ServiceCIDRs: []netip.Prefix{netip.MustParsePrefix("172.0.0.1/32")},
+				NodeCIDRs:    []netip.Prefix{netip.MustParsePrefix("10.0.0.1/32")},
+			},
+			false,
+		},
+		{
+			"flannel config",
+			[]runtime.Object{
+				validPod,
+				kubeDNS,
+				validNode,
+				&corev1.ConfigMap{
+					ObjectMeta: v1.ObjectMeta{Name: "kube-flannel-cfg", Namespace: "kube-flannel"},
+					Data:       map[string]string{"net-conf.json": `{"Network": "100.64.0.0/13", "Backend": {"Type": "vxlan"}}`},
+				},
+			},
+			ClusterDetails{},
+			ClusterDetails{
+				ServiceIP:    netip.MustParseAddr("172.0.0.1"),
+				PodCIDRs:     []netip.Prefix{netip.MustParsePrefix("100.64.0.0/13")},
+				ServiceCIDRs: []netip.Prefix{netip.MustParsePrefix("172.0.0.1/32")},
+				NodeCIDRs:    []netip.Prefix{netip.MustParsePrefix("10.0.0.1/32")},
+			},
+			false,
+		},
+		{
+			"kube-proxy config",
+			[]runtime.Object{
+				validPod,
+				kubeDNS,
+				validNode,
+				&corev1.ConfigMap{
+					ObjectMeta: v1.ObjectMeta{Name: "kube-proxy", Namespace: "kube-system"},
+					Data:       map[string]string{"config.conf": "apiVersion: kubeproxy.config.k8s.io/v1alpha1\nclusterCIDR: 100.64.0.0/11\nkind: KubeProxyConfiguration\n"},
+				},
+			},
+			ClusterDetails{},
+			ClusterDetails{
+				ServiceIP:    netip.MustParseAddr("172.0.0.1"),
+				PodCIDRs:     []netip.Prefix{netip.MustParsePrefix("100.64.0.0/11")},
+				ServiceCIDRs: []netip.Prefix{netip.MustParsePrefix("172.0.0.1/32")},
+				NodeCIDRs:    []netip.Prefix{netip.MustParsePrefix("10.0.0.1/32")},
+			},
+			false,
+		},
+		{
+			"invalid config falls back",
+			[]runtime.Object{
+				validPod,
+				kubeDNS,
+				validNode,
+				&corev1.ConfigMap{
+					ObjectMeta: v1.ObjectMeta{Name: "kube-proxy", Namespace: "kube-system"},
+					Data:       map[string]string{"config.conf": "clusterCIDR: 100.64.0.0"},
+				},
+			},
+			ClusterDetails{},
+			validClusterDetails,
+			false,
+		},
+		{
+			"node pod CIDRs",
+			[]runtime.Object{
+				validPod,
+				kubeDNS,
+				&corev1.Node{
+					ObjectMeta: v1.ObjectMeta{Name: "node-0"},
+					Spec:       corev1.NodeSpec{PodCIDRs: []string{"100.64.0.0/24"}},
+					Status: corev1.NodeStatus{
+						Addresses: []corev1.NodeAddress{{Type: corev1.NodeInternalIP, Address: "10.0.0.2"}},
+					},
+				},
+				&corev1.Node{
+					ObjectMeta: v1.ObjectMeta{Name: "node-1"},
+					Spec:       corev1.NodeSpec{PodCIDRs: []string{"100.64.1.0/24"}},
+					Status: corev1.NodeStatus{
+						Addresses: []corev1.NodeAddress{{Type: corev1.NodeInternalIP, Address: "10.0.0.1"}},
+					},
+				},
+			},
+			ClusterDetails{},
+			ClusterDetails{
+				ServiceIP:    netip.MustParseAddr("172.0.0.1"),
+				PodCIDRs:     []netip.Prefix{netip.MustParsePrefix("100.64.0.0/23")},
+				ServiceCIDRs: []netip.Prefix{netip.MustParsePrefix("172.0.0.1/32")},
+				NodeCIDRs:    []netip.Prefix{netip.MustParsePrefix("10.0.0.0/30")},
+			},
+			false,
+		},
+		{
+			"ServiceCIDR objects",
+			[]runtime.Object{
+				validPod,
+				kubeDNS,
+				validNode,
+				&networkingv1beta1.ServiceCIDR{
+					ObjectMeta: v1.ObjectMeta{Name: "kubernetes"},
+					Spec:       networkingv1beta1.ServiceCIDRSpec{CIDRs: []string{"172.0.0.0/20"}},
+				},
+				&networkingv1beta1.ServiceCIDR{
+					ObjectMeta: v1.ObjectMeta{Name: "extra"},
+					Spec:       networkingv1beta1.ServiceCIDRSpec{CIDRs: []string{"192.168.0.0/24"}},
+				},
 			},
+			ClusterDetails{},
 			ClusterDetails{
-				ServiceIP:   netip.MustParseAddr("172.0.0.1"),
-				PodCIDR:     netip.MustParsePrefix("100.64.0.0/24"),
-				ServiceCIDR: netip.MustParsePrefix("172.0.0.0/12"),
-				NodeCIDR:    netip.MustParsePrefix("10.0.0.0/12"),
+				ServiceIP:    netip.MustParseAddr("172.0.0.1"),
+				PodCIDRs:     []netip.Prefix{netip.MustParsePrefix("100.64.0.1/32")},
+				ServiceCIDRs: []netip.Prefix{netip.MustParsePrefix("192.168.0.0/24"), netip.MustParsePrefix("172.0.0.0/20")},
+				NodeCIDRs:    []netip.Prefix{netip.MustParsePrefix("10.0.0.1/32")},
+			},
+			false,
+		},
+		{
+			"multiple ranges",
+			[]runtime.Object{
+				validPod,
+				&corev1.Pod{
+					ObjectMeta: v1.ObjectMeta{Name: "test-pod-2", Namespace: namespace},
+					Status:     corev1.PodStatus{PodIP: "100.96.0.1"},
+				},
+				&corev1.Service{
+					ObjectMeta: v1.ObjectMeta{Name: "test-service", Namespace: namespace},
+					Spec:       corev1.ServiceSpec{ClusterIP: "172.1.0.10"},
+				},
+				kubeDNS,
+				validNode,
+				&corev1.Node{
+					ObjectMeta: v1.ObjectMeta{Name: "node-2"},
+					Status: corev1.NodeStatus{
+						Addresses: []corev1.NodeAddress{{Type: corev1.NodeInternalIP, Address: "10.1.0.1"}},
+					},
+				},
+			},
+			ClusterDetails{},
+			ClusterDetails{
+				ServiceIP:    netip.MustParseAddr("172.0.0.1"),
+				PodCIDRs:     []netip.Prefix{netip.MustParsePrefix("100.64.0.0/10")},
+				ServiceCIDRs: []netip.Prefix{netip.MustParsePrefix("172.0.0.0/15")},
+				NodeCIDRs:    []netip.Prefix{netip.MustParsePrefix("10.0.0.0/15")},
 			},
 			false,
 		},
@@ -236,3 +501,112 @@ func TestGetClusterDetails(t *testing.T) {
 		})
 	}
 }
+
+func TestGetClusterDetailsNamespaceScoped(t *testing.T) {
+	namespace := "test-ns"
+
+	client := fake.NewClientset(
+		&corev1.Pod{
+			ObjectMeta: v1.ObjectMeta{Name: "test-pod", Namespace: namespace},
+			Status:     corev1.PodStatus{PodIP: "100.64.0.1", HostIP: "10.0.0.1"},
+		},
+		&corev1.Service{
+			ObjectMeta: v1.ObjectMeta{Name: "test-service", Namespace: namespace},
+			Spec:       corev1.ServiceSpec{ClusterIP: "172.0.0.10"},
+		},
+	)
+
+	// Only the namespace's resources are readable
+	client.PrependReactor("*", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetNamespace() == namespace {
+			return false, nil, nil
+		}
+
+		return true, nil, errors.NewForbidden(schema.GroupResource{Resource: action.GetResource().Resource}, "", fmt.Errorf("forbidden"))
+	})
+
+	got, err := ClusterDetails{}.Resolve(context.Background(), client, namespace)
+	if err != nil {
+		t.Errorf("GetClusterDetails() error = %v", err)
+		return
+	}
+
+	want := ClusterDetails{
+		PodCIDRs:     []netip.Prefix{netip.MustParsePrefix("100.64.0.1/32")},
+		ServiceCIDRs: []netip.Prefix{netip.MustParsePrefix("172.0.0.10/32")},
+		NodeCIDRs:    []netip.Prefix{netip.MustParsePrefix("10.0.0.1/32")},
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("GetClusterDetails() got = %v, want %v", got, want)
+	}
+
+	if missing := got.Missing(); !reflect.DeepEqual(missing, []string{"DNS service IP"}) {
+		t.Errorf("Missing() got = %v, want DNS service IP", missing)
+	}
+}
+
+func TestServiceCIDRObjects(t *testing.T) {
+	serviceCIDRList := func(cidr string) string {
+		return fmt.Sprintf(`{"kind": "ServiceCIDRList", "items": [{"metadata": {"name": "kubernetes"}, "spec": {"cidrs": [%q]}}]}`, cidr)
+	}
+
+	tests := []struct {
+		name      string
+		responses map[string]string
+		want      []netip.Prefix
+		wantErr   bool
+	}{
+		{
+			"v1",
+			map[string]string{
+				"/apis/networking.k8s.io/v1/servicecidrs":      serviceCIDRList("172.0.0.0/20"),
+				"/apis/networking.k8s.io/v1beta1/servicecidrs": serviceCIDRList("172.1.0.0/20"),
+			},
+			[]netip.Prefix{netip.MustParsePrefix("172.0.0.0/20")},
+			false,
+		},
+		{
+			"v1beta1",
+			map[string]string{"/apis/networking.k8s.io/v1beta1/servicecidrs": serviceCIDRList("172.1.0.0/20")},
+			[]netip.Prefix{netip.MustParsePrefix("172.1.0.0/20")},
+			false,
+		},
+		{
+			"neither",
+			map[string]string{},
+			nil,
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, ok := tt.responses[r.URL.Path]
+				if !ok {
+					http.NotFound(w, r)
+					return
+				}
+
+				w.Header().Set("Content-Type", "application/json")
+				_, _ = io.WriteString(w, body)
+			}))
+			defer server.Close()
+
+			client, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := serviceCIDRObjects(context.Background(), client)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("serviceCIDRObjects() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("serviceCIDRObjects() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 
 	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/cli-runtime/pkg/genericclioptions"
@@ -15,12 +17,15 @@ var runtimeScheme = runtime.NewScheme()
 
 func init() {
 	utilruntime.Must(appsv1.AddToScheme(runtimeScheme))
+	utilruntime.Must(corev1.AddToScheme(runtimeScheme))
 }
 
+// ResolveObject fetches the target object, resolving its resource type through discovery so that custom resources can
+// be targeted too. Built-in types are returned as their typed objects and all others as unstructured objects.
 func ResolveObject(kubeconfig string, namespace string, targetObject []string) (runtime.Object, error) {
 	clientGetter := &genericclioptions.ConfigFlags{KubeConfig: ptr.To(kubeconfig)}
 	resourceResult := resource.NewBuilder(clientGetter).
-		WithScheme(runtimeScheme, runtimeScheme.PrioritizedVersionsAllGroups()...).
+		Unstructured().
 		NamespaceParam(namespace).DefaultNamespace().
 		ResourceTypeOrNameArgs(true, targetObject...).
 		SingleResourceType().
@@ -41,5 +46,29 @@ func ResolveObject(kubeconfig string, namespace string, targetObject []string) (
 		return nil, fmt.Errorf("unable to fetch target resource: %w", err)
 	}
 
-	return object, nil
+	u, ok := object.(*unstructured.Unstructured)
+	if !ok {
+		return object, nil
+	}
+
+	return typedObject(u)
+}
+
+// typedObject converts the unstructured object to its typed equivalent if it's of a built-in type
+func typedObject(u *unstructured.Unstructured) (runtime.Object, error) {
+	gvk := u.GroupVersionKind()
+	if !runtimeScheme.Recognizes(gvk) {
+		return u, nil
+	}
+
+	typed, err := runtimeScheme.New(gvk)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create %s: %w", gvk, err)
+	}
+
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, typed); err != nil {
+		return nil, fmt.Errorf("unable to convert %s: %w", gvk, err)
+	}
+
+	return typed, nil
 }
@@ -0,0 +1,36 @@
+package kuberneteshelpers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/utils/ptr"
+)
+
+func Test_typedObject(t *testing.T) {
+	deployment := &unstructured.Unstructured{Object: map[string]any{
+		"apiVersion": "apps/v1",
+		"kind":       "Deployment",
+		"metadata":   map[string]any{"name": "foo", "namespace": "bar"},
+		"spec":       map[string]any{"replicas": int64(3)},
+	}}
+
+	obj, err := typedObject(deployment)
+	if assert.NoError(t, err) && assert.IsType(t, &appsv1.Deployment{}, obj) {
+		assert.Equal(t, "foo", obj.(*appsv1.Deployment).Name)
+		assert.Equal(t, ptr.To(int32(3)), obj.(*appsv1.Deployment).Spec.Replicas)
+	}
+
+	rollout := &unstructured.Unstructured{Object: map[string]any{
+		"apiVersion": "argoproj.io/v1alpha1",
+		"kind":       "Rollout",
+		"metadata":   map[string]any{"name": "foo", "namespace": "bar"},
+	}}
+
+	obj, err = typedObject(rollout)
+	if assert.NoError(t, err) {
+		assert.Same(t, rollout, obj)
+	}
+}
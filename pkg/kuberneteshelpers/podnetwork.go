@@ -0,0 +1,98 @@
+package kuberneteshelpers
+
+import (
+	"bufio"
+	"io"
+	"net/netip"
+	"strings"
+
+	"go4.org/netipx"
+)
+
+// DefaultClusterDomain is the cluster domain assumed when it can't be discovered
+const DefaultClusterDomain = "cluster.local"
+
+// PodNetwork is the cluster's network as seen from within a pod, discovered by the agent and reported back so that
+// cluster details can be resolved without cluster-scoped permissions
+type PodNetwork struct {
+	PodIPs        []netip.Addr   `json:"podIPs"`
+	Nameservers   []netip.Addr   `json:"nameservers"`
+	Searches      []string       `json:"searches"`
+	ClusterDomain string         `json:"clusterDomain"`
+	Routes        []netip.Prefix `json:"routes"`
+}
+
+// WithPodNetwork returns the cluster details with those which couldn't be resolved filled in from the pod's network.
+// Pod ranges cover the pod's addresses and routes, and service ranges its nameservers.
+func (c ClusterDetails) WithPodNetwork(network PodNetwork) ClusterDetails {
+	if !c.ServiceIP.IsValid() && len(network.Nameservers) > 0 {
+		c.ServiceIP = network.Nameservers[0]
+	}
+
+	if c.ClusterDomain == "" {
+		c.ClusterDomain = network.ClusterDomain
+	}
+
+	if len(c.PodCIDRs) == 0 {
+		var builder netipx.IPSetBuilder
+
+		for _, prefix := range coveringPrefixes(network.PodIPs, ipv6PrefixBits) {
+			builder.AddPrefix(prefix)
+		}
+
+		for _, route := range network.Routes {
+			builder.AddPrefix(route)
+		}
+
+		// Only invalid prefixes, which are never reported, cause errors
+		set, _ := builder.IPSet()
+		c.PodCIDRs = set.Prefixes()
+	}
+
+	if len(c.ServiceCIDRs) == 0 {
+		c.ServiceCIDRs = coveringPrefixes(network.Nameservers, ipv6ServicePrefixBits)
+	}
+
+	return c
+}
+
+// ParseResolvConf returns the nameservers and search domains of a resolv.conf file
+func ParseResolvConf(r io.Reader) ([]netip.Addr, []string, error) {
+	var (
+		nameservers []netip.Addr
+		searches    []string
+	)
+
+	scanner := bufio.NewScanner(r)
+
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+
+		switch fields[0] {
+		case "nameserver":
+			// Scoped IPv6 nameservers aren't reachable from outside the pod
+			if addr, err := netip.ParseAddr(fields[1]); err == nil && addr.Zone() == "" {
+				nameservers = append(nameservers, addr)
+			}
+		case "search":
+			// Later search lines override earlier ones
+			searches = fields[1:]
+		}
+	}
+
+	return nameservers, searches, scanner.Err()
+}
+
+// ClusterDomainFromSearches returns the cluster domain of a pod's search domains, which include svc.<cluster domain>
+func ClusterDomainFromSearches(searches []string) string {
+	for _, search := range searches {
+		if domain, ok := strings.CutPrefix(strings.TrimSuffix(search, "."), "svc."); ok && domain != "" {
+			return domain
+		}
+	}
+
+	return DefaultClusterDomain
+}
@@ -0,0 +1,91 @@
+package kuberneteshelpers
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseResolvConf(t *testing.T) {
+	contents := `# generated by the kubelet
+search test-ns.svc.example.internal svc.example.internal example.internal
+nameserver 172.0.0.10
+nameserver fe80::1%eth0
+nameserver fd12:3456:789a::a
+options ndots:5
+`
+
+	nameservers, searches, err := ParseResolvConf(strings.NewReader(contents))
+	if assert.NoError(t, err) {
+		assert.Equal(t, []netip.Addr{netip.MustParseAddr("172.0.0.10"), netip.MustParseAddr("fd12:3456:789a::a")}, nameservers)
+		assert.Equal(t, []string{"test-ns.svc.example.internal", "svc.example.internal", "example.internal"}, searches)
+	}
+}
+
+func TestClusterDomainFromSearches(t *testing.T) {
+	tests := []struct {
+		name     string
+		searches []string
+		want     string
+	}{
+		{"default", []string{"test-ns.svc.cluster.local", "svc.cluster.local", "cluster.local"}, "cluster.local"},
+		{"custom", []string{"test-ns.svc.example.internal", "svc.example.internal.", "example.internal"}, "example.internal"},
+		{"no cluster search domains", []string{"corp.example.com"}, DefaultClusterDomain},
+		{"none", nil, DefaultClusterDomain},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, ClusterDomainFromSearches(tt.searches))
+		})
+	}
+}
+
+func TestClusterDetailsWithPodNetwork(t *testing.T) {
+	network := PodNetwork{
+		PodIPs:        []netip.Addr{netip.MustParseAddr("100.64.3.4"), netip.MustParseAddr("2600:1f14:abc:de00::4")},
+		Nameservers:   []netip.Addr{netip.MustParseAddr("172.0.0.10")},
+		ClusterDomain: "example.internal",
+		Routes:        []netip.Prefix{netip.MustParsePrefix("100.65.0.0/16")},
+	}
+
+	tests := []struct {
+		name    string
+		details ClusterDetails
+		want    ClusterDetails
+	}{
+		{
+			"nothing resolved",
+			ClusterDetails{},
+			ClusterDetails{
+				ServiceIP:     netip.MustParseAddr("172.0.0.10"),
+				PodCIDRs:      []netip.Prefix{netip.MustParsePrefix("100.64.3.4/32"), netip.MustParsePrefix("100.65.0.0/16"), netip.MustParsePrefix("2600:1f14:abc:de00::/64")},
+				ServiceCIDRs:  []netip.Prefix{netip.MustParsePrefix("172.0.0.10/32")},
+				ClusterDomain: "example.internal",
+			},
+		},
+		{
+			"resolved details are kept",
+			ClusterDetails{
+				PodCIDRs:  []netip.Prefix{netip.MustParsePrefix("100.64.0.0/12")},
+				NodeCIDRs: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/16")},
+			},
+			ClusterDetails{
+				ServiceIP:     netip.MustParseAddr("172.0.0.10"),
+				PodCIDRs:      []netip.Prefix{netip.MustParsePrefix("100.64.0.0/12")},
+				ServiceCIDRs:  []netip.Prefix{netip.MustParsePrefix("172.0.0.10/32")},
+				NodeCIDRs:     []netip.Prefix{netip.MustParsePrefix("10.0.0.0/16")},
+				ClusterDomain: "example.internal",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.details.WithPodNetwork(network)
+
+			assert.Equal(t, tt.want, got)
+			assert.Empty(t, got.Missing())
+		})
+	}
+}
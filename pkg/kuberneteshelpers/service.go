@@ -0,0 +1,173 @@
+package kuberneteshelpers
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes"
+)
+
+// ResolveService resolves the service to the workload running its pods, following its selector to the pods and their
+// controllers up to the top-level workload, e.g. from a pod to its replicaset and from the replicaset to its deployment.
+// The name of the container serving the service's target port is returned too, or an empty name if no container
+// declares it.
+func ResolveService(ctx context.Context, client kubernetes.Interface, service *corev1.Service) (runtime.Object, string, error) {
+	if len(service.Spec.Selector) == 0 {
+		return nil, "", fmt.Errorf("service %s/%s has no selector", service.Namespace, service.Name)
+	}
+
+	pods, err := client.CoreV1().Pods(service.Namespace).List(ctx, v1.ListOptions{LabelSelector: labels.SelectorFromSet(service.Spec.Selector).String()})
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to list pods of service %s/%s: %w", service.Namespace, service.Name, err)
+	}
+
+	if len(pods.Items) == 0 {
+		return nil, "", fmt.Errorf("no pods match the selector of service %s/%s", service.Namespace, service.Name)
+	}
+
+	slices.SortFunc(pods.Items, func(a, b corev1.Pod) int { return strings.Compare(a.Name, b.Name) })
+
+	var (
+		workload  runtime.Object
+		container string
+		workloads []string
+	)
+
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+
+		obj, name, err := podWorkload(ctx, client, pod)
+		if err != nil {
+			return nil, "", err
+		}
+
+		if workload == nil {
+			workload = obj
+			container = targetPortContainer(service.Spec.Ports, pod.Spec.Containers)
+		}
+
+		if !slices.Contains(workloads, name) {
+			workloads = append(workloads, name)
+		}
+	}
+
+	if len(workloads) > 1 {
+		return nil, "", fmt.Errorf("service %s/%s selects pods of multiple workloads (%s), target one of them instead", service.Namespace, service.Name, strings.Join(workloads, ", "))
+	}
+
+	return workload, container, nil
+}
+
+// podWorkload walks the controllers of the pod up to the top-level workload, returning it along with its kind and name
+func podWorkload(ctx context.Context, client kubernetes.Interface, pod *corev1.Pod) (runtime.Object, string, error) {
+	owner := v1.GetControllerOf(pod)
+	if owner == nil {
+		return pod, "pod/" + pod.Name, nil
+	}
+
+	if !appsOwner(owner) {
+		return nil, "", fmt.Errorf("pod %s/%s is managed by %s %q, target it instead", pod.Namespace, pod.Name, strings.ToLower(owner.Kind), owner.Name)
+	}
+
+	switch owner.Kind {
+	case "ReplicaSet":
+		replicaSet, err := client.AppsV1().ReplicaSets(pod.Namespace).Get(ctx, owner.Name, v1.GetOptions{})
+		if err != nil {
+			return nil, "", fmt.Errorf("unable to get replicaset %s/%s: %w", pod.Namespace, owner.Name, err)
+		}
+
+		owner = v1.GetControllerOf(replicaSet)
+		if owner == nil {
+			return replicaSet, "replicaset/" + replicaSet.Name, nil
+		}
+
+		if !appsOwner(owner) || owner.Kind != "Deployment" {
+			return nil, "", fmt.Errorf("replicaset %s/%s is managed by %s %q, target it instead", replicaSet.Namespace, replicaSet.Name, strings.ToLower(owner.Kind), owner.Name)
+		}
+
+		deployment, err := client.AppsV1().Deployments(pod.Namespace).Get(ctx, owner.Name, v1.GetOptions{})
+		if err != nil {
+			return nil, "", fmt.Errorf("unable to get deployment %s/%s: %w", pod.Namespace, owner.Name, err)
+		}
+
+		return deployment, "deployment/" + deployment.Name, nil
+	case "StatefulSet":
+		statefulSet, err := client.AppsV1().StatefulSets(pod.Namespace).Get(ctx, owner.Name, v1.GetOptions{})
+		if err != nil {
+			return nil, "", fmt.Errorf("unable to get statefulset %s/%s: %w", pod.Namespace, owner.Name, err)
+		}
+
+		return statefulSet, "statefulset/" + statefulSet.Name, nil
+	case "DaemonSet":
+		daemonSet, err := client.AppsV1().DaemonSets(pod.Namespace).Get(ctx, owner.Name, v1.GetOptions{})
+		if err != nil {
+			return nil, "", fmt.Errorf("unable to get daemonset %s/%s: %w", pod.Namespace, owner.Name, err)
+		}
+
+		return daemonSet, "daemonset/" + daemonSet.Name, nil
+	}
+
+	return nil, "", fmt.Errorf("pod %s/%s is managed by %s %q, target it instead", pod.Namespace, pod.Name, strings.ToLower(owner.Kind), owner.Name)
+}
+
+// appsOwner returns whether the owner is a built-in workload rather than a custom resource of the same kind, such as an
+// OpenKruise Advanced StatefulSet
+func appsOwner(owner *v1.OwnerReference) bool {
+	gv, err := schema.ParseGroupVersion(owner.APIVersion)
+
+	return err == nil && gv.Group == appsv1.GroupName
+}
+
+// targetPortContainer returns the name of the first container declaring one of the ports' target ports, or an empty
+// name if there isn't one
+func targetPortContainer(ports []corev1.ServicePort, containers []corev1.Container) string {
+	for _, port := range ports {
+		protocol := port.Protocol
+		if protocol == "" {
+			protocol = corev1.ProtocolTCP
+		}
+
+		for _, container := range containers {
+			for _, containerPort := range container.Ports {
+				containerProtocol := containerPort.Protocol
+				if containerProtocol == "" {
+					containerProtocol = corev1.ProtocolTCP
+				}
+
+				if containerProtocol != protocol {
+					continue
+				}
+
+				if targetPortMatches(port, containerPort) {
+					return container.Name
+				}
+			}
+		}
+	}
+
+	return ""
+}
+
+// targetPortMatches returns whether the service port targets the container port, by name or number. Without a target
+// port, the service's port is used.
+func targetPortMatches(port corev1.ServicePort, containerPort corev1.ContainerPort) bool {
+	if port.TargetPort.Type == intstr.String {
+		return port.TargetPort.StrVal == containerPort.Name
+	}
+
+	number := port.TargetPort.IntVal
+	if number == 0 {
+		number = port.Port
+	}
+
+	return number == containerPort.ContainerPort
+}
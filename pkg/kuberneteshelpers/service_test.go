@@ -0,0 +1,158 @@
+package kuberneteshelpers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/utils/ptr"
+)
+
+func TestResolveService(t *testing.T) {
+	namespace := "test-ns"
+	selector := map[string]string{"app": "payments"}
+
+	controller := func(apiVersion, kind, name string) []v1.OwnerReference {
+		return []v1.OwnerReference{{APIVersion: apiVersion, Kind: kind, Name: name, Controller: ptr.To(true)}}
+	}
+
+	pod := func(name string, owners []v1.OwnerReference) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: v1.ObjectMeta{Name: name, Namespace: namespace, Labels: selector, OwnerReferences: owners},
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{
+					{Name: "proxy", Ports: []corev1.ContainerPort{{Name: "admin", ContainerPort: 9901}}},
+					{Name: "app", Ports: []corev1.ContainerPort{{Name: "http", ContainerPort: 8080}, {Name: "dns", ContainerPort: 53, Protocol: corev1.ProtocolUDP}}},
+				},
+			},
+		}
+	}
+
+	service := func(ports ...corev1.ServicePort) *corev1.Service {
+		return &corev1.Service{
+			ObjectMeta: v1.ObjectMeta{Name: "payments", Namespace: namespace},
+			Spec:       corev1.ServiceSpec{Selector: selector, Ports: ports},
+		}
+	}
+
+	deployment := &appsv1.Deployment{ObjectMeta: v1.ObjectMeta{Name: "payments", Namespace: namespace}}
+	replicaSet := &appsv1.ReplicaSet{ObjectMeta: v1.ObjectMeta{Name: "payments-abc", Namespace: namespace, OwnerReferences: controller("apps/v1", "Deployment", "payments")}}
+	statefulSet := &appsv1.StatefulSet{ObjectMeta: v1.ObjectMeta{Name: "payments", Namespace: namespace}}
+
+	tests := []struct {
+		name          string
+		service       *corev1.Service
+		objects       []runtime.Object
+		wantWorkload  runtime.Object
+		wantContainer string
+		wantErr       string
+	}{
+		{
+			"deployment with named target port",
+			service(corev1.ServicePort{Port: 80, TargetPort: intstr.FromString("http")}),
+			[]runtime.Object{deployment, replicaSet, pod("payments-abc-1", controller("apps/v1", "ReplicaSet", "payments-abc")), pod("payments-abc-2", controller("apps/v1", "ReplicaSet", "payments-abc"))},
+			deployment,
+			"app",
+			"",
+		},
+		{
+			"statefulset with numeric target port",
+			service(corev1.ServicePort{Port: 80, TargetPort: intstr.FromInt32(8080)}),
+			[]runtime.Object{statefulSet, pod("payments-0", controller("apps/v1", "StatefulSet", "payments"))},
+			statefulSet,
+			"app",
+			"",
+		},
+		{
+			"port without target port",
+			service(corev1.ServicePort{Port: 9901}),
+			[]runtime.Object{statefulSet, pod("payments-0", controller("apps/v1", "StatefulSet", "payments"))},
+			statefulSet,
+			"proxy",
+			"",
+		},
+		{
+			"target port with another protocol",
+			service(corev1.ServicePort{Port: 53, Protocol: corev1.ProtocolUDP}),
+			[]runtime.Object{statefulSet, pod("payments-0", controller("apps/v1", "StatefulSet", "payments"))},
+			statefulSet,
+			"app",
+			"",
+		},
+		{
+			"undeclared target port",
+			service(corev1.ServicePort{Port: 80, TargetPort: intstr.FromInt32(3000)}),
+			[]runtime.Object{statefulSet, pod("payments-0", controller("apps/v1", "StatefulSet", "payments"))},
+			statefulSet,
+			"",
+			"",
+		},
+		{
+			"bare pod",
+			service(corev1.ServicePort{Port: 80, TargetPort: intstr.FromString("http")}),
+			[]runtime.Object{pod("payments", nil)},
+			pod("payments", nil),
+			"app",
+			"",
+		},
+		{
+			"custom workload",
+			service(corev1.ServicePort{Port: 80}),
+			[]runtime.Object{
+				&appsv1.ReplicaSet{ObjectMeta: v1.ObjectMeta{Name: "payments-abc", Namespace: namespace, OwnerReferences: controller("argoproj.io/v1alpha1", "Rollout", "payments")}},
+				pod("payments-abc-1", controller("apps/v1", "ReplicaSet", "payments-abc")),
+			},
+			nil,
+			"",
+			`replicaset test-ns/payments-abc is managed by rollout "payments", target it instead`,
+		},
+		{
+			"multiple workloads",
+			service(corev1.ServicePort{Port: 80}),
+			[]runtime.Object{statefulSet, pod("payments", nil), pod("payments-0", controller("apps/v1", "StatefulSet", "payments"))},
+			nil,
+			"",
+			"service test-ns/payments selects pods of multiple workloads (pod/payments, statefulset/payments), target one of them instead",
+		},
+		{
+			"no pods",
+			service(corev1.ServicePort{Port: 80}),
+			[]runtime.Object{statefulSet},
+			nil,
+			"",
+			"no pods match the selector of service test-ns/payments",
+		},
+		{
+			"no selector",
+			&corev1.Service{ObjectMeta: v1.ObjectMeta{Name: "payments", Namespace: namespace}},
+			nil,
+			nil,
+			"",
+			"service test-ns/payments has no selector",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := fake.NewClientset(tt.objects...)
+
+			workload, container, err := ResolveService(context.Background(), client, tt.service)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+
+				return
+			}
+
+			if assert.NoError(t, err) {
+				assert.Equal(t, tt.wantWorkload, workload)
+				assert.Equal(t, tt.wantContainer, container)
+			}
+		})
+	}
+}
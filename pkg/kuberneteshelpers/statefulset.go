@@ -0,0 +1,39 @@
+package kuberneteshelpers
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// ResolveStatefulSetPod returns the statefulset managing the pod along with the pod's ordinal, or a nil statefulset if
+// the pod isn't managed by one
+func ResolveStatefulSetPod(ctx context.Context, client kubernetes.Interface, pod *corev1.Pod) (*appsv1.StatefulSet, int32, error) {
+	owner := v1.GetControllerOf(pod)
+	if owner == nil || owner.Kind != "StatefulSet" || !appsOwner(owner) {
+		return nil, 0, nil
+	}
+
+	sts, err := client.AppsV1().StatefulSets(pod.Namespace).Get(ctx, owner.Name, v1.GetOptions{})
+	if err != nil {
+		return nil, 0, fmt.Errorf("unable to get statefulset %s/%s: %w", pod.Namespace, owner.Name, err)
+	}
+
+	suffix, ok := strings.CutPrefix(pod.Name, sts.Name+"-")
+	if !ok {
+		return nil, 0, fmt.Errorf("unable to determine ordinal of pod %s/%s", pod.Namespace, pod.Name)
+	}
+
+	ordinal, err := strconv.ParseInt(suffix, 10, 32)
+	if err != nil {
+		return nil, 0, fmt.Errorf("unable to determine ordinal of pod %s/%s: %w", pod.Namespace, pod.Name, err)
+	}
+
+	return sts, int32(ordinal), nil
+}
@@ -0,0 +1,58 @@
+package kuberneteshelpers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/utils/ptr"
+)
+
+func TestResolveStatefulSetPod(t *testing.T) {
+	namespace := "test-ns"
+	statefulSet := &appsv1.StatefulSet{ObjectMeta: v1.ObjectMeta{Name: "kafka", Namespace: namespace}}
+	client := fake.NewClientset(statefulSet)
+
+	pod := func(name, apiVersion, kind, owner string) *corev1.Pod {
+		return &corev1.Pod{ObjectMeta: v1.ObjectMeta{
+			Name:            name,
+			Namespace:       namespace,
+			OwnerReferences: []v1.OwnerReference{{APIVersion: apiVersion, Kind: kind, Name: owner, Controller: ptr.To(true)}},
+		}}
+	}
+
+	tests := []struct {
+		name        string
+		pod         *corev1.Pod
+		wantSts     *appsv1.StatefulSet
+		wantOrdinal int32
+		wantErr     string
+	}{
+		{"statefulset pod", pod("kafka-2", "apps/v1", "StatefulSet", "kafka"), statefulSet, 2, ""},
+		{"bare pod", &corev1.Pod{ObjectMeta: v1.ObjectMeta{Name: "kafka", Namespace: namespace}}, nil, 0, ""},
+		{"replicaset pod", pod("kafka-abc", "apps/v1", "ReplicaSet", "kafka"), nil, 0, ""},
+		{"custom statefulset pod", pod("kafka-2", "apps.kruise.io/v1beta1", "StatefulSet", "kafka"), nil, 0, ""},
+		{"unexpected name", pod("other-2", "apps/v1", "StatefulSet", "kafka"), nil, 0, "unable to determine ordinal of pod test-ns/other-2"},
+		{"missing statefulset", pod("zookeeper-0", "apps/v1", "StatefulSet", "zookeeper"), nil, 0, `unable to get statefulset test-ns/zookeeper: statefulsets.apps "zookeeper" not found`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sts, ordinal, err := ResolveStatefulSetPod(context.Background(), client, tt.pod)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+
+				return
+			}
+
+			if assert.NoError(t, err) {
+				assert.Equal(t, tt.wantSts, sts)
+				assert.Equal(t, tt.wantOrdinal, ordinal)
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+//go:build darwin
+
+package overlay
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+
+	"go4.org/netipx"
+	"golang.org/x/net/route"
+	"golang.org/x/sys/unix"
+)
+
+// LocalPrefixes returns the prefixes of the local interfaces' addresses and of the routes in the routing table, such as
+// those of other VPNs
+func LocalPrefixes(_ context.Context) ([]netip.Prefix, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, fmt.Errorf("unable to list addresses: %w", err)
+	}
+
+	var prefixes []netip.Prefix
+
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			if prefix, ok := netipx.FromStdIPNet(ipNet); ok {
+				prefixes = appendLocalPrefix(prefixes, prefix)
+			}
+		}
+	}
+
+	rib, err := route.FetchRIB(unix.AF_UNSPEC, route.RIBTypeRoute, 0)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list routes: %w", err)
+	}
+
+	messages, err := route.ParseRIB(route.RIBTypeRoute, rib)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list routes: %w", err)
+	}
+
+	for _, message := range messages {
+		routeMessage, ok := message.(*route.RouteMessage)
+		if !ok || routeMessage.Flags&unix.RTF_UP == 0 || len(routeMessage.Addrs) <= unix.RTAX_NETMASK {
+			continue
+		}
+
+		if prefix, ok := routePrefix(routeMessage); ok {
+			prefixes = appendLocalPrefix(prefixes, prefix)
+		}
+	}
+
+	return prefixes, nil
+}
+
+// routePrefix returns the destination of a route, host routes having no netmask
+func routePrefix(message *route.RouteMessage) (netip.Prefix, bool) {
+	var dst, mask []byte
+
+	switch addr := message.Addrs[unix.RTAX_DST].(type) {
+	case *route.Inet4Addr:
+		dst = addr.IP[:]
+	case *route.Inet6Addr:
+		dst = addr.IP[:]
+	default:
+		return netip.Prefix{}, false
+	}
+
+	switch addr := message.Addrs[unix.RTAX_NETMASK].(type) {
+	case *route.Inet4Addr:
+		mask = addr.IP[:]
+	case *route.Inet6Addr:
+		mask = addr.IP[:]
+	}
+
+	dstAddr, _ := netip.AddrFromSlice(dst)
+	bits := dstAddr.BitLen()
+
+	if message.Flags&unix.RTF_HOST == 0 {
+		// Non-contiguous masks have no prefix length
+		ones, size := net.IPMask(mask).Size()
+		if size == 0 {
+			return netip.Prefix{}, false
+		}
+
+		bits = ones
+	}
+
+	return netip.PrefixFrom(dstAddr, bits), true
+}
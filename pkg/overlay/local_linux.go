@@ -0,0 +1,65 @@
+//go:build linux
+
+package overlay
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+
+	"github.com/go-logr/logr"
+	"github.com/jsimonetti/rtnetlink"
+	"golang.org/x/sys/unix"
+)
+
+// LocalPrefixes returns the prefixes of the local interfaces' addresses and of the routes in every routing table, such
+// as those of other VPNs
+func LocalPrefixes(ctx context.Context) ([]netip.Prefix, error) {
+	log := logr.FromContextOrDiscard(ctx)
+
+	netlink, err := rtnetlink.Dial(nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to initialize netlink client: %w", err)
+	}
+
+	defer func() {
+		if err := netlink.Close(); err != nil {
+			log.Error(err, "unable to close netlink client")
+		}
+	}()
+
+	addresses, err := netlink.Address.List()
+	if err != nil {
+		return nil, fmt.Errorf("unable to list addresses: %w", err)
+	}
+
+	var prefixes []netip.Prefix
+
+	for _, address := range addresses {
+		if address.Attributes == nil {
+			continue
+		}
+
+		if addr, ok := netip.AddrFromSlice(address.Attributes.Address); ok {
+			prefixes = appendLocalPrefix(prefixes, netip.PrefixFrom(addr.Unmap(), int(address.PrefixLength)))
+		}
+	}
+
+	routes, err := netlink.Route.List()
+	if err != nil {
+		return nil, fmt.Errorf("unable to list routes: %w", err)
+	}
+
+	for _, route := range routes {
+		// Skip broadcast, throw and other routes which don't lead anywhere
+		if route.Type != unix.RTN_UNICAST && route.Type != unix.RTN_LOCAL {
+			continue
+		}
+
+		if addr, ok := netip.AddrFromSlice(route.Attributes.Dst); ok {
+			prefixes = appendLocalPrefix(prefixes, netip.PrefixFrom(addr.Unmap(), int(route.DstLength)))
+		}
+	}
+
+	return prefixes, nil
+}
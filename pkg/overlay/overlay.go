@@ -0,0 +1,232 @@
+package overlay
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"go4.org/netipx"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// Bits is the size of IPv4 overlays, enough for the local and agent addresses of a session
+	Bits = 28
+	// IPv6Bits is the size of IPv6 overlays
+	IPv6Bits = 64
+
+	// DefaultStatePath is where the overlays chosen for each cluster context are persisted
+	DefaultStatePath = "/var/lib/kubewire/overlays.json"
+)
+
+// DefaultPool is the ranges overlays are allocated from unless configured otherwise
+var DefaultPool = []netip.Prefix{
+	netip.MustParsePrefix("10.1.0.0/24"),
+	netip.MustParsePrefix("100.64.51.0/24"),
+	netip.MustParsePrefix("fd77:676b:6f00::/56"),
+}
+
+// JoinPrefixes returns the prefixes joined by commas, e.g. to describe a pool
+func JoinPrefixes(prefixes []netip.Prefix) string {
+	values := make([]string, len(prefixes))
+	for i, prefix := range prefixes {
+		values[i] = prefix.String()
+	}
+
+	return strings.Join(values, ", ")
+}
+
+// Allocate returns the first overlay of the IP family within the pool which overlaps none of the unavailable
+// prefixes. Ranges are tried in the order of the pool.
+func Allocate(pool []netip.Prefix, ipv6 bool, unavailable []netip.Prefix) (netip.Prefix, bool) {
+	bits := Bits
+	if ipv6 {
+		bits = IPv6Bits
+	}
+
+	var unavailableBuilder netipx.IPSetBuilder
+
+	for _, prefix := range unavailable {
+		unavailableBuilder.AddPrefix(prefix.Masked())
+	}
+
+	// Only invalid prefixes, which are never added, cause errors
+	unavailableSet, _ := unavailableBuilder.IPSet()
+
+	for _, prefix := range pool {
+		if prefix.Addr().Is6() != ipv6 {
+			continue
+		}
+
+		var builder netipx.IPSetBuilder
+
+		builder.AddPrefix(prefix.Masked())
+		builder.RemoveSet(unavailableSet)
+
+		free, _ := builder.IPSet()
+
+		// Ranges smaller than an overlay are used whole
+		if prefix.Bits() > bits {
+			if free.ContainsPrefix(prefix.Masked()) {
+				return prefix.Masked(), true
+			}
+
+			continue
+		}
+
+		if overlay, _, ok := free.RemoveFreePrefix(uint8(bits)); ok {
+			return overlay, true
+		}
+	}
+
+	return netip.Prefix{}, false
+}
+
+// Available returns whether a previously allocated overlay is still within the pool and overlaps none of the
+// unavailable prefixes
+func Available(overlay netip.Prefix, pool []netip.Prefix, unavailable []netip.Prefix) bool {
+	inPool := slices.ContainsFunc(pool, func(prefix netip.Prefix) bool {
+		return prefix.Contains(overlay.Addr()) && prefix.Bits() <= overlay.Bits()
+	})
+
+	return inPool && !slices.ContainsFunc(unavailable, overlay.Overlaps)
+}
+
+// appendLocalPrefix appends a local address or route's prefix unless it's the default route or one to link-local,
+// loopback or multicast addresses, which overlays never collide with
+func appendLocalPrefix(prefixes []netip.Prefix, prefix netip.Prefix) []netip.Prefix {
+	addr := prefix.Addr()
+
+	if !prefix.IsValid() ||
+		prefix.Bits() == 0 ||
+		addr.IsLinkLocalUnicast() ||
+		addr.IsLoopback() ||
+		addr.IsMulticast() ||
+		addr.IsUnspecified() {
+		return prefixes
+	}
+
+	return append(prefixes, prefix.Masked())
+}
+
+// Store persists the overlays chosen for each cluster context, so that sessions with the same cluster keep the same
+// overlay addresses
+type Store struct {
+	path string
+}
+
+func NewStore(path string) *Store {
+	return &Store{path: path}
+}
+
+// Load returns the overlays last chosen for the cluster context, if any
+func (s *Store) Load(context string) ([]netip.Prefix, error) {
+	overlays, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+
+	return overlays[context], nil
+}
+
+// Save persists the overlays chosen for the cluster context. Concurrent sessions, possibly saving other contexts,
+// are serialized by a lock next to the file so that none of their overlays are lost.
+func (s *Store) Save(context string, overlays []netip.Prefix) (err error) {
+	dir := filepath.Dir(s.path)
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("unable to create %s: %w", dir, err)
+	}
+
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		err = errors.Join(err, unlock())
+	}()
+
+	// Other contexts' overlays are read under the lock, as another session may have saved since they were loaded
+	all, err := s.read()
+	if err != nil {
+		return err
+	}
+
+	all[context] = overlays
+
+	contents, err := json.MarshalIndent(all, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to encode overlays: %w", err)
+	}
+
+	// Write atomically so that sessions loading overlays without the lock never read a partial file
+	tmp, err := os.CreateTemp(dir, filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("unable to create temporary file in %s: %w", dir, err)
+	}
+
+	defer func() {
+		if err != nil {
+			_ = os.Remove(tmp.Name())
+		}
+	}()
+
+	if _, err := tmp.Write(contents); err != nil {
+		return errors.Join(fmt.Errorf("unable to write %s: %w", tmp.Name(), err), tmp.Close())
+	}
+
+	if err := tmp.Chmod(0o644); err != nil {
+		return errors.Join(fmt.Errorf("unable to set permissions of %s: %w", tmp.Name(), err), tmp.Close())
+	}
+
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("unable to write %s: %w", tmp.Name(), err)
+	}
+
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("unable to write %s: %w", s.path, err)
+	}
+
+	return nil
+}
+
+// lock takes an exclusive lock on the store, held until the returned function is called
+func (s *Store) lock() (func() error, error) {
+	path := s.path + ".lock"
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open %s: %w", path, err)
+	}
+
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+		return nil, errors.Join(fmt.Errorf("unable to lock %s: %w", path, err), f.Close())
+	}
+
+	// Closing the file releases the lock
+	return f.Close, nil
+}
+
+// read returns the overlays of every cluster context, none if nothing has been persisted yet
+func (s *Store) read() (map[string][]netip.Prefix, error) {
+	overlays := make(map[string][]netip.Prefix)
+
+	contents, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return overlays, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to read %s: %w", s.path, err)
+	}
+
+	if err := json.Unmarshal(contents, &overlays); err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %w", s.path, err)
+	}
+
+	return overlays, nil
+}
@@ -0,0 +1,172 @@
+package overlay
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAllocate(t *testing.T) {
+	tests := []struct {
+		name        string
+		pool        []netip.Prefix
+		ipv6        bool
+		unavailable []netip.Prefix
+		want        netip.Prefix
+		wantOK      bool
+	}{
+		{
+			"first range",
+			DefaultPool,
+			false,
+			nil,
+			netip.MustParsePrefix("10.1.0.0/28"),
+			true,
+		},
+		{
+			"partly unavailable range",
+			DefaultPool,
+			false,
+			[]netip.Prefix{netip.MustParsePrefix("10.1.0.0/27"), netip.MustParsePrefix("10.1.0.40/32")},
+			netip.MustParsePrefix("10.1.0.48/28"),
+			true,
+		},
+		{
+			"next range",
+			DefaultPool,
+			false,
+			[]netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+			netip.MustParsePrefix("100.64.51.0/28"),
+			true,
+		},
+		{
+			"tailscale",
+			[]netip.Prefix{netip.MustParsePrefix("100.64.51.0/24"), netip.MustParsePrefix("10.1.0.0/24")},
+			false,
+			[]netip.Prefix{netip.MustParsePrefix("100.64.0.0/10")},
+			netip.MustParsePrefix("10.1.0.0/28"),
+			true,
+		},
+		{
+			"range smaller than an overlay",
+			[]netip.Prefix{netip.MustParsePrefix("192.168.10.8/30")},
+			false,
+			nil,
+			netip.MustParsePrefix("192.168.10.8/30"),
+			true,
+		},
+		{
+			"ipv6",
+			DefaultPool,
+			true,
+			[]netip.Prefix{netip.MustParsePrefix("fd77:676b:6f00::/108")},
+			netip.MustParsePrefix("fd77:676b:6f00:1::/64"),
+			true,
+		},
+		{
+			"no range of the family",
+			[]netip.Prefix{netip.MustParsePrefix("10.1.0.0/24")},
+			true,
+			nil,
+			netip.Prefix{},
+			false,
+		},
+		{
+			"exhausted",
+			DefaultPool,
+			false,
+			[]netip.Prefix{netip.MustParsePrefix("10.1.0.0/16"), netip.MustParsePrefix("100.64.0.0/10")},
+			netip.Prefix{},
+			false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := Allocate(tt.pool, tt.ipv6, tt.unavailable)
+
+			assert.Equal(t, tt.wantOK, ok)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestAvailable(t *testing.T) {
+	overlay := netip.MustParsePrefix("10.1.0.16/28")
+
+	assert.True(t, Available(overlay, DefaultPool, []netip.Prefix{netip.MustParsePrefix("10.1.0.0/28")}))
+	assert.False(t, Available(overlay, DefaultPool, []netip.Prefix{netip.MustParsePrefix("10.1.0.20/32")}))
+	assert.False(t, Available(overlay, []netip.Prefix{netip.MustParsePrefix("100.64.51.0/24")}, nil))
+}
+
+func TestStore(t *testing.T) {
+	store := NewStore(filepath.Join(t.TempDir(), "kubewire", "overlays.json"))
+
+	overlays, err := store.Load("dev")
+	if assert.NoError(t, err) {
+		assert.Empty(t, overlays)
+	}
+
+	dev := []netip.Prefix{netip.MustParsePrefix("10.1.0.0/28"), netip.MustParsePrefix("fd77:676b:6f00::/64")}
+	prod := []netip.Prefix{netip.MustParsePrefix("10.1.0.16/28")}
+
+	assert.NoError(t, store.Save("dev", dev))
+	assert.NoError(t, store.Save("prod", prod))
+
+	overlays, err = store.Load("dev")
+	if assert.NoError(t, err) {
+		assert.Equal(t, dev, overlays)
+	}
+
+	overlays, err = store.Load("prod")
+	if assert.NoError(t, err) {
+		assert.Equal(t, prod, overlays)
+	}
+}
+
+func TestStoreConcurrentSave(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "overlays.json")
+
+	var wg sync.WaitGroup
+
+	// Each session has its own store, as in separate processes
+	for i := range 20 {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			overlay := netip.PrefixFrom(netip.AddrFrom4([4]byte{10, 1, byte(i), 0}), Bits)
+			assert.NoError(t, NewStore(path).Save(fmt.Sprintf("context-%d", i), []netip.Prefix{overlay}))
+		}()
+	}
+
+	wg.Wait()
+
+	for i := range 20 {
+		overlays, err := NewStore(path).Load(fmt.Sprintf("context-%d", i))
+		if assert.NoError(t, err) {
+			assert.Equal(t, []netip.Prefix{netip.PrefixFrom(netip.AddrFrom4([4]byte{10, 1, byte(i), 0}), Bits)}, overlays)
+		}
+	}
+
+	// Only the state and its lock are left behind
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if assert.NoError(t, err) {
+		assert.Len(t, entries, 2)
+	}
+}
+
+func TestAppendLocalPrefix(t *testing.T) {
+	var prefixes []netip.Prefix
+
+	for _, prefix := range []string{"0.0.0.0/0", "127.0.0.0/8", "169.254.0.0/16", "fe80::/64", "ff00::/8", "192.168.1.7/24", "100.64.0.0/10"} {
+		prefixes = appendLocalPrefix(prefixes, netip.MustParsePrefix(prefix))
+	}
+
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("192.168.1.0/24"), netip.MustParsePrefix("100.64.0.0/10")}, prefixes)
+}
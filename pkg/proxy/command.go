@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"os/user"
+	"slices"
+	"strconv"
+	"syscall"
+
+	"github.com/go-logr/logr"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	// forwardedSignals are relayed to the command while it's running
+	forwardedSignals = []os.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGUSR1, syscall.SIGUSR2}
+	// terminalSignals are sent by the terminal to its whole foreground process group, which the command shares
+	terminalSignals = []os.Signal{syscall.SIGINT, syscall.SIGQUIT}
+
+	// inForeground is overridden in tests
+	inForeground = foregroundProcessGroup
+)
+
+// ExitError is returned by Run when the command run during the session exits unsuccessfully
+type ExitError struct {
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("command exited with code %d", e.Code)
+}
+
+// runCommand runs the command until it exits, forwarding any signals received in the meantime
+func runCommand(ctx context.Context, command []string) error {
+	log := logr.FromContextOrDiscard(ctx)
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, forwardedSignals...)
+
+	defer signal.Stop(sigCh)
+
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := runAsSudoUser(cmd); err != nil {
+		return err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("unable to start command %q: %w", command[0], err)
+	}
+
+	log.Info("Started command", "command", command[0], "pid", cmd.Process.Pid)
+
+	// Forwarding Ctrl-C from the terminal would deliver it to the command twice, which many treat as a forced exit
+	foreground := inForeground()
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	for {
+		select {
+		case sig := <-sigCh:
+			if foreground && slices.Contains(terminalSignals, sig) {
+				log.V(1).Info("Command received signal from the terminal", "signal", sig)
+				continue
+			}
+
+			log.V(1).Info("Forwarding signal to command", "signal", sig)
+
+			if err := cmd.Process.Signal(sig); err != nil && !errors.Is(err, os.ErrProcessDone) {
+				log.Error(err, "unable to forward signal to command", "signal", sig)
+			}
+		case err := <-done:
+			return commandExitError(err)
+		}
+	}
+}
+
+// foregroundProcessGroup returns whether the process group shared with the command is the foreground process group of
+// the terminal on stdin, if any
+func foregroundProcessGroup() bool {
+	pgrp, err := unix.IoctlGetInt(int(os.Stdin.Fd()), unix.TIOCGPGRP)
+
+	return err == nil && pgrp == unix.Getpgrp()
+}
+
+// commandExitError converts the result of waiting on a command into an ExitError, using the shell convention of
+// 128 + the signal number if it was killed by a signal
+func commandExitError(err error) error {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return err
+	}
+
+	if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return &ExitError{Code: 128 + int(status.Signal())}
+	}
+
+	return &ExitError{Code: exitErr.ExitCode()}
+}
+
+// runAsSudoUser runs the command as the user who invoked sudo, if any, so that it doesn't run as root
+func runAsSudoUser(cmd *exec.Cmd) error {
+	uidEnv, gidEnv := os.Getenv("SUDO_UID"), os.Getenv("SUDO_GID")
+	if uidEnv == "" || gidEnv == "" || os.Geteuid() != 0 {
+		return nil
+	}
+
+	uid, err := strconv.ParseUint(uidEnv, 10, 32)
+	if err != nil {
+		return fmt.Errorf("unable to parse SUDO_UID %q: %w", uidEnv, err)
+	}
+
+	gid, err := strconv.ParseUint(gidEnv, 10, 32)
+	if err != nil {
+		return fmt.Errorf("unable to parse SUDO_GID %q: %w", gidEnv, err)
+	}
+
+	credential := &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+
+	// Keep the supplementary groups of the user where possible
+	if u, err := user.LookupId(uidEnv); err == nil {
+		if groupIDs, err := u.GroupIds(); err == nil {
+			for _, groupID := range groupIDs {
+				if id, err := strconv.ParseUint(groupID, 10, 32); err == nil {
+					credential.Groups = append(credential.Groups, uint32(id))
+				}
+			}
+		}
+	}
+
+	cmd.SysProcAttr = &syscall.SysProcAttr{Credential: credential}
+
+	return nil
+}
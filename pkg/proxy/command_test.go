@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunCommand(t *testing.T) {
+	tests := []struct {
+		name    string
+		command []string
+		code    int
+	}{
+		{name: "success", command: []string{"sh", "-c", "exit 0"}},
+		{name: "failure", command: []string{"sh", "-c", "exit 3"}, code: 3},
+		{name: "signaled", command: []string{"sh", "-c", "kill -TERM $$"}, code: 143},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := runCommand(context.Background(), tt.command)
+			if tt.code == 0 {
+				assert.NoError(t, err)
+				return
+			}
+
+			assert.Equal(t, &ExitError{Code: tt.code}, err)
+		})
+	}
+
+	t.Run("not found", func(t *testing.T) {
+		err := runCommand(context.Background(), []string{"kw-command-does-not-exist"})
+		if assert.Error(t, err) {
+			assert.False(t, errors.As(err, new(*ExitError)))
+		}
+	})
+}
+
+func TestRunCommandTerminalSignal(t *testing.T) {
+	t.Cleanup(func() { inForeground = foregroundProcessGroup })
+
+	tests := []struct {
+		name       string
+		foreground bool
+		code       int
+	}{
+		// The terminal already delivered the signal to the command
+		{name: "foreground", foreground: true},
+		{name: "background", code: 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inForeground = func() bool { return tt.foreground }
+
+			go func() {
+				time.Sleep(200 * time.Millisecond)
+				_ = syscall.Kill(syscall.Getpid(), syscall.SIGINT)
+			}()
+
+			err := runCommand(context.Background(), []string{"sh", "-c", "trap 'exit 5' INT; sleep 1"})
+			if tt.code == 0 {
+				assert.NoError(t, err)
+				return
+			}
+
+			assert.Equal(t, &ExitError{Code: tt.code}, err)
+		})
+	}
+}
@@ -3,7 +3,10 @@ package proxy
 import (
 	"context"
 	"fmt"
+	"net"
 	"net/netip"
+	"slices"
+	"strings"
 
 	"github.com/go-logr/logr"
 	"k8s.io/client-go/kubernetes"
@@ -11,6 +14,10 @@ import (
 	"github.com/steved/kubewire/pkg/config"
 	"github.com/steved/kubewire/pkg/kuberneteshelpers"
 	"github.com/steved/kubewire/pkg/nat"
+	"github.com/steved/kubewire/pkg/overlay"
+	"github.com/steved/kubewire/pkg/remap"
+	"github.com/steved/kubewire/pkg/session"
+	"github.com/steved/kubewire/pkg/wg"
 )
 
 var getClusterDetails = func(ctx context.Context, clusterDetails kuberneteshelpers.ClusterDetails, client kubernetes.Interface, namespace string) (kuberneteshelpers.ClusterDetails, error) {
@@ -21,12 +28,22 @@ var findLocalAddressAndPort = func(ctx context.Context) (string, int, error) {
 	return nat.FindLocalAddressAndPort(ctx)
 }
 
-var overlayCIDRs = []netip.Prefix{
-	netip.MustParsePrefix("10.1.0.0/28"),
-	netip.MustParsePrefix("100.64.51.0/28"),
+var localPrefixes = func(ctx context.Context) ([]netip.Prefix, error) {
+	return overlay.LocalPrefixes(ctx)
 }
 
-func ResolveWireguardConfig(ctx context.Context, proxyConfig *config.Config, client kubernetes.Interface, overlayPrefix string, directAccess bool) error {
+// overlayStatePath is where chosen overlays are persisted, overridden in tests
+var overlayStatePath = overlay.DefaultStatePath
+
+// registry tracks the sessions on the local machine, overridden in tests
+var registry = session.NewRegistry(session.DefaultRegistryPath)
+
+// ResolveWireguardConfig resolves the cluster's details and the wireguard configuration to connect to it. Overlay
+// prefixes, at most one per IP family, are allocated from the overlay pool to not overlap the cluster or local
+// addresses and routes unless given. An IPv6 overlay is only used when the cluster has IPv6 addresses. Overlays and
+// listen ports of other sessions on the local machine are avoided. When remapping, cluster ranges colliding with local
+// addresses and routes are routed under substitutes allocated from the remap pool instead.
+func ResolveWireguardConfig(ctx context.Context, proxyConfig *config.Config, client kubernetes.Interface, overlayPrefixes []string, directAccess bool) error {
 	log := logr.FromContextOrDiscard(ctx)
 
 	clusterDetails, err := getClusterDetails(ctx, proxyConfig.KubernetesClusterDetails, client, proxyConfig.Namespace)
@@ -38,51 +55,91 @@ func ResolveWireguardConfig(ctx context.Context, proxyConfig *config.Config, cli
 		"Resolved Kubernetes cluster details",
 		"service_ip",
 		clusterDetails.ServiceIP,
-		"service_cidr",
-		clusterDetails.ServiceCIDR,
-		"pod_cidr",
-		clusterDetails.PodCIDR,
-		"node_cidr",
-		clusterDetails.NodeCIDR,
+		"service_cidrs",
+		clusterDetails.ServiceCIDRs,
+		"pod_cidrs",
+		clusterDetails.PodCIDRs,
+		"node_cidrs",
+		clusterDetails.NodeCIDRs,
 	)
 
+	if missing := clusterDetails.Missing(); len(missing) > 0 {
+		log.Info("Unable to resolve all cluster details with the current permissions, they'll be discovered by the agent", "missing", missing)
+	}
+
 	proxyConfig.KubernetesClusterDetails = clusterDetails
 
-	var overlay netip.Prefix
-	if overlayPrefix != "" {
-		overlay, err = netip.ParsePrefix(overlayPrefix)
+	sessions, err := registry.List()
+	if err != nil {
+		log.Error(err, "unable to list other sessions on the local machine")
+	}
+
+	var remaps remap.Mappings
+
+	if proxyConfig.Remap {
+		remaps, err = remapColliding(ctx, proxyConfig, sessions)
+		if err != nil {
+			return err
+		}
+	}
+
+	var ipv4Overlay, ipv6Overlay netip.Prefix
+
+	for _, overlayPrefix := range overlayPrefixes {
+		prefix, err := netip.ParsePrefix(overlayPrefix)
 		if err != nil {
 			return fmt.Errorf("unable to parse overlay prefix %q: %w", overlayPrefix, err)
 		}
-	} else {
-		overlay, err = func() (netip.Prefix, error) {
-			for _, cidr := range overlayCIDRs {
-				if cidr.Overlaps(clusterDetails.PodCIDR) || cidr.Overlaps(clusterDetails.ServiceCIDR) || cidr.Overlaps(clusterDetails.NodeCIDR) {
-					continue
-				}
 
-				return cidr, nil
-			}
+		given := &ipv4Overlay
+		if prefix.Addr().Is6() {
+			given = &ipv6Overlay
+		}
 
-			return netip.Prefix{}, fmt.Errorf("unable to determine non-overlapping CIDR range for overlay network")
-		}()
+		if given.IsValid() {
+			return fmt.Errorf("only one overlay prefix of each IP family may be given, got %s and %s", given, prefix)
+		}
+
+		*given = prefix
+	}
+
+	if !ipv4Overlay.IsValid() || (!ipv6Overlay.IsValid() && clusterDetails.HasIPv6()) {
+		ipv4Overlay, ipv6Overlay, err = allocateOverlays(ctx, proxyConfig, sessions, remaps, ipv4Overlay, ipv6Overlay)
 		if err != nil {
 			return err
 		}
 	}
 
-	log.V(1).Info("Determined overlay prefix", "overlay", overlay.String())
+	log.V(1).Info("Determined overlay prefix", "overlay", ipv4Overlay.String(), "ipv6_overlay", ipv6Overlay.String())
 
-	proxyAddr := overlay.Addr()
+	proxyAddr := ipv4Overlay.Addr()
 	localOverlayAddress := proxyAddr.Next()
 	agentOverlayAddress := localOverlayAddress.Next()
 
+	overlays := []netip.Prefix{ipv4Overlay}
+
 	options := []config.WireguardOption{
 		config.WithGeneratedKeypairs(),
-		config.WithOverlay(overlay.String(), localOverlayAddress.String(), agentOverlayAddress.String()),
-		config.WithAllowedIPs(clusterDetails.PodCIDR.String(), clusterDetails.ServiceCIDR.String(), clusterDetails.NodeCIDR.String(), overlay.String()),
+		config.WithOverlay(ipv4Overlay.String(), localOverlayAddress.String(), agentOverlayAddress.String()),
+	}
+
+	if ipv6Overlay.IsValid() {
+		localIPv6OverlayAddress := ipv6Overlay.Addr().Next()
+		agentIPv6OverlayAddress := localIPv6OverlayAddress.Next()
+
+		options = append(options, config.WithIPv6Overlay(ipv6Overlay.String(), localIPv6OverlayAddress.String(), agentIPv6OverlayAddress.String()))
+		overlays = append(overlays, ipv6Overlay)
 	}
 
+	allowedIPs := clusterAllowedIPs(clusterDetails, remaps, overlays)
+
+	allowedIPStrings := make([]string, len(allowedIPs))
+	for i, prefix := range allowedIPs {
+		allowedIPStrings[i] = prefix.String()
+	}
+
+	options = append(options, config.WithAllowedIPs(allowedIPStrings...), config.WithRemaps(remaps))
+
 	if directAccess {
 		log.V(1).Info("Starting NAT address lookup")
 
@@ -102,9 +159,228 @@ func ResolveWireguardConfig(ctx context.Context, proxyConfig *config.Config, cli
 		log.Info("NAT address lookup complete", "address", localAddress)
 	} else if proxyConfig.Wireguard.LocalAddress.IsValid() {
 		options = append(options, config.WithLocalAddress(proxyConfig.Wireguard.LocalAddress))
+	} else {
+		options = append(options, config.WithListenPort(freeListenPort(sessions)))
 	}
 
 	proxyConfig.Wireguard, err = config.NewWireguardConfig(options...)
 
 	return err
 }
+
+// CompleteClusterDetails fills in the cluster details which couldn't be resolved with those discovered by the agent,
+// updating the prefixes routed through wireguard to match. Discovered ranges can't be remapped, as the agent is already
+// running, so those colliding with local addresses and routes are an error when remapping.
+func CompleteClusterDetails(ctx context.Context, proxyConfig *config.Config, network kuberneteshelpers.PodNetwork) error {
+	log := logr.FromContextOrDiscard(ctx)
+
+	clusterDetails := proxyConfig.KubernetesClusterDetails.WithPodNetwork(network)
+	if missing := clusterDetails.Missing(); len(missing) > 0 {
+		return fmt.Errorf("unable to discover %s from the agent", strings.Join(missing, ", "))
+	}
+
+	remaps := proxyConfig.Wireguard.Remaps
+
+	if proxyConfig.Remap {
+		local, err := localPrefixes(ctx)
+		if err != nil {
+			return fmt.Errorf("unable to list local addresses and routes: %w", err)
+		}
+
+		for _, prefix := range remap.Colliding(clusterDetails.Prefixes(), local) {
+			if remaps.LocalPrefixes([]netip.Prefix{prefix})[0] == prefix {
+				return fmt.Errorf("%s discovered from the agent collides with the local network and can't be remapped once the agent is running, pass --pod-cidr, --service-cidr or --node-cidr to remap it", prefix)
+			}
+		}
+	}
+
+	log.V(1).Info(
+		"Discovered Kubernetes cluster details",
+		"service_ip",
+		clusterDetails.ServiceIP,
+		"service_cidrs",
+		clusterDetails.ServiceCIDRs,
+		"pod_cidrs",
+		clusterDetails.PodCIDRs,
+		"node_cidrs",
+		clusterDetails.NodeCIDRs,
+		"cluster_domain",
+		clusterDetails.Domain(),
+	)
+
+	var overlays []netip.Prefix
+
+	for _, overlay := range []netip.Prefix{proxyConfig.Wireguard.OverlayPrefix, proxyConfig.Wireguard.IPv6OverlayPrefix} {
+		if !overlay.IsValid() {
+			continue
+		}
+
+		if slices.ContainsFunc(clusterDetails.Prefixes(), overlay.Overlaps) {
+			return fmt.Errorf("overlay prefix %s overlaps the cluster's discovered ranges, pass --overlay with an unused range", overlay)
+		}
+
+		overlays = append(overlays, overlay)
+	}
+
+	proxyConfig.KubernetesClusterDetails = clusterDetails
+	proxyConfig.Wireguard.AllowedIPs = clusterAllowedIPs(clusterDetails, remaps, overlays)
+
+	return nil
+}
+
+// clusterAllowedIPs returns the prefixes routed through wireguard, those of the cluster, or their substitutes if
+// remapped, and the overlays
+func clusterAllowedIPs(clusterDetails kuberneteshelpers.ClusterDetails, remaps remap.Mappings, overlays []netip.Prefix) []netip.Prefix {
+	return append(remaps.LocalPrefixes(clusterDetails.Prefixes()), overlays...)
+}
+
+// remapColliding allocates substitutes for the cluster ranges colliding with local addresses and routes, avoiding the
+// cluster's ranges and the overlays and substitutes of other sessions on the local machine
+func remapColliding(ctx context.Context, proxyConfig *config.Config, sessions []session.Local) (remap.Mappings, error) {
+	log := logr.FromContextOrDiscard(ctx)
+
+	clusterPrefixes := proxyConfig.KubernetesClusterDetails.Prefixes()
+
+	local, err := localPrefixes(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list local addresses and routes: %w", err)
+	}
+
+	colliding := remap.Colliding(clusterPrefixes, local)
+	if len(colliding) == 0 {
+		return nil, nil
+	}
+
+	pool := proxyConfig.RemapPool
+	if len(pool) == 0 {
+		pool = remap.DefaultPool
+	}
+
+	unavailable := append(clusterPrefixes, local...)
+	for _, other := range sessions {
+		unavailable = append(unavailable, other.Overlays...)
+		unavailable = append(unavailable, other.Substitutes...)
+	}
+
+	remaps, err := remap.Allocate(pool, colliding, unavailable)
+	if err != nil {
+		return nil, fmt.Errorf("unable to remap cluster ranges colliding with the local network, pass --remap-pool with an unused range: %w", err)
+	}
+
+	for _, mapping := range remaps {
+		log.Info("Remapping cluster range colliding with the local network", "cluster", mapping.Cluster.String(), "local", mapping.Local.String())
+	}
+
+	return remaps, nil
+}
+
+// allocateOverlays allocates the overlays of each family which weren't given from the overlay pool, avoiding the
+// cluster's ranges and local addresses and routes. Those last chosen for the cluster context are kept while they remain
+// free, and the new choice is persisted for the next session. Overlays of other sessions on the local machine are
+// avoided even before their devices exist, as are substitutes of remapped cluster ranges.
+func allocateOverlays(ctx context.Context, proxyConfig *config.Config, sessions []session.Local, remaps remap.Mappings, ipv4Overlay, ipv6Overlay netip.Prefix) (netip.Prefix, netip.Prefix, error) {
+	log := logr.FromContextOrDiscard(ctx)
+
+	clusterDetails := proxyConfig.KubernetesClusterDetails
+
+	pool := proxyConfig.OverlayPool
+	if len(pool) == 0 {
+		pool = overlay.DefaultPool
+	}
+
+	local, err := localPrefixes(ctx)
+	if err != nil {
+		return ipv4Overlay, ipv6Overlay, fmt.Errorf("unable to list local addresses and routes: %w", err)
+	}
+
+	unavailable := append(clusterDetails.Prefixes(), local...)
+	unavailable = append(unavailable, remaps.Substitutes()...)
+
+	for _, other := range sessions {
+		unavailable = append(unavailable, other.Overlays...)
+		unavailable = append(unavailable, other.Substitutes...)
+	}
+
+	store := overlay.NewStore(overlayStatePath)
+
+	var persisted []netip.Prefix
+
+	if proxyConfig.KubeContext != "" {
+		persisted, err = store.Load(proxyConfig.KubeContext)
+		if err != nil {
+			log.Error(err, "unable to load previously chosen overlays, allocating new ones")
+		}
+	}
+
+	allocate := func(given netip.Prefix, ipv6 bool) (netip.Prefix, error) {
+		if given.IsValid() {
+			return given, nil
+		}
+
+		for _, prefix := range persisted {
+			if prefix.Addr().Is6() == ipv6 && overlay.Available(prefix, pool, unavailable) {
+				return prefix, nil
+			}
+		}
+
+		if prefix, ok := overlay.Allocate(pool, ipv6, unavailable); ok {
+			return prefix, nil
+		}
+
+		family := "IPv4"
+		if ipv6 {
+			family = "IPv6"
+		}
+
+		return netip.Prefix{}, fmt.Errorf(
+			"no free %s overlay range in the pool %s, each overlaps the cluster's ranges or local addresses and routes; pass --overlay-pool or --overlay with an unused range",
+			family,
+			overlay.JoinPrefixes(pool),
+		)
+	}
+
+	if ipv4Overlay, err = allocate(ipv4Overlay, false); err != nil {
+		return ipv4Overlay, ipv6Overlay, err
+	}
+
+	if clusterDetails.HasIPv6() {
+		if ipv6Overlay, err = allocate(ipv6Overlay, true); err != nil {
+			return ipv4Overlay, ipv6Overlay, err
+		}
+	}
+
+	if proxyConfig.KubeContext != "" && proxyConfig.DryRun == "" {
+		overlays := []netip.Prefix{ipv4Overlay}
+		if ipv6Overlay.IsValid() {
+			overlays = append(overlays, ipv6Overlay)
+		}
+
+		if err := store.Save(proxyConfig.KubeContext, overlays); err != nil {
+			log.Error(err, "unable to persist chosen overlays")
+		}
+	}
+
+	return ipv4Overlay, ipv6Overlay, nil
+}
+
+// freeListenPort returns the first port from the default wireguard port which isn't used by other sessions and can be
+// bound, e.g. isn't used by another wireguard interface or program
+func freeListenPort(sessions []session.Local) int {
+	listenPort := wg.DefaultWireguardPort
+
+	for slices.ContainsFunc(sessions, func(other session.Local) bool { return other.ListenPort == listenPort }) || !bindable(listenPort) {
+		listenPort++
+	}
+
+	return listenPort
+}
+
+// bindable returns whether the UDP port can be listened on
+func bindable(port int) bool {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+	if err != nil {
+		return false
+	}
+
+	return conn.Close() == nil
+}
@@ -2,50 +2,70 @@ package proxy
 
 import (
 	"context"
+	"net"
 	"net/netip"
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 
+	"github.com/stretchr/testify/assert"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/fake"
 
 	"github.com/steved/kubewire/pkg/config"
 	"github.com/steved/kubewire/pkg/kuberneteshelpers"
+	"github.com/steved/kubewire/pkg/remap"
+	"github.com/steved/kubewire/pkg/session"
+	"github.com/steved/kubewire/pkg/wg"
 )
 
 func TestResolveWireguardConfig(t *testing.T) {
 	validClusterDetails := kuberneteshelpers.ClusterDetails{
-		ServiceIP:   netip.MustParseAddr("172.0.0.1"),
-		PodCIDR:     netip.MustParsePrefix("100.64.0.0/16"),
-		ServiceCIDR: netip.MustParsePrefix("172.0.0.0/16"),
-		NodeCIDR:    netip.MustParsePrefix("10.0.0.0/16"),
+		ServiceIP:    netip.MustParseAddr("172.0.0.1"),
+		PodCIDRs:     []netip.Prefix{netip.MustParsePrefix("100.64.0.0/16")},
+		ServiceCIDRs: []netip.Prefix{netip.MustParsePrefix("172.0.0.0/16")},
+		NodeCIDRs:    []netip.Prefix{netip.MustParsePrefix("10.0.0.0/16")},
 	}
 
 	overlappingClusterDetails := kuberneteshelpers.ClusterDetails{
-		ServiceIP:   netip.MustParseAddr("172.0.0.1"),
-		PodCIDR:     netip.MustParsePrefix("100.64.51.0/16"),
-		ServiceCIDR: netip.MustParsePrefix("172.0.0.0/16"),
-		NodeCIDR:    netip.MustParsePrefix("10.1.0.0/16"),
+		ServiceIP:    netip.MustParseAddr("172.0.0.1"),
+		PodCIDRs:     []netip.Prefix{netip.MustParsePrefix("100.64.51.0/16")},
+		ServiceCIDRs: []netip.Prefix{netip.MustParsePrefix("172.0.0.0/16")},
+		NodeCIDRs:    []netip.Prefix{netip.MustParsePrefix("10.1.0.0/16")},
+	}
+
+	dualStackClusterDetails := kuberneteshelpers.ClusterDetails{
+		ServiceIP:    netip.MustParseAddr("172.0.0.1"),
+		PodCIDRs:     []netip.Prefix{netip.MustParsePrefix("100.64.0.0/16"), netip.MustParsePrefix("2600:1f14:abc:de00::/64")},
+		ServiceCIDRs: []netip.Prefix{netip.MustParsePrefix("172.0.0.0/16"), netip.MustParsePrefix("fd77:676b:6f00::/108")},
+		NodeCIDRs:    []netip.Prefix{netip.MustParsePrefix("10.0.0.0/16")},
 	}
 
 	findLocalAddressAndPort = func(_ context.Context) (string, int, error) {
 		return "1.2.3.4", 9080, nil
 	}
 
+	localPrefixes = func(_ context.Context) ([]netip.Prefix, error) {
+		return []netip.Prefix{netip.MustParsePrefix("192.168.1.0/24")}, nil
+	}
+
+	registry = session.NewRegistry(t.TempDir())
+
 	defaultOverlay := netip.MustParsePrefix("10.1.0.0/28")
 
 	tests := []struct {
-		name           string
-		clusterDetails kuberneteshelpers.ClusterDetails
-		overlayPrefix  string
-		directAccess   bool
-		want           config.Wireguard
-		wantErr        bool
+		name            string
+		clusterDetails  kuberneteshelpers.ClusterDetails
+		overlayPrefixes []string
+		directAccess    bool
+		want            config.Wireguard
+		wantErr         bool
 	}{
 		{
 			"invalid overlay prefix",
 			validClusterDetails,
-			"1.2./1",
+			[]string{"1.2./1"},
 			false,
 			config.Wireguard{},
 			true,
@@ -53,7 +73,7 @@ func TestResolveWireguardConfig(t *testing.T) {
 		{
 			"overlapping CIDR prefixes",
 			overlappingClusterDetails,
-			"",
+			nil,
 			false,
 			config.Wireguard{},
 			true,
@@ -61,18 +81,19 @@ func TestResolveWireguardConfig(t *testing.T) {
 		{
 			"valid",
 			validClusterDetails,
-			"",
+			nil,
 			false,
 			config.Wireguard{
 				DirectAccess:        false,
 				LocalAddress:        netip.AddrPort{},
+				ListenPort:          19070,
 				OverlayPrefix:       defaultOverlay,
 				LocalOverlayAddress: netip.MustParseAddr("10.1.0.1"),
 				AgentOverlayAddress: netip.MustParseAddr("10.1.0.2"),
 				AllowedIPs: []netip.Prefix{
-					validClusterDetails.PodCIDR,
-					validClusterDetails.ServiceCIDR,
-					validClusterDetails.NodeCIDR,
+					netip.MustParsePrefix("100.64.0.0/16"),
+					netip.MustParsePrefix("172.0.0.0/16"),
+					netip.MustParsePrefix("10.0.0.0/16"),
 					defaultOverlay,
 				},
 			},
@@ -81,18 +102,19 @@ func TestResolveWireguardConfig(t *testing.T) {
 		{
 			"overlay prefix",
 			validClusterDetails,
-			"192.168.0.0/16",
+			[]string{"192.168.0.0/16"},
 			false,
 			config.Wireguard{
 				DirectAccess:        false,
 				LocalAddress:        netip.AddrPort{},
+				ListenPort:          19070,
 				OverlayPrefix:       netip.MustParsePrefix("192.168.0.0/16"),
 				LocalOverlayAddress: netip.MustParseAddr("192.168.0.1"),
 				AgentOverlayAddress: netip.MustParseAddr("192.168.0.2"),
 				AllowedIPs: []netip.Prefix{
-					validClusterDetails.PodCIDR,
-					validClusterDetails.ServiceCIDR,
-					validClusterDetails.NodeCIDR,
+					netip.MustParsePrefix("100.64.0.0/16"),
+					netip.MustParsePrefix("172.0.0.0/16"),
+					netip.MustParsePrefix("10.0.0.0/16"),
 					netip.MustParsePrefix("192.168.0.0/16"),
 				},
 			},
@@ -101,7 +123,7 @@ func TestResolveWireguardConfig(t *testing.T) {
 		{
 			"direct access",
 			validClusterDetails,
-			"",
+			nil,
 			true,
 			config.Wireguard{
 				DirectAccess:        true,
@@ -110,10 +132,68 @@ func TestResolveWireguardConfig(t *testing.T) {
 				LocalOverlayAddress: netip.MustParseAddr("10.1.0.1"),
 				AgentOverlayAddress: netip.MustParseAddr("10.1.0.2"),
 				AllowedIPs: []netip.Prefix{
-					validClusterDetails.PodCIDR,
-					validClusterDetails.ServiceCIDR,
-					validClusterDetails.NodeCIDR,
+					netip.MustParsePrefix("100.64.0.0/16"),
+					netip.MustParsePrefix("172.0.0.0/16"),
+					netip.MustParsePrefix("10.0.0.0/16"),
+					defaultOverlay,
+				},
+			},
+			false,
+		},
+		{
+			"two overlay prefixes of a family",
+			validClusterDetails,
+			[]string{"192.168.0.0/16", "192.169.0.0/16"},
+			false,
+			config.Wireguard{},
+			true,
+		},
+		{
+			"dual-stack",
+			dualStackClusterDetails,
+			nil,
+			false,
+			config.Wireguard{
+				ListenPort:              19070,
+				OverlayPrefix:           defaultOverlay,
+				LocalOverlayAddress:     netip.MustParseAddr("10.1.0.1"),
+				AgentOverlayAddress:     netip.MustParseAddr("10.1.0.2"),
+				IPv6OverlayPrefix:       netip.MustParsePrefix("fd77:676b:6f00:1::/64"),
+				LocalIPv6OverlayAddress: netip.MustParseAddr("fd77:676b:6f00:1::1"),
+				AgentIPv6OverlayAddress: netip.MustParseAddr("fd77:676b:6f00:1::2"),
+				AllowedIPs: []netip.Prefix{
+					netip.MustParsePrefix("100.64.0.0/16"),
+					netip.MustParsePrefix("2600:1f14:abc:de00::/64"),
+					netip.MustParsePrefix("172.0.0.0/16"),
+					netip.MustParsePrefix("fd77:676b:6f00::/108"),
+					netip.MustParsePrefix("10.0.0.0/16"),
 					defaultOverlay,
+					netip.MustParsePrefix("fd77:676b:6f00:1::/64"),
+				},
+			},
+			false,
+		},
+		{
+			"dual-stack overlay prefixes",
+			dualStackClusterDetails,
+			[]string{"fd00:1::/64", "192.168.0.0/16"},
+			false,
+			config.Wireguard{
+				ListenPort:              19070,
+				OverlayPrefix:           netip.MustParsePrefix("192.168.0.0/16"),
+				LocalOverlayAddress:     netip.MustParseAddr("192.168.0.1"),
+				AgentOverlayAddress:     netip.MustParseAddr("192.168.0.2"),
+				IPv6OverlayPrefix:       netip.MustParsePrefix("fd00:1::/64"),
+				LocalIPv6OverlayAddress: netip.MustParseAddr("fd00:1::1"),
+				AgentIPv6OverlayAddress: netip.MustParseAddr("fd00:1::2"),
+				AllowedIPs: []netip.Prefix{
+					netip.MustParsePrefix("100.64.0.0/16"),
+					netip.MustParsePrefix("2600:1f14:abc:de00::/64"),
+					netip.MustParsePrefix("172.0.0.0/16"),
+					netip.MustParsePrefix("fd77:676b:6f00::/108"),
+					netip.MustParsePrefix("10.0.0.0/16"),
+					netip.MustParsePrefix("192.168.0.0/16"),
+					netip.MustParsePrefix("fd00:1::/64"),
 				},
 			},
 			false,
@@ -126,12 +206,12 @@ func TestResolveWireguardConfig(t *testing.T) {
 			}
 
 			cfg := &config.Config{}
-			if err := ResolveWireguardConfig(context.Background(), cfg, fake.NewClientset(), tt.overlayPrefix, tt.directAccess); (err != nil) != tt.wantErr {
+			if err := ResolveWireguardConfig(context.Background(), cfg, fake.NewClientset(), tt.overlayPrefixes, tt.directAccess); (err != nil) != tt.wantErr {
 				t.Errorf("ResolveWireguardConfig() error = %v, expected %v", err, tt.wantErr)
 				return
 			}
 
-			if cfg.KubernetesClusterDetails != tt.clusterDetails {
+			if !reflect.DeepEqual(cfg.KubernetesClusterDetails, tt.clusterDetails) {
 				t.Errorf("ResolveWireguardConfig() cluster details got = %v, want %v", cfg.KubernetesClusterDetails, tt.clusterDetails)
 			}
 
@@ -148,3 +228,234 @@ func TestResolveWireguardConfig(t *testing.T) {
 		})
 	}
 }
+
+func TestResolveWireguardConfigAllocation(t *testing.T) {
+	clusterDetails := kuberneteshelpers.ClusterDetails{
+		ServiceIP:    netip.MustParseAddr("172.0.0.1"),
+		PodCIDRs:     []netip.Prefix{netip.MustParsePrefix("100.64.0.0/16")},
+		ServiceCIDRs: []netip.Prefix{netip.MustParsePrefix("172.0.0.0/16")},
+	}
+
+	getClusterDetails = func(_ context.Context, _ kuberneteshelpers.ClusterDetails, _ kubernetes.Interface, _ string) (kuberneteshelpers.ClusterDetails, error) {
+		return clusterDetails, nil
+	}
+
+	overlayStatePath = filepath.Join(t.TempDir(), "overlays.json")
+	registry = session.NewRegistry(t.TempDir())
+
+	var local []netip.Prefix
+
+	localPrefixes = func(_ context.Context) ([]netip.Prefix, error) {
+		return local, nil
+	}
+
+	resolve := func(pool ...netip.Prefix) (netip.Prefix, error) {
+		cfg := &config.Config{KubeContext: "test-context", OverlayPool: pool}
+		err := ResolveWireguardConfig(context.Background(), cfg, fake.NewClientset(), nil, false)
+
+		return cfg.Wireguard.OverlayPrefix, err
+	}
+
+	// Another VPN routes part of the pool
+	local = []netip.Prefix{netip.MustParsePrefix("10.1.0.0/28")}
+
+	overlay, err := resolve()
+	if assert.NoError(t, err) {
+		assert.Equal(t, netip.MustParsePrefix("10.1.0.16/28"), overlay)
+	}
+
+	// The overlay persisted for the context is kept while it's free
+	local = nil
+
+	overlay, err = resolve()
+	if assert.NoError(t, err) {
+		assert.Equal(t, netip.MustParsePrefix("10.1.0.16/28"), overlay)
+	}
+
+	local = []netip.Prefix{netip.MustParsePrefix("10.1.0.16/32")}
+
+	overlay, err = resolve()
+	if assert.NoError(t, err) {
+		assert.Equal(t, netip.MustParsePrefix("10.1.0.0/28"), overlay)
+	}
+
+	// Another session on the local machine uses the overlay and listen port, before its device exists
+	local = nil
+
+	registry = session.NewRegistry(t.TempDir())
+	assert.NoError(t, registry.Register(session.Local{PID: os.Getpid(), Overlays: []netip.Prefix{netip.MustParsePrefix("10.1.0.0/28")}, ListenPort: 19070}))
+
+	cfg := &config.Config{}
+	if assert.NoError(t, ResolveWireguardConfig(context.Background(), cfg, fake.NewClientset(), nil, false)) {
+		assert.Equal(t, netip.MustParsePrefix("10.1.0.16/28"), cfg.Wireguard.OverlayPrefix)
+		assert.Equal(t, 19071, cfg.Wireguard.ListenPort)
+	}
+
+	// Nothing fits in the pool
+	_, err = resolve(netip.MustParsePrefix("100.64.51.0/24"))
+	assert.EqualError(t, err, "no free IPv4 overlay range in the pool 100.64.51.0/24, each overlaps the cluster's ranges or local addresses and routes; pass --overlay-pool or --overlay with an unused range")
+}
+
+func TestResolveWireguardConfigRemap(t *testing.T) {
+	getClusterDetails = func(_ context.Context, _ kuberneteshelpers.ClusterDetails, _ kubernetes.Interface, _ string) (kuberneteshelpers.ClusterDetails, error) {
+		return kuberneteshelpers.ClusterDetails{
+			ServiceIP:    netip.MustParseAddr("172.0.0.10"),
+			PodCIDRs:     []netip.Prefix{netip.MustParsePrefix("10.0.0.0/16")},
+			ServiceCIDRs: []netip.Prefix{netip.MustParsePrefix("172.0.0.0/16")},
+		}, nil
+	}
+
+	// The office network collides with the cluster's pods
+	localPrefixes = func(_ context.Context) ([]netip.Prefix, error) {
+		return []netip.Prefix{netip.MustParsePrefix("10.0.1.0/24")}, nil
+	}
+
+	overlayStatePath = filepath.Join(t.TempDir(), "overlays.json")
+	registry = session.NewRegistry(t.TempDir())
+
+	cfg := &config.Config{Remap: true}
+	if !assert.NoError(t, ResolveWireguardConfig(context.Background(), cfg, fake.NewClientset(), nil, false)) {
+		return
+	}
+
+	assert.Equal(t, remap.Mappings{{Cluster: netip.MustParsePrefix("10.0.0.0/16"), Local: netip.MustParsePrefix("100.96.0.0/16")}}, cfg.Wireguard.Remaps)
+	assert.Equal(
+		t,
+		[]netip.Prefix{
+			netip.MustParsePrefix("100.96.0.0/16"),
+			netip.MustParsePrefix("172.0.0.0/16"),
+			netip.MustParsePrefix("10.1.0.0/28"),
+		},
+		cfg.Wireguard.AllowedIPs,
+	)
+
+	// Queries are answered by the agent, which rewrites them to the substitutes
+	assert.Equal(t, netip.MustParseAddr("10.1.0.2"), dnsServer(cfg))
+
+	// Without remapping, the cluster's ranges are routed as is
+	cfg = &config.Config{}
+	if assert.NoError(t, ResolveWireguardConfig(context.Background(), cfg, fake.NewClientset(), nil, false)) {
+		assert.Empty(t, cfg.Wireguard.Remaps)
+		assert.Equal(t, netip.MustParsePrefix("10.0.0.0/16"), cfg.Wireguard.AllowedIPs[0])
+		assert.Equal(t, netip.MustParseAddr("172.0.0.10"), dnsServer(cfg))
+	}
+
+	// Substitutes of other sessions on the local machine are avoided
+	assert.NoError(t, registry.Register(session.Local{PID: os.Getpid(), Substitutes: []netip.Prefix{netip.MustParsePrefix("100.96.0.0/16")}}))
+
+	cfg = &config.Config{Remap: true}
+	if assert.NoError(t, ResolveWireguardConfig(context.Background(), cfg, fake.NewClientset(), nil, false)) {
+		assert.Equal(t, netip.MustParsePrefix("100.97.0.0/16"), cfg.Wireguard.Remaps[0].Local)
+	}
+
+	// Nothing fits in the pool
+	cfg = &config.Config{Remap: true, RemapPool: []netip.Prefix{netip.MustParsePrefix("198.18.0.0/24")}}
+	assert.Error(t, ResolveWireguardConfig(context.Background(), cfg, fake.NewClientset(), nil, false))
+}
+
+func TestCompleteClusterDetails(t *testing.T) {
+	network := kuberneteshelpers.PodNetwork{
+		PodIPs:        []netip.Addr{netip.MustParseAddr("100.64.0.5")},
+		Nameservers:   []netip.Addr{netip.MustParseAddr("172.0.0.10")},
+		ClusterDomain: "example.internal",
+	}
+
+	namespaceScopedClusterDetails := kuberneteshelpers.ClusterDetails{
+		PodCIDRs:  []netip.Prefix{netip.MustParsePrefix("100.64.0.0/16")},
+		NodeCIDRs: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/16")},
+	}
+
+	tests := []struct {
+		name           string
+		clusterDetails kuberneteshelpers.ClusterDetails
+		network        kuberneteshelpers.PodNetwork
+		overlay        string
+		want           kuberneteshelpers.ClusterDetails
+		wantAllowedIPs []netip.Prefix
+		wantErr        bool
+	}{
+		{
+			"namespace-scoped",
+			namespaceScopedClusterDetails,
+			network,
+			"10.1.0.0/28",
+			kuberneteshelpers.ClusterDetails{
+				ServiceIP:     netip.MustParseAddr("172.0.0.10"),
+				PodCIDRs:      []netip.Prefix{netip.MustParsePrefix("100.64.0.0/16")},
+				ServiceCIDRs:  []netip.Prefix{netip.MustParsePrefix("172.0.0.10/32")},
+				NodeCIDRs:     []netip.Prefix{netip.MustParsePrefix("10.0.0.0/16")},
+				ClusterDomain: "example.internal",
+			},
+			[]netip.Prefix{
+				netip.MustParsePrefix("100.64.0.0/16"),
+				netip.MustParsePrefix("172.0.0.10/32"),
+				netip.MustParsePrefix("10.0.0.0/16"),
+				netip.MustParsePrefix("10.1.0.0/28"),
+			},
+			false,
+		},
+		{
+			"no nameservers",
+			namespaceScopedClusterDetails,
+			kuberneteshelpers.PodNetwork{PodIPs: network.PodIPs},
+			"10.1.0.0/28",
+			kuberneteshelpers.ClusterDetails{},
+			nil,
+			true,
+		},
+		{
+			"overlapping overlay",
+			namespaceScopedClusterDetails,
+			network,
+			"172.0.0.0/28",
+			kuberneteshelpers.ClusterDetails{},
+			nil,
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{KubernetesClusterDetails: tt.clusterDetails}
+			cfg.Wireguard.OverlayPrefix = netip.MustParsePrefix(tt.overlay)
+
+			if err := CompleteClusterDetails(context.Background(), cfg, tt.network); (err != nil) != tt.wantErr {
+				t.Errorf("CompleteClusterDetails() error = %v, expected %v", err, tt.wantErr)
+				return
+			}
+
+			if tt.wantErr {
+				return
+			}
+
+			if !reflect.DeepEqual(cfg.KubernetesClusterDetails, tt.want) {
+				t.Errorf("CompleteClusterDetails() cluster details got = %v, want %v", cfg.KubernetesClusterDetails, tt.want)
+			}
+
+			if !reflect.DeepEqual(cfg.Wireguard.AllowedIPs, tt.wantAllowedIPs) {
+				t.Errorf("CompleteClusterDetails() allowed IPs got = %v, want %v", cfg.Wireguard.AllowedIPs, tt.wantAllowedIPs)
+			}
+		})
+	}
+	// Service ranges discovered by the agent collide with the local network, but the agent can no longer remap them
+	localPrefixes = func(_ context.Context) ([]netip.Prefix, error) {
+		return []netip.Prefix{netip.MustParsePrefix("172.0.0.0/24")}, nil
+	}
+
+	cfg := &config.Config{Remap: true, KubernetesClusterDetails: namespaceScopedClusterDetails}
+	cfg.Wireguard.OverlayPrefix = netip.MustParsePrefix("10.1.0.0/28")
+
+	assert.Error(t, CompleteClusterDetails(context.Background(), cfg, network))
+}
+
+func Test_freeListenPort(t *testing.T) {
+	// Another program listens on the default port, outside of any session
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: wg.DefaultWireguardPort})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	assert.Equal(t, wg.DefaultWireguardPort+1, freeListenPort(nil))
+	assert.Equal(t, wg.DefaultWireguardPort+2, freeListenPort([]session.Local{{ListenPort: wg.DefaultWireguardPort + 1}}))
+}
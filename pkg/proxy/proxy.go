@@ -2,127 +2,372 @@ package proxy
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io/fs"
 	"net/netip"
 	"os"
 	"os/signal"
+	"slices"
 	"syscall"
+	"time"
 
 	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 
 	"github.com/steved/kubewire/pkg/agent"
 	"github.com/steved/kubewire/pkg/config"
+	"github.com/steved/kubewire/pkg/journal"
 	"github.com/steved/kubewire/pkg/routing"
 	"github.com/steved/kubewire/pkg/runnable"
+	"github.com/steved/kubewire/pkg/session"
 	"github.com/steved/kubewire/pkg/wg"
 )
 
-var stopFuncs []runnable.StopFunc
+// journalPath is the directory local changes are journaled in, overridden in tests
+var journalPath = journal.DefaultPath
+
+// proxySession is a session running on the local machine, torn down independently of any others
+type proxySession struct {
+	cfg                  *config.Config
+	kubernetesClient     kubernetes.Interface
+	kubernetesRestConfig *rest.Config
+
+	// local is the session's registration with the other sessions on the local machine
+	local session.Local
+	// stopFuncs tear down what's been set up so far, in reverse order
+	stopFuncs []runnable.StopFunc
+}
 
 func Run(ctx context.Context, cfg *config.Config, kubernetesClient kubernetes.Interface, kubernetesRestConfig *rest.Config) error {
 	log := logr.FromContextOrDiscard(ctx)
 
-	defer func() {
-		for _, stop := range stopFuncs {
-			stop()
+	// Cancel any in-progress setup on interrupt so that changes made so far are rolled back
+	ctx, cancel := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	if cfg.DryRun != "" {
+		return dryRun(ctx, cfg, kubernetesClient, kubernetesRestConfig)
+	}
+
+	s := &proxySession{cfg: cfg, kubernetesClient: kubernetesClient, kubernetesRestConfig: kubernetesRestConfig}
+	defer s.stop()
+
+	ctx = s.openJournal(ctx)
+
+	if err := s.register(ctx); err != nil {
+		return err
+	}
+
+	if cfg.ExportWireguardConfig != "" {
+		agentAddress, err := s.kubernetesSetup(ctx)
+		if err != nil {
+			return err
 		}
-	}()
 
-	if cfg.Wireguard.LocalAddress.IsValid() {
-		if err := wireguardDeviceSetup(ctx, cfg, netip.AddrPort{}); err != nil {
+		if err := exportWireguardConfig(ctx, cfg, agentAddress); err != nil {
+			return err
+		}
+	} else if cfg.Wireguard.LocalAddress.IsValid() && len(cfg.KubernetesClusterDetails.Missing()) == 0 {
+		// The device's routes are already known, unless the agent has to discover the cluster's details first
+		if err := s.wireguardDeviceSetup(ctx, netip.AddrPort{}); err != nil {
 			return err
 		}
 
-		if _, err := kubernetesSetup(ctx, cfg, kubernetesClient, kubernetesRestConfig); err != nil {
+		if _, err := s.kubernetesSetup(ctx); err != nil {
 			return err
 		}
 	} else {
-		agentAddress, err := kubernetesSetup(ctx, cfg, kubernetesClient, kubernetesRestConfig)
+		agentAddress, err := s.kubernetesSetup(ctx)
 		if err != nil {
 			return err
 		}
 
-		if err := wireguardDeviceSetup(ctx, cfg, agentAddress); err != nil {
+		if err := s.wireguardDeviceSetup(ctx, agentAddress); err != nil {
 			return err
 		}
 	}
 
+	if len(cfg.Command) > 0 {
+		log.Info("Started, running command")
+
+		return runCommand(ctx, cfg.Command)
+	}
+
 	log.Info("Started. Use Ctrl-C to exit...")
 
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
-	<-sigCh
+	<-ctx.Done()
 
 	return nil
 }
 
-func wireguardDeviceSetup(ctx context.Context, cfg *config.Config, agentAddress netip.AddrPort) error {
+// dryRun prints the changes which would be made to the cluster without making them or setting up a local device
+func dryRun(ctx context.Context, cfg *config.Config, kubernetesClient kubernetes.Interface, kubernetesRestConfig *rest.Config) error {
+	kubernetesAgent := agent.NewKubernetesAgent(cfg, kubernetesClient, kubernetesRestConfig)
+
+	changes, err := kubernetesAgent.DryRun(ctx, cfg.DryRun == config.DryRunServer)
+	if err != nil {
+		return err
+	}
+
+	return agent.RenderChanges(os.Stdout, changes, cfg.DryRunOutput == config.DryRunOutputDiff)
+}
+
+// stop tears down the session in the reverse order it was set up
+func (s *proxySession) stop() {
+	for _, stop := range slices.Backward(s.stopFuncs) {
+		stop()
+	}
+}
+
+// openJournal rolls back changes left behind by sessions which didn't exit cleanly, then opens the session's own
+// journal, returning a context its local changes are recorded with
+func (s *proxySession) openJournal(ctx context.Context) context.Context {
 	log := logr.FromContextOrDiscard(ctx)
 
-	log.V(1).Info("Starting Wireguard device setup")
+	// Exporting the wireguard configuration may not need root, nor then makes local changes to journal
+	if _, err := journal.Recover(ctx, journalPath); errors.Is(err, fs.ErrPermission) {
+		log.V(1).Info("Unable to read journals of previous sessions", "error", err.Error())
+	} else if err != nil {
+		log.Error(err, "unable to roll back local changes of previous sessions, run kw cleanup --local")
+	}
 
-	listenPort := 0
-	if cfg.Wireguard.LocalAddress.IsValid() {
-		listenPort = int(cfg.Wireguard.LocalAddress.Port())
+	j, err := journal.Open(journalPath)
+	if err != nil {
+		log.Info("Unable to journal local changes, they won't be rolled back if kw doesn't exit cleanly", "error", err.Error())
+		return ctx
 	}
 
-	wireguardDevice := wg.NewWireguardDevice(wg.WireguardDeviceConfig{
-		Peer: wg.WireguardDevicePeer{
-			Endpoint:   agentAddress,
-			PublicKey:  cfg.Wireguard.AgentKey.PublicKey(),
-			AllowedIPs: cfg.Wireguard.AllowedIPs,
-		},
-		PrivateKey: cfg.Wireguard.LocalKey.Key,
-		ListenPort: listenPort,
-		Address:    cfg.Wireguard.LocalOverlayAddress,
+	s.stopFuncs = append(s.stopFuncs, func() {
+		// The context is already canceled when stopping
+		if err := j.Close(context.WithoutCancel(ctx)); err != nil {
+			log.Error(err, "unable to close journal")
+		}
 	})
 
+	return journal.NewContext(ctx, j)
+}
+
+// register registers the session with the other sessions on the local machine, failing if another session started
+// concurrently with the same overlays or listen port
+func (s *proxySession) register(ctx context.Context) error {
+	log := logr.FromContextOrDiscard(ctx)
+
+	s.local = session.Local{
+		PID:         os.Getpid(),
+		KubeContext: s.cfg.KubeContext,
+		Namespace:   s.cfg.Namespace,
+		ListenPort:  deviceConfig(s.cfg, netip.AddrPort{}).ListenPort,
+		StartedAt:   time.Now(),
+	}
+
+	if s.cfg.TargetObject != nil {
+		name, _ := meta.NewAccessor().Name(s.cfg.TargetObject)
+		s.local.Target = agent.TargetKind(s.cfg.TargetObject) + "/" + name
+	}
+
+	for _, overlay := range []netip.Prefix{s.cfg.Wireguard.OverlayPrefix, s.cfg.Wireguard.IPv6OverlayPrefix} {
+		if overlay.IsValid() {
+			s.local.Overlays = append(s.local.Overlays, overlay)
+		}
+	}
+
+	s.local.Substitutes = s.cfg.Wireguard.Remaps.Substitutes()
+
+	// Exporting the wireguard configuration may not need root, nor then registering
+	unlock, err := registry.Lock()
+	if errors.Is(err, fs.ErrPermission) {
+		log.Info("Unable to register session, other sessions may collide with it", "error", err.Error())
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("unable to register session: %w", err)
+	}
+
+	defer func() {
+		if err := unlock(); err != nil {
+			log.Error(err, "unable to unlock session registry")
+		}
+	}()
+
+	others, err := registry.List()
+	if err != nil {
+		return fmt.Errorf("unable to register session: %w", err)
+	}
+
+	for _, other := range others {
+		if other.PID == s.local.PID {
+			continue
+		}
+
+		otherPrefixes := append(slices.Clone(other.Overlays), other.Substitutes...)
+
+		for _, overlay := range s.local.Overlays {
+			if slices.ContainsFunc(otherPrefixes, overlay.Overlaps) {
+				return fmt.Errorf("overlay prefix %s is in use by the session of process %d, run again to allocate another", overlay, other.PID)
+			}
+		}
+
+		for _, substitute := range s.local.Substitutes {
+			if slices.ContainsFunc(otherPrefixes, substitute.Overlaps) {
+				return fmt.Errorf("remapped range %s is in use by the session of process %d, run again to allocate another", substitute, other.PID)
+			}
+		}
+
+		if s.local.ListenPort != 0 && other.ListenPort == s.local.ListenPort {
+			return fmt.Errorf("listen port %d is in use by the session of process %d, run again to choose another", other.ListenPort, other.PID)
+		}
+	}
+
+	if err := registry.Register(s.local); err != nil {
+		return fmt.Errorf("unable to register session: %w", err)
+	}
+
+	s.stopFuncs = append(s.stopFuncs, func() {
+		if err := registry.Unregister(s.local.PID); err != nil {
+			log.Error(err, "unable to unregister session")
+		}
+	})
+
+	return nil
+}
+
+func (s *proxySession) wireguardDeviceSetup(ctx context.Context, agentAddress netip.AddrPort) error {
+	log := logr.FromContextOrDiscard(ctx)
+
+	cfg := s.cfg
+
+	log.V(1).Info("Starting Wireguard device setup")
+
+	wireguardDevice := wg.NewWireguardDevice(deviceConfig(cfg, agentAddress))
+
 	wgStop, err := wireguardDevice.Start(ctx)
 	if err != nil {
 		return err
 	}
 
-	stopFuncs = append(stopFuncs, wgStop)
+	s.stopFuncs = append(s.stopFuncs, wgStop)
 
-	log.Info("Wireguard device setup complete")
+	log.Info("Wireguard device setup complete", "device", wireguardDevice.DeviceName())
+
+	s.local.Device = wireguardDevice.DeviceName()
+	if err := registry.Register(s.local); err != nil {
+		log.Error(err, "unable to register session device")
+	}
 
 	log.V(1).Info("Starting route setup")
 
-	router := routing.NewRouting(
-		wireguardDevice.DeviceName(),
-		cfg.KubernetesClusterDetails.ServiceIP,
-		cfg.KubernetesClusterDetails.PodCIDR,
-		cfg.KubernetesClusterDetails.ServiceCIDR,
-		cfg.KubernetesClusterDetails.NodeCIDR,
-		netip.PrefixFrom(cfg.Wireguard.AgentOverlayAddress, 32),
-	)
+	var routes []netip.Prefix
+
+	// With dynamic routes, the cluster's ranges are left to the local network, apart from its nameserver
+	if !cfg.DynamicRoutes {
+		routes = cfg.Wireguard.Remaps.LocalPrefixes(cfg.KubernetesClusterDetails.Prefixes())
+	} else if nameserver := dnsServer(cfg); nameserver.IsValid() && len(cfg.Wireguard.Remaps) == 0 {
+		routes = append(routes, netip.PrefixFrom(nameserver, nameserver.BitLen()))
+	}
+
+	for _, agentOverlayAddress := range cfg.Wireguard.AgentOverlayAddresses() {
+		routes = append(routes, netip.PrefixFrom(agentOverlayAddress, agentOverlayAddress.BitLen()))
+	}
+
+	router := routing.NewRouting(wireguardDevice.DeviceName(), dnsServer(cfg), cfg.KubernetesClusterDetails.Domain(), cfg.RulePriority, routes...)
 
 	routerStop, err := router.Start(ctx)
 	if err != nil {
 		return err
 	}
 
-	stopFuncs = append(stopFuncs, routerStop)
+	s.stopFuncs = append(s.stopFuncs, routerStop)
+
+	if cfg.DynamicRoutes {
+		watchStop, err := watchRoutes(ctx, s.kubernetesClient, router, cfg.Wireguard.Remaps, cfg.RouteNamespaces)
+		if err != nil {
+			return fmt.Errorf("unable to watch services and endpoints: %w", err)
+		}
+
+		s.stopFuncs = append(s.stopFuncs, watchStop)
+	}
 
 	log.Info("Routing setup complete")
 
 	return nil
 }
 
-func kubernetesSetup(ctx context.Context, cfg *config.Config, kubernetesClient kubernetes.Interface, kubernetesRestConfig *rest.Config) (netip.AddrPort, error) {
+// deviceConfig returns the configuration of the local wireguard device peering with the agent at agentAddress
+func deviceConfig(cfg *config.Config, agentAddress netip.AddrPort) wg.WireguardDeviceConfig {
+	listenPort := cfg.Wireguard.ListenPort
+	if cfg.Wireguard.LocalAddress.IsValid() {
+		listenPort = int(cfg.Wireguard.LocalAddress.Port())
+	}
+
+	return wg.WireguardDeviceConfig{
+		Peer: wg.WireguardDevicePeer{
+			Endpoint:   agentAddress,
+			PublicKey:  cfg.Wireguard.AgentKey.PublicKey(),
+			AllowedIPs: cfg.Wireguard.AllowedIPs,
+		},
+		PrivateKey: cfg.Wireguard.LocalKey.Key,
+		ListenPort: listenPort,
+		Addresses:  cfg.Wireguard.LocalOverlayAddresses(),
+	}
+}
+
+// dnsServer returns the nameserver queries for the cluster domain are sent to. With remapped ranges, it's the agent,
+// which rewrites addresses in answers to their substitutes.
+func dnsServer(cfg *config.Config) netip.Addr {
+	if len(cfg.Wireguard.Remaps) > 0 {
+		return cfg.Wireguard.AgentOverlayAddress
+	}
+
+	return cfg.KubernetesClusterDetails.ServiceIP
+}
+
+// exportWireguardConfig writes the local wireguard configuration to a file for use with other WireGuard tooling, in
+// place of setting up the device and routing
+func exportWireguardConfig(ctx context.Context, cfg *config.Config, agentAddress netip.AddrPort) error {
+	log := logr.FromContextOrDiscard(ctx)
+
+	// The file contains the private key
+	f, err := os.OpenFile(cfg.ExportWireguardConfig, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("unable to create wireguard config file: %w", err)
+	}
+
+	defer func() {
+		if err := f.Close(); err != nil {
+			log.Error(err, "unable to close wireguard config file")
+		}
+	}()
+
+	if err := wg.WriteQuickConfig(f, deviceConfig(cfg, agentAddress), dnsServer(cfg), "svc."+cfg.KubernetesClusterDetails.Domain()); err != nil {
+		return fmt.Errorf("unable to write wireguard config file: %w", err)
+	}
+
+	log.Info("Wrote wireguard config, bring it up with wg-quick or other WireGuard tooling", "path", cfg.ExportWireguardConfig)
+
+	return nil
+}
+
+func (s *proxySession) kubernetesSetup(ctx context.Context) (netip.AddrPort, error) {
 	log := logr.FromContextOrDiscard(ctx)
 
 	log.V(1).Info("Starting Kubernetes setup")
 
-	kubernetesAgent := agent.NewKubernetesAgent(cfg, kubernetesClient, kubernetesRestConfig)
+	kubernetesAgent := agent.NewKubernetesAgent(s.cfg, s.kubernetesClient, s.kubernetesRestConfig)
 
 	agentStop, err := kubernetesAgent.Start(ctx)
 	if err != nil {
 		return netip.AddrPort{}, err
 	}
 
-	stopFuncs = append(stopFuncs, agentStop)
+	s.stopFuncs = append(s.stopFuncs, agentStop)
+
+	if network, ok := kubernetesAgent.PodNetwork(); ok {
+		if err := CompleteClusterDetails(ctx, s.cfg, network); err != nil {
+			return netip.AddrPort{}, err
+		}
+	}
 
 	log.Info("Kubernetes setup complete")
 
@@ -0,0 +1,197 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"sync"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/steved/kubewire/pkg/remap"
+	"github.com/steved/kubewire/pkg/routing"
+	"github.com/steved/kubewire/pkg/runnable"
+)
+
+// routeWatcher routes the ClusterIPs of Services and the addresses of EndpointSlices' endpoints through the tunnel as
+// they come and go, rather than the cluster's ranges as a whole
+type routeWatcher struct {
+	router routing.Routing
+	remaps remap.Mappings
+
+	mu sync.Mutex
+	// objects are the prefixes routed for each Service and EndpointSlice, by kind, namespace and name. Prefixes which
+	// couldn't be routed are left out, to be retried when the object is next updated.
+	objects map[string][]netip.Prefix
+	// refs counts the objects each prefix is routed for, as a pod's address is shared by the slices of each Service
+	// selecting it
+	refs map[netip.Prefix]int
+}
+
+// watchRoutes starts routing the addresses of Services and EndpointSlices in the namespaces, or all namespaces if none,
+// returning once the existing ones are routed. Routes are kept up to date until the returned function is called.
+func watchRoutes(ctx context.Context, client kubernetes.Interface, router routing.Routing, remaps remap.Mappings, namespaces []string) (runnable.StopFunc, error) {
+	log := logr.FromContextOrDiscard(ctx)
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	w := &routeWatcher{router: router, remaps: remaps, objects: make(map[string][]netip.Prefix), refs: make(map[netip.Prefix]int)}
+
+	if len(namespaces) == 0 {
+		namespaces = []string{metav1.NamespaceAll}
+	}
+
+	for _, namespace := range namespaces {
+		factory := informers.NewSharedInformerFactoryWithOptions(client, 0, informers.WithNamespace(namespace))
+
+		handler := cache.ResourceEventHandlerFuncs{
+			AddFunc:    func(obj interface{}) { w.update(ctx, obj) },
+			UpdateFunc: func(_, obj interface{}) { w.update(ctx, obj) },
+			DeleteFunc: func(obj interface{}) { w.delete(ctx, obj) },
+		}
+
+		var synced []cache.InformerSynced
+
+		for _, informer := range []cache.SharedIndexInformer{factory.Core().V1().Services().Informer(), factory.Discovery().V1().EndpointSlices().Informer()} {
+			registration, err := informer.AddEventHandler(handler)
+			if err != nil {
+				cancel()
+				return nil, fmt.Errorf("unable to add event handler: %w", err)
+			}
+
+			synced = append(synced, registration.HasSynced)
+		}
+
+		factory.Start(ctx.Done())
+
+		// The handlers, rather than only the caches, have to have seen the existing objects for them to be routed
+		if !cache.WaitForCacheSync(ctx.Done(), synced...) {
+			cancel()
+			return nil, fmt.Errorf("unable to list services and endpoints in %q: %w", namespace, ctx.Err())
+		}
+
+		log.V(1).Info("Routed existing services and endpoints", "namespace", namespace)
+	}
+
+	return cancel, nil
+}
+
+// update routes the object's current addresses, removing the routes of those it no longer has
+func (w *routeWatcher) update(ctx context.Context, obj interface{}) {
+	key, prefixes, ok := w.prefixes(obj)
+	if !ok {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	previous := w.objects[key]
+
+	var routed []netip.Prefix
+
+	for _, prefix := range prefixes {
+		if w.ref(ctx, prefix) {
+			routed = append(routed, prefix)
+		}
+	}
+
+	w.objects[key] = routed
+
+	for _, prefix := range previous {
+		w.unref(ctx, prefix)
+	}
+}
+
+// delete removes the routes of the object's addresses which no other object has
+func (w *routeWatcher) delete(ctx context.Context, obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+
+	key, _, ok := w.prefixes(obj)
+	if !ok {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, prefix := range w.objects[key] {
+		w.unref(ctx, prefix)
+	}
+
+	delete(w.objects, key)
+}
+
+// ref counts another object routing the prefix, routing it if it's the first, and returns whether it's routed. Prefixes
+// which fail to be routed aren't counted, so that the next object with them tries again.
+func (w *routeWatcher) ref(ctx context.Context, prefix netip.Prefix) bool {
+	if w.refs[prefix] == 0 {
+		if err := w.router.AddRoute(ctx, prefix); err != nil {
+			logr.FromContextOrDiscard(ctx).Error(err, "unable to add route", "route", prefix.String())
+			return false
+		}
+	}
+
+	w.refs[prefix]++
+
+	return true
+}
+
+func (w *routeWatcher) unref(ctx context.Context, prefix netip.Prefix) {
+	w.refs[prefix]--
+	if w.refs[prefix] > 0 {
+		return
+	}
+
+	delete(w.refs, prefix)
+
+	if err := w.router.DeleteRoute(ctx, prefix); err != nil {
+		logr.FromContextOrDiscard(ctx).Error(err, "unable to delete route", "route", prefix.String())
+	}
+}
+
+// prefixes returns the key of a Service or EndpointSlice and the host prefixes of its addresses, or their substitutes
+// if remapped
+func (w *routeWatcher) prefixes(obj interface{}) (string, []netip.Prefix, bool) {
+	var (
+		key   string
+		addrs []string
+	)
+
+	switch obj := obj.(type) {
+	case *corev1.Service:
+		key = "service/" + obj.Namespace + "/" + obj.Name
+		addrs = obj.Spec.ClusterIPs
+	case *discoveryv1.EndpointSlice:
+		key = "endpointslice/" + obj.Namespace + "/" + obj.Name
+
+		for _, endpoint := range obj.Endpoints {
+			addrs = append(addrs, endpoint.Addresses...)
+		}
+	default:
+		return "", nil, false
+	}
+
+	var prefixes []netip.Prefix
+
+	// Headless services have no ClusterIP and FQDN endpoints no address, which fail to parse
+	for _, value := range addrs {
+		addr, err := netip.ParseAddr(value)
+		if err != nil {
+			continue
+		}
+
+		addr = w.remaps.ToLocal(addr.Unmap())
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+
+	return key, prefixes, true
+}
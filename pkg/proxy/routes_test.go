@@ -0,0 +1,180 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/steved/kubewire/pkg/remap"
+	"github.com/steved/kubewire/pkg/runnable"
+)
+
+// fakeRouting records the routes added and deleted once started. Adding a route in failures fails that many times.
+type fakeRouting struct {
+	mu       sync.Mutex
+	routes   []netip.Prefix
+	failures map[netip.Prefix]int
+}
+
+func (f *fakeRouting) Start(context.Context) (runnable.StopFunc, error) {
+	return func() {}, nil
+}
+
+func (f *fakeRouting) AddRoute(_ context.Context, prefix netip.Prefix) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.failures[prefix] > 0 {
+		f.failures[prefix]--
+		return errors.New("unable to add route")
+	}
+
+	f.routes = append(f.routes, prefix)
+
+	return nil
+}
+
+func (f *fakeRouting) DeleteRoute(_ context.Context, prefix netip.Prefix) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.routes = slices.DeleteFunc(f.routes, func(route netip.Prefix) bool { return route == prefix })
+
+	return nil
+}
+
+func (f *fakeRouting) current() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	routes := make([]string, len(f.routes))
+	for i, route := range f.routes {
+		routes[i] = route.String()
+	}
+
+	slices.Sort(routes)
+
+	return routes
+}
+
+func service(namespace, name string, clusterIPs ...string) *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+		Spec:       corev1.ServiceSpec{ClusterIPs: clusterIPs},
+	}
+}
+
+func endpointSlice(namespace, name string, addrs ...string) *discoveryv1.EndpointSlice {
+	slice := &discoveryv1.EndpointSlice{
+		ObjectMeta:  metav1.ObjectMeta{Namespace: namespace, Name: name},
+		AddressType: discoveryv1.AddressTypeIPv4,
+	}
+
+	for _, addr := range addrs {
+		slice.Endpoints = append(slice.Endpoints, discoveryv1.Endpoint{Addresses: []string{addr}})
+	}
+
+	return slice
+}
+
+func Test_watchRoutes(t *testing.T) {
+	ctx := context.Background()
+
+	client := fake.NewClientset(
+		service("default", "hello-world", "10.96.0.10"),
+		service("default", "headless", "None"),
+		endpointSlice("default", "hello-world-abcde", "10.0.0.5", "10.0.0.6"),
+		service("other", "ignored", "10.96.0.20"),
+	)
+
+	router := &fakeRouting{}
+
+	stop, err := watchRoutes(ctx, client, router, nil, []string{"default"})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	t.Cleanup(stop)
+
+	assert.Equal(t, []string{"10.0.0.5/32", "10.0.0.6/32", "10.96.0.10/32"}, router.current())
+
+	// A pod selected by another Service stays routed until neither slice has it
+	_, err = client.DiscoveryV1().EndpointSlices("default").Create(ctx, endpointSlice("default", "other-abcde", "10.0.0.6"), metav1.CreateOptions{})
+	assert.NoError(t, err)
+
+	_, err = client.DiscoveryV1().EndpointSlices("default").Update(ctx, endpointSlice("default", "hello-world-abcde", "10.0.0.7"), metav1.UpdateOptions{})
+	assert.NoError(t, err)
+
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.Equal(c, []string{"10.0.0.6/32", "10.0.0.7/32", "10.96.0.10/32"}, router.current())
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.NoError(t, client.CoreV1().Services("default").Delete(ctx, "hello-world", metav1.DeleteOptions{}))
+	assert.NoError(t, client.DiscoveryV1().EndpointSlices("default").Delete(ctx, "other-abcde", metav1.DeleteOptions{}))
+
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.Equal(c, []string{"10.0.0.7/32"}, router.current())
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func Test_watchRoutesRemap(t *testing.T) {
+	client := fake.NewClientset(
+		service("default", "hello-world", "10.96.0.10"),
+		service("kube-system", "kube-dns", "10.96.0.2"),
+	)
+
+	remaps := remap.Mappings{
+		{Cluster: netip.MustParsePrefix("10.96.0.0/16"), Local: netip.MustParsePrefix("100.96.0.0/16")},
+	}
+
+	router := &fakeRouting{}
+
+	stop, err := watchRoutes(context.Background(), client, router, remaps, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	t.Cleanup(stop)
+
+	assert.Equal(t, []string{"100.96.0.10/32", "100.96.0.2/32"}, router.current())
+}
+
+func Test_watchRoutesAddFailure(t *testing.T) {
+	ctx := context.Background()
+
+	client := fake.NewClientset(endpointSlice("default", "hello-world-abcde", "10.0.0.5"))
+
+	router := &fakeRouting{failures: map[netip.Prefix]int{netip.MustParsePrefix("10.0.0.5/32"): 1}}
+
+	stop, err := watchRoutes(ctx, client, router, nil, []string{"default"})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	t.Cleanup(stop)
+
+	assert.Empty(t, router.current())
+
+	// The failed route isn't counted, so another slice with the address routes it rather than assuming it's routed
+	_, err = client.DiscoveryV1().EndpointSlices("default").Create(ctx, endpointSlice("default", "other-abcde", "10.0.0.5"), metav1.CreateOptions{})
+	assert.NoError(t, err)
+
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.Equal(c, []string{"10.0.0.5/32"}, router.current())
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Nor is it uncounted when the slice it failed for is deleted, which would remove the other slice's route
+	assert.NoError(t, client.DiscoveryV1().EndpointSlices("default").Delete(ctx, "hello-world-abcde", metav1.DeleteOptions{}))
+
+	assert.Never(t, func() bool { return len(router.current()) == 0 }, 100*time.Millisecond, 10*time.Millisecond)
+}
@@ -0,0 +1,163 @@
+package remap
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+
+	"go4.org/netipx"
+)
+
+// DefaultPool is the ranges substitutes are allocated from unless configured otherwise
+var DefaultPool = []netip.Prefix{
+	netip.MustParsePrefix("100.96.0.0/11"),
+	netip.MustParsePrefix("fd77:676b:7000::/36"),
+}
+
+// Mapping exposes a cluster range colliding with the local network under a substitute range of the same size and IP
+// family. Addresses keep their offset within the range, so that the agent can translate them back with NETMAP.
+type Mapping struct {
+	// Cluster is the range in the cluster
+	Cluster netip.Prefix
+	// Local is the substitute range used on the local machine
+	Local netip.Prefix
+}
+
+// Mappings are the remapped ranges of a session
+type Mappings []Mapping
+
+// ToLocal returns the substitute of a cluster address, or the address itself if it's not remapped
+func (m Mappings) ToLocal(addr netip.Addr) netip.Addr {
+	for _, mapping := range m {
+		if mapping.Cluster.Contains(addr) {
+			return replacePrefix(addr, mapping.Local)
+		}
+	}
+
+	return addr
+}
+
+// ToCluster returns the cluster address of a substitute, or the address itself if it's not one
+func (m Mappings) ToCluster(addr netip.Addr) netip.Addr {
+	for _, mapping := range m {
+		if mapping.Local.Contains(addr) {
+			return replacePrefix(addr, mapping.Cluster)
+		}
+	}
+
+	return addr
+}
+
+// LocalPrefixes returns the prefixes with those within remapped cluster ranges replaced by their substitutes
+func (m Mappings) LocalPrefixes(prefixes []netip.Prefix) []netip.Prefix {
+	local := make([]netip.Prefix, len(prefixes))
+
+	for i, prefix := range prefixes {
+		local[i] = prefix
+
+		for _, mapping := range m {
+			if mapping.Cluster.Contains(prefix.Addr()) && mapping.Cluster.Bits() <= prefix.Bits() {
+				local[i] = netip.PrefixFrom(replacePrefix(prefix.Addr(), mapping.Local), prefix.Bits())
+				break
+			}
+		}
+	}
+
+	return local
+}
+
+// Substitutes returns the substitute ranges
+func (m Mappings) Substitutes() []netip.Prefix {
+	substitutes := make([]netip.Prefix, len(m))
+	for i, mapping := range m {
+		substitutes[i] = mapping.Local
+	}
+
+	return substitutes
+}
+
+// Colliding returns the cluster ranges which overlap local addresses and routes
+func Colliding(cluster, local []netip.Prefix) []netip.Prefix {
+	var colliding []netip.Prefix
+
+	for _, prefix := range cluster {
+		if slices.ContainsFunc(local, prefix.Overlaps) {
+			colliding = append(colliding, prefix.Masked())
+		}
+	}
+
+	return colliding
+}
+
+// Allocate returns a substitute for each colliding cluster range, the first free range of the same size and IP family
+// within the pool which overlaps none of the unavailable prefixes or the other substitutes. Ranges of the pool are
+// tried in order.
+func Allocate(pool, colliding, unavailable []netip.Prefix) (Mappings, error) {
+	var builder netipx.IPSetBuilder
+
+	for _, prefix := range unavailable {
+		builder.AddPrefix(prefix.Masked())
+	}
+
+	var mappings Mappings
+
+	for _, cluster := range colliding {
+		// Only invalid prefixes, which are never added, cause errors
+		unavailableSet, _ := builder.IPSet()
+
+		substitute, ok := allocate(pool, cluster, unavailableSet)
+		if !ok {
+			return nil, fmt.Errorf("no free /%d in the remap pool for %s, each overlaps the cluster's ranges or local addresses and routes", cluster.Bits(), cluster)
+		}
+
+		builder.AddPrefix(substitute)
+
+		mappings = append(mappings, Mapping{Cluster: cluster, Local: substitute})
+	}
+
+	return mappings, nil
+}
+
+func allocate(pool []netip.Prefix, cluster netip.Prefix, unavailable *netipx.IPSet) (netip.Prefix, bool) {
+	for _, prefix := range pool {
+		if prefix.Addr().Is6() != cluster.Addr().Is6() || prefix.Bits() > cluster.Bits() {
+			continue
+		}
+
+		var builder netipx.IPSetBuilder
+
+		builder.AddPrefix(prefix.Masked())
+		builder.RemoveSet(unavailable)
+
+		free, _ := builder.IPSet()
+
+		if substitute, _, ok := free.RemoveFreePrefix(uint8(cluster.Bits())); ok {
+			return substitute, true
+		}
+	}
+
+	return netip.Prefix{}, false
+}
+
+// replacePrefix returns the address with its leading bits replaced by those of the prefix, of the same IP family
+func replacePrefix(addr netip.Addr, prefix netip.Prefix) netip.Addr {
+	bytes := addr.As16()
+	prefixBytes := prefix.Masked().Addr().As16()
+
+	// IPv4 addresses are mapped into the last 4 bytes
+	bits := 128 - addr.BitLen() + prefix.Bits()
+
+	for i := range bytes {
+		prefixBits := min(max(bits-8*i, 0), 8)
+		mask := byte(0xff << (8 - prefixBits))
+
+		bytes[i] = prefixBytes[i]&mask | bytes[i]&^mask
+	}
+
+	replaced := netip.AddrFrom16(bytes)
+	if addr.Is4() {
+		return replaced.Unmap()
+	}
+
+	return replaced
+}
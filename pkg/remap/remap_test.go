@@ -0,0 +1,120 @@
+package remap
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMappings(t *testing.T) {
+	mappings := Mappings{
+		{Cluster: netip.MustParsePrefix("10.0.0.0/16"), Local: netip.MustParsePrefix("100.96.0.0/16")},
+		{Cluster: netip.MustParsePrefix("10.96.0.0/12"), Local: netip.MustParsePrefix("100.112.0.0/12")},
+		{Cluster: netip.MustParsePrefix("fd00:10::/56"), Local: netip.MustParsePrefix("fd77:676b:7000::/56")},
+	}
+
+	tests := []struct {
+		name    string
+		cluster netip.Addr
+		local   netip.Addr
+	}{
+		{"pod", netip.MustParseAddr("10.0.12.34"), netip.MustParseAddr("100.96.12.34")},
+		{"service", netip.MustParseAddr("10.100.1.2"), netip.MustParseAddr("100.116.1.2")},
+		{"ipv6", netip.MustParseAddr("fd00:10:0:ab::5"), netip.MustParseAddr("fd77:676b:7000:ab::5")},
+		{"not remapped", netip.MustParseAddr("192.168.1.1"), netip.MustParseAddr("192.168.1.1")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.local, mappings.ToLocal(tt.cluster))
+			assert.Equal(t, tt.cluster, mappings.ToCluster(tt.local))
+		})
+	}
+
+	assert.Equal(
+		t,
+		[]netip.Prefix{
+			netip.MustParsePrefix("100.96.0.0/16"),
+			netip.MustParsePrefix("100.96.3.4/32"),
+			netip.MustParsePrefix("172.16.0.0/16"),
+		},
+		mappings.LocalPrefixes([]netip.Prefix{
+			netip.MustParsePrefix("10.0.0.0/16"),
+			netip.MustParsePrefix("10.0.3.4/32"),
+			netip.MustParsePrefix("172.16.0.0/16"),
+		}),
+	)
+}
+
+func TestColliding(t *testing.T) {
+	cluster := []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/16"),
+		netip.MustParsePrefix("10.96.0.0/12"),
+		netip.MustParsePrefix("172.20.0.0/16"),
+	}
+	local := []netip.Prefix{
+		netip.MustParsePrefix("10.0.1.0/24"),
+		netip.MustParsePrefix("192.168.1.0/24"),
+	}
+
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("10.0.0.0/16")}, Colliding(cluster, local))
+}
+
+func TestAllocate(t *testing.T) {
+	tests := []struct {
+		name        string
+		pool        []netip.Prefix
+		colliding   []netip.Prefix
+		unavailable []netip.Prefix
+		want        Mappings
+		wantErr     bool
+	}{
+		{
+			"same size",
+			DefaultPool,
+			[]netip.Prefix{netip.MustParsePrefix("10.0.0.0/16"), netip.MustParsePrefix("10.96.0.0/12")},
+			nil,
+			Mappings{
+				{Cluster: netip.MustParsePrefix("10.0.0.0/16"), Local: netip.MustParsePrefix("100.96.0.0/16")},
+				{Cluster: netip.MustParsePrefix("10.96.0.0/12"), Local: netip.MustParsePrefix("100.112.0.0/12")},
+			},
+			false,
+		},
+		{
+			"unavailable",
+			DefaultPool,
+			[]netip.Prefix{netip.MustParsePrefix("10.0.0.0/16")},
+			[]netip.Prefix{netip.MustParsePrefix("100.96.0.0/15"), netip.MustParsePrefix("100.98.1.0/24")},
+			Mappings{{Cluster: netip.MustParsePrefix("10.0.0.0/16"), Local: netip.MustParsePrefix("100.99.0.0/16")}},
+			false,
+		},
+		{
+			"ipv6",
+			DefaultPool,
+			[]netip.Prefix{netip.MustParsePrefix("fd00:10::/48")},
+			nil,
+			Mappings{{Cluster: netip.MustParsePrefix("fd00:10::/48"), Local: netip.MustParsePrefix("fd77:676b:7000::/48")}},
+			false,
+		},
+		{
+			"pool too small",
+			[]netip.Prefix{netip.MustParsePrefix("198.18.0.0/15")},
+			[]netip.Prefix{netip.MustParsePrefix("10.96.0.0/12")},
+			nil,
+			nil,
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Allocate(tt.pool, tt.colliding, tt.unavailable)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
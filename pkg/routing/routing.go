@@ -1,17 +1,88 @@
 package routing
 
 import (
+	"context"
 	"net/netip"
+	"slices"
+	"sync"
 
 	"github.com/steved/kubewire/pkg/runnable"
 )
 
+const (
+	// DefaultRulePriority is the priority of the rules looking up routes in the session's routing table, ahead of the
+	// main table's at 32766 so that routes pushed by other VPNs don't take precedence
+	DefaultRulePriority = 5300
+	// TableBase is the first routing table and firewall mark used by sessions, each using TableBase plus the index of
+	// its wireguard device
+	TableBase = 52000
+)
+
+// Routing routes prefixes through a wireguard device and sends DNS queries for the cluster domain through it. Routes
+// may be added and removed once started.
+type Routing interface {
+	runnable.Runnable
+	// AddRoute routes the prefix through the device, if it isn't already
+	AddRoute(ctx context.Context, prefix netip.Prefix) error
+	// DeleteRoute removes the route to the prefix, if any
+	DeleteRoute(ctx context.Context, prefix netip.Prefix) error
+}
+
 type routing struct {
 	deviceName string
-	routes     []netip.Prefix
 	dnsServer  netip.Addr
+	// dnsDomain is the cluster domain whose names are resolved by dnsServer
+	dnsDomain string
+	// rulePriority is the priority of the rules looking up the routes in their own table on Linux. If 0, routes are
+	// added to the main table instead.
+	rulePriority int
+
+	// index and table are the device's index and the table its routes are in on Linux, once started
+	index int
+	table uint32
+	// ruleFamilies are the address families whose rules looking up the table were added on Linux, as their first
+	// routes were
+	ruleFamilies []uint8
+
+	mu     sync.Mutex
+	routes []netip.Prefix
+}
+
+func NewRouting(deviceName string, dnsServer netip.Addr, dnsDomain string, rulePriority int, routes ...netip.Prefix) Routing {
+	return &routing{deviceName: deviceName, dnsServer: dnsServer, dnsDomain: dnsDomain, rulePriority: rulePriority, routes: routes}
+}
+
+func (r *routing) AddRoute(ctx context.Context, prefix netip.Prefix) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if slices.Contains(r.routes, prefix) {
+		return nil
+	}
+
+	if err := r.addRoute(ctx, prefix); err != nil {
+		return err
+	}
+
+	r.routes = append(r.routes, prefix)
+
+	return nil
 }
 
-func NewRouting(deviceName string, dnsServer netip.Addr, routes ...netip.Prefix) runnable.Runnable {
-	return &routing{deviceName: deviceName, dnsServer: dnsServer, routes: routes}
+func (r *routing) DeleteRoute(ctx context.Context, prefix netip.Prefix) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	i := slices.Index(r.routes, prefix)
+	if i < 0 {
+		return nil
+	}
+
+	if err := r.deleteRoute(ctx, prefix); err != nil {
+		return err
+	}
+
+	r.routes = slices.Delete(r.routes, i, i+1)
+
+	return nil
 }
@@ -6,19 +6,38 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net/netip"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
 
 	"github.com/go-logr/logr"
 
+	"github.com/steved/kubewire/pkg/journal"
 	"github.com/steved/kubewire/pkg/runnable"
 )
 
-func (r *routing) Start(ctx context.Context) (runnable.StopFunc, error) {
+// resolverPrefix is the prefix of the resolver configurations of each session's device
+const resolverPrefix = "kubewire-"
+
+func (r *routing) Start(ctx context.Context) (_ runnable.StopFunc, err error) {
+	log := logr.FromContextOrDiscard(ctx)
+
+	// Undo whatever was set up before failing, as the caller only stops routing once started
+	defer func() {
+		if err == nil {
+			return
+		}
+
+		if stopErr := r.stop(context.WithoutCancel(ctx)); stopErr != nil {
+			log.Error(stopErr, "unable to clean up routing", "device", r.deviceName)
+		}
+	}()
+
 	for _, route := range r.routes {
-		rt := exec.Command("route", "add", "-net", route.String(), "-interface", r.deviceName)
-		if _, err := rt.CombinedOutput(); err != nil {
-			return nil, fmt.Errorf("unable to add route for %s: %w", route.String(), err)
+		if err := r.addRoute(ctx, route); err != nil {
+			return nil, err
 		}
 	}
 
@@ -27,11 +46,19 @@ func (r *routing) Start(ctx context.Context) (runnable.StopFunc, error) {
 			return nil, fmt.Errorf("unable to create /etc/resolver: %w", err)
 		}
 
-		contents := []byte(fmt.Sprintf("domain cluster.local\nnameserver %s\nsearch svc.cluster.local cluster.local local", r.dnsServer.String()))
+		if err := journal.FromContext(ctx).Record(journal.Change{Kind: journal.KindResolver, Path: r.resolverPath()}); err != nil {
+			return nil, fmt.Errorf("unable to record %s: %w", r.resolverPath(), err)
+		}
+
+		contents := []byte(fmt.Sprintf("domain %[1]s\nnameserver %[2]s\nsearch svc.%[1]s %[1]s local", r.dnsDomain, r.dnsServer.String()))
 
-		err := os.WriteFile("/etc/resolver/cluster.local", contents, 0o644)
+		err := os.WriteFile(r.resolverPath(), contents, 0o644)
 		if err != nil {
-			return nil, fmt.Errorf("unable to create /etc/resolver/cluster.local: %w", err)
+			return nil, fmt.Errorf("unable to create %s: %w", r.resolverPath(), err)
+		}
+
+		if err := journal.FromContext(ctx).Record(journal.Change{Kind: journal.KindSearchDomains}); err != nil {
+			return nil, fmt.Errorf("unable to record mDNSResponder AlwaysAppendSearchDomains: %w", err)
 		}
 
 		_, err = exec.Command("defaults", "write", "/Library/Preferences/com.apple.mDNSResponder.plist", "AlwaysAppendSearchDomains", "-bool", "yes").CombinedOutput()
@@ -46,24 +73,126 @@ func (r *routing) Start(ctx context.Context) (runnable.StopFunc, error) {
 	}
 
 	return func() {
-		log := logr.FromContextOrDiscard(ctx)
+		// The context is already canceled when stopping
+		ctx := context.WithoutCancel(ctx)
+
+		if err := r.stop(ctx); err != nil {
+			log.Error(err, "unable to clean up routing", "device", r.deviceName)
+		}
+	}, nil
+}
+
+// stop removes the resolver configuration, disabling search domains unless other sessions still need them. Routes are
+// removed along with the device.
+func (r *routing) stop(ctx context.Context) error {
+	j := journal.FromContext(ctx)
 
-		var errs []error
+	var errs []error
 
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, route := range r.routes {
+		if err := j.Forget(r.routeChange(route)); err != nil {
+			errs = append(errs, fmt.Errorf("unable to record deleted route for %s: %w", route, err))
+		}
+	}
+
+	if !r.dnsServer.IsValid() {
+		return errors.Join(errs...)
+	}
+
+	if err := os.Remove(r.resolverPath()); err != nil && !os.IsNotExist(err) {
+		errs = append(errs, fmt.Errorf("unable to remove %s: %w", r.resolverPath(), err))
+	} else if err := j.Forget(journal.Change{Kind: journal.KindResolver, Path: r.resolverPath()}); err != nil {
+		errs = append(errs, fmt.Errorf("unable to record removed %s: %w", r.resolverPath(), err))
+	}
+
+	// Search domains are still needed by other sessions, whose journals record them too
+	others, err := filepath.Glob(filepath.Join("/etc/resolver", resolverPrefix+"*"))
+	if err != nil {
+		errs = append(errs, fmt.Errorf("unable to list resolvers: %w", err))
+	}
+
+	searchDomainsUndone := true
+
+	if len(others) == 0 {
 		if _, err := exec.Command("defaults", "write", "/Library/Preferences/com.apple.mDNSResponder.plist", "AlwaysAppendSearchDomains", "-bool", "no").CombinedOutput(); err != nil {
 			errs = append(errs, fmt.Errorf("unable to disable mDNSResponder AlwaysAppendSearchDomains: %w", err))
+			searchDomainsUndone = false
 		}
+	}
 
-		if _, err := exec.Command("killall", "mDNSResponder").CombinedOutput(); err != nil {
-			errs = append(errs, fmt.Errorf("unable to restart mDNSResponder: %w", err))
+	if searchDomainsUndone {
+		if err := j.Forget(journal.Change{Kind: journal.KindSearchDomains}); err != nil {
+			errs = append(errs, fmt.Errorf("unable to record disabled mDNSResponder AlwaysAppendSearchDomains: %w", err))
 		}
+	}
 
-		if err := os.Remove("/etc/resolver/cluster.local"); err != nil && !os.IsNotExist(err) {
-			errs = append(errs, fmt.Errorf("unable to remove /etc/resolver/cluster.local: %w", err))
-		}
+	if _, err := exec.Command("killall", "mDNSResponder").CombinedOutput(); err != nil {
+		errs = append(errs, fmt.Errorf("unable to restart mDNSResponder: %w", err))
+	}
 
-		if len(errs) > 0 {
-			log.Error(errors.Join(errs...), "unable to clean up routing")
-		}
-	}, nil
+	return errors.Join(errs...)
+}
+
+// addRoute routes the prefix through the device
+func (r *routing) addRoute(ctx context.Context, prefix netip.Prefix) error {
+	// Recorded before being added so that a session dying meanwhile still has it deleted
+	if err := journal.FromContext(ctx).Record(r.routeChange(prefix)); err != nil {
+		return fmt.Errorf("unable to record route for %s: %w", prefix.String(), err)
+	}
+
+	rt := exec.Command("route", "add", routeFamily(prefix), "-net", prefix.String(), "-interface", r.deviceName)
+
+	output, err := rt.CombinedOutput()
+	if err == nil && !strings.Contains(string(output), "File exists") {
+		return nil
+	}
+
+	if forgetErr := journal.FromContext(ctx).Forget(r.routeChange(prefix)); forgetErr != nil {
+		return fmt.Errorf("unable to record route for %s: %w", prefix.String(), forgetErr)
+	}
+
+	// Another session connected to the same cluster may route the range already, which it keeps doing
+	if strings.Contains(string(output), "File exists") {
+		logr.FromContextOrDiscard(ctx).Info("Route already exists, another session may be connected to the same cluster", "route", prefix.String())
+		return nil
+	}
+
+	return fmt.Errorf("unable to add route for %s: %w", prefix.String(), err)
+}
+
+// deleteRoute removes the route to the prefix through the device
+func (r *routing) deleteRoute(ctx context.Context, prefix netip.Prefix) error {
+	rt := exec.Command("route", "delete", routeFamily(prefix), "-net", prefix.String(), "-interface", r.deviceName)
+	if output, err := rt.CombinedOutput(); err != nil && !strings.Contains(string(output), "not in table") {
+		return fmt.Errorf("unable to delete route for %s: %w", prefix.String(), err)
+	}
+
+	if err := journal.FromContext(ctx).Forget(r.routeChange(prefix)); err != nil {
+		return fmt.Errorf("unable to record deleted route for %s: %w", prefix.String(), err)
+	}
+
+	return nil
+}
+
+func (r *routing) routeChange(prefix netip.Prefix) journal.Change {
+	return journal.Change{Kind: journal.KindRoute, Device: r.deviceName, Prefix: prefix}
+}
+
+// routeFamily returns the route command's address family flag for the prefix
+func routeFamily(prefix netip.Prefix) string {
+	if prefix.Addr().Is6() {
+		return "-inet6"
+	}
+
+	return "-inet"
+}
+
+// resolverPath returns the path of the resolver configuration sending queries for the cluster domain to the cluster.
+// It's named for the device, its domain directive naming the cluster domain, so that sessions for clusters with the
+// same domain don't replace each other's.
+func (r *routing) resolverPath() string {
+	return filepath.Join("/etc/resolver", resolverPrefix+r.deviceName)
 }
@@ -4,21 +4,27 @@ package routing
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
+	"net/netip"
+	"slices"
 	"syscall"
 
 	"github.com/go-logr/logr"
 	"github.com/godbus/dbus/v5"
 	"github.com/jsimonetti/rtnetlink"
 	"golang.org/x/sys/unix"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 
+	"github.com/steved/kubewire/pkg/journal"
 	"github.com/steved/kubewire/pkg/runnable"
 )
 
 type resolvedLinkDNS struct {
 	Family int
-	IP     [4]byte
+	IP     []byte
 }
 
 type resolvedLinkDomain struct {
@@ -26,43 +32,40 @@ type resolvedLinkDomain struct {
 	RoutingOnly bool
 }
 
-func (r *routing) Start(ctx context.Context) (runnable.StopFunc, error) {
+func (r *routing) Start(ctx context.Context) (_ runnable.StopFunc, err error) {
 	log := logr.FromContextOrDiscard(ctx)
 
-	netlink, err := rtnetlink.Dial(nil)
+	iface, err := net.InterfaceByName(r.deviceName)
 	if err != nil {
-		return nil, fmt.Errorf("unable to initialize netlink client: %w", err)
+		return nil, fmt.Errorf("unable to find wireguard interface %q: %w", r.deviceName, err)
 	}
 
+	r.index = iface.Index
+	r.table = unix.RT_TABLE_MAIN
+
+	// Undo whatever was set up before failing, as the caller only stops routing once started
 	defer func() {
-		if err := netlink.Close(); err != nil {
-			log.Error(err, "unable to close netlink client")
+		if err == nil {
+			return
+		}
+
+		if stopErr := r.stop(context.WithoutCancel(ctx)); stopErr != nil {
+			log.Error(stopErr, "unable to clean up routing", "device", r.deviceName)
 		}
 	}()
 
-	iface, err := net.InterfaceByName(r.deviceName)
-	if err != nil {
-		return nil, fmt.Errorf("unable to find wireguard interface %q: %w", r.deviceName, err)
+	if r.rulePriority > 0 {
+		r.table = TableBase + uint32(iface.Index)
+
+		// Wireguard's own packets are marked so that they skip the table rather than looping into the tunnel
+		if err := setFirewallMark(ctx, r.deviceName, int(r.table)); err != nil {
+			return nil, err
+		}
 	}
 
 	for _, route := range r.routes {
-		ip := net.IP(route.Addr().AsSlice())
-
-		err = netlink.Route.Add(&rtnetlink.RouteMessage{
-			Family:    unix.AF_INET,
-			Table:     unix.RT_TABLE_MAIN,
-			Protocol:  unix.RTPROT_STATIC,
-			Scope:     unix.RT_SCOPE_LINK,
-			Type:      unix.RTN_UNICAST,
-			DstLength: uint8(route.Bits()),
-			Attributes: rtnetlink.RouteAttributes{
-				Dst:      ip,
-				OutIface: uint32(iface.Index),
-				Gateway:  net.ParseIP("0.0.0.0"),
-			},
-		})
-		if err != nil {
-			return nil, fmt.Errorf("unable to add route for %s: %w", route.String(), err)
+		if err := r.addRoute(ctx, route); err != nil {
+			return nil, err
 		}
 	}
 
@@ -78,14 +81,23 @@ func (r *routing) Start(ctx context.Context) (runnable.StopFunc, error) {
 			}
 		}()
 
+		if err := journal.FromContext(ctx).Record(journal.Change{Kind: journal.KindLinkDNS, Device: r.deviceName}); err != nil {
+			return nil, fmt.Errorf("unable to record DNS for %q: %w", r.deviceName, err)
+		}
+
 		resolved := dbusClient.Object("org.freedesktop.resolve1", "/org/freedesktop/resolve1")
 
+		dnsFamily := syscall.AF_INET
+		if r.dnsServer.Is6() {
+			dnsFamily = syscall.AF_INET6
+		}
+
 		err = resolved.CallWithContext(
 			ctx,
 			"org.freedesktop.resolve1.Manager.SetLinkDNS",
 			0,
 			iface.Index,
-			[]resolvedLinkDNS{{Family: syscall.AF_INET, IP: r.dnsServer.As4()}},
+			[]resolvedLinkDNS{{Family: dnsFamily, IP: r.dnsServer.AsSlice()}},
 		).Err
 		if err != nil {
 			return nil, fmt.Errorf("unable to set DNS for %q: %w", r.deviceName, err)
@@ -96,7 +108,7 @@ func (r *routing) Start(ctx context.Context) (runnable.StopFunc, error) {
 			"org.freedesktop.resolve1.Manager.SetLinkDomains",
 			0,
 			iface.Index,
-			[]resolvedLinkDomain{{Name: "svc.cluster.local", RoutingOnly: false}},
+			[]resolvedLinkDomain{{Name: "svc." + r.dnsDomain, RoutingOnly: false}},
 		).Err
 		if err != nil {
 			return nil, fmt.Errorf("unable to set DNS for %q: %w", r.deviceName, err)
@@ -114,5 +126,251 @@ func (r *routing) Start(ctx context.Context) (runnable.StopFunc, error) {
 		}
 	}
 
-	return func() {}, nil
+	return func() {
+		// The context is already canceled when stopping
+		ctx := context.WithoutCancel(ctx)
+
+		if err := r.stop(ctx); err != nil {
+			log.Error(err, "unable to clean up routing", "device", r.deviceName)
+		}
+	}, nil
+}
+
+// stop removes the rules and routes, and the link's DNS settings so they can't apply to a device later given the same
+// name by another session
+func (r *routing) stop(ctx context.Context) error {
+	log := logr.FromContextOrDiscard(ctx)
+
+	netlink, err := rtnetlink.Dial(nil)
+	if err != nil {
+		return fmt.Errorf("unable to initialize netlink client: %w", err)
+	}
+
+	defer func() {
+		if err := netlink.Close(); err != nil {
+			log.Error(err, "unable to close netlink client")
+		}
+	}()
+
+	var errs []error
+
+	j := journal.FromContext(ctx)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, family := range r.ruleFamilies {
+		if err := netlink.Rule.Delete(ruleMessage(family, r.table, uint32(r.rulePriority))); err != nil && !errors.Is(err, unix.ENOENT) {
+			errs = append(errs, fmt.Errorf("unable to delete rule for table %d: %w", r.table, err))
+		} else if err := j.Forget(r.ruleChange(family)); err != nil {
+			errs = append(errs, fmt.Errorf("unable to record deleted rule for table %d: %w", r.table, err))
+		}
+	}
+
+	for _, route := range r.routes {
+		if err := netlink.Route.Delete(routeMessage(route, r.index, r.table)); err != nil && !errors.Is(err, unix.ESRCH) {
+			errs = append(errs, fmt.Errorf("unable to delete route for %s: %w", route, err))
+		} else if err := j.Forget(r.routeChange(route)); err != nil {
+			errs = append(errs, fmt.Errorf("unable to record deleted route for %s: %w", route, err))
+		}
+	}
+
+	if r.dnsServer.IsValid() {
+		if err := revertLinkDNS(ctx, r.index); err != nil {
+			errs = append(errs, fmt.Errorf("unable to revert DNS: %w", err))
+		} else if err := j.Forget(journal.Change{Kind: journal.KindLinkDNS, Device: r.deviceName}); err != nil {
+			errs = append(errs, fmt.Errorf("unable to record reverted DNS: %w", err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// addRoute routes the prefix through the device in its table, adding the rule looking up the table for the prefix's
+// family first if it's the family's first route
+func (r *routing) addRoute(ctx context.Context, prefix netip.Prefix) error {
+	log := logr.FromContextOrDiscard(ctx)
+
+	netlink, err := rtnetlink.Dial(nil)
+	if err != nil {
+		return fmt.Errorf("unable to initialize netlink client: %w", err)
+	}
+
+	defer func() {
+		if err := netlink.Close(); err != nil {
+			log.Error(err, "unable to close netlink client")
+		}
+	}()
+
+	if err := r.addRule(ctx, netlink, family(prefix)); err != nil {
+		return err
+	}
+
+	// Recorded before being added so that a session dying meanwhile still has it deleted
+	if err := journal.FromContext(ctx).Record(r.routeChange(prefix)); err != nil {
+		return fmt.Errorf("unable to record route for %s: %w", prefix.String(), err)
+	}
+
+	err = netlink.Route.Add(routeMessage(prefix, r.index, r.table))
+	if err == nil {
+		return nil
+	}
+
+	if forgetErr := journal.FromContext(ctx).Forget(r.routeChange(prefix)); forgetErr != nil {
+		return fmt.Errorf("unable to record route for %s: %w", prefix.String(), forgetErr)
+	}
+
+	// Another session connected to the same cluster may route the range in the main table already, which it keeps
+	// doing
+	if errors.Is(err, unix.EEXIST) && r.table == unix.RT_TABLE_MAIN {
+		log.Info("Route already exists, another session may be connected to the same cluster", "route", prefix.String())
+		return nil
+	}
+
+	return fmt.Errorf("unable to add route for %s: %w", prefix.String(), err)
+}
+
+// deleteRoute removes the route to the prefix through the device
+func (r *routing) deleteRoute(ctx context.Context, prefix netip.Prefix) error {
+	log := logr.FromContextOrDiscard(ctx)
+
+	netlink, err := rtnetlink.Dial(nil)
+	if err != nil {
+		return fmt.Errorf("unable to initialize netlink client: %w", err)
+	}
+
+	defer func() {
+		if err := netlink.Close(); err != nil {
+			log.Error(err, "unable to close netlink client")
+		}
+	}()
+
+	if err := netlink.Route.Delete(routeMessage(prefix, r.index, r.table)); err != nil && !errors.Is(err, unix.ESRCH) {
+		return fmt.Errorf("unable to delete route for %s: %w", prefix.String(), err)
+	}
+
+	if err := journal.FromContext(ctx).Forget(r.routeChange(prefix)); err != nil {
+		return fmt.Errorf("unable to record deleted route for %s: %w", prefix.String(), err)
+	}
+
+	return nil
+}
+
+func (r *routing) routeChange(prefix netip.Prefix) journal.Change {
+	return journal.Change{Kind: journal.KindRoute, Device: r.deviceName, Prefix: prefix, Table: int(r.table)}
+}
+
+func (r *routing) ruleChange(family uint8) journal.Change {
+	return journal.Change{Kind: journal.KindRule, Table: int(r.table), Priority: r.rulePriority, IPv6: family == unix.AF_INET6}
+}
+
+// addRule adds the rule looking up the table for the family, unless routes are in the main table or it was already
+// added
+func (r *routing) addRule(ctx context.Context, netlink *rtnetlink.Conn, family uint8) error {
+	if r.table == unix.RT_TABLE_MAIN || slices.Contains(r.ruleFamilies, family) {
+		return nil
+	}
+
+	// Recorded before being added so that a session dying meanwhile still has it deleted
+	if err := journal.FromContext(ctx).Record(r.ruleChange(family)); err != nil {
+		return fmt.Errorf("unable to record rule for table %d: %w", r.table, err)
+	}
+
+	if err := netlink.Rule.Add(ruleMessage(family, r.table, uint32(r.rulePriority))); err != nil {
+		return errors.Join(fmt.Errorf("unable to add rule for table %d: %w", r.table, err), journal.FromContext(ctx).Forget(r.ruleChange(family)))
+	}
+
+	r.ruleFamilies = append(r.ruleFamilies, family)
+
+	return nil
+}
+
+// family returns the address family of the prefix
+func family(prefix netip.Prefix) uint8 {
+	if prefix.Addr().Is6() {
+		return unix.AF_INET6
+	}
+
+	return unix.AF_INET
+}
+
+// routeMessage returns the route to prefix through the device in the table
+func routeMessage(prefix netip.Prefix, index int, table uint32) *rtnetlink.RouteMessage {
+	message := &rtnetlink.RouteMessage{
+		Family:    unix.AF_INET,
+		Table:     unix.RT_TABLE_UNSPEC,
+		Protocol:  unix.RTPROT_STATIC,
+		Scope:     unix.RT_SCOPE_LINK,
+		Type:      unix.RTN_UNICAST,
+		DstLength: uint8(prefix.Bits()),
+		Attributes: rtnetlink.RouteAttributes{
+			Dst:      net.IP(prefix.Addr().AsSlice()),
+			OutIface: uint32(index),
+			Gateway:  net.ParseIP("0.0.0.0"),
+			Table:    table,
+		},
+	}
+
+	// IPv6 routes through the device have no gateway
+	if prefix.Addr().Is6() {
+		message.Family = unix.AF_INET6
+		message.Attributes.Gateway = nil
+	}
+
+	return message
+}
+
+// ruleMessage returns the rule looking up the table for all packets but those with the table's firewall mark, which
+// are wireguard's own
+func ruleMessage(family uint8, table, priority uint32) *rtnetlink.RuleMessage {
+	return &rtnetlink.RuleMessage{
+		Family: family,
+		Table:  unix.RT_TABLE_UNSPEC,
+		Action: unix.FR_ACT_TO_TBL,
+		Flags:  unix.FIB_RULE_INVERT,
+		Attributes: &rtnetlink.RuleAttributes{
+			Table:    &table,
+			FwMark:   &table,
+			Priority: &priority,
+		},
+	}
+}
+
+// setFirewallMark sets the firewall mark of the wireguard device's packets
+func setFirewallMark(ctx context.Context, deviceName string, mark int) error {
+	log := logr.FromContextOrDiscard(ctx)
+
+	wgClient, err := wgctrl.New()
+	if err != nil {
+		return fmt.Errorf("unable to create wireguard client: %w", err)
+	}
+
+	defer func() {
+		if err := wgClient.Close(); err != nil {
+			log.Error(err, "unable to close wireguard client")
+		}
+	}()
+
+	if err := wgClient.ConfigureDevice(deviceName, wgtypes.Config{FirewallMark: &mark}); err != nil {
+		return fmt.Errorf("unable to set firewall mark of %s: %w", deviceName, err)
+	}
+
+	return nil
+}
+
+func revertLinkDNS(ctx context.Context, index int) error {
+	dbusClient, err := dbus.ConnectSystemBus()
+	if err != nil {
+		return fmt.Errorf("unable to create dbus client: %w", err)
+	}
+
+	defer func() {
+		if err := dbusClient.Close(); err != nil {
+			logr.FromContextOrDiscard(ctx).Error(err, "unable to close dbus client")
+		}
+	}()
+
+	resolved := dbusClient.Object("org.freedesktop.resolve1", "/org/freedesktop/resolve1")
+
+	return resolved.CallWithContext(ctx, "org.freedesktop.resolve1.Manager.RevertLink", 0, index).Err
 }
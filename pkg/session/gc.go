@@ -0,0 +1,261 @@
+package session
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/steved/kubewire/pkg/agent"
+)
+
+// Orphan is an object created alongside the agent whose target no longer runs the agent
+type Orphan struct {
+	Kind      string
+	Namespace string
+	Name      string
+	// Target is the kind and name of the target object, e.g. deployment/foo
+	Target string
+	// Session is the ID of the session which created the object
+	Session   string
+	Reason    string
+	CreatedAt time.Time
+}
+
+// FindOrphans finds objects created alongside the agent in the namespace whose target no longer runs the agent with a
+// matching session. Only objects created more than `olderThan` ago are considered. An empty namespace searches all
+// namespaces.
+func FindOrphans(ctx context.Context, client kubernetes.Interface, namespace string, olderThan time.Duration) ([]Orphan, error) {
+	var candidates []Orphan
+
+	listOptions := v1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(labels.Set{agent.ManagedByLabelName: agent.ManagedByLabelValue}).String(),
+	}
+
+	services, err := client.CoreV1().Services(namespace).List(ctx, listOptions)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list services: %w", err)
+	}
+
+	for _, svc := range services.Items {
+		candidates = append(candidates, candidate("service", svc.ObjectMeta))
+	}
+
+	netpols, err := client.NetworkingV1().NetworkPolicies(namespace).List(ctx, listOptions)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list network policies: %w", err)
+	}
+
+	for _, netpol := range netpols.Items {
+		candidates = append(candidates, candidate("networkpolicy", netpol.ObjectMeta))
+	}
+
+	secrets, err := client.CoreV1().Secrets(namespace).List(ctx, listOptions)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list secrets: %w", err)
+	}
+
+	for _, secret := range secrets.Items {
+		candidates = append(candidates, candidate("secret", secret.ObjectMeta))
+	}
+
+	var orphans []Orphan
+
+	for _, c := range candidates {
+		if olderThan > 0 && time.Since(c.CreatedAt) < olderThan {
+			continue
+		}
+
+		reason, err := orphanReason(ctx, client, c.Namespace, c.Target, c.Session)
+		if err != nil {
+			return nil, err
+		}
+
+		if reason == "" {
+			continue
+		}
+
+		c.Reason = reason
+		orphans = append(orphans, c)
+	}
+
+	return orphans, nil
+}
+
+// DeleteOrphans deletes the given orphaned objects, ignoring any which no longer exist
+func DeleteOrphans(ctx context.Context, client kubernetes.Interface, orphans []Orphan) error {
+	for _, orphan := range orphans {
+		var err error
+
+		switch orphan.Kind {
+		case "service":
+			err = client.CoreV1().Services(orphan.Namespace).Delete(ctx, orphan.Name, v1.DeleteOptions{})
+		case "networkpolicy":
+			err = client.NetworkingV1().NetworkPolicies(orphan.Namespace).Delete(ctx, orphan.Name, v1.DeleteOptions{})
+		case "secret":
+			err = client.CoreV1().Secrets(orphan.Namespace).Delete(ctx, orphan.Name, v1.DeleteOptions{})
+		default:
+			err = fmt.Errorf("unknown kind %q", orphan.Kind)
+		}
+
+		if err != nil && !errors.IsNotFound(err) {
+			return fmt.Errorf("unable to delete %s %s/%s: %w", orphan.Kind, orphan.Namespace, orphan.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func candidate(kind string, objectMeta v1.ObjectMeta) Orphan {
+	createdAt := objectMeta.CreationTimestamp.Time
+	if unix, err := strconv.ParseInt(objectMeta.Labels[agent.CreatedAtLabelName], 10, 64); err == nil {
+		createdAt = time.Unix(unix, 0)
+	}
+
+	target := objectMeta.Annotations[agent.TargetAnnotationName]
+	if target == "" {
+		target = strings.TrimPrefix(objectMeta.Name, agent.RelatedObjectName(""))
+	}
+
+	return Orphan{
+		Kind:      kind,
+		Namespace: objectMeta.Namespace,
+		Name:      objectMeta.Name,
+		Target:    target,
+		Session:   objectMeta.Labels[agent.SessionLabelName],
+		CreatedAt: createdAt,
+	}
+}
+
+// orphanReason returns why an object for the given target and session is orphaned, or an empty string if it isn't
+func orphanReason(ctx context.Context, client kubernetes.Interface, namespace, target, session string) (string, error) {
+	var (
+		template corev1.PodTemplateSpec
+		err      error
+	)
+
+	kind, name, found := strings.Cut(target, "/")
+	if !found {
+		// Without a kind, look for any supported target with the name
+		kind, name = "", target
+	}
+
+	switch kind {
+	case "deployment":
+		template, err = deploymentTemplate(ctx, client, namespace, name)
+	case "statefulset":
+		template, err = statefulsetTemplate(ctx, client, namespace, name)
+	case "replicaset":
+		template, err = replicasetTemplate(ctx, client, namespace, name)
+	case "daemonset":
+		template, err = daemonsetTemplate(ctx, client, namespace, name)
+	case "pod":
+		template, err = podTemplate(ctx, client, namespace, name)
+	case "":
+		template, err = deploymentTemplate(ctx, client, namespace, name)
+		if errors.IsNotFound(err) {
+			template, err = statefulsetTemplate(ctx, client, namespace, name)
+		}
+	default:
+		// Custom workloads can't be checked without knowing where their pod template is, so they're never considered
+		// orphaned
+		return "", nil
+	}
+
+	if errors.IsNotFound(err) {
+		return "target not found", nil
+	} else if err != nil {
+		return "", fmt.Errorf("unable to get target %s in namespace %s: %w", target, namespace, err)
+	}
+
+	revision, ok := template.Annotations[agent.WireguardRevisionAnnotationName]
+	if !ok {
+		return "target is not running the agent", nil
+	}
+
+	if session != "" && revision != session {
+		return "target is running a different session", nil
+	}
+
+	if !slices.ContainsFunc(template.Spec.Containers, func(c corev1.Container) bool { return c.Name == agent.ContainerName }) {
+		return "target has no agent container", nil
+	}
+
+	return "", nil
+}
+
+func deploymentTemplate(ctx context.Context, client kubernetes.Interface, namespace, name string) (corev1.PodTemplateSpec, error) {
+	deployment, err := client.AppsV1().Deployments(namespace).Get(ctx, name, v1.GetOptions{})
+	if err != nil {
+		return corev1.PodTemplateSpec{}, err
+	}
+
+	return deployment.Spec.Template, nil
+}
+
+// statefulsetTemplate returns the template of the statefulset, or of the pod running the agent if only a single ordinal
+// does, in which case the statefulset's template only carries the session's revision
+func statefulsetTemplate(ctx context.Context, client kubernetes.Interface, namespace, name string) (corev1.PodTemplateSpec, error) {
+	sts, err := client.AppsV1().StatefulSets(namespace).Get(ctx, name, v1.GetOptions{})
+	if err != nil {
+		return corev1.PodTemplateSpec{}, err
+	}
+
+	revision, ok := sts.Spec.Template.Annotations[agent.WireguardRevisionAnnotationName]
+	if !ok || slices.ContainsFunc(sts.Spec.Template.Spec.Containers, func(c corev1.Container) bool { return c.Name == agent.ContainerName }) {
+		return sts.Spec.Template, nil
+	}
+
+	pods, err := client.CoreV1().Pods(namespace).List(ctx, v1.ListOptions{LabelSelector: labels.SelectorFromSet(map[string]string{agent.SessionLabelName: revision}).String()})
+	if err != nil {
+		return corev1.PodTemplateSpec{}, err
+	}
+
+	if len(pods.Items) == 0 {
+		return sts.Spec.Template, nil
+	}
+
+	return corev1.PodTemplateSpec{ObjectMeta: pods.Items[0].ObjectMeta, Spec: pods.Items[0].Spec}, nil
+}
+
+func replicasetTemplate(ctx context.Context, client kubernetes.Interface, namespace, name string) (corev1.PodTemplateSpec, error) {
+	rs, err := client.AppsV1().ReplicaSets(namespace).Get(ctx, name, v1.GetOptions{})
+	if err != nil {
+		return corev1.PodTemplateSpec{}, err
+	}
+
+	return rs.Spec.Template, nil
+}
+
+// daemonsetTemplate returns the template of the pod running the agent in place of the daemonset's own pod on a node,
+// falling back to the daemonset's template if there's no such pod
+func daemonsetTemplate(ctx context.Context, client kubernetes.Interface, namespace, name string) (corev1.PodTemplateSpec, error) {
+	ds, err := client.AppsV1().DaemonSets(namespace).Get(ctx, name, v1.GetOptions{})
+	if err != nil {
+		return corev1.PodTemplateSpec{}, err
+	}
+
+	template, err := podTemplate(ctx, client, namespace, agent.RelatedObjectName(name))
+	if errors.IsNotFound(err) {
+		return ds.Spec.Template, nil
+	}
+
+	return template, err
+}
+
+func podTemplate(ctx context.Context, client kubernetes.Interface, namespace, name string) (corev1.PodTemplateSpec, error) {
+	pod, err := client.CoreV1().Pods(namespace).Get(ctx, name, v1.GetOptions{})
+	if err != nil {
+		return corev1.PodTemplateSpec{}, err
+	}
+
+	return corev1.PodTemplateSpec{ObjectMeta: pod.ObjectMeta, Spec: pod.Spec}, nil
+}
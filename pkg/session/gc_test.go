@@ -0,0 +1,111 @@
+package session
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/steved/kubewire/pkg/agent"
+)
+
+func TestFindOrphans(t *testing.T) {
+	namespace := "test-ns"
+	created := time.Now().Add(-48 * time.Hour).Truncate(time.Second)
+
+	related := func(name, target, session string, createdAt time.Time) v1.ObjectMeta {
+		return v1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels: map[string]string{
+				agent.ManagedByLabelName: agent.ManagedByLabelValue,
+				agent.SessionLabelName:   session,
+				agent.CreatedAtLabelName: strconv.FormatInt(createdAt.Unix(), 10),
+			},
+			Annotations: map[string]string{agent.TargetAnnotationName: target},
+		}
+	}
+
+	agentTemplate := func(revision string) corev1.PodTemplateSpec {
+		return corev1.PodTemplateSpec{
+			ObjectMeta: v1.ObjectMeta{Annotations: map[string]string{agent.WireguardRevisionAnnotationName: revision}},
+			Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: agent.ContainerName}}},
+		}
+	}
+
+	objects := []*corev1.Secret{
+		// Active session
+		{ObjectMeta: related("wg-active", "deployment/active", "session-1", created)},
+		// Target restored to its original state
+		{ObjectMeta: related("wg-restored", "deployment/restored", "session-2", created)},
+		// Target deleted entirely
+		{ObjectMeta: related("wg-deleted", "statefulset/deleted", "session-3", created)},
+		// Target running a newer session
+		{ObjectMeta: related("wg-replaced", "statefulset/replaced", "session-4", created)},
+		// Orphaned, but too new
+		{ObjectMeta: related("wg-recent", "deployment/recent", "session-5", time.Now())},
+		// Not created by kw
+		{ObjectMeta: v1.ObjectMeta{Name: "wg-unrelated", Namespace: namespace}},
+		// Active session with the agent running in a pod alongside the daemonset
+		{ObjectMeta: related("wg-node-agent", "daemonset/node-agent", "session-7", created)},
+		// Daemonset restored and its agent pod deleted
+		{ObjectMeta: related("wg-restored-agent", "daemonset/restored-agent", "session-8", created)},
+		// Active session with the agent running in the pod of a single ordinal of the statefulset
+		{ObjectMeta: related("wg-ordinal", "statefulset/ordinal", "session-9", created)},
+	}
+
+	client := fake.NewClientset(
+		&appsv1.Deployment{ObjectMeta: v1.ObjectMeta{Name: "active", Namespace: namespace}, Spec: appsv1.DeploymentSpec{Template: agentTemplate("session-1")}},
+		&appsv1.Deployment{ObjectMeta: v1.ObjectMeta{Name: "restored", Namespace: namespace}},
+		&appsv1.StatefulSet{ObjectMeta: v1.ObjectMeta{Name: "replaced", Namespace: namespace}, Spec: appsv1.StatefulSetSpec{Template: agentTemplate("session-6")}},
+		&corev1.Service{ObjectMeta: related("wg-restored", "deployment/restored", "session-2", created)},
+		&networkingv1.NetworkPolicy{ObjectMeta: related("wg-active", "deployment/active", "session-1", created)},
+		&appsv1.DaemonSet{ObjectMeta: v1.ObjectMeta{Name: "node-agent", Namespace: namespace}, Spec: appsv1.DaemonSetSpec{Template: agentTemplate("session-7")}},
+		&corev1.Pod{ObjectMeta: v1.ObjectMeta{Name: "wg-node-agent", Namespace: namespace, Annotations: agentTemplate("session-7").Annotations}, Spec: agentTemplate("session-7").Spec},
+		&appsv1.DaemonSet{ObjectMeta: v1.ObjectMeta{Name: "restored-agent", Namespace: namespace}},
+		&appsv1.StatefulSet{ObjectMeta: v1.ObjectMeta{Name: "ordinal", Namespace: namespace}, Spec: appsv1.StatefulSetSpec{Template: corev1.PodTemplateSpec{ObjectMeta: agentTemplate("session-9").ObjectMeta}}},
+		&corev1.Pod{ObjectMeta: v1.ObjectMeta{Name: "ordinal-2", Namespace: namespace, Labels: map[string]string{agent.SessionLabelName: "session-9"}, Annotations: agentTemplate("session-9").Annotations}, Spec: agentTemplate("session-9").Spec},
+		objects[0], objects[1], objects[2], objects[3], objects[4], objects[5], objects[6], objects[7], objects[8],
+	)
+
+	orphans, err := FindOrphans(context.Background(), client, "", time.Hour)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.ElementsMatch(
+		t,
+		[]Orphan{
+			{Kind: "service", Namespace: namespace, Name: "wg-restored", Target: "deployment/restored", Session: "session-2", Reason: "target is not running the agent", CreatedAt: created},
+			{Kind: "secret", Namespace: namespace, Name: "wg-restored", Target: "deployment/restored", Session: "session-2", Reason: "target is not running the agent", CreatedAt: created},
+			{Kind: "secret", Namespace: namespace, Name: "wg-deleted", Target: "statefulset/deleted", Session: "session-3", Reason: "target not found", CreatedAt: created},
+			{Kind: "secret", Namespace: namespace, Name: "wg-replaced", Target: "statefulset/replaced", Session: "session-4", Reason: "target is running a different session", CreatedAt: created},
+			{Kind: "secret", Namespace: namespace, Name: "wg-restored-agent", Target: "daemonset/restored-agent", Session: "session-8", Reason: "target is not running the agent", CreatedAt: created},
+		},
+		orphans,
+	)
+
+	orphans, err = FindOrphans(context.Background(), client, namespace, 0)
+	if assert.NoError(t, err) {
+		assert.Len(t, orphans, 6)
+	}
+
+	if assert.NoError(t, DeleteOrphans(context.Background(), client, orphans)) {
+		_, err := client.CoreV1().Secrets(namespace).Get(context.Background(), "wg-recent", v1.GetOptions{})
+		assert.True(t, errors.IsNotFound(err))
+
+		_, err = client.CoreV1().Secrets(namespace).Get(context.Background(), "wg-active", v1.GetOptions{})
+		assert.NoError(t, err)
+
+		_, err = client.CoreV1().Secrets(namespace).Get(context.Background(), "wg-unrelated", v1.GetOptions{})
+		assert.NoError(t, err)
+	}
+}
@@ -0,0 +1,157 @@
+package session
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Local describes a session running on the local machine, registered so that concurrent sessions don't collide
+type Local struct {
+	// PID is the process running the session
+	PID int `json:"pid"`
+	// KubeContext is the kubeconfig context of the session's cluster
+	KubeContext string `json:"kubeContext,omitempty"`
+	// Namespace is the namespace of the target object
+	Namespace string `json:"namespace"`
+	// Target is the kind and name of the target object
+	Target string `json:"target"`
+	// Device is the name of the session's wireguard device, once created
+	Device string `json:"device,omitempty"`
+	// Overlays are the session's overlay prefixes
+	Overlays []netip.Prefix `json:"overlays"`
+	// Substitutes are the ranges the session exposes remapped cluster ranges under
+	Substitutes []netip.Prefix `json:"substitutes,omitempty"`
+	// ListenPort is the port the session's wireguard device listens on
+	ListenPort int `json:"listenPort,omitempty"`
+	// StartedAt is when the session was started
+	StartedAt time.Time `json:"startedAt"`
+}
+
+// Registry tracks the sessions running on the local machine, one file per session
+type Registry struct {
+	dir string
+}
+
+func NewRegistry(dir string) *Registry {
+	return &Registry{dir: dir}
+}
+
+// Lock takes an exclusive lock on the registry, held until the returned function is called, so that sessions can
+// check for and register their resources without racing others
+func (r *Registry) Lock() (func() error, error) {
+	if err := os.MkdirAll(r.dir, 0o755); err != nil {
+		return nil, fmt.Errorf("unable to create %s: %w", r.dir, err)
+	}
+
+	path := filepath.Join(r.dir, "lock")
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open %s: %w", path, err)
+	}
+
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+		return nil, errors.Join(fmt.Errorf("unable to lock %s: %w", path, err), f.Close())
+	}
+
+	// Closing the file releases the lock
+	return f.Close, nil
+}
+
+// List returns the sessions whose process is still running. Sessions of processes which exited without unregistering
+// are ignored.
+func (r *Registry) List() ([]Local, error) {
+	entries, err := os.ReadDir(r.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to read %s: %w", r.dir, err)
+	}
+
+	var sessions []Local
+
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+
+		path := filepath.Join(r.dir, entry.Name())
+
+		contents, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("unable to read %s: %w", path, err)
+		}
+
+		var session Local
+		if err := json.Unmarshal(contents, &session); err != nil {
+			return nil, fmt.Errorf("unable to parse %s: %w", path, err)
+		}
+
+		if running(session.PID) {
+			sessions = append(sessions, session)
+		}
+	}
+
+	return sessions, nil
+}
+
+// Register adds the session to the registry, replacing its previous registration if any
+func (r *Registry) Register(session Local) error {
+	contents, err := json.MarshalIndent(session, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to encode session: %w", err)
+	}
+
+	if err := os.MkdirAll(r.dir, 0o755); err != nil {
+		return fmt.Errorf("unable to create %s: %w", r.dir, err)
+	}
+
+	// Write atomically so that other sessions never read a partial file
+	path := r.path(session.PID)
+	tmp := path + ".tmp"
+
+	if err := os.WriteFile(tmp, contents, 0o644); err != nil {
+		return fmt.Errorf("unable to write %s: %w", tmp, err)
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("unable to write %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// Unregister removes the session of the process from the registry
+func (r *Registry) Unregister(pid int) error {
+	if err := os.Remove(r.path(pid)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("unable to remove %s: %w", r.path(pid), err)
+	}
+
+	return nil
+}
+
+func (r *Registry) path(pid int) string {
+	return filepath.Join(r.dir, strconv.Itoa(pid)+".json")
+}
+
+// running returns whether the process exists, even if owned by another user
+func running(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+
+	err := unix.Kill(pid, 0)
+
+	return err == nil || errors.Is(err, unix.EPERM)
+}
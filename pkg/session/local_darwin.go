@@ -0,0 +1,7 @@
+//go:build darwin
+
+package session
+
+// DefaultRegistryPath is the directory sessions running on the local machine are registered in. /run can't be created
+// on the read-only system volume.
+const DefaultRegistryPath = "/var/run/kubewire"
@@ -0,0 +1,6 @@
+//go:build linux
+
+package session
+
+// DefaultRegistryPath is the directory sessions running on the local machine are registered in
+const DefaultRegistryPath = "/run/kubewire"
@@ -0,0 +1,61 @@
+package session
+
+import (
+	"net/netip"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistry(t *testing.T) {
+	registry := NewRegistry(t.TempDir())
+
+	sessions, err := registry.List()
+	if assert.NoError(t, err) {
+		assert.Empty(t, sessions)
+	}
+
+	unlock, err := registry.Lock()
+	if assert.NoError(t, err) {
+		assert.NoError(t, unlock())
+	}
+
+	running := Local{
+		PID:         os.Getpid(),
+		KubeContext: "dev",
+		Namespace:   "default",
+		Target:      "deployment/hello-world",
+		Overlays:    []netip.Prefix{netip.MustParsePrefix("10.1.0.0/28")},
+		ListenPort:  19070,
+		StartedAt:   time.Date(2024, 11, 1, 12, 0, 0, 0, time.UTC),
+	}
+
+	// No process has a PID above the maximum, so its session exited without unregistering
+	exited := Local{PID: 1<<22 + 1, Overlays: []netip.Prefix{netip.MustParsePrefix("10.1.0.16/28")}}
+
+	assert.NoError(t, registry.Register(running))
+	assert.NoError(t, registry.Register(exited))
+
+	sessions, err = registry.List()
+	if assert.NoError(t, err) {
+		assert.Equal(t, []Local{running}, sessions)
+	}
+
+	running.Device = "wg1"
+	assert.NoError(t, registry.Register(running))
+
+	sessions, err = registry.List()
+	if assert.NoError(t, err) {
+		assert.Equal(t, []Local{running}, sessions)
+	}
+
+	assert.NoError(t, registry.Unregister(running.PID))
+	assert.NoError(t, registry.Unregister(running.PID))
+
+	sessions, err = registry.List()
+	if assert.NoError(t, err) {
+		assert.Empty(t, sessions)
+	}
+}
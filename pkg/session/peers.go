@@ -0,0 +1,54 @@
+package session
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-logr/logr"
+	"golang.zx2c4.com/wireguard/wgctrl"
+)
+
+// PeerStats contains statistics for a local wireguard peer
+type PeerStats struct {
+	Device        string
+	LastHandshake time.Time
+	ReceiveBytes  int64
+	TransmitBytes int64
+}
+
+// LocalPeerStats returns statistics for all peers of local wireguard devices, keyed by the peer's public key
+func LocalPeerStats(ctx context.Context) (map[string]PeerStats, error) {
+	log := logr.FromContextOrDiscard(ctx)
+
+	client, err := wgctrl.New()
+	if err != nil {
+		return nil, fmt.Errorf("unable to create wireguard client: %w", err)
+	}
+
+	defer func() {
+		if err := client.Close(); err != nil {
+			log.Error(err, "unable to close wireguard client")
+		}
+	}()
+
+	devices, err := client.Devices()
+	if err != nil {
+		return nil, fmt.Errorf("unable to list wireguard devices: %w", err)
+	}
+
+	stats := make(map[string]PeerStats)
+
+	for _, device := range devices {
+		for _, peer := range device.Peers {
+			stats[peer.PublicKey.String()] = PeerStats{
+				Device:        device.Name,
+				LastHandshake: peer.LastHandshakeTime,
+				ReceiveBytes:  peer.ReceiveBytes,
+				TransmitBytes: peer.TransmitBytes,
+			}
+		}
+	}
+
+	return stats, nil
+}
@@ -0,0 +1,198 @@
+package session
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/steved/kubewire/pkg/agent"
+)
+
+// Session describes a Kubernetes object which currently runs the agent in place of one of its containers
+type Session struct {
+	Namespace string
+	Kind      string
+	Name      string
+
+	// Container is the name of the container replaced by the agent
+	Container string
+	// Mode is how the local machine and agent connect, see agent.ModeLoadBalancer and friends
+	Mode string
+	// Endpoint is the address wireguard connects to, if known
+	Endpoint string
+	// StartedAt is when the session was started, if known
+	StartedAt time.Time
+	// PublicKey is the public key of the agent, used to match sessions to local wireguard peers
+	PublicKey string
+
+	// Resources lists the kinds of `wg-*` companion objects which exist for the session
+	Resources []string
+}
+
+// List finds all sessions in the namespace. An empty namespace searches all namespaces.
+func List(ctx context.Context, client kubernetes.Interface, namespace string) ([]Session, error) {
+	var sessions []Session
+
+	deployments, err := client.AppsV1().Deployments(namespace).List(ctx, v1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list deployments: %w", err)
+	}
+
+	for _, deployment := range deployments.Items {
+		if session, ok := fromObject("deployment", deployment.ObjectMeta, deployment.Spec.Template); ok {
+			sessions = append(sessions, session)
+		}
+	}
+
+	statefulsets, err := client.AppsV1().StatefulSets(namespace).List(ctx, v1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list statefulsets: %w", err)
+	}
+
+	for _, sts := range statefulsets.Items {
+		if session, ok := fromObject("statefulset", sts.ObjectMeta, sts.Spec.Template); ok {
+			sessions = append(sessions, session)
+		}
+	}
+
+	replicasets, err := client.AppsV1().ReplicaSets(namespace).List(ctx, v1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list replicasets: %w", err)
+	}
+
+	for _, rs := range replicasets.Items {
+		// Replicasets of a deployment are given its template, revision included, and linger as its history
+		if v1.GetControllerOf(&rs) != nil {
+			continue
+		}
+
+		if session, ok := fromObject("replicaset", rs.ObjectMeta, rs.Spec.Template); ok {
+			sessions = append(sessions, session)
+		}
+	}
+
+	daemonsets, err := client.AppsV1().DaemonSets(namespace).List(ctx, v1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list daemonsets: %w", err)
+	}
+
+	for _, ds := range daemonsets.Items {
+		if session, ok := fromObject("daemonset", ds.ObjectMeta, ds.Spec.Template); ok {
+			sessions = append(sessions, session)
+		}
+	}
+
+	pods, err := client.CoreV1().Pods(namespace).List(ctx, v1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list pods: %w", err)
+	}
+
+	for _, pod := range pods.Items {
+		// Pods created by a workload running the agent carry its revision too, but only targeted pods are annotated
+		if _, ok := pod.Annotations[agent.ContainerAnnotationName]; !ok {
+			continue
+		}
+
+		if session, ok := fromObject("pod", pod.ObjectMeta, corev1.PodTemplateSpec{ObjectMeta: pod.ObjectMeta, Spec: pod.Spec}); ok {
+			sessions = append(sessions, session)
+		}
+	}
+
+	for i := range sessions {
+		if err := resolveCompanions(ctx, client, &sessions[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return sessions, nil
+}
+
+func fromObject(kind string, objectMeta v1.ObjectMeta, template corev1.PodTemplateSpec) (Session, bool) {
+	if _, ok := template.Annotations[agent.WireguardRevisionAnnotationName]; !ok {
+		return Session{}, false
+	}
+
+	session := Session{
+		Namespace: objectMeta.Namespace,
+		Kind:      kind,
+		Name:      objectMeta.Name,
+		Container: objectMeta.Annotations[agent.ContainerAnnotationName],
+		Mode:      objectMeta.Annotations[agent.ModeAnnotationName],
+		Endpoint:  objectMeta.Annotations[agent.EndpointAnnotationName],
+		PublicKey: objectMeta.Annotations[agent.PublicKeyAnnotationName],
+	}
+
+	if startedAt, err := time.Parse(time.RFC3339, objectMeta.Annotations[agent.StartedAtAnnotationName]); err == nil {
+		session.StartedAt = startedAt
+	}
+
+	return session, true
+}
+
+// resolveCompanions looks up the `wg-*` objects created alongside the session and fills in any details which weren't
+// recorded on the target object, e.g. by older versions of kw
+func resolveCompanions(ctx context.Context, client kubernetes.Interface, session *Session) error {
+	name := agent.RelatedObjectName(session.Name)
+
+	svc, err := client.CoreV1().Services(session.Namespace).Get(ctx, name, v1.GetOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("unable to get service %s/%s: %w", session.Namespace, name, err)
+	}
+
+	hasService := err == nil
+	if hasService {
+		session.Resources = append(session.Resources, "service")
+	}
+
+	_, err = client.NetworkingV1().NetworkPolicies(session.Namespace).Get(ctx, name, v1.GetOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("unable to get network policy %s/%s: %w", session.Namespace, name, err)
+	}
+
+	hasNetworkPolicy := err == nil
+	if hasNetworkPolicy {
+		session.Resources = append(session.Resources, "networkpolicy")
+	}
+
+	secret, err := client.CoreV1().Secrets(session.Namespace).Get(ctx, name, v1.GetOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("unable to get secret %s/%s: %w", session.Namespace, name, err)
+	} else if err == nil {
+		session.Resources = append(session.Resources, "secret")
+
+		if session.StartedAt.IsZero() {
+			session.StartedAt = secret.CreationTimestamp.Time
+		}
+	}
+
+	if session.Mode == "" {
+		switch {
+		case hasService:
+			session.Mode = agent.ModeLoadBalancer
+		case hasNetworkPolicy:
+			session.Mode = agent.ModeDirect
+		default:
+			session.Mode = agent.ModeLocalAddress
+		}
+	}
+
+	if session.Endpoint == "" && hasService && len(svc.Status.LoadBalancer.Ingress) > 0 && len(svc.Spec.Ports) > 0 {
+		ingress := svc.Status.LoadBalancer.Ingress[0]
+
+		host := ingress.IP
+		if host == "" {
+			host = ingress.Hostname
+		}
+
+		session.Endpoint = net.JoinHostPort(host, strconv.Itoa(int(svc.Spec.Ports[0].Port)))
+	}
+
+	return nil
+}
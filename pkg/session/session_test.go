@@ -0,0 +1,135 @@
+package session
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/utils/ptr"
+
+	"github.com/steved/kubewire/pkg/agent"
+)
+
+func TestList(t *testing.T) {
+	startedAt := time.Date(2024, 10, 1, 12, 0, 0, 0, time.UTC)
+	revisionTemplate := corev1.PodTemplateSpec{
+		ObjectMeta: v1.ObjectMeta{Annotations: map[string]string{agent.WireguardRevisionAnnotationName: "1-2-3-4"}},
+	}
+
+	annotatedDeployment := &appsv1.Deployment{
+		ObjectMeta: v1.ObjectMeta{
+			Name:      "annotated",
+			Namespace: "ns-1",
+			Annotations: map[string]string{
+				agent.ContainerAnnotationName: "app",
+				agent.ModeAnnotationName:      agent.ModeDirect,
+				agent.EndpointAnnotationName:  "4.5.6.7:19017",
+				agent.StartedAtAnnotationName: startedAt.Format(time.RFC3339),
+				agent.PublicKeyAnnotationName: "public-key",
+			},
+		},
+		Spec: appsv1.DeploymentSpec{Template: revisionTemplate},
+	}
+
+	untouchedDeployment := &appsv1.Deployment{
+		ObjectMeta: v1.ObjectMeta{Name: "untouched", Namespace: "ns-1"},
+	}
+
+	unannotatedStatefulset := &appsv1.StatefulSet{
+		ObjectMeta: v1.ObjectMeta{Name: "unannotated", Namespace: "ns-2"},
+		Spec:       appsv1.StatefulSetSpec{Template: revisionTemplate},
+	}
+
+	targetedPod := &corev1.Pod{
+		ObjectMeta: v1.ObjectMeta{
+			Name:      "targeted",
+			Namespace: "ns-1",
+			Annotations: map[string]string{
+				agent.WireguardRevisionAnnotationName: "1-2-3-4",
+				agent.ContainerAnnotationName:         "app",
+				agent.ModeAnnotationName:              agent.ModeLocalAddress,
+			},
+		},
+	}
+
+	// Pods of a targeted workload carry the revision too, but aren't sessions themselves
+	workloadPod := &corev1.Pod{
+		ObjectMeta: v1.ObjectMeta{Name: "annotated-abc", Namespace: "ns-1", Annotations: revisionTemplate.Annotations},
+	}
+
+	// Nor are the replicasets of a targeted deployment, which are given its template
+	deploymentReplicaSet := &appsv1.ReplicaSet{
+		ObjectMeta: v1.ObjectMeta{
+			Name:            "annotated-abc",
+			Namespace:       "ns-1",
+			OwnerReferences: []v1.OwnerReference{{APIVersion: "apps/v1", Kind: "Deployment", Name: "annotated", Controller: ptr.To(true)}},
+		},
+		Spec: appsv1.ReplicaSetSpec{Template: revisionTemplate},
+	}
+
+	loadBalancer := &corev1.Service{
+		ObjectMeta: v1.ObjectMeta{Name: "wg-unannotated", Namespace: "ns-2"},
+		Spec:       corev1.ServiceSpec{Ports: []corev1.ServicePort{{Port: 19070}}},
+		Status: corev1.ServiceStatus{
+			LoadBalancer: corev1.LoadBalancerStatus{Ingress: []corev1.LoadBalancerIngress{{Hostname: "example.com"}}},
+		},
+	}
+
+	secret := &corev1.Secret{
+		ObjectMeta: v1.ObjectMeta{Name: "wg-unannotated", Namespace: "ns-2", CreationTimestamp: v1.NewTime(startedAt)},
+	}
+
+	netpol := &networkingv1.NetworkPolicy{
+		ObjectMeta: v1.ObjectMeta{Name: "wg-annotated", Namespace: "ns-1"},
+	}
+
+	client := fake.NewClientset(annotatedDeployment, untouchedDeployment, unannotatedStatefulset, targetedPod, workloadPod, deploymentReplicaSet, loadBalancer, secret, netpol)
+
+	sessions, err := List(context.Background(), client, "")
+	if assert.NoError(t, err) {
+		assert.Equal(
+			t,
+			[]Session{
+				{
+					Namespace: "ns-1",
+					Kind:      "deployment",
+					Name:      "annotated",
+					Container: "app",
+					Mode:      agent.ModeDirect,
+					Endpoint:  "4.5.6.7:19017",
+					StartedAt: startedAt,
+					PublicKey: "public-key",
+					Resources: []string{"networkpolicy"},
+				},
+				{
+					Namespace: "ns-2",
+					Kind:      "statefulset",
+					Name:      "unannotated",
+					Mode:      agent.ModeLoadBalancer,
+					Endpoint:  "example.com:19070",
+					StartedAt: startedAt,
+					Resources: []string{"service", "secret"},
+				},
+				{
+					Namespace: "ns-1",
+					Kind:      "pod",
+					Name:      "targeted",
+					Container: "app",
+					Mode:      agent.ModeLocalAddress,
+				},
+			},
+			sessions,
+		)
+	}
+
+	sessions, err = List(context.Background(), client, "ns-2")
+	if assert.NoError(t, err) && assert.Len(t, sessions, 1) {
+		assert.Equal(t, "unannotated", sessions[0].Name)
+	}
+}
@@ -12,7 +12,10 @@ import (
 const (
 	PersistentKeepaliveInterval = 25 * time.Second
 	DefaultWireguardPort        = 19070
-	defaultDeviceName           = "wg0"
+	// DeviceNamePrefix is the prefix of wireguard device names on Linux, numbered from 0 for each concurrent session
+	DeviceNamePrefix = "wg"
+	// MaxDevices is the maximum number of wireguard devices, and so concurrent sessions, on Linux
+	MaxDevices = 16
 )
 
 type WireguardDevicePeer struct {
@@ -25,7 +28,8 @@ type WireguardDeviceConfig struct {
 	Peer       WireguardDevicePeer
 	PrivateKey wgtypes.Key
 	ListenPort int
-	Address    netip.Addr
+	// Addresses are the device's addresses inside the overlay networks, at most one of each IP family
+	Addresses []netip.Addr
 }
 
 type WireguardDevice interface {
@@ -39,9 +43,10 @@ type wireguardDevice struct {
 }
 
 func NewWireguardDevice(cfg WireguardDeviceConfig) WireguardDevice {
-	return &wireguardDevice{config: cfg, deviceName: defaultDeviceName}
+	return &wireguardDevice{config: cfg}
 }
 
+// DeviceName returns the name of the device, assigned once started
 func (w *wireguardDevice) DeviceName() string {
 	return w.deviceName
 }
@@ -16,6 +16,7 @@ import (
 	"github.com/tailscale/wireguard-go/ipc"
 	"github.com/tailscale/wireguard-go/tun"
 
+	"github.com/steved/kubewire/pkg/journal"
 	"github.com/steved/kubewire/pkg/runnable"
 )
 
@@ -32,6 +33,11 @@ func (w *wireguardDevice) Start(ctx context.Context) (runnable.StopFunc, error)
 		return nil, fmt.Errorf("unable to obtain utun device name: %w", err)
 	}
 
+	// The device is removed by the kernel when the process exits, so is only recorded for completeness
+	if err := journal.FromContext(ctx).Record(journal.Change{Kind: journal.KindLink, Device: w.deviceName}); err != nil {
+		return nil, fmt.Errorf("unable to record utun device: %w", err)
+	}
+
 	ipcDev, err := ipc.UAPIOpen(w.deviceName)
 	if err != nil {
 		return nil, fmt.Errorf("unable to create proxy socket: %w", err)
@@ -103,12 +109,19 @@ func (w *wireguardDevice) Start(ctx context.Context) (runnable.StopFunc, error)
 		return nil, fmt.Errorf("unable to setup %s: %w", w.deviceName, err)
 	}
 
-	output, err := exec.Command("ifconfig", w.deviceName, "inet", w.config.Address.String(), w.config.Address.String()).CombinedOutput()
-	if err != nil {
-		return nil, fmt.Errorf("unable to setup %s with ifconfig (%w): %s", w.deviceName, err, string(output))
+	for _, address := range w.config.Addresses {
+		args := []string{w.deviceName, "inet", address.String(), address.String()}
+		if address.Is6() {
+			args = []string{w.deviceName, "inet6", address.String(), "prefixlen", "128"}
+		}
+
+		output, err := exec.Command("ifconfig", args...).CombinedOutput()
+		if err != nil {
+			return nil, fmt.Errorf("unable to setup %s with ifconfig (%w): %s", w.deviceName, err, string(output))
+		}
 	}
 
-	output, err = exec.Command("ifconfig", w.deviceName, "up").CombinedOutput()
+	output, err := exec.Command("ifconfig", w.deviceName, "up").CombinedOutput()
 	if err != nil {
 		return nil, fmt.Errorf("unable to setup %s with ifconfig (%w): %s", w.deviceName, err, string(output))
 	}
@@ -122,6 +135,8 @@ func (w *wireguardDevice) Start(ctx context.Context) (runnable.StopFunc, error)
 
 		if err != nil {
 			log.Error(err, "unable to cleanly terminate wireguard device")
+		} else if err := journal.FromContext(ctx).Forget(journal.Change{Kind: journal.KindLink, Device: w.deviceName}); err != nil {
+			log.Error(err, "unable to record terminated wireguard device")
 		}
 	}, nil
 }
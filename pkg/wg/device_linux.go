@@ -4,8 +4,10 @@ package wg
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
+	"strconv"
 	"syscall"
 
 	"github.com/go-logr/logr"
@@ -15,6 +17,7 @@ import (
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 	"k8s.io/utils/ptr"
 
+	"github.com/steved/kubewire/pkg/journal"
 	"github.com/steved/kubewire/pkg/runnable"
 )
 
@@ -26,16 +29,42 @@ func (w *wireguardDevice) Start(ctx context.Context) (runnable.StopFunc, error)
 		return nil, fmt.Errorf("unable to initialize netlink client: %w", err)
 	}
 
-	err = conn.Link.New(&rtnetlink.LinkMessage{
-		Family: syscall.AF_UNSPEC,
-		Flags:  unix.IFF_UP,
-		Attributes: &rtnetlink.LinkAttributes{
-			Name: w.deviceName,
-			Info: &rtnetlink.LinkInfo{Kind: "wireguard"},
-		},
-	})
-	if err != nil {
-		return nil, fmt.Errorf("unable to create wireguard interface: %w", err)
+	// Take the first free name, other sessions having created devices with the others
+	for _, name := range deviceNames() {
+		// Recorded before being created so that a session dying meanwhile still has it deleted
+		change := journal.Change{Kind: journal.KindLink, Device: name}
+		if err := journal.FromContext(ctx).Record(change); err != nil {
+			return nil, fmt.Errorf("unable to record wireguard interface: %w", err)
+		}
+
+		err = conn.Link.New(&rtnetlink.LinkMessage{
+			Family: syscall.AF_UNSPEC,
+			Flags:  unix.IFF_UP,
+			Attributes: &rtnetlink.LinkAttributes{
+				Name: name,
+				Info: &rtnetlink.LinkInfo{Kind: "wireguard"},
+			},
+		})
+		if err != nil {
+			// The name is another session's device, or nothing was created
+			if forgetErr := journal.FromContext(ctx).Forget(change); forgetErr != nil {
+				return nil, fmt.Errorf("unable to record wireguard interface: %w", forgetErr)
+			}
+		}
+
+		if errors.Is(err, unix.EEXIST) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("unable to create wireguard interface: %w", err)
+		}
+
+		w.deviceName = name
+
+		break
+	}
+
+	if w.deviceName == "" {
+		return nil, fmt.Errorf("unable to create wireguard interface, %s0 to %s%d are all in use", DeviceNamePrefix, DeviceNamePrefix, MaxDevices-1)
 	}
 
 	iface, err := net.InterfaceByName(w.deviceName)
@@ -43,22 +72,29 @@ func (w *wireguardDevice) Start(ctx context.Context) (runnable.StopFunc, error)
 		return nil, fmt.Errorf("unable to find created wireguard interface: %w", err)
 	}
 
-	overlayIP := net.IP(w.config.Address.AsSlice())
-	broadcast := net.IPv4(255, 255, 255, 255)
-
-	err = conn.Address.New(&rtnetlink.AddressMessage{
-		Family:       syscall.AF_INET,
-		PrefixLength: uint8(32),
-		Scope:        unix.RT_SCOPE_UNIVERSE,
-		Index:        uint32(iface.Index),
-		Attributes: &rtnetlink.AddressAttributes{
-			Address:   overlayIP,
-			Local:     overlayIP,
-			Broadcast: broadcast,
-		},
-	})
-	if err != nil {
-		return nil, fmt.Errorf("unable to add %s to %s: %w", overlayIP, w.deviceName, err)
+	for _, address := range w.config.Addresses {
+		overlayIP := net.IP(address.AsSlice())
+
+		message := &rtnetlink.AddressMessage{
+			Family:       syscall.AF_INET,
+			PrefixLength: uint8(address.BitLen()),
+			Scope:        unix.RT_SCOPE_UNIVERSE,
+			Index:        uint32(iface.Index),
+			Attributes: &rtnetlink.AddressAttributes{
+				Address:   overlayIP,
+				Local:     overlayIP,
+				Broadcast: net.IPv4(255, 255, 255, 255),
+			},
+		}
+
+		if address.Is6() {
+			message.Family = syscall.AF_INET6
+			message.Attributes.Broadcast = nil
+		}
+
+		if err := conn.Address.New(message); err != nil {
+			return nil, fmt.Errorf("unable to add %s to %s: %w", overlayIP, w.deviceName, err)
+		}
 	}
 
 	wgClient, err := wgctrl.New()
@@ -115,7 +151,9 @@ func (w *wireguardDevice) Start(ctx context.Context) (runnable.StopFunc, error)
 
 	return func() {
 		if err := conn.Link.Delete(uint32(iface.Index)); err != nil {
-			log.Error(err, "unable to delete interface", "w.deviceName", iface.Name)
+			log.Error(err, "unable to delete interface", "device", iface.Name)
+		} else if err := journal.FromContext(ctx).Forget(journal.Change{Kind: journal.KindLink, Device: w.deviceName}); err != nil {
+			log.Error(err, "unable to record deleted interface", "device", iface.Name)
 		}
 
 		if err := conn.Close(); err != nil {
@@ -123,3 +161,24 @@ func (w *wireguardDevice) Start(ctx context.Context) (runnable.StopFunc, error)
 		}
 	}, nil
 }
+
+// FreeDeviceName returns the name the next wireguard device will be given, if any is free
+func FreeDeviceName() (string, bool) {
+	for _, name := range deviceNames() {
+		if _, err := net.InterfaceByName(name); err != nil {
+			return name, true
+		}
+	}
+
+	return "", false
+}
+
+// deviceNames returns the names a wireguard device may be given on Linux, in order of preference
+func deviceNames() []string {
+	names := make([]string, MaxDevices)
+	for i := range names {
+		names[i] = DeviceNamePrefix + strconv.Itoa(i)
+	}
+
+	return names
+}
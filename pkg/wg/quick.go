@@ -0,0 +1,61 @@
+package wg
+
+import (
+	"fmt"
+	"io"
+	"net/netip"
+	"strings"
+)
+
+// WriteQuickConfig writes the device configuration in the format used by wg-quick and other WireGuard tooling. When
+// dnsServer is valid, PostUp and PreDown commands are included to send queries for the search domain to it through
+// systemd-resolved.
+func WriteQuickConfig(w io.Writer, cfg WireguardDeviceConfig, dnsServer netip.Addr, searchDomain string) error {
+	listenPort := DefaultWireguardPort
+	if cfg.ListenPort > 0 {
+		listenPort = cfg.ListenPort
+	}
+
+	allowedIPs := make([]string, len(cfg.Peer.AllowedIPs))
+	for i, prefix := range cfg.Peer.AllowedIPs {
+		allowedIPs[i] = prefix.String()
+	}
+
+	var b strings.Builder
+
+	fmt.Fprintln(&b, "[Interface]")
+	fmt.Fprintf(&b, "PrivateKey = %s\n", cfg.PrivateKey)
+	addresses := make([]string, len(cfg.Addresses))
+	for i, address := range cfg.Addresses {
+		addresses[i] = netip.PrefixFrom(address, address.BitLen()).String()
+	}
+
+	fmt.Fprintf(&b, "Address = %s\n", strings.Join(addresses, ", "))
+
+	if cfg.ListenPort >= 0 {
+		fmt.Fprintf(&b, "ListenPort = %d\n", listenPort)
+	}
+
+	if dnsServer.IsValid() {
+		fmt.Fprintf(&b, "# Send DNS queries for %s to the cluster with systemd-resolved\n", searchDomain)
+		fmt.Fprintf(&b, "PostUp = resolvectl dns %%i %s; resolvectl domain %%i %s\n", dnsServer, searchDomain)
+		fmt.Fprintln(&b, "PreDown = resolvectl revert %i")
+		fmt.Fprintf(&b, "# On macOS, instead create /etc/resolver/%s containing:\n", searchDomain)
+		fmt.Fprintf(&b, "#   nameserver %s\n", dnsServer)
+	}
+
+	fmt.Fprintln(&b)
+	fmt.Fprintln(&b, "[Peer]")
+	fmt.Fprintf(&b, "PublicKey = %s\n", cfg.Peer.PublicKey)
+
+	if cfg.Peer.Endpoint.IsValid() {
+		fmt.Fprintf(&b, "Endpoint = %s\n", cfg.Peer.Endpoint)
+	}
+
+	fmt.Fprintf(&b, "AllowedIPs = %s\n", strings.Join(allowedIPs, ", "))
+	fmt.Fprintf(&b, "PersistentKeepalive = %d\n", int(PersistentKeepaliveInterval.Seconds()))
+
+	_, err := io.WriteString(w, b.String())
+
+	return err
+}
@@ -0,0 +1,87 @@
+package wg
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestWriteQuickConfig(t *testing.T) {
+	privateKey, err := wgtypes.GeneratePrivateKey()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	peerKey, err := wgtypes.GeneratePrivateKey()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	cfg := WireguardDeviceConfig{
+		Peer: WireguardDevicePeer{
+			Endpoint:   netip.MustParseAddrPort("1.2.3.4:19070"),
+			PublicKey:  peerKey.PublicKey(),
+			AllowedIPs: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/16"), netip.MustParsePrefix("10.1.0.0/28")},
+		},
+		PrivateKey: privateKey,
+		Addresses:  []netip.Addr{netip.MustParseAddr("10.1.0.1")},
+	}
+
+	t.Run("load balancer", func(t *testing.T) {
+		var b strings.Builder
+
+		if assert.NoError(t, WriteQuickConfig(&b, cfg, netip.MustParseAddr("172.20.0.10"), "svc.cluster.local")) {
+			assert.Equal(
+				t,
+				`[Interface]
+PrivateKey = `+privateKey.String()+`
+Address = 10.1.0.1/32
+ListenPort = 19070
+# Send DNS queries for svc.cluster.local to the cluster with systemd-resolved
+PostUp = resolvectl dns %i 172.20.0.10; resolvectl domain %i svc.cluster.local
+PreDown = resolvectl revert %i
+# On macOS, instead create /etc/resolver/svc.cluster.local containing:
+#   nameserver 172.20.0.10
+
+[Peer]
+PublicKey = `+peerKey.PublicKey().String()+`
+Endpoint = 1.2.3.4:19070
+AllowedIPs = 10.0.0.0/16, 10.1.0.0/28
+PersistentKeepalive = 25
+`,
+				b.String(),
+			)
+		}
+	})
+
+	t.Run("local address", func(t *testing.T) {
+		var b strings.Builder
+
+		cfg := cfg
+		cfg.ListenPort = 51820
+		cfg.Peer.Endpoint = netip.AddrPort{}
+
+		if assert.NoError(t, WriteQuickConfig(&b, cfg, netip.Addr{}, "svc.cluster.local")) {
+			assert.Contains(t, b.String(), "ListenPort = 51820\n")
+			assert.NotContains(t, b.String(), "Endpoint")
+			assert.NotContains(t, b.String(), "PostUp")
+		}
+	})
+
+	t.Run("dual-stack", func(t *testing.T) {
+		var b strings.Builder
+
+		cfg := cfg
+		cfg.Addresses = []netip.Addr{netip.MustParseAddr("10.1.0.1"), netip.MustParseAddr("fd77:676b:6f00::1")}
+		cfg.Peer.AllowedIPs = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/16"), netip.MustParsePrefix("fd77:676b:6f00::/64")}
+
+		if assert.NoError(t, WriteQuickConfig(&b, cfg, netip.MustParseAddr("fd12:3456:789a::a"), "svc.cluster.local")) {
+			assert.Contains(t, b.String(), "Address = 10.1.0.1/32, fd77:676b:6f00::1/128\n")
+			assert.Contains(t, b.String(), "AllowedIPs = 10.0.0.0/16, fd77:676b:6f00::/64\n")
+			assert.Contains(t, b.String(), "resolvectl dns %i fd12:3456:789a::a;")
+		}
+	})
+}